@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"strconv"
 )
 
 type Config struct {
@@ -11,6 +12,36 @@ type Config struct {
 	MigrationsPath    string
 	SessionSecret     string
 	MaxBookingsPerDay int
+
+	// Хранилище файлов пациентов: local (каталог FilesDir) или s3
+	FileStorage string
+	FilesDir    string
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+
+	// Депозиты: счета Telegram Payments (TelegramPaymentToken) или оплата по ссылке через PaymentProvider
+	PaymentProvider       string // yookassa или fake (только для разработки); пусто - без оплаты по ссылке
+	TelegramPaymentToken  string
+	YooKassaShopID        string
+	YooKassaSecretKey     string
+	PaymentReturnURL      string
+	DepositTimeoutMinutes int
+
+	// Название клиники в квитанциях
+	ClinicName string
+
+	// Отзывы после приема: через сколько часов спрашивать оценку, чат администраторов
+	// для уведомлений о низких оценках и показ рейтинга врачей в /api/doctors
+	FeedbackDelayHours  int
+	FeedbackAlertChatID int64
+	FeedbackLowRating   int
+	ShowDoctorRatings   bool
+
+	// Чат администраторов, куда бот пересылает сообщения пациентов; ответ реплаем уходит пациенту
+	SupportChatID int64
 }
 
 func LoadConfig() *Config {
@@ -21,6 +52,29 @@ func LoadConfig() *Config {
 		MigrationsPath:    "migrations_v2.sql",
 		SessionSecret:     "secret",
 		MaxBookingsPerDay: 8,
+		FileStorage:       getEnvOrDefault("FILE_STORAGE", "local"),
+		FilesDir:          getEnvOrDefault("FILES_DIR", "uploads"),
+		S3Endpoint:        getEnvOrDefault("S3_ENDPOINT", ""),
+		S3Region:          getEnvOrDefault("S3_REGION", "us-east-1"),
+		S3Bucket:          getEnvOrDefault("S3_BUCKET", ""),
+		S3AccessKey:       getEnvOrDefault("S3_ACCESS_KEY", ""),
+		S3SecretKey:       getEnvOrDefault("S3_SECRET_KEY", ""),
+
+		PaymentProvider:       getEnvOrDefault("PAYMENT_PROVIDER", ""),
+		TelegramPaymentToken:  getEnvOrDefault("TELEGRAM_PAYMENT_TOKEN", ""),
+		YooKassaShopID:        getEnvOrDefault("YOOKASSA_SHOP_ID", ""),
+		YooKassaSecretKey:     getEnvOrDefault("YOOKASSA_SECRET_KEY", ""),
+		PaymentReturnURL:      getEnvOrDefault("PAYMENT_RETURN_URL", ""),
+		DepositTimeoutMinutes: getEnvIntOrDefault("DEPOSIT_TIMEOUT_MINUTES", 60),
+
+		ClinicName: getEnvOrDefault("CLINIC_NAME", ""),
+
+		FeedbackDelayHours:  getEnvIntOrDefault("FEEDBACK_DELAY_HOURS", 2),
+		FeedbackAlertChatID: int64(getEnvIntOrDefault("FEEDBACK_ALERT_CHAT_ID", 0)),
+		FeedbackLowRating:   getEnvIntOrDefault("FEEDBACK_LOW_RATING", 3),
+		ShowDoctorRatings:   getEnvOrDefault("SHOW_DOCTOR_RATINGS", "") == "true",
+
+		SupportChatID: int64(getEnvIntOrDefault("SUPPORT_CHAT_ID", 0)),
 	}
 }
 
@@ -30,3 +84,10 @@ func getEnvOrDefault(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvIntOrDefault(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
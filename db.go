@@ -50,9 +50,74 @@ func InitDB(dbPath string, migrationsPath string) *sql.DB {
 		}
 	}
 
+	if err := allowUsersWithoutTelegram(db); err != nil {
+		log.Printf("Error migrating users table: %v", err)
+	}
+
 	return db
 }
 
+// allowUsersWithoutTelegram снимает NOT NULL с users.telegram_id в старых базах.
+// SQLite не умеет менять ограничения столбца, поэтому таблица пересоздается.
+func allowUsersWithoutTelegram(db *sql.DB) error {
+	rows, err := db.Query("PRAGMA table_info(users)")
+	if err != nil {
+		return err
+	}
+	var notNull bool
+	var columns []string
+	for rows.Next() {
+		var (
+			cid       int
+			name, typ string
+			notnull   int
+			dflt      sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notnull, &dflt, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		columns = append(columns, name)
+		if name == "telegram_id" && notnull == 1 {
+			notNull = true
+		}
+	}
+	rows.Close()
+	if !notNull {
+		return nil
+	}
+
+	var createSQL string
+	if err := db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'users'").Scan(&createSQL); err != nil {
+		return err
+	}
+	newSQL := strings.Replace(createSQL, "telegram_id INTEGER UNIQUE NOT NULL", "telegram_id INTEGER UNIQUE", 1)
+	if newSQL == createSQL {
+		return fmt.Errorf("unexpected users schema: %s", createSQL)
+	}
+	newSQL = strings.Replace(newSQL, "users", "users_new", 1)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	list := strings.Join(columns, ", ")
+	for _, query := range []string{
+		newSQL,
+		"INSERT INTO users_new (" + list + ") SELECT " + list + " FROM users",
+		"DROP TABLE users",
+		"ALTER TABLE users_new RENAME TO users",
+	} {
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func GetUserState(db *sql.DB, telegramID int64) (*models.UserState, error) {
 	var s models.UserState
 	err := db.QueryRow("SELECT telegram_id, step, service, doctor_id, date, time, phone, created_at FROM user_states WHERE telegram_id = ?", telegramID).
@@ -4,7 +4,9 @@ import (
 	"database/sql"
 	"fmt"
 	"html/template"
+	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 
@@ -337,7 +339,7 @@ func adminBookingsHandler(db *sql.DB) gin.HandlerFunc {
 	}
 }
 
-func AdminLoginHandler() gin.HandlerFunc {
+func AdminLoginHandler(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if c.Request.Method == "GET" {
 			c.HTML(http.StatusOK, "admin_login.html", nil)
@@ -347,11 +349,23 @@ func AdminLoginHandler() gin.HandlerFunc {
 		username := c.PostForm("username")
 		password := c.PostForm("password")
 
-		fmt.Printf("Login attempt: username=%s, password=%s\n", username, password)
+		// Сначала ищем сотрудника; встроенная учетная запись администратора работает,
+		// только пока не заведен ни один сотрудник
+		staff, err := authenticateStaff(db, username, password)
+		if err != nil {
+			log.Printf("Error checking staff user: %v", err)
+		}
+		if staff == nil && err == nil && username == "admin" && password == "admin" && staffUsersCount(db) == 0 {
+			staff = &staffSession{Username: username, Role: staffRoleAdmin}
+		}
 
-		if username == "admin" && password == "admin" {
+		if staff != nil {
 			session := sessions.Default(c)
 			session.Set("authenticated", true)
+			session.Set("staff_id", staff.ID)
+			session.Set("username", staff.Username)
+			session.Set("role", staff.Role)
+			session.Set("doctor_id", staff.DoctorID)
 			session.Save()
 			c.Redirect(http.StatusFound, "/admin/bookings")
 		} else {
@@ -383,15 +397,317 @@ func AdminAuthMiddleware() gin.HandlerFunc {
 	}
 }
 
+// adminBookingRow строка записи в админке
+type adminBookingRow struct {
+	ID          int64  `json:"id"`
+	Date        string `json:"date"`
+	Time        string `json:"time"`
+	Status      string `json:"status"`
+	ServiceName string `json:"service_name"`
+	DoctorName  string `json:"doctor_name"`
+	PatientName string `json:"patient_name"` // член семьи, если запись сделана за него
+	ClientName  string `json:"client_name"`
+	Phone       string `json:"phone"`
+	TelegramID  int64  `json:"telegram_id"`
+
+	Discount   float64 `json:"discount"`
+	FinalPrice float64 `json:"final_price"` // цена на момент записи с учетом скидки
+}
+
+// adminBookingSession объединяет записи одного приема: у групповых услуг это несколько пациентов
+type adminBookingSession struct {
+	Date        string
+	Time        string
+	ServiceName string
+	DoctorName  string
+	Capacity    int
+	Attendees   []adminBookingRow
+}
+
+// groupBookingSessions группирует записи на групповые услуги по приемам.
+// Записи должны быть отсортированы по дате и времени.
+func groupBookingSessions(rows []adminBookingRow, capacities []int) []adminBookingSession {
+	var sessions []adminBookingSession
+	index := make(map[string]int)
+	for i, b := range rows {
+		if capacities[i] > 1 {
+			key := fmt.Sprintf("%s|%s|%s|%s", b.Date, b.Time, b.ServiceName, b.DoctorName)
+			if pos, ok := index[key]; ok {
+				sessions[pos].Attendees = append(sessions[pos].Attendees, b)
+				continue
+			}
+			index[key] = len(sessions)
+		}
+		sessions = append(sessions, adminBookingSession{
+			Date:        b.Date,
+			Time:        b.Time,
+			ServiceName: b.ServiceName,
+			DoctorName:  b.DoctorName,
+			Capacity:    capacities[i],
+			Attendees:   []adminBookingRow{b},
+		})
+	}
+	return sessions
+}
+
+// adminBookingFilter фильтры журнала записей
+type adminBookingFilter struct {
+	Date      string // конкретный день
+	DateFrom  string // начало периода
+	DateTo    string // конец периода
+	DoctorID  int64
+	ServiceID int64
+	Status    string
+	Client    string // имя, username, телефон или Telegram ID клиента либо имя члена семьи
+	Search    string // поиск по всем текстовым полям
+	Sort      string
+	Order     string // asc или desc
+	Page      int
+	PerPage   int // 0 - без разбивки на страницы
+}
+
+// adminBookingSorts допустимые поля сортировки журнала
+var adminBookingSorts = map[string]string{
+	"date":    "b.date %[1]s, b.time %[1]s",
+	"id":      "b.id %[1]s",
+	"service": "s.name %[1]s, b.date DESC, b.time DESC",
+	"doctor":  "COALESCE(d.name, '') %[1]s, b.date DESC, b.time DESC",
+	"client":  "client_name %[1]s, b.date DESC, b.time DESC",
+	"status":  "b.status %[1]s, b.date DESC, b.time DESC",
+}
+
+const (
+	adminBookingsPerPage    = 50
+	adminBookingsMaxPerPage = 500
+)
+
+func adminBookingFilterFromQuery(c *gin.Context) adminBookingFilter {
+	f := adminBookingFilter{
+		Date:     strings.TrimSpace(c.Query("date")),
+		DateFrom: strings.TrimSpace(c.Query("date_from")),
+		DateTo:   strings.TrimSpace(c.Query("date_to")),
+		Status:   strings.TrimSpace(c.Query("status")),
+		Client:   strings.TrimSpace(c.Query("client")),
+		Search:   strings.TrimSpace(c.Query("q")),
+		Sort:     c.DefaultQuery("sort", "date"),
+		Order:    strings.ToLower(c.DefaultQuery("order", "desc")),
+	}
+	f.DoctorID, _ = strconv.ParseInt(c.Query("doctor_id"), 10, 64)
+	f.ServiceID, _ = strconv.ParseInt(c.Query("service_id"), 10, 64)
+	f.Page, _ = strconv.Atoi(c.Query("page"))
+	f.PerPage, _ = strconv.Atoi(c.Query("per_page"))
+
+	if _, ok := adminBookingSorts[f.Sort]; !ok {
+		f.Sort = "date"
+	}
+	if f.Order != "asc" {
+		f.Order = "desc"
+	}
+	if f.Page < 1 {
+		f.Page = 1
+	}
+	if f.PerPage > adminBookingsMaxPerPage {
+		f.PerPage = adminBookingsMaxPerPage
+	}
+	return f
+}
+
+// values возвращает параметры запроса фильтра без страницы, для ссылок на выгрузки и страницы
+func (f adminBookingFilter) values() url.Values {
+	v := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			v.Set(key, value)
+		}
+	}
+	set("date", f.Date)
+	set("date_from", f.DateFrom)
+	set("date_to", f.DateTo)
+	if f.DoctorID != 0 {
+		v.Set("doctor_id", strconv.FormatInt(f.DoctorID, 10))
+	}
+	if f.ServiceID != 0 {
+		v.Set("service_id", strconv.FormatInt(f.ServiceID, 10))
+	}
+	set("status", f.Status)
+	set("client", f.Client)
+	set("q", f.Search)
+	if f.Sort != "date" || f.Order != "desc" {
+		v.Set("sort", f.Sort)
+		v.Set("order", f.Order)
+	}
+	return v
+}
+
+// where возвращает условия отбора записей и их параметры
+func (f adminBookingFilter) where() (string, []interface{}) {
+	where := " WHERE 1 = 1"
+	var args []interface{}
+	if f.Date != "" {
+		where += " AND b.date = ?"
+		args = append(args, f.Date)
+	}
+	if f.DateFrom != "" {
+		where += " AND b.date >= ?"
+		args = append(args, f.DateFrom)
+	}
+	if f.DateTo != "" {
+		where += " AND b.date <= ?"
+		args = append(args, f.DateTo)
+	}
+	if f.DoctorID != 0 {
+		where += " AND b.doctor_id = ?"
+		args = append(args, f.DoctorID)
+	}
+	if f.ServiceID != 0 {
+		where += " AND b.service_id = ?"
+		args = append(args, f.ServiceID)
+	}
+	if f.Status != "" {
+		// Старые записи отменялись с разными формами статуса
+		if f.Status == "Отменено" || f.Status == "Отменена" {
+			where += " AND b.status IN ('Отменено', 'Отменена')"
+		} else {
+			where += " AND b.status = ?"
+			args = append(args, f.Status)
+		}
+	}
+	if f.Client != "" {
+		like := "%" + f.Client + "%"
+		where += ` AND (u.first_name LIKE ? OR u.last_name LIKE ? OR u.username LIKE ?
+			OR u.phone LIKE ? OR dp.name LIKE ? OR CAST(u.telegram_id AS TEXT) = ?)`
+		args = append(args, like, like, like, like, like, f.Client)
+	}
+	if f.Search != "" {
+		like := "%" + f.Search + "%"
+		where += ` AND (s.name LIKE ? OR s.category LIKE ? OR d.name LIKE ? OR b.status LIKE ?
+			OR u.first_name LIKE ? OR u.last_name LIKE ? OR u.username LIKE ? OR u.phone LIKE ?
+			OR dp.name LIKE ? OR CAST(b.id AS TEXT) = ? OR CAST(u.telegram_id AS TEXT) = ?)`
+		args = append(args, like, like, like, like, like, like, like, like, like, f.Search, f.Search)
+	}
+	return where, args
+}
+
+const adminBookingsFrom = `
+		FROM bookings b
+		JOIN services s ON b.service_id = s.id
+		JOIN users u ON b.user_id = u.id
+		LEFT JOIN doctors d ON b.doctor_id = d.id
+		LEFT JOIN dependents dp ON b.dependent_id = dp.id`
+
+// queryAdminBookings возвращает записи журнала с учетом фильтров и вместимость их услуг
+func queryAdminBookings(db *sql.DB, f adminBookingFilter) ([]adminBookingRow, []int, error) {
+	where, args := f.where()
+	query := `
+		SELECT b.id, b.date, b.time, b.status, s.name as service_name, COALESCE(d.name, ''),
+			   COALESCE(NULLIF(TRIM(COALESCE(u.first_name, '') || ' ' || COALESCE(u.last_name, '')), ''), u.username, '') AS client_name,
+			   COALESCE(u.phone, ''), COALESCE(u.telegram_id, 0), s.capacity, COALESCE(dp.name, ''),
+			   b.discount, COALESCE(b.final_price, s.price)` +
+		adminBookingsFrom + where +
+		" ORDER BY " + fmt.Sprintf(adminBookingSorts[f.Sort], strings.ToUpper(f.Order))
+	if f.PerPage > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, f.PerPage, (f.Page-1)*f.PerPage)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var bookings []adminBookingRow
+	var capacities []int
+	for rows.Next() {
+		var b adminBookingRow
+		var capacity int
+		if err := rows.Scan(&b.ID, &b.Date, &b.Time, &b.Status, &b.ServiceName, &b.DoctorName,
+			&b.ClientName, &b.Phone, &b.TelegramID, &capacity, &b.PatientName, &b.Discount, &b.FinalPrice); err == nil {
+			bookings = append(bookings, b)
+			capacities = append(capacities, capacity)
+		}
+	}
+	return bookings, capacities, rows.Err()
+}
+
+// countAdminBookings возвращает количество записей, подходящих под фильтры
+func countAdminBookings(db *sql.DB, f adminBookingFilter) (int, error) {
+	where, args := f.where()
+	var total int
+	err := db.QueryRow("SELECT COUNT(*)"+adminBookingsFrom+where, args...).Scan(&total)
+	return total, err
+}
+
+// adminBookingsPage одна страница журнала записей
+type adminBookingsPage struct {
+	Bookings []adminBookingRow `json:"bookings"`
+	Total    int               `json:"total"`
+	Page     int               `json:"page"`
+	PerPage  int               `json:"per_page"`
+	Pages    int               `json:"pages"`
+
+	capacities []int
+}
+
+func loadAdminBookingsPage(db *sql.DB, f adminBookingFilter) (*adminBookingsPage, error) {
+	if f.PerPage <= 0 {
+		f.PerPage = adminBookingsPerPage
+	}
+	total, err := countAdminBookings(db, f)
+	if err != nil {
+		return nil, err
+	}
+	pages := (total + f.PerPage - 1) / f.PerPage
+	if pages == 0 {
+		pages = 1
+	}
+	if f.Page > pages {
+		f.Page = pages
+	}
+
+	bookings, capacities, err := queryAdminBookings(db, f)
+	if err != nil {
+		return nil, err
+	}
+	if bookings == nil {
+		bookings = []adminBookingRow{}
+	}
+	return &adminBookingsPage{
+		Bookings:   bookings,
+		Total:      total,
+		Page:       f.Page,
+		PerPage:    f.PerPage,
+		Pages:      pages,
+		capacities: capacities,
+	}, nil
+}
+
+// adminFilterOption вариант выбора в фильтре
+type adminFilterOption struct {
+	ID   int64
+	Name string
+}
+
+func loadAdminFilterOptions(db *sql.DB, query string, args ...interface{}) []adminFilterOption {
+	var options []adminFilterOption
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return options
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var o adminFilterOption
+		if err := rows.Scan(&o.ID, &o.Name); err == nil {
+			options = append(options, o)
+		}
+	}
+	return options
+}
+
 func AdminBookingsHandler(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		rows, err := db.Query(`
-			SELECT b.id, b.date, b.time, b.status, s.name as service_name, u.telegram_id
-			FROM bookings b
-			JOIN services s ON b.service_id = s.id
-			JOIN users u ON b.user_id = u.id
-			ORDER BY b.date DESC, b.time DESC
-		`)
+		filter := adminBookingFilterFromQuery(c)
+		page, err := loadAdminBookingsPage(db, filter)
 		if err != nil {
 			fmt.Printf("AdminBookingsHandler error: %v\n", err)
 			c.HTML(http.StatusInternalServerError, "error.html", gin.H{
@@ -399,34 +715,49 @@ func AdminBookingsHandler(db *sql.DB) gin.HandlerFunc {
 			})
 			return
 		}
-		defer rows.Close()
-
-		var bookings []struct {
-			ID          int64
-			Date        string
-			Time        string
-			Status      string
-			ServiceName string
-			TelegramID  int64
-		}
 
-		for rows.Next() {
-			var b struct {
-				ID          int64
-				Date        string
-				Time        string
-				Status      string
-				ServiceName string
-				TelegramID  int64
+		query := filter.values()
+		pageURL := func(n int) template.URL {
+			v := filter.values()
+			if n > 1 {
+				v.Set("page", strconv.Itoa(n))
 			}
-			if err := rows.Scan(&b.ID, &b.Date, &b.Time, &b.Status, &b.ServiceName, &b.TelegramID); err == nil {
-				bookings = append(bookings, b)
+			if filter.PerPage > 0 {
+				v.Set("per_page", strconv.Itoa(filter.PerPage))
 			}
+			return template.URL("/admin/bookings?" + v.Encode())
+		}
+		data := gin.H{
+			"sessions": groupBookingSessions(page.Bookings, page.capacities),
+			"page":     page,
+			"filter":   filter,
+			"doctors":  loadAdminFilterOptions(db, "SELECT id, name FROM doctors ORDER BY name"),
+			"services": loadAdminFilterOptions(db, "SELECT id, name FROM services ORDER BY name"),
+			"statuses": []string{"Ожидает подтверждения", "Подтверждено", bookingStatusCompleted, "Отменено", bookingStatusNoShow},
+			"pdfURL":   template.URL("/admin/export_pdf?" + query.Encode()),
+			"csvURL":   template.URL("/admin/export/bookings?format=csv&" + query.Encode()),
+			"xlsxURL":  template.URL("/admin/export/bookings?format=xlsx&" + query.Encode()),
+		}
+		if page.Page > 1 {
+			data["prevURL"] = pageURL(page.Page - 1)
+		}
+		if page.Page < page.Pages {
+			data["nextURL"] = pageURL(page.Page + 1)
 		}
 
-		c.HTML(http.StatusOK, "admin_bookings.html", gin.H{
-			"bookings": bookings,
-		})
+		c.HTML(http.StatusOK, "admin_bookings.html", data)
+	}
+}
+
+// AdminBookingsJSONHandler отдает журнал записей в JSON с теми же фильтрами, что и страница
+func AdminBookingsJSONHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		page, err := loadAdminBookingsPage(db, adminBookingFilterFromQuery(c))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при получении данных"})
+			return
+		}
+		c.JSON(http.StatusOK, page)
 	}
 }
 
@@ -442,7 +773,7 @@ func AdminDeleteBookingHandler(db *sql.DB, bot *tgbotapi.BotAPI) gin.HandlerFunc
 		var telegramID int64
 		var date, time string
 		err := db.QueryRow(`
-			SELECT u.telegram_id, b.date, b.time
+			SELECT COALESCE(u.telegram_id, 0), b.date, b.time
 			FROM bookings b
 			JOIN users u ON b.user_id = u.id
 			WHERE b.id = ?
@@ -452,6 +783,9 @@ func AdminDeleteBookingHandler(db *sql.DB, bot *tgbotapi.BotAPI) gin.HandlerFunc
 			return
 		}
 
+		bookingID, _ := strconv.ParseInt(id, 10, 64)
+		slot, slotErr := freedSlotForBooking(db, bookingID)
+
 		// Удаляем запись
 		_, err = db.Exec("DELETE FROM bookings WHERE id = ?", id)
 		if err != nil {
@@ -459,9 +793,16 @@ func AdminDeleteBookingHandler(db *sql.DB, bot *tgbotapi.BotAPI) gin.HandlerFunc
 			return
 		}
 
-		// Отправляем уведомление пользователю
-		msg := tgbotapi.NewMessage(telegramID, "Ваша запись на "+date+" в "+time+" была отменена администратором.")
-		bot.Send(msg)
+		// Отправляем уведомление пользователю, если он пользуется ботом
+		if telegramID != 0 {
+			msg := tgbotapi.NewMessage(telegramID, "Ваша запись на "+date+" в "+time+" была отменена администратором.")
+			bot.Send(msg)
+		}
+
+		// Предлагаем освободившееся время листу ожидания
+		if slotErr == nil {
+			go offerFreedSlot(bot, db, slot)
+		}
 
 		c.Redirect(http.StatusFound, "/admin/bookings")
 	}
@@ -470,7 +811,7 @@ func AdminDeleteBookingHandler(db *sql.DB, bot *tgbotapi.BotAPI) gin.HandlerFunc
 func AdminServicesHandler(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if c.Request.Method == "GET" {
-			rows, err := db.Query("SELECT id, name, category, duration, price FROM services ORDER BY category, name")
+			rows, err := db.Query("SELECT id, name, category, duration, price, capacity, deposit FROM services ORDER BY category, name")
 			if err != nil {
 				c.HTML(http.StatusInternalServerError, "error.html", gin.H{
 					"error": "Ошибка при получении данных",
@@ -485,6 +826,8 @@ func AdminServicesHandler(db *sql.DB) gin.HandlerFunc {
 				Category string
 				Duration int
 				Price    float64
+				Capacity int
+				Deposit  float64
 			}
 
 			for rows.Next() {
@@ -494,8 +837,10 @@ func AdminServicesHandler(db *sql.DB) gin.HandlerFunc {
 					Category string
 					Duration int
 					Price    float64
+					Capacity int
+					Deposit  float64
 				}
-				if err := rows.Scan(&s.ID, &s.Name, &s.Category, &s.Duration, &s.Price); err == nil {
+				if err := rows.Scan(&s.ID, &s.Name, &s.Category, &s.Duration, &s.Price, &s.Capacity, &s.Deposit); err == nil {
 					services = append(services, s)
 				}
 			}
@@ -511,6 +856,14 @@ func AdminServicesHandler(db *sql.DB) gin.HandlerFunc {
 		category := c.PostForm("category")
 		duration := c.PostForm("duration")
 		price := c.PostForm("price")
+		capacity, _ := strconv.Atoi(c.PostForm("capacity"))
+		if capacity < 1 {
+			capacity = 1
+		}
+		deposit, _ := strconv.ParseFloat(c.PostForm("deposit"), 64)
+		if deposit < 0 {
+			deposit = 0
+		}
 
 		if name == "" || category == "" || duration == "" || price == "" {
 			c.HTML(http.StatusBadRequest, "admin_services.html", gin.H{
@@ -520,9 +873,9 @@ func AdminServicesHandler(db *sql.DB) gin.HandlerFunc {
 		}
 
 		_, err := db.Exec(`
-			INSERT INTO services (name, category, duration, price)
-			VALUES (?, ?, ?, ?)
-		`, name, category, duration, price)
+			INSERT INTO services (name, category, duration, price, capacity, deposit)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, name, category, duration, price, capacity, deposit)
 
 		if err != nil {
 			c.HTML(http.StatusInternalServerError, "admin_services.html", gin.H{
@@ -550,10 +903,12 @@ func AdminEditServiceHandler(db *sql.DB) gin.HandlerFunc {
 				Category string
 				Duration int
 				Price    float64
+				Capacity int
+				Deposit  float64
 			}
 
-			err := db.QueryRow("SELECT id, name, category, duration, price FROM services WHERE id = ?", id).
-				Scan(&service.ID, &service.Name, &service.Category, &service.Duration, &service.Price)
+			err := db.QueryRow("SELECT id, name, category, duration, price, capacity, deposit FROM services WHERE id = ?", id).
+				Scan(&service.ID, &service.Name, &service.Category, &service.Duration, &service.Price, &service.Capacity, &service.Deposit)
 			if err != nil {
 				c.HTML(http.StatusInternalServerError, "error.html", gin.H{
 					"error": "Ошибка при получении данных",
@@ -572,6 +927,14 @@ func AdminEditServiceHandler(db *sql.DB) gin.HandlerFunc {
 		category := c.PostForm("category")
 		duration := c.PostForm("duration")
 		price := c.PostForm("price")
+		capacity, _ := strconv.Atoi(c.PostForm("capacity"))
+		if capacity < 1 {
+			capacity = 1
+		}
+		deposit, _ := strconv.ParseFloat(c.PostForm("deposit"), 64)
+		if deposit < 0 {
+			deposit = 0
+		}
 
 		if name == "" || category == "" || duration == "" || price == "" {
 			c.HTML(http.StatusBadRequest, "admin_edit_service.html", gin.H{
@@ -582,9 +945,9 @@ func AdminEditServiceHandler(db *sql.DB) gin.HandlerFunc {
 
 		_, err := db.Exec(`
 			UPDATE services
-			SET name = ?, category = ?, duration = ?, price = ?
+			SET name = ?, category = ?, duration = ?, price = ?, capacity = ?, deposit = ?
 			WHERE id = ?
-		`, name, category, duration, price, id)
+		`, name, category, duration, price, capacity, deposit, id)
 
 		if err != nil {
 			c.HTML(http.StatusInternalServerError, "admin_edit_service.html", gin.H{
@@ -614,10 +977,3 @@ func AdminDeleteServiceHandler(db *sql.DB) gin.HandlerFunc {
 		c.Redirect(http.StatusFound, "/admin/services")
 	}
 }
-
-func AdminExportPDFHandler(db *sql.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		// TODO: Реализовать экспорт в PDF
-		c.JSON(http.StatusNotImplemented, gin.H{"error": "Функция в разработке"})
-	}
-}
@@ -15,7 +15,11 @@ type Doctor struct {
 	Specialization string `json:"specialization"`
 	Description    string `json:"description"`
 	PhotoURL       string `json:"photo_url"`
+	PhotoThumbURL  string `json:"photo_thumb_url"`
 	IsActive       bool   `json:"is_active"`
+	// Средняя оценка по отзывам пациентов, в /api/doctors только при включенном показе рейтинга
+	Rating       float64 `json:"rating,omitempty"`
+	ReviewsCount int     `json:"reviews_count,omitempty"`
 }
 
 // DoctorSchedule представляет расписание врача
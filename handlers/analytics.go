@@ -0,0 +1,621 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// analyticsMaxDays максимальная длина периода отчета
+const analyticsMaxDays = 366
+
+// analyticsGroupings группировка записей по периодам: выражение SQL для ключа периода
+var analyticsGroupings = map[string]string{
+	"day":   "b.date",
+	"week":  "date(b.date, 'weekday 0', '-6 days')", // понедельник недели
+	"month": "substr(b.date, 1, 7)",
+}
+
+// analyticsGroupTitles названия группировок для формы
+var analyticsGroupTitles = map[string]string{
+	"day":   "По дням",
+	"week":  "По неделям",
+	"month": "По месяцам",
+}
+
+// analyticsFilter период, группировка и врач отчета
+type analyticsFilter struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Group    string `json:"group"`
+	DoctorID int64  `json:"doctor_id"`
+}
+
+// analyticsFilterFromQuery читает фильтр отчета; по умолчанию последние 30 дней по дням
+func analyticsFilterFromQuery(c *gin.Context) (analyticsFilter, error) {
+	today := time.Now()
+	f := analyticsFilter{
+		From:  c.DefaultQuery("from", today.AddDate(0, 0, -29).Format("2006-01-02")),
+		To:    c.DefaultQuery("to", today.Format("2006-01-02")),
+		Group: c.DefaultQuery("group", "day"),
+	}
+	f.DoctorID, _ = strconv.ParseInt(c.Query("doctor_id"), 10, 64)
+	if _, ok := analyticsGroupings[f.Group]; !ok {
+		f.Group = "day"
+	}
+
+	from, err := time.Parse("2006-01-02", f.From)
+	if err != nil {
+		return f, fmt.Errorf("неверная дата начала периода")
+	}
+	to, err := time.Parse("2006-01-02", f.To)
+	if err != nil {
+		return f, fmt.Errorf("неверная дата окончания периода")
+	}
+	if to.Before(from) {
+		return f, fmt.Errorf("дата окончания раньше даты начала")
+	}
+	if to.Sub(from).Hours()/24 >= analyticsMaxDays {
+		return f, fmt.Errorf("период отчета не может быть длиннее %d дней", analyticsMaxDays)
+	}
+	return f, nil
+}
+
+// values параметры фильтра для ссылок на выгрузки
+func (f analyticsFilter) values() url.Values {
+	v := url.Values{}
+	v.Set("from", f.From)
+	v.Set("to", f.To)
+	v.Set("group", f.Group)
+	if f.DoctorID != 0 {
+		v.Set("doctor_id", strconv.FormatInt(f.DoctorID, 10))
+	}
+	return v
+}
+
+// where условие отбора записей отчета
+func (f analyticsFilter) where() (string, []interface{}) {
+	where := " WHERE b.date BETWEEN ? AND ?"
+	args := []interface{}{f.From, f.To}
+	if f.DoctorID != 0 {
+		where += " AND b.doctor_id = ?"
+		args = append(args, f.DoctorID)
+	}
+	return where, args
+}
+
+// analyticsPeriod записи за день, неделю или месяц
+type analyticsPeriod struct {
+	Period    string `json:"period"`
+	Total     int    `json:"total"`
+	Completed int    `json:"completed"`
+	Cancelled int    `json:"cancelled"`
+	NoShow    int    `json:"no_show"`
+
+	BarWidth int `json:"-"` // ширина столбика на странице, % от максимума
+}
+
+// analyticsRevenue выручка по услуге или врачу
+type analyticsRevenue struct {
+	Name     string  `json:"name"`
+	Bookings int     `json:"bookings"`
+	Revenue  float64 `json:"revenue"`
+}
+
+// analyticsUtilization загрузка врача относительно расписания
+type analyticsUtilization struct {
+	DoctorID         int64   `json:"doctor_id"`
+	DoctorName       string  `json:"doctor_name"`
+	ScheduledMinutes int     `json:"scheduled_minutes"`
+	BookedMinutes    int     `json:"booked_minutes"`
+	Utilization      float64 `json:"utilization"` // процент
+}
+
+func (u analyticsUtilization) ScheduledHours() float64 {
+	return float64(u.ScheduledMinutes) / 60
+}
+
+func (u analyticsUtilization) BookedHours() float64 {
+	return float64(u.BookedMinutes) / 60
+}
+
+// analyticsLeadBucket количество записей с временем до визита в интервале
+type analyticsLeadBucket struct {
+	Title string `json:"title"`
+	Count int    `json:"count"`
+}
+
+// analyticsSummary итоговые показатели за период
+type analyticsSummary struct {
+	Total             int     `json:"total"`
+	Cancelled         int     `json:"cancelled"`
+	NoShow            int     `json:"no_show"`
+	CancellationRate  float64 `json:"cancellation_rate"` // процент от всех записей
+	NoShowRate        float64 `json:"no_show_rate"`      // процент от неотмененных записей
+	Revenue           float64 `json:"revenue"`
+	NewPatients       int     `json:"new_patients"`
+	ReturningPatients int     `json:"returning_patients"`
+	AverageLeadDays   float64 `json:"average_lead_days"`
+	MedianLeadDays    float64 `json:"median_lead_days"`
+}
+
+// analyticsReport отчет для владельцев клиники
+type analyticsReport struct {
+	Filter      analyticsFilter        `json:"filter"`
+	Summary     analyticsSummary       `json:"summary"`
+	Periods     []analyticsPeriod      `json:"periods"`
+	Services    []analyticsRevenue     `json:"services"`
+	Doctors     []analyticsRevenue     `json:"doctors"`
+	Utilization []analyticsUtilization `json:"utilization"`
+	LeadTime    []analyticsLeadBucket  `json:"lead_time"`
+}
+
+// percent доля в процентах с одним знаком после запятой
+func percent(part, total float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(part/total*1000) / 10
+}
+
+// buildAnalytics собирает отчет за период. Выручка считается по ценам записей с учетом скидок,
+// без отмененных записей и неявок.
+func buildAnalytics(db *sql.DB, f analyticsFilter) (*analyticsReport, error) {
+	r := &analyticsReport{Filter: f}
+	var err error
+	if r.Periods, err = analyticsPeriods(db, f); err != nil {
+		return nil, err
+	}
+	for _, p := range r.Periods {
+		r.Summary.Total += p.Total
+		r.Summary.Cancelled += p.Cancelled
+		r.Summary.NoShow += p.NoShow
+	}
+	r.Summary.CancellationRate = percent(float64(r.Summary.Cancelled), float64(r.Summary.Total))
+	r.Summary.NoShowRate = percent(float64(r.Summary.NoShow), float64(r.Summary.Total-r.Summary.Cancelled))
+
+	if r.Services, err = analyticsRevenueBy(db, f, "s.id", "s.name"); err != nil {
+		return nil, err
+	}
+	if r.Doctors, err = analyticsRevenueBy(db, f, "b.doctor_id", "COALESCE(d.name, 'Без врача')"); err != nil {
+		return nil, err
+	}
+	for _, s := range r.Services {
+		r.Summary.Revenue += s.Revenue
+	}
+	r.Summary.Revenue = roundMoney(r.Summary.Revenue)
+
+	if r.Utilization, err = analyticsDoctorUtilization(db, f); err != nil {
+		return nil, err
+	}
+	if r.Summary.NewPatients, r.Summary.ReturningPatients, err = analyticsPatients(db, f); err != nil {
+		return nil, err
+	}
+	if r.LeadTime, r.Summary.AverageLeadDays, r.Summary.MedianLeadDays, err = analyticsLeadTime(db, f); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// analyticsPeriods записи по периодам; периоды без записей тоже попадают в отчет
+func analyticsPeriods(db *sql.DB, f analyticsFilter) ([]analyticsPeriod, error) {
+	where, args := f.where()
+	key := analyticsGroupings[f.Group]
+	rows, err := db.Query(`
+		SELECT `+key+`, COUNT(*),
+			   SUM(CASE WHEN b.status = ? THEN 1 ELSE 0 END),
+			   SUM(CASE WHEN b.status IN ('Отменено', 'Отменена') THEN 1 ELSE 0 END),
+			   SUM(CASE WHEN b.status = ? THEN 1 ELSE 0 END)
+		FROM bookings b`+where+`
+		GROUP BY 1
+	`, append([]interface{}{bookingStatusCompleted, bookingStatusNoShow}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := make(map[string]analyticsPeriod)
+	for rows.Next() {
+		var p analyticsPeriod
+		if err := rows.Scan(&p.Period, &p.Total, &p.Completed, &p.Cancelled, &p.NoShow); err == nil {
+			found[p.Period] = p
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	from, _ := time.Parse("2006-01-02", f.From)
+	to, _ := time.Parse("2006-01-02", f.To)
+	var periods []analyticsPeriod
+	maxTotal := 0
+	seen := make(map[string]bool)
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		key := d.Format("2006-01-02")
+		switch f.Group {
+		case "week":
+			weekday := int(d.Weekday()+6) % 7 // 0 - понедельник
+			key = d.AddDate(0, 0, -weekday).Format("2006-01-02")
+		case "month":
+			key = d.Format("2006-01")
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		p, ok := found[key]
+		if !ok {
+			p = analyticsPeriod{Period: key}
+		}
+		if p.Total > maxTotal {
+			maxTotal = p.Total
+		}
+		periods = append(periods, p)
+	}
+	for i := range periods {
+		if maxTotal > 0 {
+			periods[i].BarWidth = periods[i].Total * 100 / maxTotal
+		}
+	}
+	return periods, nil
+}
+
+// analyticsRevenueBy выручка и количество состоявшихся или предстоящих записей по группе
+func analyticsRevenueBy(db *sql.DB, f analyticsFilter, groupBy, name string) ([]analyticsRevenue, error) {
+	where, args := f.where()
+	rows, err := db.Query(`
+		SELECT `+name+`, COUNT(*), COALESCE(SUM(COALESCE(b.final_price, s.price)), 0)
+		FROM bookings b
+		JOIN services s ON b.service_id = s.id
+		LEFT JOIN doctors d ON b.doctor_id = d.id`+where+`
+		  AND b.status NOT IN ('Отменено', 'Отменена', ?)
+		GROUP BY `+groupBy+`
+		ORDER BY 3 DESC, 1
+	`, append(args, bookingStatusNoShow)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []analyticsRevenue
+	for rows.Next() {
+		var r analyticsRevenue
+		if err := rows.Scan(&r.Name, &r.Bookings, &r.Revenue); err == nil {
+			r.Revenue = roundMoney(r.Revenue)
+			list = append(list, r)
+		}
+	}
+	return list, rows.Err()
+}
+
+// shiftMinutes длительность смены без перерыва
+func shiftMinutes(s doctorShift) int {
+	minutes := func(from, to string) int {
+		start, err1 := time.Parse("15:04", from)
+		end, err2 := time.Parse("15:04", to)
+		if err1 != nil || err2 != nil || !end.After(start) {
+			return 0
+		}
+		return int(end.Sub(start).Minutes())
+	}
+	total := minutes(s.Start, s.End)
+	if s.BreakStart != "" && s.BreakEnd != "" {
+		total -= minutes(s.BreakStart, s.BreakEnd)
+	}
+	if total < 0 {
+		return 0
+	}
+	return total
+}
+
+// analyticsDoctorUtilization сравнивает занятое записями время врача с его рабочим временем
+// по расписанию за вычетом перерывов и отсутствий. Групповой прием занимает время один раз.
+func analyticsDoctorUtilization(db *sql.DB, f analyticsFilter) ([]analyticsUtilization, error) {
+	schedule, err := loadCalendarSchedule(db, f.From, f.To)
+	if err != nil {
+		return nil, err
+	}
+
+	booked := make(map[int64]int)
+	where, args := f.where()
+	rows, err := db.Query(`
+		SELECT doctor_id, COALESCE(SUM(duration), 0)
+		FROM (
+			SELECT DISTINCT b.doctor_id, b.date, b.time, s.duration
+			FROM bookings b
+			JOIN services s ON b.service_id = s.id`+where+`
+			  AND b.doctor_id IS NOT NULL AND b.status NOT IN ('Отменено', 'Отменена')
+		)
+		GROUP BY doctor_id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var doctorID int64
+		var minutes int
+		if err := rows.Scan(&doctorID, &minutes); err == nil {
+			booked[doctorID] = minutes
+		}
+	}
+	rows.Close()
+
+	doctorsQuery := "SELECT id, name FROM doctors ORDER BY name"
+	var doctorArgs []interface{}
+	if f.DoctorID != 0 {
+		doctorsQuery = "SELECT id, name FROM doctors WHERE id = ?"
+		doctorArgs = append(doctorArgs, f.DoctorID)
+	}
+	doctors := loadAdminFilterOptions(db, doctorsQuery, doctorArgs...)
+
+	from, _ := time.Parse("2006-01-02", f.From)
+	to, _ := time.Parse("2006-01-02", f.To)
+	var list []analyticsUtilization
+	for _, doctor := range doctors {
+		u := analyticsUtilization{DoctorID: doctor.ID, DoctorName: doctor.Name, BookedMinutes: booked[doctor.ID]}
+		for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+			for _, shift := range schedule.day(doctor.ID, d).Shifts {
+				u.ScheduledMinutes += shiftMinutes(shift)
+			}
+		}
+		u.Utilization = percent(float64(u.BookedMinutes), float64(u.ScheduledMinutes))
+		list = append(list, u)
+	}
+	return list, nil
+}
+
+// analyticsPatients считает пациентов с записями за период: новые впервые записались в этом
+// периоде, повторные записывались раньше. Члены семьи считаются отдельными пациентами.
+func analyticsPatients(db *sql.DB, f analyticsFilter) (int, int, error) {
+	where, args := f.where()
+	var total, newPatients int
+	err := db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(CASE WHEN first_date >= ? THEN 1 ELSE 0 END), 0)
+		FROM (
+			SELECT (SELECT MIN(b2.date) FROM bookings b2
+			        WHERE b2.user_id = b.user_id AND COALESCE(b2.dependent_id, 0) = COALESCE(b.dependent_id, 0)
+			          AND b2.status NOT IN ('Отменено', 'Отменена')) AS first_date
+			FROM bookings b`+where+`
+			  AND b.status NOT IN ('Отменено', 'Отменена')
+			GROUP BY b.user_id, COALESCE(b.dependent_id, 0)
+		)
+	`, append([]interface{}{f.From}, args...)...).Scan(&total, &newPatients)
+	return newPatients, total - newPatients, err
+}
+
+// analyticsLeadBounds интервалы времени между созданием записи и визитом, в днях
+var analyticsLeadBounds = []struct {
+	Title string
+	Days  float64
+}{
+	{"В тот же день", 1},
+	{"1–3 дня", 4},
+	{"4–7 дней", 8},
+	{"8–30 дней", 31},
+	{"Больше 30 дней", math.Inf(1)},
+}
+
+// analyticsLeadTime распределение, среднее и медиана времени от записи до визита
+func analyticsLeadTime(db *sql.DB, f analyticsFilter) ([]analyticsLeadBucket, float64, float64, error) {
+	where, args := f.where()
+	rows, err := db.Query(`
+		SELECT julianday(b.date || ' ' || b.time) - julianday(b.created_at)
+		FROM bookings b`+where+`
+		  AND b.created_at IS NOT NULL AND b.status NOT IN ('Отменено', 'Отменена')
+	`, args...)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer rows.Close()
+
+	var leads []float64
+	for rows.Next() {
+		var days sql.NullFloat64
+		if err := rows.Scan(&days); err == nil && days.Valid {
+			leads = append(leads, math.Max(days.Float64, 0))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	buckets := make([]analyticsLeadBucket, len(analyticsLeadBounds))
+	var sum float64
+	for i, b := range analyticsLeadBounds {
+		buckets[i].Title = b.Title
+	}
+	for _, days := range leads {
+		sum += days
+		for i, b := range analyticsLeadBounds {
+			if days < b.Days {
+				buckets[i].Count++
+				break
+			}
+		}
+	}
+	if len(leads) == 0 {
+		return buckets, 0, 0, nil
+	}
+
+	sort.Float64s(leads)
+	median := leads[len(leads)/2]
+	if len(leads)%2 == 0 {
+		median = (leads[len(leads)/2-1] + leads[len(leads)/2]) / 2
+	}
+	round := func(v float64) float64 { return math.Round(v*10) / 10 }
+	return buckets, round(sum / float64(len(leads))), round(median), nil
+}
+
+// analyticsSectionTitles разделы отчета, которые можно получить отдельно и выгрузить в CSV
+var analyticsSectionTitles = map[string]string{
+	"summary":     "Итоги",
+	"periods":     "Записи по периодам",
+	"services":    "Выручка по услугам",
+	"doctors":     "Выручка по врачам",
+	"utilization": "Загрузка врачей",
+	"lead_time":   "Время до визита",
+}
+
+// section возвращает раздел отчета для JSON
+func (r *analyticsReport) section(name string) interface{} {
+	switch name {
+	case "summary":
+		return r.Summary
+	case "periods":
+		return r.Periods
+	case "services":
+		return r.Services
+	case "doctors":
+		return r.Doctors
+	case "utilization":
+		return r.Utilization
+	case "lead_time":
+		return r.LeadTime
+	}
+	return nil
+}
+
+// table возвращает раздел отчета в виде таблицы для CSV
+func (r *analyticsReport) table(name string) ([]string, [][]interface{}) {
+	var rows [][]interface{}
+	switch name {
+	case "summary":
+		s := r.Summary
+		return []string{"Показатель", "Значение"}, [][]interface{}{
+			{"Записей", s.Total},
+			{"Отменено", s.Cancelled},
+			{"Доля отмен, %", s.CancellationRate},
+			{"Неявок", s.NoShow},
+			{"Доля неявок, %", s.NoShowRate},
+			{"Выручка, ₽", s.Revenue},
+			{"Новых пациентов", s.NewPatients},
+			{"Повторных пациентов", s.ReturningPatients},
+			{"Среднее время до визита, дней", s.AverageLeadDays},
+			{"Медиана времени до визита, дней", s.MedianLeadDays},
+		}
+	case "periods":
+		for _, p := range r.Periods {
+			rows = append(rows, []interface{}{p.Period, p.Total, p.Completed, p.Cancelled, p.NoShow})
+		}
+		return []string{"Период", "Записей", "Завершено", "Отменено", "Неявок"}, rows
+	case "services", "doctors":
+		list, title := r.Services, "Услуга"
+		if name == "doctors" {
+			list, title = r.Doctors, "Врач"
+		}
+		for _, v := range list {
+			rows = append(rows, []interface{}{v.Name, v.Bookings, v.Revenue})
+		}
+		return []string{title, "Записей", "Выручка, ₽"}, rows
+	case "utilization":
+		for _, u := range r.Utilization {
+			rows = append(rows, []interface{}{u.DoctorName, u.ScheduledMinutes, u.BookedMinutes, u.Utilization})
+		}
+		return []string{"Врач", "По расписанию, мин", "Занято записями, мин", "Загрузка, %"}, rows
+	case "lead_time":
+		for _, b := range r.LeadTime {
+			rows = append(rows, []interface{}{b.Title, b.Count})
+		}
+		return []string{"Время до визита", "Записей"}, rows
+	}
+	return nil, nil
+}
+
+// AdminAnalyticsHandler выводит страницу аналитики
+func AdminAnalyticsHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		f, filterErr := analyticsFilterFromQuery(c)
+		data := gin.H{
+			"filter":   f,
+			"groups":   analyticsGroupTitles,
+			"sections": analyticsSectionTitles,
+			"doctors":  loadAdminFilterOptions(db, "SELECT id, name FROM doctors ORDER BY name"),
+		}
+		if filterErr != nil {
+			data["error"] = "Ошибка в периоде: " + filterErr.Error()
+			c.HTML(http.StatusBadRequest, "admin_analytics.html", data)
+			return
+		}
+
+		report, err := buildAnalytics(db, f)
+		if err != nil {
+			log.Printf("Error building analytics: %v", err)
+			c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Ошибка при получении данных",
+			})
+			return
+		}
+		data["report"] = report
+		data["query"] = template.URL(f.values().Encode())
+		c.HTML(http.StatusOK, "admin_analytics.html", data)
+	}
+}
+
+// AdminAnalyticsJSONHandler отдает отчет целиком или один раздел (параметр section)
+func AdminAnalyticsJSONHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		section := c.Param("section")
+		if _, ok := analyticsSectionTitles[section]; section != "" && !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Неизвестный раздел отчета"})
+			return
+		}
+		f, err := analyticsFilterFromQuery(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		report, err := buildAnalytics(db, f)
+		if err != nil {
+			log.Printf("Error building analytics: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при получении данных"})
+			return
+		}
+		if section == "" {
+			c.JSON(http.StatusOK, report)
+			return
+		}
+		c.JSON(http.StatusOK, report.section(section))
+	}
+}
+
+// AdminAnalyticsCSVHandler выгружает раздел отчета в CSV
+func AdminAnalyticsCSVHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		section := c.Param("section")
+		if _, ok := analyticsSectionTitles[section]; !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Неизвестный раздел отчета"})
+			return
+		}
+		f, err := analyticsFilterFromQuery(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		report, err := buildAnalytics(db, f)
+		if err != nil {
+			log.Printf("Error building analytics: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при получении данных"})
+			return
+		}
+
+		header, rows := report.table(section)
+		var buf bytes.Buffer
+		if err := writeCSV(&buf, header, rows); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при формировании файла"})
+			return
+		}
+		filename := fmt.Sprintf("analytics_%s_%s_%s.csv", section, f.From, f.To)
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+		c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+	}
+}
@@ -3,9 +3,11 @@ package handlers
 import (
 	"database/sql"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
 // Структура для услуги
@@ -15,12 +17,14 @@ type Service struct {
 	Category string  `json:"category"`
 	Duration int     `json:"duration"`
 	Price    float64 `json:"price"`
+	Capacity int     `json:"capacity"` // количество пациентов на одном приеме
+	Deposit  float64 `json:"deposit"`  // депозит при записи через бота; 0 - без депозита
 }
 
 func GetServicesHandler(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		rows, err := db.Query(`
-			SELECT id, name, category, duration, price
+			SELECT id, name, category, duration, price, capacity, deposit
 			FROM services
 			ORDER BY category, name
 		`)
@@ -30,23 +34,10 @@ func GetServicesHandler(db *sql.DB) gin.HandlerFunc {
 		}
 		defer rows.Close()
 
-		var services []struct {
-			ID       int64   `json:"id"`
-			Name     string  `json:"name"`
-			Category string  `json:"category"`
-			Duration int     `json:"duration"`
-			Price    float64 `json:"price"`
-		}
-
+		var services []Service
 		for rows.Next() {
-			var s struct {
-				ID       int64   `json:"id"`
-				Name     string  `json:"name"`
-				Category string  `json:"category"`
-				Duration int     `json:"duration"`
-				Price    float64 `json:"price"`
-			}
-			if err := rows.Scan(&s.ID, &s.Name, &s.Category, &s.Duration, &s.Price); err == nil {
+			var s Service
+			if err := rows.Scan(&s.ID, &s.Name, &s.Category, &s.Duration, &s.Price, &s.Capacity, &s.Deposit); err == nil {
 				services = append(services, s)
 			}
 		}
@@ -69,45 +60,29 @@ func GetAvailableDatesHandler(db *sql.DB) gin.HandlerFunc {
 			endDate = time.Now().AddDate(0, 0, 14).Format("2006-01-02")
 		}
 
-		// Получаем все записи в указанном периоде
-		rows, err := db.Query(`
-			SELECT date, COUNT(*) as booking_count
-			FROM bookings
-			WHERE date BETWEEN ? AND ?
-			GROUP BY date
-		`, startDate, endDate)
+		// Услуга и врач необязательны: без них проверяются только общие ограничения
+		serviceID, _ := strconv.ParseInt(c.Query("service_id"), 10, 64)
+		doctorID, _ := strconv.ParseInt(c.Query("doctor_id"), 10, 64)
+
+		start, err := time.Parse("2006-01-02", startDate)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при получении данных"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный формат даты начала"})
 			return
 		}
-		defer rows.Close()
-
-		// Создаем карту занятых дат
-		bookedDates := make(map[string]int)
-		for rows.Next() {
-			var date string
-			var count int
-			if err := rows.Scan(&date, &count); err == nil {
-				bookedDates[date] = count
-			}
+		end, err := time.Parse("2006-01-02", endDate)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный формат даты окончания"})
+			return
 		}
 
-		// Максимальное количество записей в день
-		maxBookingsPerDay := 8
-
-		// Формируем список доступных дат
-		var availableDates []string
-		start, _ := time.Parse("2006-01-02", startDate)
-		end, _ := time.Parse("2006-01-02", endDate)
-
-		for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
-			dateStr := d.Format("2006-01-02")
-			if bookedDates[dateStr] < maxBookingsPerDay {
-				availableDates = append(availableDates, dateStr)
-			}
+		// Формируем список дат, на которые не исчерпаны ограничения
+		dates, err := availableDates(db, serviceID, doctorID, start, end)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при получении данных"})
+			return
 		}
 
-		c.JSON(http.StatusOK, availableDates)
+		c.JSON(http.StatusOK, dates)
 	}
 }
 
@@ -156,11 +131,43 @@ func GetAvailableTimesHandler(db *sql.DB) gin.HandlerFunc {
 	}
 }
 
+// Получение времени приема со свободными местами для услуги
+func GetAvailableSlotsHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		date := c.Query("date")
+		serviceID, _ := strconv.ParseInt(c.Query("service_id"), 10, 64)
+		doctorID, _ := strconv.ParseInt(c.Query("doctor_id"), 10, 64)
+		if date == "" || serviceID == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Не указана дата или услуга"})
+			return
+		}
+
+		type slot struct {
+			Time      string `json:"time"`
+			Capacity  int    `json:"capacity"`
+			SeatsLeft int    `json:"seats_left"`
+		}
+		slots := []slot{}
+		for _, t := range dayTimeSlots() {
+			capacity, free, err := slotSeats(db, serviceID, doctorID, date, t, 0)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при получении данных"})
+				return
+			}
+			if free > 0 {
+				slots = append(slots, slot{Time: t, Capacity: capacity, SeatsLeft: free})
+			}
+		}
+
+		c.JSON(http.StatusOK, slots)
+	}
+}
+
 // Получение списка врачей
 func GetDoctorsHandler(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		rows, err := db.Query(`
-			SELECT id, name, specialization, description, photo_url
+			SELECT id, name, specialization, COALESCE(description, ''), COALESCE(photo_url, ''), COALESCE(photo_thumb_url, '')
 			FROM doctors
 			ORDER BY name
 		`)
@@ -173,10 +180,13 @@ func GetDoctorsHandler(db *sql.DB) gin.HandlerFunc {
 		var doctors []Doctor
 		for rows.Next() {
 			var d Doctor
-			if err := rows.Scan(&d.ID, &d.Name, &d.Specialization, &d.Description, &d.PhotoURL); err == nil {
+			if err := rows.Scan(&d.ID, &d.Name, &d.Specialization, &d.Description, &d.PhotoURL, &d.PhotoThumbURL); err == nil {
 				doctors = append(doctors, d)
 			}
 		}
+		if showDoctorRatings {
+			fillDoctorRatings(db, doctors)
+		}
 
 		c.JSON(http.StatusOK, doctors)
 	}
@@ -257,10 +267,17 @@ func AddServiceHandler(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
+		if service.Capacity < 1 {
+			service.Capacity = 1
+		}
+		if service.Deposit < 0 {
+			service.Deposit = 0
+		}
+
 		result, err := db.Exec(`
-			INSERT INTO services (name, category, duration, price)
-			VALUES (?, ?, ?, ?)
-		`, service.Name, service.Category, service.Duration, service.Price)
+			INSERT INTO services (name, category, duration, price, capacity, deposit)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, service.Name, service.Category, service.Duration, service.Price, service.Capacity, service.Deposit)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при добавлении услуги"})
 			return
@@ -286,11 +303,18 @@ func UpdateServiceHandler(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
+		if service.Capacity < 1 {
+			service.Capacity = 1
+		}
+		if service.Deposit < 0 {
+			service.Deposit = 0
+		}
+
 		_, err := db.Exec(`
 			UPDATE services
-			SET name = ?, category = ?, duration = ?, price = ?
+			SET name = ?, category = ?, duration = ?, price = ?, capacity = ?, deposit = ?
 			WHERE id = ?
-		`, service.Name, service.Category, service.Duration, service.Price, service.ID)
+		`, service.Name, service.Category, service.Duration, service.Price, service.Capacity, service.Deposit, service.ID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при обновлении услуги"})
 			return
@@ -318,28 +342,44 @@ func DeleteServiceHandler(db *sql.DB) gin.HandlerFunc {
 func CreateBookingHandler(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var booking struct {
-			UserID    int64  `json:"user_id"`
-			ServiceID int64  `json:"service_id"`
-			Date      string `json:"date"`
-			Time      string `json:"time"`
+			UserID      int64  `json:"user_id"`
+			DependentID int64  `json:"dependent_id"`
+			ServiceID   int64  `json:"service_id"`
+			DoctorID    int64  `json:"doctor_id"`
+			Date        string `json:"date"`
+			Time        string `json:"time"`
 		}
 		if err := c.ShouldBindJSON(&booking); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный формат данных"})
 			return
 		}
-
-		result, err := db.Exec(`
-			INSERT INTO bookings (user_id, service_id, date, time)
-			VALUES (?, ?, ?, ?)
-		`, booking.UserID, booking.ServiceID, booking.Date, booking.Time)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при создании записи"})
+		if isPatientBlocked(db, booking.UserID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Запись для пациента заблокирована администратором"})
 			return
 		}
 
-		id, err := result.LastInsertId()
+		id, err := insertBooking(db, bookingParams{
+			UserID:      booking.UserID,
+			DependentID: booking.DependentID,
+			ServiceID:   booking.ServiceID,
+			DoctorID:    booking.DoctorID,
+			Date:        booking.Date,
+			Time:        booking.Time,
+		})
+		if err == errSlotTaken {
+			c.JSON(http.StatusConflict, gin.H{"error": "На это время нет свободных мест"})
+			return
+		}
+		if err == errDependentNotFound {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Член семьи не найден"})
+			return
+		}
+		if le, ok := err.(*limitError); ok {
+			c.JSON(http.StatusConflict, gin.H{"error": le.reason})
+			return
+		}
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при получении ID"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при создании записи"})
 			return
 		}
 
@@ -352,9 +392,10 @@ func GetUserBookingsHandler(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID := c.Param("user_id")
 		rows, err := db.Query(`
-			SELECT b.id, b.date, b.time, b.status, s.name as service_name
+			SELECT b.id, b.date, b.time, b.status, s.name as service_name, COALESCE(dp.name, '')
 			FROM bookings b
 			JOIN services s ON b.service_id = s.id
+			LEFT JOIN dependents dp ON b.dependent_id = dp.id
 			WHERE b.user_id = ?
 			ORDER BY b.date DESC, b.time DESC
 		`, userID)
@@ -370,6 +411,7 @@ func GetUserBookingsHandler(db *sql.DB) gin.HandlerFunc {
 			Time        string `json:"time"`
 			Status      string `json:"status"`
 			ServiceName string `json:"service_name"`
+			PatientName string `json:"patient_name,omitempty"`
 		}
 
 		for rows.Next() {
@@ -379,8 +421,9 @@ func GetUserBookingsHandler(db *sql.DB) gin.HandlerFunc {
 				Time        string `json:"time"`
 				Status      string `json:"status"`
 				ServiceName string `json:"service_name"`
+				PatientName string `json:"patient_name,omitempty"`
 			}
-			if err := rows.Scan(&b.ID, &b.Date, &b.Time, &b.Status, &b.ServiceName); err == nil {
+			if err := rows.Scan(&b.ID, &b.Date, &b.Time, &b.Status, &b.ServiceName, &b.PatientName); err == nil {
 				bookings = append(bookings, b)
 			}
 		}
@@ -390,15 +433,23 @@ func GetUserBookingsHandler(db *sql.DB) gin.HandlerFunc {
 }
 
 // Отмена записи
-func CancelBookingHandler(db *sql.DB) gin.HandlerFunc {
+func CancelBookingHandler(db *sql.DB, bot *tgbotapi.BotAPI) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		id := c.Param("id")
+		bookingID, _ := strconv.ParseInt(id, 10, 64)
+		slot, slotErr := freedSlotForBooking(db, bookingID)
+
 		_, err := db.Exec("UPDATE bookings SET status = 'Отменена' WHERE id = ?", id)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при отмене записи"})
 			return
 		}
 
+		// Предлагаем освободившееся время листу ожидания
+		if slotErr == nil {
+			go offerFreedSlot(bot, db, slot)
+		}
+
 		c.JSON(http.StatusOK, gin.H{"message": "Запись успешно отменена"})
 	}
 }
@@ -0,0 +1,416 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// maxAttachmentSize максимальный размер файла пациента
+const maxAttachmentSize = 15 << 20
+
+// attachmentTypes допустимые типы файлов и их расширения
+var attachmentTypes = map[string]string{
+	"image/jpeg":        ".jpg",
+	"image/png":         ".png",
+	"image/webp":        ".webp",
+	"image/heic":        ".heic",
+	"application/pdf":   ".pdf",
+	"application/dicom": ".dcm",
+}
+
+// attachmentExtTypes типы по расширению для форматов, которые не распознаются по содержимому
+var attachmentExtTypes = map[string]string{
+	".heic": "image/heic",
+	".heif": "image/heic",
+	".dcm":  "application/dicom",
+}
+
+// patientFile файл пациента: снимок, фото или документ
+type patientFile struct {
+	ID          int64
+	UserID      int64
+	BookingID   int64
+	BookingDate string
+	FileName    string
+	ContentType string
+	Size        int64
+	Source      string
+	Caption     string
+	CreatedAt   string
+	StorageKey  string
+}
+
+// IsImage показывает, можно ли открыть файл в браузере как картинку
+func (f patientFile) IsImage() bool {
+	return f.ContentType == "image/jpeg" || f.ContentType == "image/png" || f.ContentType == "image/webp"
+}
+
+// SizeText размер файла для вывода
+func (f patientFile) SizeText() string {
+	if f.Size >= 1<<20 {
+		return fmt.Sprintf("%.1f МБ", float64(f.Size)/(1<<20))
+	}
+	return fmt.Sprintf("%d КБ", (f.Size+1023)/1024)
+}
+
+// attachmentError ошибка проверки файла, текст показывается пользователю
+type attachmentError struct {
+	reason string
+}
+
+func (e *attachmentError) Error() string {
+	return e.reason
+}
+
+// attachmentContentType определяет тип файла по содержимому и проверяет, что он допустим
+func attachmentContentType(fileName string, data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", &attachmentError{"Файл пустой"}
+	}
+	if len(data) > maxAttachmentSize {
+		return "", &attachmentError{fmt.Sprintf("Файл больше %d МБ", maxAttachmentSize>>20)}
+	}
+	contentType := http.DetectContentType(data)
+	if _, ok := attachmentTypes[contentType]; ok {
+		return contentType, nil
+	}
+	// DICOM: 128 байт преамбулы и сигнатура DICM
+	if len(data) > 132 && string(data[128:132]) == "DICM" {
+		return "application/dicom", nil
+	}
+	if t, ok := attachmentExtTypes[strings.ToLower(filepath.Ext(fileName))]; ok && contentType == "application/octet-stream" {
+		return t, nil
+	}
+	return "", &attachmentError{"Можно загрузить фото (JPG, PNG, WEBP, HEIC), PDF или снимок DICOM"}
+}
+
+// randomFileName генерирует случайное имя файла в хранилище, которое нельзя подобрать
+func randomFileName() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// attachmentKey генерирует ключ файла пациента в хранилище
+func attachmentKey(userID int64, contentType string) (string, error) {
+	name, err := randomFileName()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("patients/%d/%s%s", userID, name, attachmentTypes[contentType]), nil
+}
+
+// storePatientFile проверяет файл, сохраняет его в хранилище и добавляет в карточку пациента
+func storePatientFile(db *sql.DB, f patientFile, data []byte) (int64, error) {
+	contentType, err := attachmentContentType(f.FileName, data)
+	if err != nil {
+		return 0, err
+	}
+	key, err := attachmentKey(f.UserID, contentType)
+	if err != nil {
+		return 0, err
+	}
+	if f.FileName == "" {
+		f.FileName = "file" + attachmentTypes[contentType]
+	}
+	if err := fileStore.Save(key, data, contentType); err != nil {
+		return 0, err
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO patient_files (user_id, booking_id, storage_key, file_name, content_type, size, source, caption)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, f.UserID, nullInt64(f.BookingID), key, f.FileName, contentType, len(data), f.Source, f.Caption)
+	if err != nil {
+		// Файл без записи в базе никому не виден, удаляем его из хранилища
+		if delErr := fileStore.Delete(key); delErr != nil {
+			log.Printf("Error deleting orphan file %s: %v", key, delErr)
+		}
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// loadPatientFiles возвращает файлы пациента, новые первыми
+func loadPatientFiles(db *sql.DB, where string, args ...interface{}) ([]patientFile, error) {
+	rows, err := db.Query(`
+		SELECT f.id, f.user_id, COALESCE(f.booking_id, 0), COALESCE(b.date || ' ' || b.time, ''),
+			   f.file_name, f.content_type, f.size, f.source, COALESCE(f.caption, ''),
+			   COALESCE(f.created_at, ''), f.storage_key
+		FROM patient_files f
+		LEFT JOIN bookings b ON f.booking_id = b.id
+		WHERE `+where+`
+		ORDER BY f.id DESC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []patientFile
+	for rows.Next() {
+		var f patientFile
+		if err := rows.Scan(&f.ID, &f.UserID, &f.BookingID, &f.BookingDate, &f.FileName, &f.ContentType,
+			&f.Size, &f.Source, &f.Caption, &f.CreatedAt, &f.StorageKey); err == nil {
+			files = append(files, f)
+		}
+	}
+	return files, rows.Err()
+}
+
+// attachmentBookingForBot выбирает запись, к которой относится файл из бота:
+// ближайший предстоящий прием, иначе прием за последние 3 дня
+func attachmentBookingForBot(db *sql.DB, userID int64) int64 {
+	var bookingID int64
+	err := db.QueryRow(`
+		SELECT id FROM bookings
+		WHERE user_id = ? AND status NOT IN ('Отменено', 'Отменена') AND date >= date('now', 'localtime')
+		ORDER BY date, time
+		LIMIT 1
+	`, userID).Scan(&bookingID)
+	if err == sql.ErrNoRows {
+		err = db.QueryRow(`
+			SELECT id FROM bookings
+			WHERE user_id = ? AND status NOT IN ('Отменено', 'Отменена') AND date >= date('now', 'localtime', '-3 days')
+			ORDER BY date DESC, time DESC
+			LIMIT 1
+		`, userID).Scan(&bookingID)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error getting booking for attachment: %v", err)
+	}
+	return bookingID
+}
+
+// handleAttachmentMessage сохраняет фото или документ, присланные пациентом в чат
+func handleAttachmentMessage(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB, userID int64) {
+	var fileID, fileName string
+	var fileSize int
+	if message.Document != nil {
+		fileID, fileName, fileSize = message.Document.FileID, message.Document.FileName, message.Document.FileSize
+	} else {
+		// Telegram присылает несколько размеров фото, последний - самый большой
+		photo := message.Photo[len(message.Photo)-1]
+		fileID, fileSize = photo.FileID, photo.FileSize
+		fileName = fmt.Sprintf("photo_%s.jpg", time.Unix(int64(message.Date), 0).Format("2006-01-02_15-04-05"))
+	}
+
+	if fileSize > maxAttachmentSize {
+		bot.Send(tgbotapi.NewMessage(message.Chat.ID, fmt.Sprintf("Файл слишком большой. Отправьте файл до %d МБ.", maxAttachmentSize>>20)))
+		return
+	}
+
+	data, err := downloadTelegramFile(bot, fileID)
+	if err != nil {
+		log.Printf("Error downloading telegram file: %v", err)
+		bot.Send(tgbotapi.NewMessage(message.Chat.ID, "Не удалось получить файл. Попробуйте отправить его еще раз."))
+		return
+	}
+
+	_, err = storePatientFile(db, patientFile{
+		UserID:    userID,
+		BookingID: attachmentBookingForBot(db, userID),
+		FileName:  fileName,
+		Source:    "telegram",
+		Caption:   message.Caption,
+	}, data)
+	if err != nil {
+		if e, ok := err.(*attachmentError); ok {
+			bot.Send(tgbotapi.NewMessage(message.Chat.ID, e.reason+"."))
+			return
+		}
+		log.Printf("Error saving patient file: %v", err)
+		bot.Send(tgbotapi.NewMessage(message.Chat.ID, "Произошла ошибка при сохранении файла. Попробуйте позже."))
+		return
+	}
+
+	bot.Send(tgbotapi.NewMessage(message.Chat.ID, "Файл получен и добавлен в вашу карточку. Врач увидит его перед приемом."))
+}
+
+// downloadTelegramFile скачивает файл с серверов Telegram
+func downloadTelegramFile(bot *tgbotapi.BotAPI, fileID string) ([]byte, error) {
+	url, err := bot.GetFileDirectURL(fileID)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("telegram file download: %s", resp.Status)
+	}
+	// Читаем на байт больше лимита, чтобы отличить слишком большой файл
+	return io.ReadAll(io.LimitReader(resp.Body, maxAttachmentSize+1))
+}
+
+// renderPatientFiles выводит файлы пациента
+func renderPatientFiles(c *gin.Context, db *sql.DB, userID int64, status int, errorText string) {
+	patient, err := loadPatient(db, userID)
+	if err != nil {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{
+			"error": "Пациент не найден",
+		})
+		return
+	}
+	files, err := loadPatientFiles(db, "f.user_id = ?", userID)
+	if err != nil {
+		log.Printf("Error getting patient files: %v", err)
+	}
+	bookings := loadAdminFilterOptions(db, `
+		SELECT b.id, b.date || ' ' || b.time || ' — ' || COALESCE(s.name, '')
+		FROM bookings b
+		LEFT JOIN services s ON b.service_id = s.id
+		WHERE b.user_id = ? AND b.status NOT IN ('Отменено', 'Отменена')
+		ORDER BY b.date DESC, b.time DESC
+	`, userID)
+
+	c.HTML(status, "admin_patient_files.html", gin.H{
+		"patient":  patient,
+		"files":    files,
+		"bookings": bookings,
+		"maxSize":  maxAttachmentSize >> 20,
+		"error":    errorText,
+	})
+}
+
+// AdminPatientFilesHandler выводит файлы пациента и загружает новые
+func AdminPatientFilesHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := patientIDParam(c)
+		if !ok {
+			return
+		}
+		if c.Request.Method == http.MethodGet {
+			renderPatientFiles(c, db, id, http.StatusOK, "")
+			return
+		}
+
+		// POST запрос - загрузка файла
+		header, err := c.FormFile("file")
+		if err != nil {
+			renderPatientFiles(c, db, id, http.StatusBadRequest, "Выберите файл")
+			return
+		}
+		if header.Size > maxAttachmentSize {
+			renderPatientFiles(c, db, id, http.StatusBadRequest, fmt.Sprintf("Файл больше %d МБ", maxAttachmentSize>>20))
+			return
+		}
+		file, err := header.Open()
+		if err != nil {
+			renderPatientFiles(c, db, id, http.StatusBadRequest, "Не удалось прочитать файл")
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(file, maxAttachmentSize+1))
+		file.Close()
+		if err != nil {
+			renderPatientFiles(c, db, id, http.StatusBadRequest, "Не удалось прочитать файл")
+			return
+		}
+
+		bookingID, _ := strconv.ParseInt(c.PostForm("booking_id"), 10, 64)
+		if bookingID != 0 {
+			var n int
+			db.QueryRow("SELECT COUNT(*) FROM bookings WHERE id = ? AND user_id = ?", bookingID, id).Scan(&n)
+			if n == 0 {
+				renderPatientFiles(c, db, id, http.StatusBadRequest, "Прием не найден у этого пациента")
+				return
+			}
+		}
+
+		_, err = storePatientFile(db, patientFile{
+			UserID:    id,
+			BookingID: bookingID,
+			FileName:  filepath.Base(header.Filename),
+			Source:    "admin",
+			Caption:   strings.TrimSpace(c.PostForm("caption")),
+		}, data)
+		if err != nil {
+			if e, ok := err.(*attachmentError); ok {
+				renderPatientFiles(c, db, id, http.StatusBadRequest, e.reason)
+				return
+			}
+			log.Printf("Error saving patient file: %v", err)
+			renderPatientFiles(c, db, id, http.StatusInternalServerError, "Ошибка при сохранении файла")
+			return
+		}
+
+		c.Redirect(http.StatusFound, fmt.Sprintf("/admin/patients/%d/files", id))
+	}
+}
+
+// patientFileByID находит файл по ID из пути
+func patientFileByID(c *gin.Context, db *sql.DB) (*patientFile, bool) {
+	files, err := loadPatientFiles(db, "f.id = ?", c.Param("id"))
+	if err != nil || len(files) == 0 {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{
+			"error": "Файл не найден",
+		})
+		return nil, false
+	}
+	return &files[0], true
+}
+
+// AdminDownloadFileHandler отдает файл пациента. Картинки и PDF открываются в браузере
+// с параметром inline=1, остальное скачивается.
+func AdminDownloadFileHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		f, ok := patientFileByID(c, db)
+		if !ok {
+			return
+		}
+		reader, err := fileStore.Open(f.StorageKey)
+		if err != nil {
+			log.Printf("Error opening patient file %s: %v", f.StorageKey, err)
+			c.HTML(http.StatusNotFound, "error.html", gin.H{
+				"error": "Файл не найден в хранилище",
+			})
+			return
+		}
+		defer reader.Close()
+
+		disposition := "attachment"
+		if c.Query("inline") == "1" && (f.IsImage() || f.ContentType == "application/pdf") {
+			disposition = "inline"
+		}
+		c.DataFromReader(http.StatusOK, f.Size, f.ContentType, reader, map[string]string{
+			"Content-Disposition":    mime.FormatMediaType(disposition, map[string]string{"filename": f.FileName}),
+			"X-Content-Type-Options": "nosniff",
+		})
+	}
+}
+
+// AdminDeleteFileHandler удаляет файл пациента
+func AdminDeleteFileHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		f, ok := patientFileByID(c, db)
+		if !ok {
+			return
+		}
+		if _, err := db.Exec("DELETE FROM patient_files WHERE id = ?", f.ID); err != nil {
+			renderPatientFiles(c, db, f.UserID, http.StatusInternalServerError, "Ошибка при удалении файла")
+			return
+		}
+		if err := fileStore.Delete(f.StorageKey); err != nil {
+			log.Printf("Error deleting patient file %s: %v", f.StorageKey, err)
+		}
+		c.Redirect(http.StatusFound, fmt.Sprintf("/admin/patients/%d/files", f.UserID))
+	}
+}
@@ -0,0 +1,568 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// clinicName название клиники в квитанциях
+var clinicName = "Стоматологическая клиника"
+
+// SetClinicName задает название клиники для квитанций
+func SetClinicName(name string) {
+	if name != "" {
+		clinicName = name
+	}
+}
+
+// invoicePaymentMethods способы оплаты, которые администратор отмечает по счету
+var invoicePaymentMethods = []string{"cash", "card", "online"}
+
+// billingError ошибка в данных счета, текст которой показывается администратору
+type billingError struct {
+	reason string
+}
+
+func (e *billingError) Error() string {
+	return e.reason
+}
+
+// roundMoney округляет сумму до копеек
+func roundMoney(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// invoiceItemAmount сумма строки счета с учетом скидки
+func invoiceItemAmount(quantity int, unitPrice, discountPercent float64) float64 {
+	return roundMoney(float64(quantity) * unitPrice * (1 - discountPercent/100))
+}
+
+// invoiceItem строка счета
+type invoiceItem struct {
+	ID              int64
+	ServiceID       int64
+	Description     string
+	Quantity        int
+	UnitPrice       float64
+	DiscountPercent float64
+	Amount          float64
+}
+
+// invoice счет за прием. Оплаченная сумма складывается из оплаченных платежей по записи,
+// поэтому депозит, внесенный при записи, засчитывается автоматически.
+type invoice struct {
+	ID          int64
+	BookingID   int64
+	UserID      int64
+	Date        string
+	Time        string
+	ServiceName string
+	ClientName  string
+	PatientName string
+	Total       float64
+	Paid        float64
+	CreatedAt   string
+	Items       []invoiceItem
+}
+
+// Balance остаток к оплате; отрицательный при переплате
+func (i invoice) Balance() float64 {
+	return roundMoney(i.Total - i.Paid)
+}
+
+func (i invoice) StatusTitle() string {
+	switch balance := i.Balance(); {
+	case balance < 0:
+		return "Переплата"
+	case balance == 0:
+		return "Оплачен"
+	case i.Paid > 0:
+		return "Частично оплачен"
+	}
+	return "Не оплачен"
+}
+
+// loadInvoices возвращает счета по условию на invoices i и bookings b без строк
+func loadInvoices(db *sql.DB, where string, args ...interface{}) ([]invoice, error) {
+	rows, err := db.Query(`
+		SELECT i.id, i.booking_id, b.user_id, b.date, b.time, COALESCE(s.name, ''),
+			   COALESCE(NULLIF(TRIM(COALESCE(u.first_name, '') || ' ' || COALESCE(u.last_name, '')), ''), u.username, ''),
+			   COALESCE(dp.name, ''), i.total,
+			   COALESCE((SELECT SUM(p.amount) FROM payments p WHERE p.booking_id = i.booking_id AND p.status = ?), 0),
+			   COALESCE(i.created_at, '')
+		FROM invoices i
+		JOIN bookings b ON i.booking_id = b.id
+		JOIN users u ON b.user_id = u.id
+		LEFT JOIN services s ON b.service_id = s.id
+		LEFT JOIN dependents dp ON b.dependent_id = dp.id
+		WHERE `+where+`
+		ORDER BY b.date DESC, b.time DESC
+	`, append([]interface{}{paymentStatusPaid}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invoices []invoice
+	for rows.Next() {
+		var inv invoice
+		if err := rows.Scan(&inv.ID, &inv.BookingID, &inv.UserID, &inv.Date, &inv.Time, &inv.ServiceName,
+			&inv.ClientName, &inv.PatientName, &inv.Total, &inv.Paid, &inv.CreatedAt); err == nil {
+			invoices = append(invoices, inv)
+		}
+	}
+	return invoices, rows.Err()
+}
+
+// loadInvoice возвращает счет со строками
+func loadInvoice(db *sql.DB, where string, args ...interface{}) (*invoice, error) {
+	invoices, err := loadInvoices(db, where, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(invoices) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	inv := invoices[0]
+
+	rows, err := db.Query(`
+		SELECT id, COALESCE(service_id, 0), description, quantity, unit_price, discount_percent, amount
+		FROM invoice_items
+		WHERE invoice_id = ?
+		ORDER BY id
+	`, inv.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item invoiceItem
+		if err := rows.Scan(&item.ID, &item.ServiceID, &item.Description, &item.Quantity,
+			&item.UnitPrice, &item.DiscountPercent, &item.Amount); err == nil {
+			inv.Items = append(inv.Items, item)
+		}
+	}
+	return &inv, rows.Err()
+}
+
+// recalcInvoiceTotal пересчитывает сумму счета по строкам
+func recalcInvoiceTotal(q dbExecutor, invoiceID int64) error {
+	_, err := q.Exec(`
+		UPDATE invoices
+		SET total = COALESCE((SELECT ROUND(SUM(amount), 2) FROM invoice_items WHERE invoice_id = ?), 0)
+		WHERE id = ?
+	`, invoiceID, invoiceID)
+	return err
+}
+
+// insertInvoiceItem добавляет строку счета
+func insertInvoiceItem(q dbExecutor, invoiceID int64, item invoiceItem) error {
+	_, err := q.Exec(`
+		INSERT INTO invoice_items (invoice_id, service_id, description, quantity, unit_price, discount_percent, amount)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, invoiceID, nullInt64(item.ServiceID), item.Description, item.Quantity, item.UnitPrice, item.DiscountPercent,
+		invoiceItemAmount(item.Quantity, item.UnitPrice, item.DiscountPercent))
+	return err
+}
+
+// createInvoice выставляет счет по завершенному приему. В счет попадают услуга записи и процедуры
+// из медицинской записи, совпадающие по названию с услугами из прайса; остальное администратор
+// добавляет вручную. Если счет уже есть, возвращается его ID.
+func createInvoice(db *sql.DB, bookingID, staffID int64) (int64, error) {
+	var existing int64
+	err := db.QueryRow("SELECT id FROM invoices WHERE booking_id = ?", bookingID).Scan(&existing)
+	if err == nil {
+		return existing, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	var status, serviceName string
+	var serviceID int64
+	var price, discount float64
+	err = db.QueryRow(`
+		SELECT b.status, b.service_id, COALESCE(s.name, ''), COALESCE(b.base_price, s.price, 0), b.discount
+		FROM bookings b
+		LEFT JOIN services s ON b.service_id = s.id
+		WHERE b.id = ?
+	`, bookingID).Scan(&status, &serviceID, &serviceName, &price, &discount)
+	if err != nil {
+		return 0, err
+	}
+	if status != bookingStatusCompleted {
+		return 0, &billingError{reason: "Счет выставляется по завершенному приему"}
+	}
+
+	// Услуга записи идет по цене на момент записи, скидка из записи переводится в проценты
+	item := invoiceItem{ServiceID: serviceID, Description: serviceName, Quantity: 1, UnitPrice: price}
+	if price > 0 && discount > 0 {
+		item.DiscountPercent = discount / price * 100
+	}
+	items := []invoiceItem{item}
+	added := map[string]bool{strings.ToLower(serviceName): true}
+
+	rows, err := db.Query(`
+		SELECT s.id, s.name, s.price
+		FROM visit_procedures p
+		JOIN visit_records v ON p.visit_id = v.id
+		JOIN services s ON LOWER(s.name) = LOWER(p.name)
+		WHERE v.booking_id = ?
+		ORDER BY p.id
+	`, bookingID)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var item invoiceItem
+		if err := rows.Scan(&item.ServiceID, &item.Description, &item.UnitPrice); err != nil {
+			continue
+		}
+		if key := strings.ToLower(item.Description); !added[key] {
+			added[key] = true
+			item.Quantity = 1
+			items = append(items, item)
+		}
+	}
+	rows.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO invoices (booking_id, staff_id) VALUES (?, ?)", bookingID, nullInt64(staffID))
+	if err != nil {
+		return 0, err
+	}
+	invoiceID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	for _, item := range items {
+		if err := insertInvoiceItem(tx, invoiceID, item); err != nil {
+			return 0, err
+		}
+	}
+	if err := recalcInvoiceTotal(tx, invoiceID); err != nil {
+		return 0, err
+	}
+	return invoiceID, tx.Commit()
+}
+
+// invoiceItemFromForm читает строку счета из формы; цена и название по умолчанию берутся из услуги
+func invoiceItemFromForm(db *sql.DB, c *gin.Context) (invoiceItem, error) {
+	item := invoiceItem{
+		Description: strings.TrimSpace(c.PostForm("description")),
+		Quantity:    1,
+	}
+	item.ServiceID, _ = strconv.ParseInt(c.PostForm("service_id"), 10, 64)
+
+	if q := strings.TrimSpace(c.PostForm("quantity")); q != "" {
+		n, err := strconv.Atoi(q)
+		if err != nil || n < 1 {
+			return item, &billingError{reason: "Количество должно быть целым числом больше нуля"}
+		}
+		item.Quantity = n
+	}
+	if d := strings.TrimSpace(c.PostForm("discount_percent")); d != "" {
+		v, err := strconv.ParseFloat(strings.Replace(d, ",", ".", 1), 64)
+		if err != nil || v < 0 || v > 100 {
+			return item, &billingError{reason: "Скидка указывается в процентах от 0 до 100"}
+		}
+		item.DiscountPercent = v
+	}
+
+	priceText := strings.TrimSpace(c.PostForm("unit_price"))
+	if item.ServiceID != 0 {
+		var name string
+		var price float64
+		err := db.QueryRow("SELECT name, price FROM services WHERE id = ?", item.ServiceID).Scan(&name, &price)
+		if err == sql.ErrNoRows {
+			return item, &billingError{reason: "Услуга не найдена"}
+		}
+		if err != nil {
+			return item, err
+		}
+		if item.Description == "" {
+			item.Description = name
+		}
+		if priceText == "" {
+			item.UnitPrice = price
+		}
+	}
+	if priceText != "" {
+		v, err := strconv.ParseFloat(strings.Replace(priceText, ",", ".", 1), 64)
+		if err != nil || v < 0 {
+			return item, &billingError{reason: "Неверная цена"}
+		}
+		item.UnitPrice = roundMoney(v)
+	}
+	if item.Description == "" {
+		return item, &billingError{reason: "Выберите услугу или укажите название"}
+	}
+	return item, nil
+}
+
+// recordInvoicePayment сохраняет оплату по счету на месте
+func recordInvoicePayment(db *sql.DB, inv *invoice, amount float64, method string, staffID int64) (int64, error) {
+	valid := false
+	for _, m := range invoicePaymentMethods {
+		valid = valid || m == method
+	}
+	if !valid {
+		return 0, &billingError{reason: "Выберите способ оплаты"}
+	}
+	amount = roundMoney(amount)
+	if amount <= 0 {
+		return 0, &billingError{reason: "Сумма оплаты должна быть больше нуля"}
+	}
+	if amount > inv.Balance() {
+		return 0, &billingError{reason: fmt.Sprintf("Сумма больше остатка по счету (%.2f ₽)", inv.Balance())}
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO payments (booking_id, user_id, amount, currency, status, provider, paid_at, staff_id)
+		VALUES (?, ?, ?, ?, ?, ?, datetime('now'), ?)
+	`, inv.BookingID, inv.UserID, amount, paymentCurrency, paymentStatusPaid, method, nullInt64(staffID))
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// sendReceipt отправляет пациенту квитанцию об оплате в Telegram
+func sendReceipt(bot *tgbotapi.BotAPI, db *sql.DB, paymentID int64) error {
+	p, err := paymentByID(db, paymentID)
+	if err != nil {
+		return err
+	}
+	var telegramID int64
+	db.QueryRow("SELECT COALESCE(telegram_id, 0) FROM users WHERE id = ?", p.UserID).Scan(&telegramID)
+	if telegramID == 0 {
+		return nil
+	}
+
+	buf, err := buildReceiptPDF(db, p)
+	if err != nil {
+		return err
+	}
+	doc := tgbotapi.NewDocument(telegramID, tgbotapi.FileBytes{
+		Name:  fmt.Sprintf("receipt_%d.pdf", p.ID),
+		Bytes: buf.Bytes(),
+	})
+	doc.Caption = fmt.Sprintf("Квитанция об оплате %.2f ₽. Спасибо!", p.Amount)
+	_, err = bot.Send(doc)
+	return err
+}
+
+// renderAdminInvoice выводит страницу счета
+func renderAdminInvoice(c *gin.Context, db *sql.DB, id int64, status int, errorText string) {
+	inv, err := loadInvoice(db, "i.id = ?", id)
+	if err == sql.ErrNoRows {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{
+			"error": "Счет не найден",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting invoice: %v", err)
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Ошибка при получении данных",
+		})
+		return
+	}
+
+	payments, err := loadPayments(db, "booking_id = ? AND status = ?", inv.BookingID, paymentStatusPaid)
+	if err != nil {
+		log.Printf("Error getting invoice payments: %v", err)
+	}
+
+	c.HTML(status, "admin_invoice.html", gin.H{
+		"invoice":  inv,
+		"payments": payments,
+		"services": loadAdminFilterOptions(db, "SELECT id, name FROM services ORDER BY name"),
+		"methods":  invoicePaymentMethods,
+		"titles":   paymentMethodTitles,
+		"error":    errorText,
+	})
+}
+
+// invoiceIDParam читает ID счета из пути
+func invoiceIDParam(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{
+			"error": "Неверный ID счета",
+		})
+		return 0, false
+	}
+	return id, true
+}
+
+// billingErrorText текст ошибки для страницы счета
+func billingErrorText(err error, fallback string) string {
+	if e, ok := err.(*billingError); ok {
+		return e.reason
+	}
+	log.Printf("Billing error: %v", err)
+	return fallback
+}
+
+// AdminCreateInvoiceHandler выставляет счет по записи
+func AdminCreateInvoiceHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bookingID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.HTML(http.StatusBadRequest, "error.html", gin.H{
+				"error": "Неверный ID записи",
+			})
+			return
+		}
+
+		invoiceID, err := createInvoice(db, bookingID, currentStaff(c).ID)
+		if err == sql.ErrNoRows {
+			c.HTML(http.StatusNotFound, "error.html", gin.H{
+				"error": "Запись не найдена",
+			})
+			return
+		}
+		if err != nil {
+			renderAdminBooking(c, db, bookingID, http.StatusBadRequest, billingErrorText(err, "Ошибка при создании счета"))
+			return
+		}
+
+		c.Redirect(http.StatusFound, fmt.Sprintf("/admin/invoices/%d", invoiceID))
+	}
+}
+
+// AdminInvoiceHandler выводит счет со строками и оплатами
+func AdminInvoiceHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := invoiceIDParam(c)
+		if !ok {
+			return
+		}
+		renderAdminInvoice(c, db, id, http.StatusOK, "")
+	}
+}
+
+// AdminAddInvoiceItemHandler добавляет строку в счет
+func AdminAddInvoiceItemHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := invoiceIDParam(c)
+		if !ok {
+			return
+		}
+
+		item, err := invoiceItemFromForm(db, c)
+		if err == nil {
+			if err = insertInvoiceItem(db, id, item); err == nil {
+				err = recalcInvoiceTotal(db, id)
+			}
+		}
+		if err != nil {
+			renderAdminInvoice(c, db, id, http.StatusBadRequest, billingErrorText(err, "Ошибка при добавлении строки"))
+			return
+		}
+
+		c.Redirect(http.StatusFound, fmt.Sprintf("/admin/invoices/%d", id))
+	}
+}
+
+// AdminDeleteInvoiceItemHandler удаляет строку из счета
+func AdminDeleteInvoiceItemHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := invoiceIDParam(c)
+		if !ok {
+			return
+		}
+
+		_, err := db.Exec("DELETE FROM invoice_items WHERE id = ? AND invoice_id = ?", c.Param("item_id"), id)
+		if err == nil {
+			err = recalcInvoiceTotal(db, id)
+		}
+		if err != nil {
+			renderAdminInvoice(c, db, id, http.StatusInternalServerError, billingErrorText(err, "Ошибка при удалении строки"))
+			return
+		}
+
+		c.Redirect(http.StatusFound, fmt.Sprintf("/admin/invoices/%d", id))
+	}
+}
+
+// AdminInvoicePaymentHandler записывает оплату по счету и отправляет пациенту квитанцию
+func AdminInvoicePaymentHandler(db *sql.DB, bot *tgbotapi.BotAPI) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := invoiceIDParam(c)
+		if !ok {
+			return
+		}
+		inv, err := loadInvoice(db, "i.id = ?", id)
+		if err != nil {
+			c.HTML(http.StatusNotFound, "error.html", gin.H{
+				"error": "Счет не найден",
+			})
+			return
+		}
+
+		amount, err := strconv.ParseFloat(strings.Replace(strings.TrimSpace(c.PostForm("amount")), ",", ".", 1), 64)
+		if err != nil {
+			renderAdminInvoice(c, db, id, http.StatusBadRequest, "Неверная сумма")
+			return
+		}
+
+		paymentID, err := recordInvoicePayment(db, inv, amount, c.PostForm("method"), currentStaff(c).ID)
+		if err != nil {
+			renderAdminInvoice(c, db, id, http.StatusBadRequest, billingErrorText(err, "Ошибка при сохранении оплаты"))
+			return
+		}
+
+		if err := sendReceipt(bot, db, paymentID); err != nil {
+			log.Printf("Error sending receipt: %v", err)
+		}
+
+		c.Redirect(http.StatusFound, fmt.Sprintf("/admin/invoices/%d", id))
+	}
+}
+
+// AdminReceiptHandler отдает квитанцию об оплате в PDF
+func AdminReceiptHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.HTML(http.StatusBadRequest, "error.html", gin.H{
+				"error": "Неверный ID платежа",
+			})
+			return
+		}
+		p, err := paymentByID(db, id)
+		if err != nil || p.Status != paymentStatusPaid {
+			c.HTML(http.StatusNotFound, "error.html", gin.H{
+				"error": "Оплата не найдена",
+			})
+			return
+		}
+
+		buf, err := buildReceiptPDF(db, p)
+		if err != nil {
+			log.Printf("Error building receipt: %v", err)
+			c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Ошибка при формировании PDF",
+			})
+			return
+		}
+
+		c.Header("Content-Disposition", fmt.Sprintf(`inline; filename="receipt_%d.pdf"`, p.ID))
+		c.Data(http.StatusOK, "application/pdf", buf.Bytes())
+	}
+}
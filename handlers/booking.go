@@ -21,6 +21,9 @@ type BookingState struct {
 var userStates = make(map[int64]*BookingState)
 
 func startBookingProcess(bot *tgbotapi.BotAPI, chatID int64, db *sql.DB, userID int64) {
+	// Промокод вводится заново для каждой записи
+	clearPromoCode(db, chatID)
+
 	// Получаем список услуг
 	rows, err := db.Query(`
 		SELECT id, name, category, duration, price
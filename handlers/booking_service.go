@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// dbExecutor общий интерфейс для *sql.DB и *sql.Tx
+type dbExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// errSlotTaken возвращается, когда выбранное время у врача уже занято
+var errSlotTaken = errors.New("время уже занято")
+
+// errDependentNotFound возвращается, когда член семьи не принадлежит пациенту
+var errDependentNotFound = errors.New("член семьи не найден")
+
+// bookingParams описывает создаваемую запись
+type bookingParams struct {
+	UserID      int64
+	DependentID int64 // член семьи, для которого запись; 0 - сам пациент
+	ServiceID   int64
+	DoctorID    int64
+	SeriesID    int64
+	Date        string
+	Time        string
+	Status      string
+	PromoCode   string // промокод, введенный пациентом в боте
+}
+
+// nullInt64 превращает нулевой идентификатор в NULL для базы данных
+func nullInt64(v int64) interface{} {
+	if v == 0 {
+		return nil
+	}
+	return v
+}
+
+// slotSeats возвращает вместимость услуги и количество свободных мест на указанное время у врача.
+// Записи без врача ведутся как отдельное расписание (doctor_id = 0) и не занимают время врачей.
+// На групповой прием время делят только записи на ту же услугу, любая другая запись занимает
+// время целиком. excludeID позволяет не учитывать переносимую запись.
+func slotSeats(q dbExecutor, serviceID, doctorID int64, date, time string, excludeID int64) (int, int, error) {
+	capacity := 1
+	if err := q.QueryRow("SELECT COALESCE(capacity, 1) FROM services WHERE id = ?", serviceID).Scan(&capacity); err != nil && err != sql.ErrNoRows {
+		return 0, 0, err
+	}
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	var sameService, otherService int
+	err := q.QueryRow(`
+		SELECT COALESCE(SUM(CASE WHEN service_id = ? THEN 1 ELSE 0 END), 0),
+			   COALESCE(SUM(CASE WHEN service_id != ? THEN 1 ELSE 0 END), 0)
+		FROM bookings
+		WHERE COALESCE(doctor_id, 0) = ? AND date = ? AND time = ? AND id != ?
+		  AND status NOT IN ('Отменено', 'Отменена')
+	`, serviceID, serviceID, doctorID, date, time, excludeID).Scan(&sameService, &otherService)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if otherService > 0 || sameService >= capacity {
+		return capacity, 0, nil
+	}
+	return capacity, capacity - sameService, nil
+}
+
+// checkSlotAvailable проверяет, что на указанное время у врача есть свободное место для услуги
+func checkSlotAvailable(q dbExecutor, serviceID, doctorID int64, date, time string, excludeID int64) error {
+	_, free, err := slotSeats(q, serviceID, doctorID, date, time, excludeID)
+	if err != nil {
+		return err
+	}
+	if free == 0 {
+		return errSlotTaken
+	}
+	return nil
+}
+
+// dayTimeSlots возвращает времена приема в течение рабочего дня с 9:00 до 18:00 с шагом 30 минут
+func dayTimeSlots() []string {
+	var slots []string
+	start, _ := time.Parse("15:04", "09:00")
+	end, _ := time.Parse("15:04", "18:00")
+	for t := start; t.Before(end); t = t.Add(30 * time.Minute) {
+		slots = append(slots, t.Format("15:04"))
+	}
+	return slots
+}
+
+// insertBooking проверяет доступность времени и сохраняет запись
+func insertBooking(q dbExecutor, p bookingParams) (int64, error) {
+	if p.DependentID != 0 {
+		var count int
+		if err := q.QueryRow("SELECT COUNT(*) FROM dependents WHERE id = ? AND user_id = ?", p.DependentID, p.UserID).Scan(&count); err != nil {
+			return 0, err
+		}
+		if count == 0 {
+			return 0, errDependentNotFound
+		}
+	}
+
+	if err := checkSlotAvailable(q, p.ServiceID, p.DoctorID, p.Date, p.Time, 0); err != nil {
+		return 0, err
+	}
+
+	if err := checkBookingLimits(q, p); err != nil {
+		return 0, err
+	}
+
+	status := p.Status
+	if status == "" {
+		status = "Ожидает подтверждения"
+	}
+
+	quote, err := quotePrice(q, p)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := q.Exec(`
+		INSERT INTO bookings (user_id, dependent_id, service_id, doctor_id, series_id, date, time, status,
+			base_price, discount, final_price, discount_id, discount_title)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''))
+	`, p.UserID, nullInt64(p.DependentID), p.ServiceID, nullInt64(p.DoctorID), nullInt64(p.SeriesID), p.Date, p.Time, status,
+		quote.BasePrice, quote.Discount, quote.FinalPrice, nullInt64(quote.DiscountID), quote.DiscountTitle)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// errBookingNotFound возвращается, когда переносимая запись не найдена или отменена
+var errBookingNotFound = errors.New("запись не найдена")
+
+// moveBooking переносит запись на другое время и, при необходимости, к другому врачу
+func moveBooking(q dbExecutor, bookingID, doctorID int64, date, time string) error {
+	var serviceID, oldDoctorID int64
+	var oldDate string
+	err := q.QueryRow(`
+		SELECT service_id, COALESCE(doctor_id, 0), date FROM bookings
+		WHERE id = ? AND status NOT IN ('Отменено', 'Отменена')
+	`, bookingID).Scan(&serviceID, &oldDoctorID, &oldDate)
+	if err == sql.ErrNoRows {
+		return errBookingNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := checkSlotAvailable(q, serviceID, doctorID, date, time, bookingID); err != nil {
+		return err
+	}
+
+	// При переносе на другой день или к другому врачу запись должна уложиться в дневные ограничения
+	if date != oldDate || doctorID != oldDoctorID {
+		reason, err := dayLimitViolation(q, serviceID, doctorID, date, bookingID)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			return &limitError{reason: reason}
+		}
+	}
+
+	_, err = q.Exec(`
+		UPDATE bookings SET doctor_id = ?, date = ?, time = ? WHERE id = ?
+	`, nullInt64(doctorID), date, time, bookingID)
+	return err
+}
@@ -4,7 +4,10 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -24,11 +27,23 @@ func ProcessBotUpdates(bot *tgbotapi.BotAPI, updates tgbotapi.UpdatesChannel, db
 			continue
 		}
 
+		// Telegram спрашивает подтверждение перед списанием по счету
+		if update.PreCheckoutQuery != nil {
+			handlePreCheckoutQuery(bot, update.PreCheckoutQuery, db)
+			continue
+		}
+
 		// Пропускаем обновления без сообщений
 		if update.Message == nil {
 			continue
 		}
 
+		// Ответы сотрудников пациентам из чата администраторов
+		if isSupportChat(update.Message.Chat.ID) {
+			handleSupportChatMessage(bot, update.Message, db)
+			continue
+		}
+
 		// Получаем или создаем пользователя
 		userID, err := getOrCreateUser(db, update.Message.From.ID, update.Message.From.UserName)
 		if err != nil {
@@ -36,12 +51,30 @@ func ProcessBotUpdates(bot *tgbotapi.BotAPI, updates tgbotapi.UpdatesChannel, db
 			continue
 		}
 
+		// Пациент поделился своим контактом: телефон подтвержден Telegram
+		if update.Message.Contact != nil {
+			handleContactMessage(bot, update.Message, db, userID)
+			continue
+		}
+
+		// Счет за депозит оплачен
+		if update.Message.SuccessfulPayment != nil {
+			handleSuccessfulPayment(bot, update.Message, db)
+			continue
+		}
+
 		// Обрабатываем команды
 		if update.Message.IsCommand() {
 			handleCommand(bot, update.Message, db, userID)
 			continue
 		}
 
+		// Сохраняем присланные снимки, фото и документы в карточку пациента
+		if len(update.Message.Photo) > 0 || update.Message.Document != nil {
+			handleAttachmentMessage(bot, update.Message, db, userID)
+			continue
+		}
+
 		// Обрабатываем текстовые сообщения
 		handleTextMessage(update, bot, db)
 	}
@@ -68,6 +101,7 @@ func getOrCreateUser(db *sql.DB, telegramID int64, username string) (int64, erro
 func handleCommand(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB, userID int64) {
 	switch message.Command() {
 	case "start":
+		resetPendingInput(db, message.Chat.ID)
 		msg := tgbotapi.NewMessage(message.Chat.ID, "Добро пожаловать! Я помогу вам записаться на прием. Используйте /help для получения списка доступных команд.")
 		bot.Send(msg)
 
@@ -78,7 +112,12 @@ func handleCommand(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB,
 /services - Показать список услуг
 /book - Записаться на прием
 /my_bookings - Показать мои записи
-/cancel - Отменить запись`
+/waitlist - Показать лист ожидания
+/family - Члены семьи
+/phone - Подтвердить номер телефона
+/cancel - Отменить запись
+/unsubscribe - Отписаться от рассылок клиники
+/subscribe - Подписаться на рассылки клиники`
 		msg := tgbotapi.NewMessage(message.Chat.ID, helpText)
 		bot.Send(msg)
 
@@ -86,6 +125,11 @@ func handleCommand(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB,
 		showServices(bot, message.Chat.ID, db)
 
 	case "book":
+		if botBookingBlocked(bot, message.Chat.ID, db) {
+			return
+		}
+		resetPendingInput(db, message.Chat.ID)
+		trackFunnelStep(db, message.Chat.ID, funnelStepStarted, "")
 		startBookingProcess(bot, message.Chat.ID, db, userID)
 
 	case "my_bookings":
@@ -94,6 +138,21 @@ func handleCommand(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB,
 	case "cancel":
 		startCancellationProcess(bot, message.Chat.ID, db, userID)
 
+	case "waitlist":
+		showUserWaitlist(bot, message.Chat.ID, db, userID)
+
+	case "family":
+		showFamily(bot, message.Chat.ID, db, userID)
+
+	case "phone":
+		requestPhoneContact(bot, message.Chat.ID)
+
+	case "unsubscribe":
+		setMarketingOptOut(bot, message.Chat.ID, true, db)
+
+	case "subscribe":
+		setMarketingOptOut(bot, message.Chat.ID, false, db)
+
 	default:
 		msg := tgbotapi.NewMessage(message.Chat.ID, "Неизвестная команда. Используйте /help для получения списка доступных команд.")
 		bot.Send(msg)
@@ -128,7 +187,7 @@ func handleTextMessage(update tgbotapi.Update, bot *tgbotapi.BotAPI, db *sql.DB)
 		}
 
 		// Обновляем номер телефона
-		_, err = db.Exec("UPDATE users SET phone = ? WHERE telegram_id = ?", phone, update.Message.Chat.ID)
+		_, err = db.Exec("UPDATE users SET phone = ?, phone_verified = 0 WHERE telegram_id = ?", phone, update.Message.Chat.ID)
 		if err != nil {
 			log.Printf("Error updating phone: %v", err)
 			msg.Text = "Произошла ошибка при сохранении номера телефона. Попробуйте позже."
@@ -149,6 +208,7 @@ func handleTextMessage(update tgbotapi.Update, bot *tgbotapi.BotAPI, db *sql.DB)
 		// TODO: Отправить код через SMS
 		msg.Text = fmt.Sprintf("Ваш код подтверждения: %s\nКод действителен 5 минут.", code)
 		bot.Send(msg)
+		trackFunnelStep(db, update.Message.Chat.ID, funnelStepPhone, "")
 
 		// Обновляем состояние
 		_, err = db.Exec("UPDATE users SET state = 'waiting_for_code' WHERE telegram_id = ?", update.Message.Chat.ID)
@@ -182,7 +242,7 @@ func handleTextMessage(update tgbotapi.Update, bot *tgbotapi.BotAPI, db *sql.DB)
 		}
 
 		// Обновляем состояние
-		_, err = db.Exec("UPDATE users SET state = 'ready', confirmation_code = NULL, code_expires_at = NULL WHERE telegram_id = ?", update.Message.Chat.ID)
+		_, err = db.Exec("UPDATE users SET state = 'ready', phone_verified = 1, confirmation_code = NULL, code_expires_at = NULL WHERE telegram_id = ?", update.Message.Chat.ID)
 		if err != nil {
 			log.Printf("Error updating state: %v", err)
 			msg.Text = "Произошла ошибка. Попробуйте позже."
@@ -190,12 +250,27 @@ func handleTextMessage(update tgbotapi.Update, bot *tgbotapi.BotAPI, db *sql.DB)
 			return
 		}
 
-		msg.Text = "Номер телефона успешно подтвержден! Теперь вы можете использовать все функции бота."
+		// Код показывается в этом же чате и не доказывает, что номер принадлежит пациенту,
+		// поэтому записи из клиники привязываются только по контакту Telegram (/phone)
+		msg.Text = "Номер телефона успешно подтвержден! Теперь вы можете использовать все функции бота.\n\nЕсли вы уже записывались в клинике по телефону, отправьте свой контакт командой /phone, и мы привяжем эти записи к аккаунту."
+		trackFunnelStep(db, update.Message.Chat.ID, funnelStepPhoneVerified, "")
 		bot.Send(msg)
 
+	case "waiting_for_dependent":
+		saveDependentFromMessage(bot, update.Message, db)
+
+	case "waiting_for_promo":
+		savePromoCodeFromMessage(bot, update.Message, db)
+
+	case "waiting_for_review":
+		saveReviewCommentFromMessage(bot, update.Message, db)
+
+	case "choosing_date":
+		suggestSlotsFromText(bot, update.Message, db)
+
 	default:
-		msg.Text = "Пожалуйста, используйте команды для взаимодействия с ботом. /help для получения списка команд."
-		bot.Send(msg)
+		// Свободный текст уходит в переписку с регистратурой
+		saveSupportMessageFromPatient(bot, update.Message, db)
 	}
 }
 
@@ -205,11 +280,19 @@ func handleCallbackQuery(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery,
 		return
 	}
 
+	// Заблокированным пациентам запись через бота недоступна
+	for _, prefix := range []string{"service_", "date_", "time_", "confirm_", "promo_", "wl_join", "wl_doc_", "wl_range_", "wl_take_", "rc_"} {
+		if strings.HasPrefix(callback.Data, prefix) && botBookingBlocked(bot, callback.Message.Chat.ID, db) {
+			return
+		}
+	}
+
 	// Обрабатываем callback в зависимости от его типа
 	switch {
 	case strings.HasPrefix(callback.Data, "service_"):
 		// Пользователь выбрал услугу
 		serviceID := strings.TrimPrefix(callback.Data, "service_")
+		trackFunnelStep(db, callback.Message.Chat.ID, funnelStepService, serviceID)
 		startDateSelection(bot, callback.Message.Chat.ID, serviceID, db)
 
 	case strings.HasPrefix(callback.Data, "date_"):
@@ -222,6 +305,7 @@ func handleCallbackQuery(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery,
 		}
 		serviceID := parts[1]
 		date := parts[2]
+		trackFunnelStep(db, callback.Message.Chat.ID, funnelStepDate, serviceID)
 		startTimeSelection(bot, callback.Message.Chat.ID, serviceID, date, db)
 
 	case strings.HasPrefix(callback.Data, "time_"):
@@ -235,12 +319,13 @@ func handleCallbackQuery(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery,
 		serviceID := parts[1]
 		date := parts[2]
 		time := parts[3]
+		trackFunnelStep(db, callback.Message.Chat.ID, funnelStepTime, serviceID)
 		confirmBooking(bot, callback.Message.Chat.ID, serviceID, date, time, db)
 
 	case strings.HasPrefix(callback.Data, "confirm_"):
-		// Пользователь подтвердил запись
+		// Пользователь подтвердил запись; пятая часть - член семьи, для которого запись
 		parts := strings.Split(callback.Data, "_")
-		if len(parts) != 4 {
+		if len(parts) != 4 && len(parts) != 5 {
 			callbackConfig := tgbotapi.NewCallback(callback.ID, "Ошибка: неверный формат данных")
 			bot.Request(callbackConfig)
 			return
@@ -248,13 +333,47 @@ func handleCallbackQuery(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery,
 		serviceID := parts[1]
 		date := parts[2]
 		time := parts[3]
-		createBooking(bot, callback.Message.Chat.ID, serviceID, date, time, db)
+		var dependentID int64
+		if len(parts) == 5 {
+			dependentID, _ = strconv.ParseInt(parts[4], 10, 64)
+		}
+		createBooking(bot, callback.Message.Chat.ID, serviceID, date, time, dependentID, db)
+
+	case strings.HasPrefix(callback.Data, "promo_"):
+		// Пользователь хочет ввести промокод к выбранному времени
+		parts := strings.Split(callback.Data, "_")
+		if len(parts) != 4 {
+			callbackConfig := tgbotapi.NewCallback(callback.ID, "Ошибка: неверный формат данных")
+			bot.Request(callbackConfig)
+			return
+		}
+		askPromoCode(bot, callback.Message.Chat.ID, parts[1], parts[2], parts[3], db)
 
 	case strings.HasPrefix(callback.Data, "cancel_"):
 		// Пользователь отменил запись
 		bookingID := strings.TrimPrefix(callback.Data, "cancel_")
 		cancelBooking(bot, callback.Message.Chat.ID, bookingID, db)
 
+	case strings.HasPrefix(callback.Data, "wl_"):
+		// Лист ожидания
+		handleWaitlistCallback(bot, callback, db)
+
+	case strings.HasPrefix(callback.Data, "fam_"):
+		// Члены семьи
+		handleFamilyCallback(bot, callback, db)
+
+	case callback.Data == broadcastUnsubscribeData:
+		// Отписка кнопкой под сообщением рассылки
+		setMarketingOptOut(bot, callback.Message.Chat.ID, true, db)
+
+	case strings.HasPrefix(callback.Data, "fb_"):
+		// Оценка приема
+		handleFeedbackCallback(bot, callback, db)
+
+	case strings.HasPrefix(callback.Data, "rc_"):
+		// Запись из приглашения на повторный визит
+		handleRecallCallback(bot, callback, db)
+
 	default:
 		// Неизвестный тип callback
 		callbackConfig := tgbotapi.NewCallback(callback.ID, "Неизвестная команда")
@@ -366,9 +485,10 @@ func showServices(bot *tgbotapi.BotAPI, chatID int64, db *sql.DB) {
 
 func showUserBookings(bot *tgbotapi.BotAPI, chatID int64, db *sql.DB, userID int64) {
 	rows, err := db.Query(`
-		SELECT b.id, b.date, b.time, s.name as service_name, b.status
+		SELECT b.id, b.date, b.time, s.name as service_name, b.status, COALESCE(dp.name, '')
 		FROM bookings b
 		JOIN services s ON b.service_id = s.id
+		LEFT JOIN dependents dp ON b.dependent_id = dp.id
 		WHERE b.user_id = ?
 		ORDER BY b.date DESC, b.time DESC
 	`, userID)
@@ -382,15 +502,19 @@ func showUserBookings(bot *tgbotapi.BotAPI, chatID int64, db *sql.DB, userID int
 	var bookings []string
 	for rows.Next() {
 		var id int64
-		var date, time, serviceName, status string
-		if err := rows.Scan(&id, &date, &time, &serviceName, &status); err != nil {
+		var date, time, serviceName, status, patientName string
+		if err := rows.Scan(&id, &date, &time, &serviceName, &status, &patientName); err != nil {
 			continue
 		}
 
-		bookings = append(bookings, fmt.Sprintf(
+		text := fmt.Sprintf(
 			"• %s\n  Дата: %s\n  Время: %s\n  Статус: %s",
 			serviceName, date, time, status,
-		))
+		)
+		if patientName != "" {
+			text += "\n  Пациент: " + patientName
+		}
+		bookings = append(bookings, text)
 	}
 
 	if len(bookings) == 0 {
@@ -435,30 +559,31 @@ func generateConfirmationCode() string {
 }
 
 func startDateSelection(bot *tgbotapi.BotAPI, chatID int64, serviceID string, db *sql.DB) {
+	// Пациент мог уже исчерпать лимит активных записей
+	var userID int64
+	if err := db.QueryRow("SELECT id FROM users WHERE telegram_id = ?", chatID).Scan(&userID); err != nil && err != sql.ErrNoRows {
+		log.Printf("Error getting user ID: %v", err)
+	}
+	reason, err := patientLimitViolation(db, userID, 0)
+	if err != nil {
+		log.Printf("Error checking patient limit: %v", err)
+	}
+	if reason != "" {
+		msg := tgbotapi.NewMessage(chatID, reason+". Отменить ненужные записи можно через /cancel.")
+		bot.Send(msg)
+		return
+	}
+
 	// Получаем доступные даты на ближайшие 14 дней
-	var dates []string
-	rows, err := db.Query(`
-		SELECT date
-		FROM bookings
-		WHERE date BETWEEN date('now') AND date('now', '+14 days')
-		GROUP BY date
-		HAVING COUNT(*) < 8
-		ORDER BY date
-	`)
+	serviceIDInt, _ := strconv.ParseInt(serviceID, 10, 64)
+	today := time.Now()
+	dates, err := availableDates(db, serviceIDInt, 0, today, today.AddDate(0, 0, 14))
 	if err != nil {
 		log.Printf("Error getting available dates: %v", err)
 		msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении доступных дат. Попробуйте позже.")
 		bot.Send(msg)
 		return
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var date string
-		if err := rows.Scan(&date); err == nil {
-			dates = append(dates, date)
-		}
-	}
 
 	// Создаем клавиатуру с датами
 	var keyboard [][]tgbotapi.InlineKeyboardButton
@@ -472,63 +597,261 @@ func startDateSelection(bot *tgbotapi.BotAPI, chatID int64, serviceID string, db
 		})
 	}
 
-	msg := tgbotapi.NewMessage(chatID, "Выберите удобную дату:")
+	// Занятые дни скрыты, поэтому предлагаем встать в лист ожидания
+	keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Нет подходящей даты? Лист ожидания", fmt.Sprintf("wl_join_%s", serviceID)),
+	))
+
+	// Пока пациент выбирает дату, текст вида «завтра после 15» разбирается как пожелание по времени
+	_, err = db.Exec(`
+		UPDATE users SET state = 'choosing_date', booking_service = ?
+		WHERE telegram_id = ? AND COALESCE(state, 'ready') IN ('ready', 'choosing_date')
+	`, serviceIDInt, chatID)
+	if err != nil {
+		log.Printf("Error updating state: %v", err)
+	}
+
+	msg := tgbotapi.NewMessage(chatID, "Выберите удобную дату или напишите, когда вам удобно, например: «завтра после 15», «в пятницу утром», «25 октября в 10:30».")
 	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
 	bot.Send(msg)
 }
 
 func startTimeSelection(bot *tgbotapi.BotAPI, chatID int64, serviceID, date string, db *sql.DB) {
-	// Получаем доступные времена для выбранной даты
-	rows, err := db.Query(`
-		SELECT time
-		FROM bookings
-		WHERE date = ?
-		ORDER BY time
-	`, date)
+	serviceIDInt, _ := strconv.ParseInt(serviceID, 10, 64)
+
+	// Генерируем временные слоты и оставляем те, где есть свободные места
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	var row []tgbotapi.InlineKeyboardButton
+
+	for _, timeStr := range dayTimeSlots() {
+		capacity, free, err := slotSeats(db, serviceIDInt, 0, date, timeStr, 0)
+		if err != nil {
+			log.Printf("Error getting booked times: %v", err)
+			msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении доступного времени. Попробуйте позже.")
+			bot.Send(msg)
+			return
+		}
+		if free == 0 {
+			continue
+		}
+
+		// Для групповых приемов показываем количество свободных мест
+		text := timeStr
+		if capacity > 1 {
+			text = fmt.Sprintf("%s (мест: %d)", timeStr, free)
+		}
+		callbackData := fmt.Sprintf("time_%s_%s_%s", serviceID, date, timeStr)
+		row = append(row, tgbotapi.InlineKeyboardButton{
+			Text:         text,
+			CallbackData: &callbackData,
+		})
+		if len(row) == 2 {
+			keyboard = append(keyboard, row)
+			row = []tgbotapi.InlineKeyboardButton{}
+		}
+	}
+	if len(row) > 0 {
+		keyboard = append(keyboard, row)
+	}
+
+	msg := tgbotapi.NewMessage(chatID, "Выберите удобное время:")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	bot.Send(msg)
+}
+
+// slotOption свободное время, предложенное пациенту по текстовому пожеланию
+type slotOption struct {
+	Date   time.Time
+	Time   string
+	Minute int
+}
+
+// findFreeSlots свободное время услуги в указанные дни; прошедшее время сегодня пропускается
+func findFreeSlots(db *sql.DB, serviceID int64, dates []time.Time, now time.Time) ([]slotOption, error) {
+	var slots []slotOption
+	for _, d := range dates {
+		dateStr := d.Format("2006-01-02")
+		available, err := availableDates(db, serviceID, 0, d, d)
+		if err != nil {
+			return nil, err
+		}
+		if len(available) == 0 {
+			continue
+		}
+		for _, timeStr := range dayTimeSlots() {
+			if dateStr+" "+timeStr <= now.Format("2006-01-02 15:04") {
+				continue
+			}
+			_, free, err := slotSeats(db, serviceID, 0, dateStr, timeStr, 0)
+			if err != nil {
+				return nil, err
+			}
+			if free == 0 {
+				continue
+			}
+			t, _ := time.Parse("15:04", timeStr)
+			slots = append(slots, slotOption{Date: d, Time: timeStr, Minute: t.Hour()*60 + t.Minute()})
+		}
+	}
+	return slots, nil
+}
+
+// matchSlots подбирает свободное время под пожелание. Если точно подходящего нет, возвращает
+// ближайшее по времени в названные дни, а если и в эти дни мест нет - в следующие дни.
+// exact сообщает, совпало ли время с пожеланием.
+func matchSlots(db *sql.DB, serviceID int64, q dateQuery, now time.Time) (slots []slotOption, exact bool, err error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	horizon := func(from time.Time, days int) []time.Time {
+		var dates []time.Time
+		for d := from; d.Before(today.AddDate(0, 0, days+1)); d = d.AddDate(0, 0, 1) {
+			dates = append(dates, d)
+		}
+		return dates
+	}
+
+	dates := q.Dates
+	if len(dates) == 0 {
+		dates = horizon(today, 14)
+	}
+	free, err := findFreeSlots(db, serviceID, dates, now)
 	if err != nil {
-		log.Printf("Error getting booked times: %v", err)
-		msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении доступного времени. Попробуйте позже.")
-		bot.Send(msg)
-		return
+		return nil, false, err
 	}
-	defer rows.Close()
 
-	// Создаем карту занятых времен
-	bookedTimes := make(map[string]bool)
-	for rows.Next() {
-		var time string
-		if err := rows.Scan(&time); err == nil {
-			bookedTimes[time] = true
+	var matching []slotOption
+	for _, s := range free {
+		if q.matches(s.Minute) {
+			matching = append(matching, s)
+		}
+	}
+	if len(matching) > 0 {
+		return firstSlots(matching), true, nil
+	}
+
+	// В эти дни есть другое время: предлагаем ближайшее к пожеланию
+	if len(free) > 0 {
+		sort.SliceStable(free, func(i, j int) bool { return q.distance(free[i].Minute) < q.distance(free[j].Minute) })
+		closest := firstSlots(free)
+		sort.SliceStable(closest, func(i, j int) bool {
+			if !closest[i].Date.Equal(closest[j].Date) {
+				return closest[i].Date.Before(closest[j].Date)
+			}
+			return closest[i].Minute < closest[j].Minute
+		})
+		return closest, false, nil
+	}
+
+	// В названные дни мест нет: ищем в следующие дни сначала в нужное время, затем любое
+	if len(q.Dates) == 0 {
+		return nil, false, nil
+	}
+	last := q.Dates[len(q.Dates)-1]
+	free, err = findFreeSlots(db, serviceID, horizon(last.AddDate(0, 0, 1), int(last.Sub(today).Hours()/24)+14), now)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, s := range free {
+		if q.matches(s.Minute) {
+			matching = append(matching, s)
 		}
 	}
+	if len(matching) > 0 {
+		return firstSlots(matching), false, nil
+	}
+	return firstSlots(free), false, nil
+}
+
+// firstSlots ограничивает число предложенных вариантов
+func firstSlots(slots []slotOption) []slotOption {
+	const maxSuggestedSlots = 6
+	if len(slots) > maxSuggestedSlots {
+		return slots[:maxSuggestedSlots]
+	}
+	return slots
+}
+
+// suggestSlotsFromText разбирает пожелание пациента по дате и времени и предлагает
+// подходящее свободное время кнопками
+func suggestSlotsFromText(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB) {
+	chatID := message.Chat.ID
+	var serviceID int64
+	if err := db.QueryRow("SELECT COALESCE(booking_service, 0) FROM users WHERE telegram_id = ?", chatID).Scan(&serviceID); err != nil {
+		log.Printf("Error getting booking service: %v", err)
+	}
+
+	now := time.Now()
+	q, err := parseDateQuery(message.Text, now)
+	if err == errDateNotRecognized || serviceID == 0 {
+		// Это не дата: пациент пишет в клинику, выбор даты прекращается
+		finishDateChoice(db, chatID)
+		saveSupportMessageFromPatient(bot, message, db)
+		return
+	}
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(chatID, "Не получилось подобрать время: "+err.Error()+". Напишите иначе или выберите дату кнопкой."))
+		return
+	}
 
-	// Генерируем временные слоты с 9:00 до 18:00 с интервалом в 30 минут
-	start, _ := time.Parse("15:04", "09:00")
-	end, _ := time.Parse("15:04", "18:00")
+	slots, exact, err := matchSlots(db, serviceID, q, now)
+	if err != nil {
+		log.Printf("Error matching slots: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Произошла ошибка при получении доступного времени. Попробуйте позже."))
+		return
+	}
+	if len(slots) == 0 {
+		msg := tgbotapi.NewMessage(chatID, "К сожалению, свободного времени в ближайшие дни нет. Можно встать в лист ожидания.")
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Лист ожидания", fmt.Sprintf("wl_join_%d", serviceID)),
+		))
+		bot.Send(msg)
+		return
+	}
+
+	text := fmt.Sprintf("Свободное время: %s.", q.Title())
+	if !exact {
+		text = fmt.Sprintf("Точно по запросу «%s» свободного времени нет. Ближайшие варианты:", q.Title())
+	}
 	var keyboard [][]tgbotapi.InlineKeyboardButton
 	var row []tgbotapi.InlineKeyboardButton
-
-	for t := start; t.Before(end); t = t.Add(30 * time.Minute) {
-		timeStr := t.Format("15:04")
-		if !bookedTimes[timeStr] {
-			callbackData := fmt.Sprintf("time_%s_%s_%s", serviceID, date, timeStr)
-			row = append(row, tgbotapi.InlineKeyboardButton{
-				Text:         timeStr,
-				CallbackData: &callbackData,
-			})
-			if len(row) == 2 {
-				keyboard = append(keyboard, row)
-				row = []tgbotapi.InlineKeyboardButton{}
-			}
+	for _, s := range slots {
+		date := s.Date.Format("2006-01-02")
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(
+			fmt.Sprintf("%s %s", russianDate(s.Date), s.Time),
+			fmt.Sprintf("time_%d_%s_%s", serviceID, date, s.Time),
+		))
+		if len(row) == 2 {
+			keyboard = append(keyboard, row)
+			row = nil
 		}
 	}
 	if len(row) > 0 {
 		keyboard = append(keyboard, row)
 	}
 
-	msg := tgbotapi.NewMessage(chatID, "Выберите удобное время:")
+	msg := tgbotapi.NewMessage(chatID, text)
 	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
 	bot.Send(msg)
+	trackFunnelStep(db, chatID, funnelStepDate, strconv.FormatInt(serviceID, 10))
+}
+
+// finishDateChoice завершает выбор даты: дальше свободный текст снова уходит в переписку
+func finishDateChoice(db *sql.DB, chatID int64) {
+	if _, err := db.Exec(`
+		UPDATE users SET state = 'ready', booking_service = NULL WHERE telegram_id = ? AND state = 'choosing_date'
+	`, chatID); err != nil {
+		log.Printf("Error updating state: %v", err)
+	}
+}
+
+// resetPendingInput сбрасывает ожидание ввода (член семьи, промокод, отзыв, дата), чтобы
+// /start и /book всегда начинали заново. Регистрация по телефону не сбрасывается
+func resetPendingInput(db *sql.DB, chatID int64) {
+	if _, err := db.Exec(`
+		UPDATE users SET state = 'ready', booking_service = NULL
+		WHERE telegram_id = ? AND state IN ('waiting_for_dependent', 'waiting_for_promo', 'waiting_for_review', 'choosing_date')
+	`, chatID); err != nil {
+		log.Printf("Error updating state: %v", err)
+	}
 }
 
 func confirmBooking(bot *tgbotapi.BotAPI, chatID int64, serviceID, date, time string, db *sql.DB) {
@@ -536,9 +859,9 @@ func confirmBooking(bot *tgbotapi.BotAPI, chatID int64, serviceID, date, time st
 	var service struct {
 		Name     string
 		Duration int
-		Price    float64
+		Deposit  float64
 	}
-	err := db.QueryRow("SELECT name, duration, price FROM services WHERE id = ?", serviceID).Scan(&service.Name, &service.Duration, &service.Price)
+	err := db.QueryRow("SELECT name, duration, deposit FROM services WHERE id = ?", serviceID).Scan(&service.Name, &service.Duration, &service.Deposit)
 	if err != nil {
 		log.Printf("Error getting service info: %v", err)
 		msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении информации об услуге. Попробуйте позже.")
@@ -546,6 +869,31 @@ func confirmBooking(bot *tgbotapi.BotAPI, chatID int64, serviceID, date, time st
 		return
 	}
 
+	var userID int64
+	var promoCode string
+	db.QueryRow("SELECT id, COALESCE(promo_code, '') FROM users WHERE telegram_id = ?", chatID).Scan(&userID, &promoCode)
+
+	// Цена со скидками; промокод, который перестал действовать, сбрасываем
+	serviceIDInt, _ := strconv.ParseInt(serviceID, 10, 64)
+	params := bookingParams{UserID: userID, ServiceID: serviceIDInt, Date: date, PromoCode: promoCode}
+	quote, err := quotePrice(db, params)
+	var promoNote string
+	if pe, ok := err.(*promoError); ok {
+		promoNote = fmt.Sprintf("Промокод %s не применен: %s.", promoCode, pe.reason)
+		clearPromoCode(db, chatID)
+		params.PromoCode = ""
+		quote, err = quotePrice(db, params)
+	}
+	if err != nil {
+		log.Printf("Error calculating price: %v", err)
+		msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при расчете стоимости. Попробуйте позже.")
+		bot.Send(msg)
+		return
+	}
+	if quote.PromoIgnored {
+		promoNote = "Скидки не суммируются: применена более выгодная скидка вместо промокода."
+	}
+
 	// Создаем клавиатуру для подтверждения
 	confirmData := fmt.Sprintf("confirm_%s_%s_%s", serviceID, date, time)
 	cancelData := "cancel"
@@ -562,18 +910,52 @@ func confirmBooking(bot *tgbotapi.BotAPI, chatID int64, serviceID, date, time st
 		},
 	}
 
-	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf(
-		"Подтвердите запись:\n\nУслуга: %s\nДата: %s\nВремя: %s\nДлительность: %d мин.\nСтоимость: %.2f ₽",
-		service.Name, date, time, service.Duration, service.Price,
+	text := fmt.Sprintf("Подтвердите запись:\n\nУслуга: %s\nДата: %s\nВремя: %s\nДлительность: %d мин.\n%s",
+		service.Name, date, time, service.Duration, quote.priceText())
+	if deposit := math.Min(service.Deposit, quote.FinalPrice); deposit > 0 && depositsEnabled() {
+		text += fmt.Sprintf("\nДепозит: %.2f ₽ - оплачивается онлайн после подтверждения и учитывается в стоимости", deposit)
+	}
+	if promoNote != "" {
+		text += "\n\n" + promoNote
+	}
+
+	// Если у пациента есть члены семьи, предлагаем выбрать, для кого запись
+	if dependents, err := getDependents(db, userID); err == nil && len(dependents) > 0 {
+		keyboard[0][0].Text = "Подтвердить для себя"
+		text += "\n"
+		for _, d := range dependents {
+			data := fmt.Sprintf("confirm_%s_%s_%s_%d", serviceID, date, time, d.ID)
+			keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("Подтвердить для: %s (%s)", d.Name, d.Relation), data),
+			))
+
+			// Скидки на первый визит и день рождения у членов семьи свои
+			params.DependentID = d.ID
+			if q, err := quotePrice(db, params); err == nil && q.FinalPrice != quote.FinalPrice {
+				text += fmt.Sprintf("\nСтоимость для: %s - %.2f ₽ (%s)", d.Name, q.FinalPrice, q.DiscountTitle)
+			}
+		}
+		text += "\n\nВыберите, для кого запись."
+	}
+
+	promoText := "Ввести промокод"
+	if params.PromoCode != "" {
+		promoText = "Изменить промокод"
+	}
+	keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(promoText, fmt.Sprintf("promo_%s_%s_%s", serviceID, date, time)),
 	))
+
+	msg := tgbotapi.NewMessage(chatID, text)
 	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
 	bot.Send(msg)
 }
 
-func createBooking(bot *tgbotapi.BotAPI, chatID int64, serviceID, date, time string, db *sql.DB) {
-	// Получаем ID пользователя
+func createBooking(bot *tgbotapi.BotAPI, chatID int64, serviceID, date, time string, dependentID int64, db *sql.DB) {
+	// Получаем ID пользователя и введенный промокод
 	var userID int64
-	err := db.QueryRow("SELECT id FROM users WHERE telegram_id = ?", chatID).Scan(&userID)
+	var promoCode string
+	err := db.QueryRow("SELECT id, COALESCE(promo_code, '') FROM users WHERE telegram_id = ?", chatID).Scan(&userID, &promoCode)
 	if err != nil {
 		log.Printf("Error getting user ID: %v", err)
 		msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при создании записи. Попробуйте позже.")
@@ -582,10 +964,35 @@ func createBooking(bot *tgbotapi.BotAPI, chatID int64, serviceID, date, time str
 	}
 
 	// Создаем запись
-	_, err = db.Exec(`
-		INSERT INTO bookings (user_id, service_id, date, time)
-		VALUES (?, ?, ?, ?)
-	`, userID, serviceID, date, time)
+	serviceIDInt, _ := strconv.ParseInt(serviceID, 10, 64)
+	bookingID, err := insertBooking(db, bookingParams{
+		UserID:      userID,
+		DependentID: dependentID,
+		ServiceID:   serviceIDInt,
+		Date:        date,
+		Time:        time,
+		PromoCode:   promoCode,
+	})
+	if _, ok := err.(*promoError); ok {
+		// Промокод перестал действовать: показываем подтверждение заново с ценой без него
+		confirmBooking(bot, chatID, serviceID, date, time, db)
+		return
+	}
+	if err == errSlotTaken {
+		msg := tgbotapi.NewMessage(chatID, "К сожалению, на это время уже нет свободных мест. Пожалуйста, выберите другое время.")
+		bot.Send(msg)
+		return
+	}
+	if err == errDependentNotFound {
+		msg := tgbotapi.NewMessage(chatID, "Член семьи не найден. Проверьте список через /family.")
+		bot.Send(msg)
+		return
+	}
+	if le, ok := err.(*limitError); ok {
+		msg := tgbotapi.NewMessage(chatID, "Не удалось записаться: "+le.reason+".")
+		bot.Send(msg)
+		return
+	}
 	if err != nil {
 		log.Printf("Error creating booking: %v", err)
 		msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при создании записи. Попробуйте позже.")
@@ -593,11 +1000,31 @@ func createBooking(bot *tgbotapi.BotAPI, chatID int64, serviceID, date, time str
 		return
 	}
 
+	clearPromoCode(db, chatID)
+	finishDateChoice(db, chatID)
+	trackFunnelBooking(db, chatID, serviceID, bookingID)
+
+	// По услугам с депозитом запись подтверждается после оплаты; без настроенной оплаты
+	// депозит не берется, запись подтверждает администратор как обычно
+	if depositsEnabled() && bookingDeposit(db, bookingID) > 0 {
+		msg := tgbotapi.NewMessage(chatID, "Запись создана! Она будет подтверждена после оплаты депозита.")
+		bot.Send(msg)
+		if err := requestDeposit(bot, db, chatID, userID, bookingID); err != nil {
+			log.Printf("Error requesting deposit: %v", err)
+			msg := tgbotapi.NewMessage(chatID, "Не удалось выставить счет на депозит. Мы свяжемся с вами для подтверждения записи.")
+			bot.Send(msg)
+		}
+		return
+	}
+
 	msg := tgbotapi.NewMessage(chatID, "Запись успешно создана! Мы свяжемся с вами для подтверждения.")
 	bot.Send(msg)
 }
 
 func cancelBooking(bot *tgbotapi.BotAPI, chatID int64, bookingID string, db *sql.DB) {
+	id, _ := strconv.ParseInt(bookingID, 10, 64)
+	slot, slotErr := freedSlotForBooking(db, id)
+
 	// Отменяем запись
 	_, err := db.Exec("UPDATE bookings SET status = 'Отменена' WHERE id = ?", bookingID)
 	if err != nil {
@@ -609,4 +1036,9 @@ func cancelBooking(bot *tgbotapi.BotAPI, chatID int64, bookingID string, db *sql
 
 	msg := tgbotapi.NewMessage(chatID, "Запись успешно отменена.")
 	bot.Send(msg)
+
+	// Предлагаем освободившееся время листу ожидания
+	if slotErr == nil {
+		offerFreedSlot(bot, db, slot)
+	}
 }
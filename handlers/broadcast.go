@@ -0,0 +1,706 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Статусы рассылки
+const (
+	broadcastStatusDraft     = "draft"
+	broadcastStatusSending   = "sending"
+	broadcastStatusDone      = "done"
+	broadcastStatusCancelled = "cancelled"
+)
+
+var broadcastStatusTitles = map[string]string{
+	broadcastStatusDraft:     "Черновик",
+	broadcastStatusSending:   "Отправляется",
+	broadcastStatusDone:      "Отправлена",
+	broadcastStatusCancelled: "Остановлена",
+}
+
+// Статусы доставки получателю
+const (
+	recipientStatusPending = "pending"
+	recipientStatusSent    = "sent"
+	recipientStatusBlocked = "blocked" // пациент заблокировал бота
+	recipientStatusFailed  = "failed"
+	recipientStatusSkipped = "skipped" // пациент отписался после запуска рассылки
+)
+
+var recipientStatusTitles = map[string]string{
+	recipientStatusPending: "В очереди",
+	recipientStatusSent:    "Доставлено",
+	recipientStatusBlocked: "Бот заблокирован",
+	recipientStatusFailed:  "Ошибка",
+	recipientStatusSkipped: "Отписался",
+}
+
+// Сегменты получателей
+const (
+	broadcastSegmentAll      = "all"
+	broadcastSegmentInactive = "inactive"
+	broadcastSegmentDoctor   = "doctor"
+	broadcastSegmentService  = "service"
+)
+
+// broadcastInactiveMonths сколько месяцев без визитов для сегмента inactive
+const broadcastInactiveMonths = 6
+
+var broadcastSegmentTitles = map[string]string{
+	broadcastSegmentAll:      "Все пациенты",
+	broadcastSegmentInactive: fmt.Sprintf("Без визитов %d месяцев", broadcastInactiveMonths),
+	broadcastSegmentDoctor:   "Пациенты врача",
+	broadcastSegmentService:  "Пациенты услуги",
+}
+
+// Ограничения рассылки. Telegram допускает около 30 сообщений в секунду на бота,
+// оставляем запас для ответов пациентам.
+const (
+	broadcastMessagesPerSecond = 20
+	broadcastBatchSize         = 200
+	broadcastMaxButtons        = 5
+	broadcastMaxText           = 4096
+	broadcastMaxCaption        = 1024 // подпись к фото
+	broadcastUnsubscribeData   = "mk_off"
+)
+
+// broadcastError ошибка проверки рассылки, текст показывается администратору
+type broadcastError struct {
+	reason string
+}
+
+func (e *broadcastError) Error() string {
+	return e.reason
+}
+
+// broadcastButton кнопка-ссылка под сообщением рассылки
+type broadcastButton struct {
+	Text string
+	URL  string
+}
+
+// parseBroadcastButtons разбирает кнопки: по строке на кнопку в формате «текст | ссылка»
+func parseBroadcastButtons(text string) ([]broadcastButton, error) {
+	var buttons []broadcastButton
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "|", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, &broadcastError{fmt.Sprintf("Кнопка «%s»: укажите текст и ссылку через «|»", line)}
+		}
+		b := broadcastButton{Text: strings.TrimSpace(parts[0]), URL: strings.TrimSpace(parts[1])}
+		u, err := url.Parse(b.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, &broadcastError{fmt.Sprintf("Кнопка «%s»: ссылка должна начинаться с http:// или https://", b.Text)}
+		}
+		buttons = append(buttons, b)
+	}
+	if len(buttons) > broadcastMaxButtons {
+		return nil, &broadcastError{fmt.Sprintf("Не больше %d кнопок", broadcastMaxButtons)}
+	}
+	return buttons, nil
+}
+
+// broadcastStats количество получателей по статусам доставки
+type broadcastStats struct {
+	Total   int
+	Pending int
+	Sent    int
+	Blocked int
+	Failed  int
+	Skipped int
+}
+
+// broadcast рассылка в админке
+type broadcast struct {
+	ID              int64
+	Text            string
+	PhotoURL        string
+	PhotoTelegramID string
+	Buttons         []broadcastButton
+	Segment         string
+	DoctorID        int64
+	ServiceID       int64
+	TargetName      string // врач или услуга сегмента
+	Status          string
+	CreatedAt       string
+	StartedAt       string
+	FinishedAt      string
+	Stats           broadcastStats
+	Audience        int // для черновика - сколько пациентов получат рассылку сейчас
+}
+
+func (b broadcast) StatusTitle() string {
+	return broadcastStatusTitles[b.Status]
+}
+
+func (b broadcast) SegmentTitle() string {
+	title := broadcastSegmentTitles[b.Segment]
+	if b.TargetName != "" {
+		title += ": " + b.TargetName
+	}
+	return title
+}
+
+// audience условие отбора получателей сегмента. Заблокированные в клинике, отписавшиеся
+// и пациенты без Telegram не получают рассылки.
+func (b broadcast) audience() (string, []interface{}) {
+	where := `
+		FROM users u
+		WHERE u.telegram_id IS NOT NULL AND COALESCE(u.is_blocked, 0) = 0 AND u.marketing_opt_out = 0`
+	var args []interface{}
+	switch b.Segment {
+	case broadcastSegmentInactive:
+		where += `
+		  AND NOT EXISTS (
+			SELECT 1 FROM bookings b WHERE b.user_id = u.id
+			  AND b.status NOT IN ('Отменено', 'Отменена', ?)
+			  AND b.date >= date('now', 'localtime', ?)
+		  )`
+		args = append(args, bookingStatusNoShow, fmt.Sprintf("-%d months", broadcastInactiveMonths))
+	case broadcastSegmentDoctor:
+		where += `
+		  AND EXISTS (
+			SELECT 1 FROM bookings b WHERE b.user_id = u.id AND b.doctor_id = ?
+			  AND b.status NOT IN ('Отменено', 'Отменена')
+		  )`
+		args = append(args, b.DoctorID)
+	case broadcastSegmentService:
+		where += `
+		  AND EXISTS (
+			SELECT 1 FROM bookings b WHERE b.user_id = u.id AND b.service_id = ?
+			  AND b.status NOT IN ('Отменено', 'Отменена')
+		  )`
+		args = append(args, b.ServiceID)
+	}
+	return where, args
+}
+
+// countBroadcastAudience сколько пациентов сейчас попадает в сегмент рассылки
+func countBroadcastAudience(db *sql.DB, b broadcast) (int, error) {
+	where, args := b.audience()
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) "+where, args...).Scan(&n)
+	return n, err
+}
+
+// loadBroadcasts рассылки со статистикой доставки
+func loadBroadcasts(db *sql.DB, where string, args ...interface{}) ([]broadcast, error) {
+	rows, err := db.Query(`
+		SELECT br.id, br.text, COALESCE(br.photo_url, ''), COALESCE(br.photo_telegram_id, ''), COALESCE(br.buttons, ''),
+			   br.segment, COALESCE(br.doctor_id, 0), COALESCE(br.service_id, 0), COALESCE(d.name, s.name, ''),
+			   br.status, strftime('%Y-%m-%d %H:%M', br.created_at),
+			   COALESCE(strftime('%Y-%m-%d %H:%M', br.started_at), ''), COALESCE(strftime('%Y-%m-%d %H:%M', br.finished_at), ''),
+			   COUNT(r.id), COALESCE(SUM(r.status = 'pending'), 0), COALESCE(SUM(r.status = 'sent'), 0),
+			   COALESCE(SUM(r.status = 'blocked'), 0), COALESCE(SUM(r.status = 'failed'), 0), COALESCE(SUM(r.status = 'skipped'), 0)
+		FROM broadcasts br
+		LEFT JOIN doctors d ON br.segment = 'doctor' AND br.doctor_id = d.id
+		LEFT JOIN services s ON br.segment = 'service' AND br.service_id = s.id
+		LEFT JOIN broadcast_recipients r ON r.broadcast_id = br.id
+	`+where+`
+		GROUP BY br.id
+		ORDER BY br.id DESC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []broadcast
+	for rows.Next() {
+		var b broadcast
+		var buttons string
+		if err := rows.Scan(&b.ID, &b.Text, &b.PhotoURL, &b.PhotoTelegramID, &buttons,
+			&b.Segment, &b.DoctorID, &b.ServiceID, &b.TargetName,
+			&b.Status, &b.CreatedAt, &b.StartedAt, &b.FinishedAt,
+			&b.Stats.Total, &b.Stats.Pending, &b.Stats.Sent, &b.Stats.Blocked, &b.Stats.Failed, &b.Stats.Skipped); err != nil {
+			return nil, err
+		}
+		// Кнопки проверены при сохранении
+		b.Buttons, _ = parseBroadcastButtons(buttons)
+		list = append(list, b)
+	}
+	return list, rows.Err()
+}
+
+// loadBroadcast рассылка по ID
+func loadBroadcast(db *sql.DB, id int64) (*broadcast, error) {
+	list, err := loadBroadcasts(db, " WHERE br.id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &list[0], nil
+}
+
+// startBroadcast фиксирует получателей черновика и ставит рассылку в очередь отправки
+func startBroadcast(db *sql.DB, id int64) (int, error) {
+	b, err := loadBroadcast(db, id)
+	if err != nil {
+		return 0, err
+	}
+	if b.Status != broadcastStatusDraft {
+		return 0, &broadcastError{"Рассылка уже запущена"}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	where, args := b.audience()
+	result, err := tx.Exec(`
+		INSERT INTO broadcast_recipients (broadcast_id, user_id, telegram_id)
+		SELECT ?, u.id, u.telegram_id `+where, append([]interface{}{id}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := result.RowsAffected()
+	if n == 0 {
+		return 0, &broadcastError{"В выбранном сегменте нет пациентов, которым можно отправить рассылку"}
+	}
+	if _, err := tx.Exec(`
+		UPDATE broadcasts SET status = ?, started_at = CURRENT_TIMESTAMP WHERE id = ?
+	`, broadcastStatusSending, id); err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
+
+// broadcastMessage сообщение рассылки для пациента: текст или фото с подписью и кнопками
+func broadcastMessage(b *broadcast, chatID int64) (tgbotapi.Chattable, error) {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, btn := range b.Buttons {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonURL(btn.Text, btn.URL)))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Отписаться от рассылок", broadcastUnsubscribeData),
+	))
+	markup := tgbotapi.NewInlineKeyboardMarkup(rows...)
+
+	if b.PhotoURL == "" {
+		msg := tgbotapi.NewMessage(chatID, b.Text)
+		msg.ReplyMarkup = markup
+		return msg, nil
+	}
+
+	var file tgbotapi.RequestFileData
+	if b.PhotoTelegramID != "" {
+		file = tgbotapi.FileID(b.PhotoTelegramID)
+	} else {
+		reader, err := fileStore.Open(mediaKey(b.PhotoURL))
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		file = tgbotapi.FileBytes{Name: path.Base(b.PhotoURL), Bytes: data}
+	}
+	photo := tgbotapi.NewPhoto(chatID, file)
+	photo.Caption = b.Text
+	photo.ReplyMarkup = markup
+	return photo, nil
+}
+
+// RunBroadcastWorker отправляет запущенные рассылки с ограничением скорости
+func RunBroadcastWorker(bot *tgbotapi.BotAPI, db *sql.DB) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sendBroadcastBatch(bot, db)
+	}
+}
+
+// sendBroadcastBatch отправляет очередную порцию сообщений самой старой запущенной рассылки
+func sendBroadcastBatch(bot *tgbotapi.BotAPI, db *sql.DB) {
+	var id int64
+	err := db.QueryRow("SELECT id FROM broadcasts WHERE status = ? ORDER BY started_at, id LIMIT 1", broadcastStatusSending).Scan(&id)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting broadcast: %v", err)
+		return
+	}
+	b, err := loadBroadcast(db, id)
+	if err != nil {
+		log.Printf("Error loading broadcast %d: %v", id, err)
+		return
+	}
+
+	type recipient struct {
+		ID         int64
+		TelegramID int64
+		OptedOut   bool
+	}
+	rows, err := db.Query(`
+		SELECT r.id, r.telegram_id, COALESCE(u.marketing_opt_out, 1)
+		FROM broadcast_recipients r
+		LEFT JOIN users u ON r.user_id = u.id
+		WHERE r.broadcast_id = ? AND r.status = ?
+		ORDER BY r.id
+		LIMIT ?
+	`, id, recipientStatusPending, broadcastBatchSize)
+	if err != nil {
+		log.Printf("Error getting broadcast recipients: %v", err)
+		return
+	}
+	var recipients []recipient
+	for rows.Next() {
+		var r recipient
+		if err := rows.Scan(&r.ID, &r.TelegramID, &r.OptedOut); err == nil {
+			recipients = append(recipients, r)
+		}
+	}
+	rows.Close()
+
+	if len(recipients) == 0 {
+		if _, err := db.Exec(`
+			UPDATE broadcasts SET status = ?, finished_at = CURRENT_TIMESTAMP WHERE id = ? AND status = ?
+		`, broadcastStatusDone, id, broadcastStatusSending); err != nil {
+			log.Printf("Error finishing broadcast %d: %v", id, err)
+		}
+		return
+	}
+
+	limiter := time.NewTicker(time.Second / broadcastMessagesPerSecond)
+	defer limiter.Stop()
+
+	for _, r := range recipients {
+		// Рассылку могли остановить во время отправки
+		var status string
+		db.QueryRow("SELECT status FROM broadcasts WHERE id = ?", id).Scan(&status)
+		if status != broadcastStatusSending {
+			return
+		}
+		if r.OptedOut {
+			setRecipientStatus(db, r.ID, recipientStatusSkipped, "")
+			continue
+		}
+
+		<-limiter.C
+		msg, err := broadcastMessage(b, r.TelegramID)
+		if err != nil {
+			// Например, фото удалено из хранилища: отмечаем получателя, иначе рассылка зависнет
+			log.Printf("Error preparing broadcast %d: %v", id, err)
+			setRecipientStatus(db, r.ID, recipientStatusFailed, "не удалось подготовить сообщение: "+err.Error())
+			continue
+		}
+		sent, err := bot.Send(msg)
+		if apiErr, ok := err.(*tgbotapi.Error); ok {
+			switch {
+			case apiErr.Code == http.StatusTooManyRequests:
+				// Превысили лимит Telegram: ждем и продолжаем со следующей порции
+				log.Printf("Broadcast %d rate limited, retry after %d s", id, apiErr.RetryAfter)
+				time.Sleep(time.Duration(apiErr.RetryAfter) * time.Second)
+				return
+			case apiErr.Code == http.StatusForbidden:
+				setRecipientStatus(db, r.ID, recipientStatusBlocked, apiErr.Message)
+				continue
+			}
+		}
+		if err != nil {
+			setRecipientStatus(db, r.ID, recipientStatusFailed, err.Error())
+			continue
+		}
+		setRecipientStatus(db, r.ID, recipientStatusSent, "")
+
+		// Фото загружаем в Telegram один раз, дальше отправляем по file_id
+		if b.PhotoURL != "" && b.PhotoTelegramID == "" && len(sent.Photo) > 0 {
+			b.PhotoTelegramID = sent.Photo[len(sent.Photo)-1].FileID
+			db.Exec("UPDATE broadcasts SET photo_telegram_id = ? WHERE id = ?", b.PhotoTelegramID, id)
+		}
+	}
+}
+
+func setRecipientStatus(db *sql.DB, recipientID int64, status, errorText string) {
+	_, err := db.Exec(`
+		UPDATE broadcast_recipients SET status = ?, error = NULLIF(?, ''), sent_at = CURRENT_TIMESTAMP WHERE id = ?
+	`, status, errorText, recipientID)
+	if err != nil {
+		log.Printf("Error updating broadcast recipient %d: %v", recipientID, err)
+	}
+}
+
+// setMarketingOptOut отписывает пациента от рассылок или подписывает обратно
+func setMarketingOptOut(bot *tgbotapi.BotAPI, chatID int64, optOut bool, db *sql.DB) {
+	if _, err := db.Exec("UPDATE users SET marketing_opt_out = ? WHERE telegram_id = ?", optOut, chatID); err != nil {
+		log.Printf("Error updating marketing opt-out: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Произошла ошибка. Попробуйте позже."))
+		return
+	}
+	if optOut {
+		bot.Send(tgbotapi.NewMessage(chatID, "Вы отписались от рассылок клиники. Напоминания о ваших записях будут приходить как прежде. Подписаться снова: /subscribe"))
+		return
+	}
+	bot.Send(tgbotapi.NewMessage(chatID, "Вы подписались на новости и акции клиники. Отписаться: /unsubscribe"))
+}
+
+// renderAdminBroadcasts выводит список рассылок и форму новой рассылки
+func renderAdminBroadcasts(c *gin.Context, db *sql.DB, status int, errorText string) {
+	list, err := loadBroadcasts(db, "")
+	if err != nil {
+		log.Printf("Error getting broadcasts: %v", err)
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Ошибка при получении данных",
+		})
+		return
+	}
+	c.HTML(status, "admin_broadcasts.html", gin.H{
+		"broadcasts":     list,
+		"segments":       broadcastSegmentTitles,
+		"doctors":        loadAdminFilterOptions(db, "SELECT id, name FROM doctors ORDER BY name"),
+		"services":       loadAdminFilterOptions(db, "SELECT id, name FROM services ORDER BY name"),
+		"maxButtons":     broadcastMaxButtons,
+		"ratePerSecond":  broadcastMessagesPerSecond,
+		"inactiveMonths": broadcastInactiveMonths,
+		"error":          errorText,
+	})
+}
+
+// AdminBroadcastsHandler выводит рассылки и создает черновик новой рассылки
+func AdminBroadcastsHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodGet {
+			renderAdminBroadcasts(c, db, http.StatusOK, "")
+			return
+		}
+
+		// POST запрос - новая рассылка
+		b := broadcast{
+			Text:    strings.TrimSpace(c.PostForm("text")),
+			Segment: c.PostForm("segment"),
+		}
+		b.DoctorID, _ = strconv.ParseInt(c.PostForm("doctor_id"), 10, 64)
+		b.ServiceID, _ = strconv.ParseInt(c.PostForm("service_id"), 10, 64)
+		buttonsText := strings.TrimSpace(c.PostForm("buttons"))
+
+		if b.Text == "" {
+			renderAdminBroadcasts(c, db, http.StatusBadRequest, "Введите текст рассылки")
+			return
+		}
+		if _, ok := broadcastSegmentTitles[b.Segment]; !ok {
+			renderAdminBroadcasts(c, db, http.StatusBadRequest, "Выберите получателей")
+			return
+		}
+		if (b.Segment == broadcastSegmentDoctor && b.DoctorID == 0) || (b.Segment == broadcastSegmentService && b.ServiceID == 0) {
+			renderAdminBroadcasts(c, db, http.StatusBadRequest, "Выберите врача или услугу для сегмента")
+			return
+		}
+		if b.Segment != broadcastSegmentDoctor {
+			b.DoctorID = 0
+		}
+		if b.Segment != broadcastSegmentService {
+			b.ServiceID = 0
+		}
+		if _, err := parseBroadcastButtons(buttonsText); err != nil {
+			renderAdminBroadcasts(c, db, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var photo []byte
+		if header, err := c.FormFile("photo"); err == nil {
+			if photo, err = readUploadedPhoto(header); err == nil {
+				photo, _, err = processDoctorPhoto(photo)
+			}
+			if err != nil {
+				renderAdminBroadcasts(c, db, http.StatusBadRequest, adminDoctorPhotoError(err))
+				return
+			}
+		}
+		limit := broadcastMaxText
+		if photo != nil {
+			limit = broadcastMaxCaption
+		}
+		if utf8.RuneCountInString(b.Text) > limit {
+			renderAdminBroadcasts(c, db, http.StatusBadRequest, fmt.Sprintf("Текст длиннее %d символов", limit))
+			return
+		}
+
+		var photoURL string
+		if photo != nil {
+			name, err := randomFileName()
+			if err == nil {
+				key := "media/broadcasts/" + name + ".jpg"
+				if err = fileStore.Save(key, photo, "image/jpeg"); err == nil {
+					photoURL = "/" + key
+				}
+			}
+			if err != nil {
+				log.Printf("Error saving broadcast photo: %v", err)
+				renderAdminBroadcasts(c, db, http.StatusInternalServerError, "Ошибка при сохранении фото")
+				return
+			}
+		}
+
+		result, err := db.Exec(`
+			INSERT INTO broadcasts (text, photo_url, buttons, segment, doctor_id, service_id, staff_id)
+			VALUES (?, NULLIF(?, ''), NULLIF(?, ''), ?, ?, ?, ?)
+		`, b.Text, photoURL, buttonsText, b.Segment, nullInt64(b.DoctorID), nullInt64(b.ServiceID), nullInt64(currentStaff(c).ID))
+		if err != nil {
+			log.Printf("Error creating broadcast: %v", err)
+			deleteMediaFiles(photoURL)
+			renderAdminBroadcasts(c, db, http.StatusInternalServerError, "Ошибка при сохранении рассылки")
+			return
+		}
+		id, _ := result.LastInsertId()
+		c.Redirect(http.StatusFound, fmt.Sprintf("/admin/broadcasts/%d", id))
+	}
+}
+
+// broadcastRecipient получатель на странице рассылки
+type broadcastRecipient struct {
+	UserID int64
+	Name   string
+	Status string
+	Error  string
+	SentAt string
+}
+
+func (r broadcastRecipient) StatusTitle() string {
+	return recipientStatusTitles[r.Status]
+}
+
+// adminBroadcastProblemsLimit сколько недоставленных сообщений показывать на странице рассылки
+const adminBroadcastProblemsLimit = 100
+
+// renderAdminBroadcast выводит предпросмотр рассылки и статистику доставки
+func renderAdminBroadcast(c *gin.Context, db *sql.DB, status int, errorText string) {
+	id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+	b, err := loadBroadcast(db, id)
+	if err != nil {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{
+			"error": "Рассылка не найдена",
+		})
+		return
+	}
+	if b.Status == broadcastStatusDraft {
+		if b.Audience, err = countBroadcastAudience(db, *b); err != nil {
+			log.Printf("Error counting broadcast audience: %v", err)
+		}
+	}
+
+	rows, err := db.Query(`
+		SELECT r.user_id, COALESCE(NULLIF(TRIM(COALESCE(u.first_name, '') || ' ' || COALESCE(u.last_name, '')), ''), u.username, ''),
+			   r.status, COALESCE(r.error, ''), COALESCE(strftime('%Y-%m-%d %H:%M', r.sent_at), '')
+		FROM broadcast_recipients r
+		LEFT JOIN users u ON r.user_id = u.id
+		WHERE r.broadcast_id = ? AND r.status IN (?, ?, ?)
+		ORDER BY r.id
+		LIMIT ?
+	`, id, recipientStatusBlocked, recipientStatusFailed, recipientStatusSkipped, adminBroadcastProblemsLimit)
+	if err != nil {
+		log.Printf("Error getting broadcast recipients: %v", err)
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Ошибка при получении данных",
+		})
+		return
+	}
+	defer rows.Close()
+	var problems []broadcastRecipient
+	for rows.Next() {
+		var r broadcastRecipient
+		if err := rows.Scan(&r.UserID, &r.Name, &r.Status, &r.Error, &r.SentAt); err == nil {
+			problems = append(problems, r)
+		}
+	}
+
+	c.HTML(status, "admin_broadcast.html", gin.H{
+		"broadcast":     b,
+		"problems":      problems,
+		"problemsLimit": adminBroadcastProblemsLimit,
+		"error":         errorText,
+	})
+}
+
+// AdminBroadcastHandler страница рассылки
+func AdminBroadcastHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		renderAdminBroadcast(c, db, http.StatusOK, "")
+	}
+}
+
+// AdminSendBroadcastHandler запускает отправку черновика
+func AdminSendBroadcastHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		if _, err := startBroadcast(db, id); err != nil {
+			if be, ok := err.(*broadcastError); ok {
+				renderAdminBroadcast(c, db, http.StatusBadRequest, be.reason)
+				return
+			}
+			if err == sql.ErrNoRows {
+				renderAdminBroadcast(c, db, http.StatusNotFound, "")
+				return
+			}
+			log.Printf("Error starting broadcast: %v", err)
+			renderAdminBroadcast(c, db, http.StatusInternalServerError, "Ошибка при запуске рассылки")
+			return
+		}
+		c.Redirect(http.StatusFound, "/admin/broadcasts/"+c.Param("id"))
+	}
+}
+
+// AdminCancelBroadcastHandler останавливает отправку. Уже доставленные сообщения остаются у пациентов.
+func AdminCancelBroadcastHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, err := db.Exec(`
+			UPDATE broadcasts SET status = ?, finished_at = CURRENT_TIMESTAMP WHERE id = ? AND status = ?
+		`, broadcastStatusCancelled, c.Param("id"), broadcastStatusSending)
+		if err != nil {
+			log.Printf("Error cancelling broadcast: %v", err)
+			renderAdminBroadcast(c, db, http.StatusInternalServerError, "Ошибка при остановке рассылки")
+			return
+		}
+		c.Redirect(http.StatusFound, "/admin/broadcasts/"+c.Param("id"))
+	}
+}
+
+// AdminDeleteBroadcastHandler удаляет черновик рассылки
+func AdminDeleteBroadcastHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		b, err := loadBroadcast(db, id)
+		if err != nil {
+			c.HTML(http.StatusNotFound, "error.html", gin.H{
+				"error": "Рассылка не найдена",
+			})
+			return
+		}
+		if b.Status != broadcastStatusDraft {
+			renderAdminBroadcast(c, db, http.StatusBadRequest, "Удалить можно только черновик")
+			return
+		}
+		if _, err := db.Exec("DELETE FROM broadcasts WHERE id = ? AND status = ?", id, broadcastStatusDraft); err != nil {
+			log.Printf("Error deleting broadcast: %v", err)
+			renderAdminBroadcast(c, db, http.StatusInternalServerError, "Ошибка при удалении рассылки")
+			return
+		}
+		deleteMediaFiles(b.PhotoURL)
+		c.Redirect(http.StatusFound, "/admin/broadcasts")
+	}
+}
@@ -0,0 +1,590 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// calendarStep шаг строк календаря
+const calendarStep = 30 * time.Minute
+
+// Рабочие часы по умолчанию: для записей без врача и врачей без заполненного расписания
+const (
+	defaultWorkStart = "09:00"
+	defaultWorkEnd   = "18:00"
+)
+
+var calendarWeekdays = []string{"Вс", "Пн", "Вт", "Ср", "Чт", "Пт", "Сб"}
+
+// doctorShift смена врача в течение дня
+type doctorShift struct {
+	Start      string
+	End        string
+	BreakStart string
+	BreakEnd   string
+}
+
+// doctorWorkDay рабочее время врача в конкретный день
+type doctorWorkDay struct {
+	Shifts    []doctorShift
+	OffReason string // почему врач не работает: отпуск, выходной
+}
+
+// doctorTimeOff отсутствие врача
+type doctorTimeOff struct {
+	ID         int64
+	DoctorID   int64
+	DoctorName string
+	DateFrom   string
+	DateTo     string
+	Reason     string
+}
+
+// calendarSchedule расписания и отсутствия врачей
+type calendarSchedule struct {
+	weekly  map[int64]map[int][]doctorShift
+	timeOff []doctorTimeOff
+}
+
+func loadCalendarSchedule(q dbExecutor, from, to string) (*calendarSchedule, error) {
+	s := &calendarSchedule{weekly: make(map[int64]map[int][]doctorShift)}
+
+	rows, err := q.Query(`
+		SELECT doctor_id, day_of_week, start_time, end_time, COALESCE(break_start, ''), COALESCE(break_end, '')
+		FROM doctor_schedule
+		ORDER BY doctor_id, day_of_week, start_time
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var doctorID int64
+		var weekday int
+		var shift doctorShift
+		if err := rows.Scan(&doctorID, &weekday, &shift.Start, &shift.End, &shift.BreakStart, &shift.BreakEnd); err != nil {
+			continue
+		}
+		if s.weekly[doctorID] == nil {
+			s.weekly[doctorID] = make(map[int][]doctorShift)
+		}
+		s.weekly[doctorID][weekday] = append(s.weekly[doctorID][weekday], shift)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	s.timeOff, err = loadTimeOff(q, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadTimeOff возвращает отсутствия врачей, пересекающиеся с периодом
+func loadTimeOff(q dbExecutor, from, to string) ([]doctorTimeOff, error) {
+	rows, err := q.Query(`
+		SELECT t.id, t.doctor_id, d.name, t.date_from, t.date_to, COALESCE(t.reason, '')
+		FROM doctor_time_off t
+		JOIN doctors d ON t.doctor_id = d.id
+		WHERE t.date_to >= ? AND t.date_from <= ?
+		ORDER BY t.date_from, d.name
+	`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []doctorTimeOff
+	for rows.Next() {
+		var t doctorTimeOff
+		if err := rows.Scan(&t.ID, &t.DoctorID, &t.DoctorName, &t.DateFrom, &t.DateTo, &t.Reason); err == nil {
+			list = append(list, t)
+		}
+	}
+	return list, rows.Err()
+}
+
+// day возвращает рабочее время врача на дату
+func (s *calendarSchedule) day(doctorID int64, date time.Time) doctorWorkDay {
+	defaultDay := doctorWorkDay{Shifts: []doctorShift{{Start: defaultWorkStart, End: defaultWorkEnd}}}
+	if doctorID == 0 {
+		return defaultDay
+	}
+
+	dateStr := date.Format("2006-01-02")
+	for _, t := range s.timeOff {
+		if t.DoctorID == doctorID && t.DateFrom <= dateStr && dateStr <= t.DateTo {
+			reason := t.Reason
+			if reason == "" {
+				reason = "Отсутствует"
+			}
+			return doctorWorkDay{OffReason: reason}
+		}
+	}
+
+	weekly, ok := s.weekly[doctorID]
+	if !ok {
+		return defaultDay
+	}
+	weekday := int(date.Weekday())
+	if weekday == 0 {
+		weekday = 7
+	}
+	if len(weekly[weekday]) == 0 {
+		return doctorWorkDay{OffReason: "Выходной"}
+	}
+	return doctorWorkDay{Shifts: weekly[weekday]}
+}
+
+// slotState возвращает состояние времени по расписанию: free, break или off
+func (d doctorWorkDay) slotState(t string) (string, string) {
+	if len(d.Shifts) == 0 {
+		return "off", d.OffReason
+	}
+	for _, shift := range d.Shifts {
+		if t < shift.Start || t >= shift.End {
+			continue
+		}
+		if shift.BreakStart != "" && shift.BreakEnd != "" && t >= shift.BreakStart && t < shift.BreakEnd {
+			return "break", "Перерыв"
+		}
+		return "free", ""
+	}
+	return "off", "Нерабочее время"
+}
+
+// checkDoctorWorks проверяет, что врач работает в указанное время и оно не в прошлом
+func checkDoctorWorks(q dbExecutor, doctorID int64, date, t string) error {
+	day, err := time.ParseInLocation("2006-01-02 15:04", date+" "+t, time.Local)
+	if err != nil {
+		return fmt.Errorf("неверная дата или время")
+	}
+	if day.Before(time.Now()) {
+		return fmt.Errorf("нельзя записать на прошедшее время")
+	}
+
+	schedule, err := loadCalendarSchedule(q, date, date)
+	if err != nil {
+		return err
+	}
+	state, reason := schedule.day(doctorID, day).slotState(t)
+	if state != "free" {
+		return fmt.Errorf("врач не принимает в это время: %s", reason)
+	}
+	return nil
+}
+
+// calendarColumn колонка календаря: врач в конкретный день
+type calendarColumn struct {
+	Date       string
+	DoctorID   int64
+	DoctorName string
+}
+
+// calendarDay заголовок дня в календаре
+type calendarDay struct {
+	Date    string
+	Title   string
+	Columns int
+}
+
+// calendarBooking запись в ячейке календаря
+type calendarBooking struct {
+	ID       int64
+	Time     string
+	Patient  string
+	Service  string
+	Status   string
+	Capacity int
+}
+
+// calendarCell ячейка календаря
+type calendarCell struct {
+	State    string // free, busy, break, off, past
+	Reason   string
+	Date     string
+	Time     string
+	DoctorID int64
+	Bookings []calendarBooking
+}
+
+// calendarRow строка календаря
+type calendarRow struct {
+	Time  string
+	Cells []calendarCell
+}
+
+// calendarRowTime округляет время записи вниз до строки календаря
+func calendarRowTime(t string) string {
+	parsed, err := time.Parse("15:04", t)
+	if err != nil {
+		return t
+	}
+	minutes := parsed.Hour()*60 + parsed.Minute()
+	step := int(calendarStep / time.Minute)
+	minutes -= minutes % step
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// buildCalendar строит сетку календаря на дни days для врачей doctors
+func buildCalendar(db *sql.DB, days []time.Time, doctors []adminFilterOption) ([]calendarDay, []calendarColumn, []calendarRow, error) {
+	from := days[0].Format("2006-01-02")
+	to := days[len(days)-1].Format("2006-01-02")
+
+	schedule, err := loadCalendarSchedule(db, from, to)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var headers []calendarDay
+	var columns []calendarColumn
+	var workDays []doctorWorkDay
+	rangeStart, rangeEnd := defaultWorkStart, defaultWorkEnd
+	for _, d := range days {
+		headers = append(headers, calendarDay{
+			Date:    d.Format("2006-01-02"),
+			Title:   calendarWeekdays[d.Weekday()] + " " + d.Format("02.01"),
+			Columns: len(doctors),
+		})
+		for _, doctor := range doctors {
+			columns = append(columns, calendarColumn{Date: d.Format("2006-01-02"), DoctorID: doctor.ID, DoctorName: doctor.Name})
+			wd := schedule.day(doctor.ID, d)
+			workDays = append(workDays, wd)
+			for _, shift := range wd.Shifts {
+				if shift.Start < rangeStart {
+					rangeStart = shift.Start
+				}
+				if shift.End > rangeEnd {
+					rangeEnd = shift.End
+				}
+			}
+		}
+	}
+
+	// Записи периода по ячейкам
+	rows, err := db.Query(`
+		SELECT b.id, b.date, b.time, COALESCE(b.doctor_id, 0), s.name, b.status, s.capacity,
+			   COALESCE(dp.name, NULLIF(TRIM(COALESCE(u.first_name, '') || ' ' || COALESCE(u.last_name, '')), ''), u.username, '')
+		FROM bookings b
+		JOIN services s ON b.service_id = s.id
+		JOIN users u ON b.user_id = u.id
+		LEFT JOIN dependents dp ON b.dependent_id = dp.id
+		WHERE b.date BETWEEN ? AND ? AND b.status NOT IN ('Отменено', 'Отменена')
+		ORDER BY b.time, b.id
+	`, from, to)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer rows.Close()
+
+	bookings := make(map[string][]calendarBooking)
+	for rows.Next() {
+		var b calendarBooking
+		var date string
+		var doctorID int64
+		if err := rows.Scan(&b.ID, &date, &b.Time, &doctorID, &b.Service, &b.Status, &b.Capacity, &b.Patient); err != nil {
+			continue
+		}
+		rowTime := calendarRowTime(b.Time)
+		if rowTime < rangeStart {
+			rangeStart = rowTime
+		}
+		// Запись вне рабочего времени тоже должна попасть в сетку
+		if rowTime >= rangeEnd {
+			t, _ := time.Parse("15:04", rowTime)
+			rangeEnd = t.Add(calendarStep).Format("15:04")
+		}
+		key := fmt.Sprintf("%s|%d|%s", date, doctorID, rowTime)
+		bookings[key] = append(bookings[key], b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	start, _ := time.Parse("15:04", rangeStart)
+	end, _ := time.Parse("15:04", rangeEnd)
+	now := time.Now()
+
+	var grid []calendarRow
+	for t := start; t.Before(end); t = t.Add(calendarStep) {
+		rowTime := t.Format("15:04")
+		row := calendarRow{Time: rowTime}
+		for i, col := range columns {
+			cell := calendarCell{Date: col.Date, Time: rowTime, DoctorID: col.DoctorID}
+			cell.State, cell.Reason = workDays[i].slotState(rowTime)
+			if list := bookings[fmt.Sprintf("%s|%d|%s", col.Date, col.DoctorID, rowTime)]; len(list) > 0 {
+				cell.State = "busy"
+				cell.Bookings = list
+			} else if cell.State == "free" {
+				slotTime, _ := time.ParseInLocation("2006-01-02 15:04", col.Date+" "+rowTime, time.Local)
+				if slotTime.Before(now) {
+					cell.State = "past"
+				}
+			}
+			row.Cells = append(row.Cells, cell)
+		}
+		grid = append(grid, row)
+	}
+
+	return headers, columns, grid, nil
+}
+
+// bookingTelegramID возвращает Telegram ID пациента записи
+func bookingTelegramID(db *sql.DB, bookingID int64) int64 {
+	var telegramID int64
+	err := db.QueryRow(`
+		SELECT COALESCE(u.telegram_id, 0)
+		FROM bookings b
+		JOIN users u ON b.user_id = u.id
+		WHERE b.id = ?
+	`, bookingID).Scan(&telegramID)
+	if err != nil {
+		log.Printf("Error getting booking patient: %v", err)
+	}
+	return telegramID
+}
+
+// AdminCalendarHandler выводит календарь записей на день или неделю
+func AdminCalendarHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		date, err := time.ParseInLocation("2006-01-02", c.Query("date"), time.Local)
+		if err != nil {
+			date, _ = time.ParseInLocation("2006-01-02", time.Now().Format("2006-01-02"), time.Local)
+		}
+		view := c.DefaultQuery("view", "day")
+		doctorID, _ := strconv.ParseInt(c.Query("doctor_id"), 10, 64)
+
+		days := []time.Time{date}
+		step := 1
+		if view == "week" {
+			step = 7
+			// Неделя начинается с понедельника
+			offset := (int(date.Weekday()) + 6) % 7
+			monday := date.AddDate(0, 0, -offset)
+			days = nil
+			for i := 0; i < 7; i++ {
+				days = append(days, monday.AddDate(0, 0, i))
+			}
+		} else {
+			view = "day"
+		}
+
+		allDoctors := loadAdminFilterOptions(db, "SELECT id, name FROM doctors ORDER BY name")
+		var doctors []adminFilterOption
+		for _, d := range allDoctors {
+			if doctorID == 0 || d.ID == doctorID {
+				doctors = append(doctors, d)
+			}
+		}
+		// Записи из бота создаются без врача, для них отдельная колонка
+		if doctorID == 0 {
+			doctors = append(doctors, adminFilterOption{ID: 0, Name: "Без врача"})
+		}
+
+		headers, columns, grid, err := buildCalendar(db, days, doctors)
+		if err != nil {
+			log.Printf("AdminCalendarHandler error: %v", err)
+			c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Ошибка при получении данных",
+			})
+			return
+		}
+
+		timeOff, err := loadTimeOff(db, time.Now().Format("2006-01-02"), "9999-12-31")
+		if err != nil {
+			log.Printf("Error loading time off: %v", err)
+		}
+
+		calendarURL := func(d time.Time) template.URL {
+			v := url.Values{}
+			v.Set("date", d.Format("2006-01-02"))
+			v.Set("view", view)
+			if doctorID != 0 {
+				v.Set("doctor_id", strconv.FormatInt(doctorID, 10))
+			}
+			return template.URL("/admin/calendar?" + v.Encode())
+		}
+
+		c.HTML(http.StatusOK, "admin_calendar.html", gin.H{
+			"date":       date.Format("2006-01-02"),
+			"view":       view,
+			"doctorID":   doctorID,
+			"doctors":    allDoctors,
+			"days":       headers,
+			"columns":    columns,
+			"rows":       grid,
+			"timeOff":    timeOff,
+			"services":   loadAdminFilterOptions(db, "SELECT id, name FROM services ORDER BY name"),
+			"patients":   loadAdminFilterOptions(db, "SELECT id, COALESCE(NULLIF(TRIM(COALESCE(first_name, '') || ' ' || COALESCE(last_name, '')), ''), username, '') || COALESCE(' ' || phone, '') FROM users ORDER BY 2"),
+			"prevURL":    calendarURL(date.AddDate(0, 0, -step)),
+			"nextURL":    calendarURL(date.AddDate(0, 0, step)),
+			"todayURL":   calendarURL(time.Now()),
+			"isWeekView": view == "week",
+		})
+	}
+}
+
+// calendarSlotRequest время в календаре, куда переносится или создается запись
+type calendarSlotRequest struct {
+	BookingID int64  `json:"booking_id"`
+	UserID    int64  `json:"user_id"`
+	ServiceID int64  `json:"service_id"`
+	DoctorID  int64  `json:"doctor_id"`
+	Date      string `json:"date"`
+	Time      string `json:"time"`
+}
+
+// calendarBookingError переводит ошибку сервиса записи в ответ API
+func calendarBookingError(c *gin.Context, err error) {
+	switch e := err.(type) {
+	case *limitError:
+		c.JSON(http.StatusConflict, gin.H{"error": e.reason})
+		return
+	}
+	switch err {
+	case errSlotTaken:
+		c.JSON(http.StatusConflict, gin.H{"error": "На это время нет свободных мест"})
+	case errBookingNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Запись не найдена"})
+	default:
+		log.Printf("Calendar booking error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при сохранении записи"})
+	}
+}
+
+// AdminCalendarMoveHandler переносит запись перетаскиванием в календаре
+func AdminCalendarMoveHandler(db *sql.DB, bot *tgbotapi.BotAPI) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req calendarSlotRequest
+		if err := c.ShouldBindJSON(&req); err != nil || req.BookingID == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный формат данных"})
+			return
+		}
+		if err := checkDoctorWorks(db, req.DoctorID, req.Date, req.Time); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		slot, slotErr := freedSlotForBooking(db, req.BookingID)
+
+		tx, err := db.Begin()
+		if err != nil {
+			calendarBookingError(c, err)
+			return
+		}
+		defer tx.Rollback()
+
+		if err := moveBooking(tx, req.BookingID, req.DoctorID, req.Date, req.Time); err != nil {
+			calendarBookingError(c, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			calendarBookingError(c, err)
+			return
+		}
+
+		if telegramID := bookingTelegramID(db, req.BookingID); telegramID != 0 {
+			msg := tgbotapi.NewMessage(telegramID, fmt.Sprintf("Ваша запись перенесена администратором на %s в %s.", req.Date, req.Time))
+			bot.Send(msg)
+		}
+
+		// Предлагаем освободившееся время листу ожидания
+		if slotErr == nil && (slot.Date != req.Date || slot.Time != req.Time || slot.DoctorID != req.DoctorID) {
+			go offerFreedSlot(bot, db, slot)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Запись перенесена"})
+	}
+}
+
+// AdminCalendarCreateHandler создает запись по клику на свободное время в календаре
+func AdminCalendarCreateHandler(db *sql.DB, bot *tgbotapi.BotAPI) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req calendarSlotRequest
+		if err := c.ShouldBindJSON(&req); err != nil || req.UserID == 0 || req.ServiceID == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Выберите пациента и услугу"})
+			return
+		}
+		if err := checkDoctorWorks(db, req.DoctorID, req.Date, req.Time); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		id, err := insertBooking(db, bookingParams{
+			UserID:    req.UserID,
+			ServiceID: req.ServiceID,
+			DoctorID:  req.DoctorID,
+			Date:      req.Date,
+			Time:      req.Time,
+			Status:    "Подтверждено",
+		})
+		if err != nil {
+			calendarBookingError(c, err)
+			return
+		}
+
+		if telegramID := bookingTelegramID(db, id); telegramID != 0 {
+			msg := tgbotapi.NewMessage(telegramID, fmt.Sprintf("Администратор записал вас на %s в %s.", req.Date, req.Time))
+			bot.Send(msg)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"id": id})
+	}
+}
+
+// AdminAddTimeOffHandler добавляет отсутствие врача
+func AdminAddTimeOffHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		doctorID, _ := strconv.ParseInt(c.PostForm("doctor_id"), 10, 64)
+		dateFrom := c.PostForm("date_from")
+		dateTo := c.PostForm("date_to")
+		if dateTo == "" {
+			dateTo = dateFrom
+		}
+
+		from, errFrom := time.Parse("2006-01-02", dateFrom)
+		to, errTo := time.Parse("2006-01-02", dateTo)
+		if doctorID == 0 || errFrom != nil || errTo != nil || to.Before(from) {
+			c.HTML(http.StatusBadRequest, "error.html", gin.H{
+				"error": "Укажите врача и корректный период",
+			})
+			return
+		}
+
+		_, err := db.Exec(`
+			INSERT INTO doctor_time_off (doctor_id, date_from, date_to, reason)
+			VALUES (?, ?, ?, ?)
+		`, doctorID, dateFrom, dateTo, c.PostForm("reason"))
+		if err != nil {
+			c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Ошибка при сохранении",
+			})
+			return
+		}
+
+		c.Redirect(http.StatusFound, "/admin/calendar?date="+dateFrom)
+	}
+}
+
+// AdminDeleteTimeOffHandler удаляет отсутствие врача
+func AdminDeleteTimeOffHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, err := db.Exec("DELETE FROM doctor_time_off WHERE id = ?", c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при удалении"})
+			return
+		}
+
+		c.Redirect(http.StatusFound, "/admin/calendar")
+	}
+}
@@ -118,6 +118,7 @@ func confirmCancellation(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery,
 	// Извлекаем ID записи из callback data
 	var bookingID int64
 	fmt.Sscanf(callback.Data[15:], "%d", &bookingID)
+	slot, slotErr := freedSlotForBooking(db, bookingID)
 
 	// Обновляем статус записи
 	_, err := db.Exec("UPDATE bookings SET status = 'Отменено' WHERE id = ?", bookingID)
@@ -153,6 +154,11 @@ func confirmCancellation(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery,
 	msg := tgbotapi.NewMessage(callback.Message.Chat.ID, confirmationText)
 	bot.Send(msg)
 
+	// Предлагаем освободившееся время листу ожидания
+	if slotErr == nil {
+		offerFreedSlot(bot, db, slot)
+	}
+
 	// Отвечаем на callback
 	callbackResponse := tgbotapi.NewCallback(callback.ID, "")
 	bot.Send(callbackResponse)
@@ -0,0 +1,399 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errDateNotRecognized в тексте нет ни даты, ни времени
+var errDateNotRecognized = errors.New("дата и время не распознаны")
+
+const (
+	// minutesInDay граница окна времени "до конца дня"
+	minutesInDay = 24 * 60
+	// dateQueryMaxDays на сколько дней вперед можно назвать дату текстом
+	dateQueryMaxDays = 60
+)
+
+// dateQuery разобранное пожелание пациента: дни и окно времени в минутах от полуночи
+type dateQuery struct {
+	Dates []time.Time // пусто - любой день
+	From  int         // окно времени [From, To)
+	To    int
+	Exact int    // точное время, -1 - не указано
+	Part  string // часть дня словами для ответа: «утром», «после 15:00»
+}
+
+// HasTime указано ли время или часть дня
+func (q dateQuery) HasTime() bool {
+	return q.Exact >= 0 || q.From > 0 || q.To < minutesInDay
+}
+
+// matches подходит ли время слота под пожелание
+func (q dateQuery) matches(minute int) bool {
+	if q.Exact >= 0 {
+		return minute == q.Exact
+	}
+	return minute >= q.From && minute < q.To
+}
+
+// distance насколько время слота далеко от пожелания, в минутах
+func (q dateQuery) distance(minute int) int {
+	target := q.Exact
+	switch {
+	case target >= 0:
+	case minute < q.From:
+		target = q.From
+	case minute >= q.To:
+		target = q.To - 1
+	default:
+		return 0
+	}
+	if minute > target {
+		return minute - target
+	}
+	return target - minute
+}
+
+// Title пожелание словами для ответа пациенту: «пт, 23 октября, утром»
+func (q dateQuery) Title() string {
+	var parts []string
+	switch {
+	case len(q.Dates) > 3:
+		parts = append(parts, fmt.Sprintf("с %s по %s", russianDate(q.Dates[0]), russianDate(q.Dates[len(q.Dates)-1])))
+	case len(q.Dates) > 0:
+		var days []string
+		for _, d := range q.Dates {
+			days = append(days, russianDate(d))
+		}
+		parts = append(parts, strings.Join(days, " или "))
+	}
+	if q.Part != "" {
+		parts = append(parts, q.Part)
+	}
+	return strings.Join(parts, ", ")
+}
+
+var russianMonthsGenitive = []string{"января", "февраля", "марта", "апреля", "мая", "июня",
+	"июля", "августа", "сентября", "октября", "ноября", "декабря"}
+
+var russianWeekdaysShort = []string{"вс", "пн", "вт", "ср", "чт", "пт", "сб"}
+
+// russianDate дата для сообщений бота: «пт, 23 октября»
+func russianDate(d time.Time) string {
+	return fmt.Sprintf("%s, %d %s", russianWeekdaysShort[d.Weekday()], d.Day(), russianMonthsGenitive[d.Month()-1])
+}
+
+// russianMonthPrefixes первые буквы названий месяцев: «октября», «окт»
+var russianMonthPrefixes = []string{"янв", "фев", "мар", "апр", "ма", "июн", "июл", "авг", "сен", "окт", "ноя", "дек"}
+
+// russianMonth номер месяца по слову, 0 - не месяц
+func russianMonth(word string) time.Month {
+	for i, prefix := range russianMonthPrefixes {
+		if strings.HasPrefix(word, prefix) {
+			return time.Month(i + 1)
+		}
+	}
+	return 0
+}
+
+// russianWeekdays основы названий дней недели и сокращения
+var russianWeekdays = []struct {
+	stem  string
+	short string
+	day   time.Weekday
+}{
+	{"понедельник", "пн", time.Monday},
+	{"вторник", "вт", time.Tuesday},
+	{"сред", "ср", time.Wednesday},
+	{"четверг", "чт", time.Thursday},
+	{"пятниц", "пт", time.Friday},
+	{"суббот", "сб", time.Saturday},
+	{"воскресень", "вс", time.Sunday},
+}
+
+// Части дня: окно времени в минутах от полуночи
+var dayParts = []struct {
+	pattern  *regexp.Regexp
+	from, to int
+	title    string
+}{
+	{regexp.MustCompile(`после\s+обеда`), 13 * 60, minutesInDay, "после обеда"},
+	{regexp.MustCompile(`до\s+обеда`), 0, 13 * 60, "до обеда"},
+	{regexp.MustCompile(`(?:^|\s)(?:в\s+)?обед(?:\s|$)`), 12 * 60, 14 * 60, "в обед"},
+	{regexp.MustCompile(`(?:^|\s)(?:утром|утро|с\s+утра|поутру)(?:\s|$)`), 0, 12 * 60, "утром"},
+	{regexp.MustCompile(`(?:^|\s)(?:днем|днём)(?:\s|$)`), 12 * 60, 17 * 60, "днем"},
+	{regexp.MustCompile(`(?:^|\s)(?:вечером|вечер)(?:\s|$)`), 17 * 60, minutesInDay, "вечером"},
+}
+
+var (
+	isoDateRe     = regexp.MustCompile(`\b(\d{4})-(\d{1,2})-(\d{1,2})\b`)
+	numericDateRe = regexp.MustCompile(`(^|[^\d:.])(\d{1,2})[./](\d{1,2})(?:[./](\d{2,4}))?($|[^\d:])`)
+	wordDateRe    = regexp.MustCompile(`(\d{1,2})(?:-?го)?\s+(январ[ья]|феврал[ья]|марта?|апрел[ья]|ма[йя]|июн[ья]|июл[ья]|августа?|сентябр[ья]|октябр[ья]|ноябр[ья]|декабр[ья]|янв|фев|апр|авг|сент?|окт|ноя|дек)(?:\s+(\d{4}))?`)
+	timePrepRe    = regexp.MustCompile(`(?:^|\s)(?:в|во|после|до|с|со|от|к|около|на)\s*$`)
+	inDaysRe      = regexp.MustCompile(`через\s+(\d+|один|одну|два|две|три|четыре|пять|шесть|семь)?\s*(дн[а-я]*|день|недел[а-я]*)`)
+	rangeTimeRe   = regexp.MustCompile(`(?:^|\s)(?:с|со|от)\s+(\d{1,2})(?:[:.](\d{2}))?\s*(?:час[а-я]*\s*)?(утра|дня|вечера)?\s*до\s+(\d{1,2})(?:[:.](\d{2}))?\s*(?:час[а-я]*\s*)?(утра|дня|вечера)?`)
+	afterTimeRe   = regexp.MustCompile(`(?:^|\s)после\s+(\d{1,2})(?:[:.](\d{2}))?\s*(?:час[а-я]*\s*)?(утра|дня|вечера)?`)
+	beforeTimeRe  = regexp.MustCompile(`(?:^|\s)до\s+(\d{1,2})(?:[:.](\d{2}))?\s*(?:час[а-я]*\s*)?(утра|дня|вечера)?`)
+	exactTimeRe   = regexp.MustCompile(`(?:^|\s)(?:в|во|к|на|около)\s+(\d{1,2})(?:[:.](\d{2}))?\s*(?:час[а-я]*\s*)?(утра|дня|вечера)?(?:\s|$)`)
+	bareTimeRe    = regexp.MustCompile(`(?:^|\s)(\d{1,2}):(\d{2})(?:\s|$)`)
+	wordRe        = regexp.MustCompile(`[а-я]+`)
+)
+
+var smallNumbers = map[string]int{"": 1, "один": 1, "одну": 1, "два": 2, "две": 2, "три": 3, "четыре": 4, "пять": 5, "шесть": 6, "семь": 7}
+
+// parseDateQuery разбирает пожелание пациента по дате и времени на русском:
+// «завтра после 15», «в пятницу утром», «25 октября в 10:30», «через неделю с 10 до 12».
+// now задает текущий момент; прошедшие даты без года переносятся на следующий год.
+func parseDateQuery(text string, now time.Time) (dateQuery, error) {
+	q := dateQuery{To: minutesInDay, Exact: -1}
+	s := " " + strings.ReplaceAll(strings.ToLower(text), "ё", "е") + " "
+	s = strings.NewReplacer(",", " ", "!", " ", "?", " ", ";", " ").Replace(s)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	addDate := func(d time.Time) {
+		for _, existing := range q.Dates {
+			if existing.Equal(d) {
+				return
+			}
+		}
+		q.Dates = append(q.Dates, d)
+	}
+	explicitDate := func(year, month, day int, yearGiven bool) error {
+		d := time.Date(year, time.Month(month), day, 0, 0, 0, 0, now.Location())
+		if d.Day() != day || d.Month() != time.Month(month) {
+			return fmt.Errorf("такой даты нет: %d.%02d", day, month)
+		}
+		if d.Before(today) {
+			if yearGiven {
+				return fmt.Errorf("дата %s уже прошла", d.Format("02.01.2006"))
+			}
+			d = d.AddDate(1, 0, 0)
+		}
+		addDate(d)
+		return nil
+	}
+
+	// Явные даты; найденное вырезается, чтобы числа не разбирались повторно как время
+	for _, m := range isoDateRe.FindAllStringSubmatch(s, -1) {
+		year, _ := strconv.Atoi(m[1])
+		month, _ := strconv.Atoi(m[2])
+		day, _ := strconv.Atoi(m[3])
+		if err := explicitDate(year, month, day, true); err != nil {
+			return q, err
+		}
+		s = strings.Replace(s, m[0], " ", 1)
+	}
+	for _, m := range wordDateRe.FindAllStringSubmatch(s, -1) {
+		month := russianMonth(m[2])
+		if month == 0 {
+			continue
+		}
+		day, _ := strconv.Atoi(m[1])
+		year := now.Year()
+		if m[3] != "" {
+			year, _ = strconv.Atoi(m[3])
+		}
+		if err := explicitDate(year, int(month), day, m[3] != ""); err != nil {
+			return q, err
+		}
+		s = strings.Replace(s, m[0], " ", 1)
+	}
+	for {
+		loc := numericDateRe.FindStringSubmatchIndex(s)
+		if loc == nil {
+			break
+		}
+		first, _ := strconv.Atoi(s[loc[4]:loc[5]])
+		second, _ := strconv.Atoi(s[loc[6]:loc[7]])
+		yearStr := ""
+		if loc[8] >= 0 {
+			yearStr = s[loc[8]:loc[9]]
+		}
+		// «в 15.30» и «после 10.30» - это время, а не дата
+		if yearStr == "" && first <= 23 && second <= 59 && (timePrepRe.MatchString(s[:loc[4]]) || second > 12) {
+			// Заменяем разделитель двоеточием, время разберется ниже
+			s = s[:loc[5]] + ":" + s[loc[6]:]
+			continue
+		}
+		year := now.Year()
+		if yearStr != "" {
+			year, _ = strconv.Atoi(yearStr)
+			if year < 100 {
+				year += 2000
+			}
+		}
+		if err := explicitDate(year, second, first, yearStr != ""); err != nil {
+			return q, err
+		}
+		s = s[:loc[4]] + " " + s[loc[10]:]
+	}
+
+	// Относительные даты
+	if strings.Contains(s, "послезавтра") {
+		addDate(today.AddDate(0, 0, 2))
+		s = strings.Replace(s, "послезавтра", " ", -1)
+	}
+	if strings.Contains(s, "завтра") {
+		addDate(today.AddDate(0, 0, 1))
+	}
+	if strings.Contains(s, "сегодня") {
+		addDate(today)
+	}
+	for _, m := range inDaysRe.FindAllStringSubmatch(s, -1) {
+		n, ok := smallNumbers[m[1]]
+		if !ok {
+			n, _ = strconv.Atoi(m[1])
+		}
+		if strings.HasPrefix(m[2], "недел") {
+			n *= 7
+		}
+		addDate(today.AddDate(0, 0, n))
+		s = strings.Replace(s, m[0], " ", 1)
+	}
+	weekStart := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7)) // понедельник этой недели
+	switch {
+	case strings.Contains(s, "следующей неделе") || strings.Contains(s, "след неделе"):
+		for i := 0; i < 7; i++ {
+			addDate(weekStart.AddDate(0, 0, 7+i))
+		}
+	case strings.Contains(s, "этой неделе"):
+		for d := today; d.Before(weekStart.AddDate(0, 0, 7)); d = d.AddDate(0, 0, 1) {
+			addDate(d)
+		}
+	case strings.Contains(s, "выходн"):
+		if today.Weekday() == time.Sunday {
+			addDate(today)
+		} else {
+			saturday := today.AddDate(0, 0, int(time.Saturday-today.Weekday()))
+			addDate(saturday)
+			addDate(saturday.AddDate(0, 0, 1))
+		}
+	}
+
+	// Дни недели: ближайший после сегодняшнего дня; «в следующую пятницу» - пятница следующей недели
+	words := wordRe.FindAllStringIndex(s, -1)
+	for i, w := range words {
+		word := s[w[0]:w[1]]
+		for _, wd := range russianWeekdays {
+			if word != wd.short && !strings.HasPrefix(word, wd.stem) {
+				continue
+			}
+			next := i > 0 && strings.HasPrefix(s[words[i-1][0]:words[i-1][1]], "следующ")
+			offset := (int(wd.day) - int(today.Weekday()) + 7) % 7
+			if offset == 0 {
+				// «В понедельник» в понедельник - следующий, на сегодня пишут «сегодня»
+				offset = 7
+			}
+			d := today.AddDate(0, 0, offset)
+			if next {
+				d = weekStart.AddDate(0, 0, 7+(int(wd.day)+6)%7)
+			}
+			addDate(d)
+		}
+	}
+
+	// Время: интервал, «после», «до», точное время, затем части дня
+	if m := rangeTimeRe.FindStringSubmatch(s); m != nil {
+		from, err := clockMinutes(m[1], m[2], m[3])
+		if err != nil {
+			return q, err
+		}
+		to, err := clockMinutes(m[4], m[5], m[6])
+		if err != nil {
+			return q, err
+		}
+		if to <= from {
+			return q, fmt.Errorf("время окончания раньше начала")
+		}
+		q.From, q.To = from, to
+		q.Part = fmt.Sprintf("с %s до %s", formatMinutes(from), formatMinutes(to))
+		s = strings.Replace(s, m[0], " ", 1)
+	}
+	if m := afterTimeRe.FindStringSubmatch(s); m != nil {
+		from, err := clockMinutes(m[1], m[2], m[3])
+		if err != nil {
+			return q, err
+		}
+		q.From = from
+		q.Part = "после " + formatMinutes(from)
+		s = strings.Replace(s, m[0], " ", 1)
+	}
+	if m := beforeTimeRe.FindStringSubmatch(s); m != nil {
+		to, err := clockMinutes(m[1], m[2], m[3])
+		if err != nil {
+			return q, err
+		}
+		q.To = to
+		if q.From > 0 {
+			q.Part = fmt.Sprintf("с %s до %s", formatMinutes(q.From), formatMinutes(to))
+		} else {
+			q.Part = "до " + formatMinutes(to)
+		}
+		s = strings.Replace(s, m[0], " ", 1)
+	}
+	if m := exactTimeRe.FindStringSubmatch(s); m != nil && !q.HasTime() {
+		exact, err := clockMinutes(m[1], m[2], m[3])
+		if err != nil {
+			return q, err
+		}
+		q.Exact = exact
+		q.Part = "в " + formatMinutes(exact)
+	} else if m := bareTimeRe.FindStringSubmatch(s); m != nil && !q.HasTime() {
+		exact, err := clockMinutes(m[1], m[2], "")
+		if err != nil {
+			return q, err
+		}
+		q.Exact = exact
+		q.Part = "в " + formatMinutes(exact)
+	}
+	if !q.HasTime() {
+		for _, p := range dayParts {
+			if p.pattern.MatchString(s) {
+				q.From, q.To, q.Part = p.from, p.to, p.title
+				break
+			}
+		}
+	}
+
+	if len(q.Dates) == 0 && !q.HasTime() {
+		return q, errDateNotRecognized
+	}
+	for _, d := range q.Dates {
+		if d.After(today.AddDate(0, 0, dateQueryMaxDays)) {
+			return q, fmt.Errorf("запись открыта не дальше чем на %d дней вперед", dateQueryMaxDays)
+		}
+	}
+	sort.Slice(q.Dates, func(i, j int) bool { return q.Dates[i].Before(q.Dates[j]) })
+	return q, nil
+}
+
+// clockMinutes переводит часы и минуты в минуты от полуночи. «3 часа дня» - 15:00;
+// часы с 1 до 7 без уточнения считаются дневными: клиника ночью не работает.
+func clockMinutes(hourStr, minuteStr, period string) (int, error) {
+	hour, _ := strconv.Atoi(hourStr)
+	minute := 0
+	if minuteStr != "" {
+		minute, _ = strconv.Atoi(minuteStr)
+	}
+	if hour > 24 || minute > 59 || (hour == 24 && minute > 0) {
+		return 0, fmt.Errorf("неверное время: %s:%02d", hourStr, minute)
+	}
+	switch {
+	case (period == "дня" || period == "вечера") && hour < 12:
+		hour += 12
+	case period == "" && hour >= 1 && hour <= 7:
+		hour += 12
+	}
+	return hour*60 + minute, nil
+}
+
+// formatMinutes минуты от полуночи в виде 15:04
+func formatMinutes(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
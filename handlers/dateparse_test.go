@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseDateQuery(t *testing.T) {
+	monday := time.Date(2026, 10, 19, 11, 20, 0, 0, time.UTC)    // понедельник
+	saturday := time.Date(2026, 10, 24, 9, 0, 0, 0, time.UTC)    // суббота
+	endOfMonth := time.Date(2026, 10, 30, 12, 0, 0, 0, time.UTC) // пятница, последние дни октября
+	endOfYear := time.Date(2026, 12, 31, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		text  string
+		now   time.Time
+		dates []string
+		from  int
+		to    int
+		exact int
+		err   bool
+	}{
+		// Относительные дни
+		{name: "сегодня", text: "сегодня", now: monday, dates: []string{"2026-10-19"}, to: minutesInDay, exact: -1},
+		{name: "завтра после", text: "завтра после 15", now: monday, dates: []string{"2026-10-20"}, from: 15 * 60, to: minutesInDay, exact: -1},
+		{name: "послезавтра вечером", text: "Послезавтра вечером", now: monday, dates: []string{"2026-10-21"}, from: 17 * 60, to: minutesInDay, exact: -1},
+		{name: "через три дня", text: "через 3 дня в 10:30", now: monday, dates: []string{"2026-10-22"}, to: minutesInDay, exact: 10*60 + 30},
+		{name: "через неделю", text: "через неделю", now: monday, dates: []string{"2026-10-26"}, to: minutesInDay, exact: -1},
+
+		// Дни недели
+		{name: "пятница этой недели", text: "в пятницу утром", now: monday, dates: []string{"2026-10-23"}, to: 12 * 60, exact: -1},
+		{name: "тот же день недели", text: "в понедельник в 9 утра", now: monday, dates: []string{"2026-10-26"}, to: minutesInDay, exact: 9 * 60},
+		{name: "понедельник из субботы", text: "в пн", now: saturday, dates: []string{"2026-10-26"}, to: minutesInDay, exact: -1},
+		{name: "вторник из субботы", text: "во вторник после обеда", now: saturday, dates: []string{"2026-10-27"}, from: 13 * 60, to: minutesInDay, exact: -1},
+		{name: "следующая пятница", text: "в следующую пятницу", now: monday, dates: []string{"2026-10-30"}, to: minutesInDay, exact: -1},
+
+		// Переход через месяц и год
+		{name: "послезавтра в ноябре", text: "послезавтра", now: endOfMonth, dates: []string{"2026-11-01"}, to: minutesInDay, exact: -1},
+		{name: "через три дня в ноябре", text: "через 3 дня", now: endOfMonth, dates: []string{"2026-11-02"}, to: minutesInDay, exact: -1},
+		{name: "вторник в ноябре", text: "во вторник", now: endOfMonth, dates: []string{"2026-11-03"}, to: minutesInDay, exact: -1},
+		{name: "завтра в новом году", text: "завтра", now: endOfYear, dates: []string{"2027-01-01"}, to: minutesInDay, exact: -1},
+		{name: "январь без года", text: "5 января в 12", now: endOfYear, dates: []string{"2027-01-05"}, to: minutesInDay, exact: 12 * 60},
+
+		// Явные даты
+		{name: "число и месяц словом", text: "25 октября в 10:30", now: monday, dates: []string{"2026-10-25"}, to: minutesInDay, exact: 10*60 + 30},
+		{name: "числовая дата", text: "02.11 к 9", now: monday, dates: []string{"2026-11-02"}, to: minutesInDay, exact: 9 * 60},
+		{name: "только время", text: "в 15.30", now: monday, to: minutesInDay, exact: 15*60 + 30},
+
+		// Ошибки
+		{name: "несуществующая дата", text: "31 февраля", now: monday, err: true},
+		{name: "прошедшая дата с годом", text: "1 марта 2025", now: monday, err: true},
+		{name: "слишком далеко", text: "5 мая", now: monday, err: true},
+		{name: "неверное время", text: "завтра в 25:00", now: monday, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := parseDateQuery(tt.text, tt.now)
+			if tt.err {
+				if err == nil || err == errDateNotRecognized {
+					t.Fatalf("parseDateQuery(%q) error = %v, want a date error", tt.text, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseDateQuery(%q) error = %v", tt.text, err)
+			}
+
+			var dates []string
+			for _, d := range q.Dates {
+				dates = append(dates, d.Format("2006-01-02"))
+			}
+			if !reflect.DeepEqual(dates, tt.dates) {
+				t.Errorf("parseDateQuery(%q) dates = %v, want %v", tt.text, dates, tt.dates)
+			}
+			if q.From != tt.from || q.To != tt.to || q.Exact != tt.exact {
+				t.Errorf("parseDateQuery(%q) time = [%d, %d) exact %d, want [%d, %d) exact %d",
+					tt.text, q.From, q.To, q.Exact, tt.from, tt.to, tt.exact)
+			}
+		})
+	}
+}
+
+// Текст без даты и времени не должен разбираться как дата: бот передает его в переписку с клиникой
+func TestParseDateQueryNotRecognized(t *testing.T) {
+	now := time.Date(2026, 10, 19, 11, 20, 0, 0, time.UTC)
+	for _, text := range []string{"болит зуб", "Здравствуйте, сколько стоит чистка?", "", "спасибо"} {
+		if _, err := parseDateQuery(text, now); err != errDateNotRecognized {
+			t.Errorf("parseDateQuery(%q) error = %v, want errDateNotRecognized", text, err)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Ограничения и размеры фото врачей
+const (
+	doctorPhotoMaxUpload = 10 << 20
+	doctorPhotoMinSide   = 200        // минимальная сторона исходного фото, пикселей
+	doctorPhotoMaxPixels = 50_000_000 // защита от изображений огромного разрешения
+	doctorPhotoFullSide  = 1200       // большая сторона полного размера
+	doctorPhotoThumbSide = 320        // сторона квадратной миниатюры
+	doctorPhotoQuality   = 85
+)
+
+// mediaCacheControl файлы в /media не меняются: новое фото получает новый ключ
+const mediaCacheControl = "public, max-age=31536000, immutable"
+
+// photoError ошибка проверки фото, текст показывается пользователю
+type photoError struct {
+	reason string
+}
+
+func (e *photoError) Error() string {
+	return e.reason
+}
+
+// processDoctorPhoto проверяет изображение и готовит полный размер и квадратную миниатюру в JPEG
+func processDoctorPhoto(data []byte) (full, thumb []byte, err error) {
+	if len(data) > doctorPhotoMaxUpload {
+		return nil, nil, &photoError{fmt.Sprintf("Фото больше %d МБ", doctorPhotoMaxUpload>>20)}
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, &photoError{"Загрузите изображение в формате JPG, PNG или WEBP"}
+	}
+	if cfg.Width < doctorPhotoMinSide || cfg.Height < doctorPhotoMinSide {
+		return nil, nil, &photoError{fmt.Sprintf("Фото слишком маленькое: нужно не меньше %d×%d пикселей", doctorPhotoMinSide, doctorPhotoMinSide)}
+	}
+	if cfg.Width*cfg.Height > doctorPhotoMaxPixels {
+		return nil, nil, &photoError{"Слишком большое разрешение фото"}
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, &photoError{"Не удалось прочитать изображение"}
+	}
+
+	// Полный размер: вписываем в квадрат doctorPhotoFullSide, не увеличивая
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > doctorPhotoFullSide || h > doctorPhotoFullSide {
+		if w >= h {
+			w, h = doctorPhotoFullSide, h*doctorPhotoFullSide/w
+		} else {
+			w, h = w*doctorPhotoFullSide/h, doctorPhotoFullSide
+		}
+	}
+	if full, err = encodeScaledJPEG(src, b, w, h); err != nil {
+		return nil, nil, err
+	}
+
+	// Миниатюра: квадрат по центру, для портрета смещенный к верху, где лицо
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/4
+	crop := image.Rect(x0, y0, x0+side, y0+side)
+	if thumb, err = encodeScaledJPEG(src, crop, doctorPhotoThumbSide, doctorPhotoThumbSide); err != nil {
+		return nil, nil, err
+	}
+	return full, thumb, nil
+}
+
+// encodeScaledJPEG масштабирует часть изображения и кодирует в JPEG. Прозрачность заливается белым.
+func encodeScaledJPEG(src image.Image, srcRect image.Rectangle, w, h int) ([]byte, error) {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, srcRect, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: doctorPhotoQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// mediaKey переводит адрес /media/... в ключ хранилища. Для внешних ссылок возвращает пустую строку.
+func mediaKey(url string) string {
+	if !strings.HasPrefix(url, "/media/") {
+		return ""
+	}
+	return strings.TrimPrefix(url, "/")
+}
+
+// saveDoctorPhoto сохраняет новое фото врача и удаляет прежнее
+func saveDoctorPhoto(db *sql.DB, doctorID int64, data []byte) (fullURL, thumbURL string, err error) {
+	var oldFull, oldThumb string
+	err = db.QueryRow(`
+		SELECT COALESCE(photo_url, ''), COALESCE(photo_thumb_url, '') FROM doctors WHERE id = ?
+	`, doctorID).Scan(&oldFull, &oldThumb)
+	if err != nil {
+		return "", "", err
+	}
+
+	full, thumb, err := processDoctorPhoto(data)
+	if err != nil {
+		return "", "", err
+	}
+	name, err := randomFileName()
+	if err != nil {
+		return "", "", err
+	}
+	base := fmt.Sprintf("media/doctors/%d/%s", doctorID, name)
+	if err := fileStore.Save(base+".jpg", full, "image/jpeg"); err != nil {
+		return "", "", err
+	}
+	if err := fileStore.Save(base+"_thumb.jpg", thumb, "image/jpeg"); err != nil {
+		return "", "", err
+	}
+
+	fullURL, thumbURL = "/"+base+".jpg", "/"+base+"_thumb.jpg"
+	_, err = db.Exec(`
+		UPDATE doctors SET photo_url = ?, photo_thumb_url = ?, photo_telegram_id = NULL WHERE id = ?
+	`, fullURL, thumbURL, doctorID)
+	if err != nil {
+		return "", "", err
+	}
+
+	deleteMediaFiles(oldFull, oldThumb)
+	return fullURL, thumbURL, nil
+}
+
+// removeDoctorPhoto удаляет фото врача
+func removeDoctorPhoto(db *sql.DB, doctorID int64) error {
+	var oldFull, oldThumb string
+	err := db.QueryRow(`
+		SELECT COALESCE(photo_url, ''), COALESCE(photo_thumb_url, '') FROM doctors WHERE id = ?
+	`, doctorID).Scan(&oldFull, &oldThumb)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(`
+		UPDATE doctors SET photo_url = NULL, photo_thumb_url = NULL, photo_telegram_id = NULL WHERE id = ?
+	`, doctorID); err != nil {
+		return err
+	}
+	deleteMediaFiles(oldFull, oldThumb)
+	return nil
+}
+
+// deleteMediaFiles удаляет из хранилища загруженные файлы, внешние ссылки пропускает
+func deleteMediaFiles(urls ...string) {
+	for _, url := range urls {
+		if key := mediaKey(url); key != "" {
+			if err := fileStore.Delete(key); err != nil {
+				log.Printf("Error deleting media file %s: %v", key, err)
+			}
+		}
+	}
+}
+
+// readUploadedPhoto читает загруженный файл фото с ограничением размера
+func readUploadedPhoto(header *multipart.FileHeader) ([]byte, error) {
+	if header.Size > doctorPhotoMaxUpload {
+		return nil, &photoError{fmt.Sprintf("Фото больше %d МБ", doctorPhotoMaxUpload>>20)}
+	}
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(io.LimitReader(file, doctorPhotoMaxUpload+1))
+}
+
+// MediaHandler отдает загруженные изображения из хранилища. Доступны только ключи media/...,
+// файлы пациентов через этот адрес не открываются.
+func MediaHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p := path.Clean("/" + c.Param("path"))
+		if path.Ext(p) != ".jpg" {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		etag := `"` + path.Base(p) + `"`
+		if c.GetHeader("If-None-Match") == etag {
+			c.Header("Cache-Control", mediaCacheControl)
+			c.Status(http.StatusNotModified)
+			return
+		}
+
+		reader, err := fileStore.Open("media" + p)
+		if err != nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		defer reader.Close()
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			log.Printf("Error reading media file %s: %v", p, err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+
+		c.Header("Cache-Control", mediaCacheControl)
+		c.Header("ETag", etag)
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.Data(http.StatusOK, "image/jpeg", data)
+	}
+}
+
+// UploadDoctorPhotoHandler загружает фото врача через API (multipart, поле photo)
+func UploadDoctorPhotoHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID врача"})
+			return
+		}
+		header, err := c.FormFile("photo")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Файл фото не передан"})
+			return
+		}
+		data, err := readUploadedPhoto(header)
+		if err != nil {
+			doctorPhotoJSONError(c, err)
+			return
+		}
+		fullURL, thumbURL, err := saveDoctorPhoto(db, id, data)
+		if err != nil {
+			doctorPhotoJSONError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"photo_url": fullURL, "photo_thumb_url": thumbURL})
+	}
+}
+
+// doctorPhotoJSONError переводит ошибку загрузки фото в ответ API
+func doctorPhotoJSONError(c *gin.Context, err error) {
+	if e, ok := err.(*photoError); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": e.reason})
+		return
+	}
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Врач не найден"})
+		return
+	}
+	log.Printf("Error saving doctor photo: %v", err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при сохранении фото"})
+}
+
+// DeleteDoctorPhotoHandler удаляет фото врача через API
+func DeleteDoctorPhotoHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID врача"})
+			return
+		}
+		if err := removeDoctorPhoto(db, id); err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Врач не найден"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при удалении фото"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Фото удалено"})
+	}
+}
+
+// sendDoctorCard отправляет пациенту фото и описание врача
+func sendDoctorCard(bot *tgbotapi.BotAPI, chatID, doctorID int64, db *sql.DB) {
+	var name, specialization, description, photoURL, telegramFileID string
+	err := db.QueryRow(`
+		SELECT name, COALESCE(specialization, ''), COALESCE(description, ''),
+			   COALESCE(photo_url, ''), COALESCE(photo_telegram_id, '')
+		FROM doctors WHERE id = ?
+	`, doctorID).Scan(&name, &specialization, &description, &photoURL, &telegramFileID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error getting doctor card: %v", err)
+		}
+		return
+	}
+
+	caption := name
+	if specialization != "" {
+		caption += "\n" + specialization
+	}
+	if description != "" {
+		caption += "\n\n" + description
+	}
+	// Подпись к фото в Telegram ограничена 1024 символами
+	if utf8.RuneCountInString(caption) > 1024 {
+		caption = string([]rune(caption)[:1020]) + "..."
+	}
+
+	var file tgbotapi.RequestFileData
+	switch {
+	case telegramFileID != "":
+		file = tgbotapi.FileID(telegramFileID)
+	case mediaKey(photoURL) != "":
+		reader, err := fileStore.Open(mediaKey(photoURL))
+		if err == nil {
+			data, readErr := io.ReadAll(reader)
+			reader.Close()
+			if readErr == nil {
+				file = tgbotapi.FileBytes{Name: path.Base(photoURL), Bytes: data}
+			}
+		}
+		if file == nil {
+			log.Printf("Error reading doctor photo %s: %v", photoURL, err)
+		}
+	case strings.HasPrefix(photoURL, "http://") || strings.HasPrefix(photoURL, "https://"):
+		file = tgbotapi.FileURL(photoURL)
+	}
+
+	if file == nil {
+		bot.Send(tgbotapi.NewMessage(chatID, caption))
+		return
+	}
+
+	photo := tgbotapi.NewPhoto(chatID, file)
+	photo.Caption = caption
+	sent, err := bot.Send(photo)
+	if err != nil {
+		log.Printf("Error sending doctor photo: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, caption))
+		return
+	}
+	// Запоминаем file_id, чтобы не загружать фото в Telegram повторно
+	if telegramFileID == "" && len(sent.Photo) > 0 {
+		db.Exec("UPDATE doctors SET photo_telegram_id = ? WHERE id = ? AND photo_url = ?",
+			sent.Photo[len(sent.Photo)-1].FileID, doctorID, photoURL)
+	}
+}
@@ -2,145 +2,185 @@ package handlers
 
 import (
 	"database/sql"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// loadAdminDoctors возвращает врачей для страницы управления
+func loadAdminDoctors(db *sql.DB) ([]Doctor, error) {
+	rows, err := db.Query(`
+		SELECT id, name, specialization, COALESCE(description, ''), COALESCE(photo_url, ''), COALESCE(photo_thumb_url, '')
+		FROM doctors
+		ORDER BY name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var doctors []Doctor
+	for rows.Next() {
+		var d Doctor
+		if err := rows.Scan(&d.ID, &d.Name, &d.Specialization, &d.Description, &d.PhotoURL, &d.PhotoThumbURL); err == nil {
+			doctors = append(doctors, d)
+		}
+	}
+	return doctors, rows.Err()
+}
+
+// renderAdminDoctors выводит страницу врачей
+func renderAdminDoctors(c *gin.Context, db *sql.DB, status int, errorText string) {
+	doctors, err := loadAdminDoctors(db)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Ошибка при получении данных",
+		})
+		return
+	}
+	fillDoctorRatings(db, doctors)
+	c.HTML(status, "admin_doctors.html", gin.H{
+		"doctors": doctors,
+		"error":   errorText,
+	})
+}
+
+// adminDoctorPhotoError текст ошибки фото для страницы врача
+func adminDoctorPhotoError(err error) string {
+	if e, ok := err.(*photoError); ok {
+		return e.reason
+	}
+	log.Printf("Error saving doctor photo: %v", err)
+	return "Ошибка при сохранении фото"
+}
+
 func AdminDoctorsHandler(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if c.Request.Method == "GET" {
-			rows, err := db.Query(`
-				SELECT id, name, specialization, experience, education
-				FROM doctors
-				ORDER BY name
-			`)
-			if err != nil {
-				c.HTML(http.StatusInternalServerError, "error.html", gin.H{
-					"error": "Ошибка при получении данных",
-				})
-				return
-			}
-			defer rows.Close()
-
-			var doctors []struct {
-				ID             int64
-				Name           string
-				Specialization string
-				Experience     int
-				Education      string
-			}
-
-			for rows.Next() {
-				var d struct {
-					ID             int64
-					Name           string
-					Specialization string
-					Experience     int
-					Education      string
-				}
-				if err := rows.Scan(&d.ID, &d.Name, &d.Specialization, &d.Experience, &d.Education); err == nil {
-					doctors = append(doctors, d)
-				}
-			}
-
-			c.HTML(http.StatusOK, "doctors.html", gin.H{
-				"doctors": doctors,
-			})
+			renderAdminDoctors(c, db, http.StatusOK, "")
 			return
 		}
 
 		// POST запрос - добавление нового врача
-		name := c.PostForm("name")
-		specialization := c.PostForm("specialization")
-		experience := c.PostForm("experience")
-		education := c.PostForm("education")
-
-		if name == "" || specialization == "" || experience == "" || education == "" {
-			c.HTML(http.StatusBadRequest, "doctors.html", gin.H{
-				"error": "Все поля должны быть заполнены",
-			})
+		name := strings.TrimSpace(c.PostForm("name"))
+		specialization := strings.TrimSpace(c.PostForm("specialization"))
+		description := strings.TrimSpace(c.PostForm("description"))
+
+		if name == "" || specialization == "" {
+			renderAdminDoctors(c, db, http.StatusBadRequest, "Укажите ФИО и специализацию")
 			return
 		}
 
-		_, err := db.Exec(`
-			INSERT INTO doctors (name, specialization, experience, education)
-			VALUES (?, ?, ?, ?)
-		`, name, specialization, experience, education)
+		// Фото проверяем до создания врача, чтобы не оставить карточку без фото из-за ошибки
+		var photo []byte
+		if header, err := c.FormFile("photo"); err == nil {
+			if photo, err = readUploadedPhoto(header); err == nil {
+				_, _, err = processDoctorPhoto(photo)
+			}
+			if err != nil {
+				renderAdminDoctors(c, db, http.StatusBadRequest, adminDoctorPhotoError(err))
+				return
+			}
+		}
 
+		result, err := db.Exec(`
+			INSERT INTO doctors (name, specialization, description)
+			VALUES (?, ?, ?)
+		`, name, specialization, description)
 		if err != nil {
-			c.HTML(http.StatusInternalServerError, "doctors.html", gin.H{
-				"error": "Ошибка при добавлении врача",
-			})
+			renderAdminDoctors(c, db, http.StatusInternalServerError, "Ошибка при добавлении врача")
 			return
 		}
 
+		if photo != nil {
+			id, _ := result.LastInsertId()
+			if _, _, err := saveDoctorPhoto(db, id, photo); err != nil {
+				renderAdminDoctors(c, db, http.StatusInternalServerError, adminDoctorPhotoError(err))
+				return
+			}
+		}
+
 		c.Redirect(http.StatusFound, "/admin/doctors")
 	}
 }
 
+// renderAdminEditDoctor выводит форму редактирования врача
+func renderAdminEditDoctor(c *gin.Context, db *sql.DB, doctorID string, status int, errorText string) {
+	var doctor Doctor
+	err := db.QueryRow(`
+		SELECT id, name, specialization, COALESCE(description, ''), COALESCE(photo_url, ''), COALESCE(photo_thumb_url, '')
+		FROM doctors
+		WHERE id = ?
+	`, doctorID).Scan(&doctor.ID, &doctor.Name, &doctor.Specialization, &doctor.Description, &doctor.PhotoURL, &doctor.PhotoThumbURL)
+	if err != nil {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{
+			"error": "Врач не найден",
+		})
+		return
+	}
+
+	c.HTML(status, "admin_doctor_edit.html", gin.H{
+		"doctor": doctor,
+		"error":  errorText,
+	})
+}
+
 func AdminEditDoctorHandler(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		doctorID := c.Param("doctor_id")
-		if doctorID == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "ID врача не указан"})
+		id, err := strconv.ParseInt(doctorID, 10, 64)
+		if err != nil {
+			c.HTML(http.StatusBadRequest, "error.html", gin.H{
+				"error": "Неверный ID врача",
+			})
 			return
 		}
 
 		if c.Request.Method == "GET" {
-			var doctor struct {
-				ID             int64
-				Name           string
-				Specialization string
-				Experience     int
-				Education      string
-			}
-
-			err := db.QueryRow(`
-				SELECT id, name, specialization, experience, education
-				FROM doctors
-				WHERE id = ?
-			`, doctorID).Scan(&doctor.ID, &doctor.Name, &doctor.Specialization, &doctor.Experience, &doctor.Education)
-
-			if err != nil {
-				c.HTML(http.StatusInternalServerError, "error.html", gin.H{
-					"error": "Ошибка при получении данных",
-				})
-				return
-			}
-
-			c.HTML(http.StatusOK, "edit_doctor.html", gin.H{
-				"doctor": doctor,
-			})
+			renderAdminEditDoctor(c, db, doctorID, http.StatusOK, "")
 			return
 		}
 
 		// POST запрос - обновление врача
-		name := c.PostForm("name")
-		specialization := c.PostForm("specialization")
-		experience := c.PostForm("experience")
-		education := c.PostForm("education")
-
-		if name == "" || specialization == "" || experience == "" || education == "" {
-			c.HTML(http.StatusBadRequest, "edit_doctor.html", gin.H{
-				"error": "Все поля должны быть заполнены",
-			})
+		name := strings.TrimSpace(c.PostForm("name"))
+		specialization := strings.TrimSpace(c.PostForm("specialization"))
+		description := strings.TrimSpace(c.PostForm("description"))
+
+		if name == "" || specialization == "" {
+			renderAdminEditDoctor(c, db, doctorID, http.StatusBadRequest, "Укажите ФИО и специализацию")
 			return
 		}
 
-		_, err := db.Exec(`
+		_, err = db.Exec(`
 			UPDATE doctors
-			SET name = ?, specialization = ?, experience = ?, education = ?
+			SET name = ?, specialization = ?, description = ?
 			WHERE id = ?
-		`, name, specialization, experience, education, doctorID)
-
+		`, name, specialization, description, id)
 		if err != nil {
-			c.HTML(http.StatusInternalServerError, "edit_doctor.html", gin.H{
-				"error": "Ошибка при обновлении данных врача",
-			})
+			renderAdminEditDoctor(c, db, doctorID, http.StatusInternalServerError, "Ошибка при обновлении данных врача")
 			return
 		}
 
+		if header, err := c.FormFile("photo"); err == nil {
+			photo, err := readUploadedPhoto(header)
+			if err == nil {
+				_, _, err = saveDoctorPhoto(db, id, photo)
+			}
+			if err != nil {
+				renderAdminEditDoctor(c, db, doctorID, http.StatusBadRequest, adminDoctorPhotoError(err))
+				return
+			}
+		} else if c.PostForm("remove_photo") == "on" {
+			if err := removeDoctorPhoto(db, id); err != nil {
+				renderAdminEditDoctor(c, db, doctorID, http.StatusInternalServerError, "Ошибка при удалении фото")
+				return
+			}
+		}
+
 		c.Redirect(http.StatusFound, "/admin/doctors")
 	}
 }
@@ -153,16 +193,91 @@ func AdminDeleteDoctorHandler(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
+		var photoURL, thumbURL string
+		db.QueryRow(`
+			SELECT COALESCE(photo_url, ''), COALESCE(photo_thumb_url, '') FROM doctors WHERE id = ?
+		`, doctorID).Scan(&photoURL, &thumbURL)
+
 		_, err := db.Exec("DELETE FROM doctors WHERE id = ?", doctorID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при удалении врача"})
 			return
 		}
+		deleteMediaFiles(photoURL, thumbURL)
 
 		c.Redirect(http.StatusFound, "/admin/doctors")
 	}
 }
 
+// scheduleWeekdays названия дней недели расписания врача, 1 - понедельник, 7 - воскресенье
+var scheduleWeekdays = []string{"", "Понедельник", "Вторник", "Среда", "Четверг", "Пятница", "Суббота", "Воскресенье"}
+
+// doctorScheduleRow смена врача в расписании
+type doctorScheduleRow struct {
+	ID         int64
+	DayOfWeek  int
+	DayTitle   string
+	StartTime  string
+	EndTime    string
+	BreakStart string
+	BreakEnd   string
+}
+
+// renderAdminDoctorSchedule выводит страницу расписания врача
+func renderAdminDoctorSchedule(c *gin.Context, db *sql.DB, doctorID string, status int, errorText string) {
+	var doctor Doctor
+	err := db.QueryRow("SELECT id, name FROM doctors WHERE id = ?", doctorID).Scan(&doctor.ID, &doctor.Name)
+	if err == sql.ErrNoRows {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{"error": "Врач не найден"})
+		return
+	}
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": "Ошибка при получении данных"})
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT id, day_of_week, start_time, end_time, COALESCE(break_start, ''), COALESCE(break_end, '')
+		FROM doctor_schedule
+		WHERE doctor_id = ?
+		ORDER BY day_of_week, start_time
+	`, doctorID)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": "Ошибка при получении данных"})
+		return
+	}
+	defer rows.Close()
+
+	var schedules []doctorScheduleRow
+	for rows.Next() {
+		var s doctorScheduleRow
+		if err := rows.Scan(&s.ID, &s.DayOfWeek, &s.StartTime, &s.EndTime, &s.BreakStart, &s.BreakEnd); err == nil {
+			if s.DayOfWeek >= 1 && s.DayOfWeek <= 7 {
+				s.DayTitle = scheduleWeekdays[s.DayOfWeek]
+			}
+			schedules = append(schedules, s)
+		}
+	}
+
+	var weekdays []adminFilterOption
+	for i := 1; i < len(scheduleWeekdays); i++ {
+		weekdays = append(weekdays, adminFilterOption{ID: int64(i), Name: scheduleWeekdays[i]})
+	}
+
+	c.HTML(status, "admin_doctor_schedule.html", gin.H{
+		"doctor":    doctor,
+		"schedules": schedules,
+		"weekdays":  weekdays,
+		"error":     errorText,
+	})
+}
+
+// validScheduleTime проверяет время в формате ЧЧ:ММ
+func validScheduleTime(t string) bool {
+	_, err := time.Parse("15:04", t)
+	return err == nil && len(t) == 5
+}
+
 func AdminDoctorScheduleHandler(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		doctorID := c.Param("doctor_id")
@@ -172,67 +287,43 @@ func AdminDoctorScheduleHandler(db *sql.DB) gin.HandlerFunc {
 		}
 
 		if c.Request.Method == "GET" {
-			rows, err := db.Query(`
-				SELECT id, day_of_week, start_time, end_time
-				FROM doctor_schedule
-				WHERE doctor_id = ?
-				ORDER BY day_of_week, start_time
-			`, doctorID)
-			if err != nil {
-				c.HTML(http.StatusInternalServerError, "error.html", gin.H{
-					"error": "Ошибка при получении данных",
-				})
-				return
-			}
-			defer rows.Close()
-
-			var schedules []struct {
-				ID        int64
-				DayOfWeek int
-				StartTime string
-				EndTime   string
-			}
-
-			for rows.Next() {
-				var s struct {
-					ID        int64
-					DayOfWeek int
-					StartTime string
-					EndTime   string
-				}
-				if err := rows.Scan(&s.ID, &s.DayOfWeek, &s.StartTime, &s.EndTime); err == nil {
-					schedules = append(schedules, s)
-				}
-			}
-
-			c.HTML(http.StatusOK, "doctor_schedule.html", gin.H{
-				"doctor_id": doctorID,
-				"schedules": schedules,
-			})
+			renderAdminDoctorSchedule(c, db, doctorID, http.StatusOK, "")
 			return
 		}
 
-		// POST запрос - добавление расписания
-		dayOfWeek := c.PostForm("day_of_week")
+		// POST запрос - добавление смены; перерыв необязателен
+		dayOfWeek, _ := strconv.Atoi(c.PostForm("day_of_week"))
 		startTime := c.PostForm("start_time")
 		endTime := c.PostForm("end_time")
+		breakStart := c.PostForm("break_start")
+		breakEnd := c.PostForm("break_end")
 
-		if dayOfWeek == "" || startTime == "" || endTime == "" {
-			c.HTML(http.StatusBadRequest, "doctor_schedule.html", gin.H{
-				"error": "Все поля должны быть заполнены",
-			})
+		if dayOfWeek < 1 || dayOfWeek > 7 || !validScheduleTime(startTime) || !validScheduleTime(endTime) {
+			renderAdminDoctorSchedule(c, db, doctorID, http.StatusBadRequest, "Укажите день недели, время начала и окончания")
 			return
 		}
+		if startTime >= endTime {
+			renderAdminDoctorSchedule(c, db, doctorID, http.StatusBadRequest, "Время окончания должно быть позже времени начала")
+			return
+		}
+		if breakStart != "" || breakEnd != "" {
+			if !validScheduleTime(breakStart) || !validScheduleTime(breakEnd) {
+				renderAdminDoctorSchedule(c, db, doctorID, http.StatusBadRequest, "Укажите начало и конец перерыва или оставьте оба поля пустыми")
+				return
+			}
+			if breakStart >= breakEnd || breakStart < startTime || breakEnd > endTime {
+				renderAdminDoctorSchedule(c, db, doctorID, http.StatusBadRequest, "Перерыв должен быть внутри рабочего времени")
+				return
+			}
+		}
 
 		_, err := db.Exec(`
-			INSERT INTO doctor_schedule (doctor_id, day_of_week, start_time, end_time)
-			VALUES (?, ?, ?, ?)
-		`, doctorID, dayOfWeek, startTime, endTime)
-
+			INSERT INTO doctor_schedule (doctor_id, day_of_week, start_time, end_time, break_start, break_end)
+			VALUES (?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''))
+		`, doctorID, dayOfWeek, startTime, endTime, breakStart, breakEnd)
 		if err != nil {
-			c.HTML(http.StatusInternalServerError, "doctor_schedule.html", gin.H{
-				"error": "Ошибка при добавлении расписания",
-			})
+			log.Printf("Error adding doctor schedule: %v", err)
+			renderAdminDoctorSchedule(c, db, doctorID, http.StatusInternalServerError, "Ошибка при добавлении расписания")
 			return
 		}
 
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	_ "embed"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pdf/fpdf"
+)
+
+// Шрифты DejaVu встраиваются в PDF, чтобы кириллица отображалась без шрифтов на сервере
+var (
+	//go:embed fonts/DejaVuSans.ttf
+	fontRegular []byte
+	//go:embed fonts/DejaVuSans-Bold.ttf
+	fontBold []byte
+)
+
+// pdfColumn описывает колонку таблицы в PDF
+type pdfColumn struct {
+	Title string
+	Width float64
+}
+
+var bookingsPDFColumns = []pdfColumn{
+	{"Дата", 24},
+	{"Время", 16},
+	{"Пациент", 62},
+	{"Телефон", 36},
+	{"Услуга", 75},
+	{"Статус", 44},
+}
+
+// fitText обрезает текст под ширину колонки
+func fitText(pdf *fpdf.Fpdf, text string, width float64) string {
+	const padding = 2
+	if pdf.GetStringWidth(text) <= width-padding {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 && pdf.GetStringWidth(string(runes)+"…") > width-padding {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "…"
+}
+
+// bookingsPDFPeriod возвращает описание периода для заголовка
+func bookingsPDFPeriod(f adminBookingFilter) string {
+	switch {
+	case f.Date != "":
+		return "за " + f.Date
+	case f.DateFrom != "" && f.DateTo != "":
+		return fmt.Sprintf("с %s по %s", f.DateFrom, f.DateTo)
+	case f.DateFrom != "":
+		return "с " + f.DateFrom
+	case f.DateTo != "":
+		return "по " + f.DateTo
+	}
+	return "за весь период"
+}
+
+// buildBookingsPDF формирует расписание, сгруппированное по врачам
+func buildBookingsPDF(bookings []adminBookingRow, f adminBookingFilter) (*bytes.Buffer, error) {
+	// Внутри врача записи идут по порядку приема
+	sort.SliceStable(bookings, func(i, j int) bool {
+		if bookings[i].DoctorName != bookings[j].DoctorName {
+			if bookings[i].DoctorName == "" || bookings[j].DoctorName == "" {
+				return bookings[j].DoctorName == ""
+			}
+			return bookings[i].DoctorName < bookings[j].DoctorName
+		}
+		if bookings[i].Date != bookings[j].Date {
+			return bookings[i].Date < bookings[j].Date
+		}
+		return bookings[i].Time < bookings[j].Time
+	})
+
+	pdf := fpdf.New("L", "mm", "A4", "")
+	pdf.AddUTF8FontFromBytes("DejaVu", "", fontRegular)
+	pdf.AddUTF8FontFromBytes("DejaVu", "B", fontBold)
+	pdf.SetMargins(10, 10, 10)
+	pdf.SetAutoPageBreak(false, 10)
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-10)
+		pdf.SetFont("DejaVu", "", 8)
+		pdf.CellFormat(0, 5, fmt.Sprintf("Стр. %d", pdf.PageNo()), "", 0, "R", false, 0, "")
+	})
+	pdf.AddPage()
+
+	_, pageHeight := pdf.GetPageSize()
+	const rowHeight = 7.0
+	bottom := pageHeight - 15
+
+	pdf.SetFont("DejaVu", "B", 16)
+	pdf.CellFormat(0, 10, "Журнал записей "+bookingsPDFPeriod(f), "", 1, "L", false, 0, "")
+	pdf.SetFont("DejaVu", "", 9)
+	info := "Сформировано " + time.Now().Format("02.01.2006 15:04")
+	if f.Client != "" {
+		info += ", клиент: " + f.Client
+	}
+	pdf.CellFormat(0, 6, info, "", 1, "L", false, 0, "")
+	pdf.Ln(2)
+
+	header := func() {
+		pdf.SetFont("DejaVu", "B", 9)
+		pdf.SetFillColor(240, 240, 240)
+		for _, col := range bookingsPDFColumns {
+			pdf.CellFormat(col.Width, rowHeight, col.Title, "1", 0, "L", true, 0, "")
+		}
+		pdf.Ln(-1)
+		pdf.SetFont("DejaVu", "", 9)
+	}
+
+	if len(bookings) == 0 {
+		pdf.SetFont("DejaVu", "", 11)
+		pdf.CellFormat(0, 8, "Записей не найдено", "", 1, "L", false, 0, "")
+	}
+
+	for i := 0; i < len(bookings); {
+		doctor := bookings[i].DoctorName
+		title := doctor
+		if title == "" {
+			title = "Врач не назначен"
+		}
+
+		// Заголовок врача не должен оставаться внизу страницы без строк
+		if pdf.GetY()+10+2*rowHeight > bottom {
+			pdf.AddPage()
+		}
+		pdf.Ln(2)
+		pdf.SetFont("DejaVu", "B", 12)
+		pdf.CellFormat(0, 8, title, "", 1, "L", false, 0, "")
+		header()
+
+		for ; i < len(bookings) && bookings[i].DoctorName == doctor; i++ {
+			b := bookings[i]
+			if pdf.GetY()+rowHeight > bottom {
+				pdf.AddPage()
+				pdf.SetFont("DejaVu", "B", 10)
+				pdf.CellFormat(0, 7, title+" (продолжение)", "", 1, "L", false, 0, "")
+				header()
+			}
+
+			patient := b.ClientName
+			if b.PatientName != "" {
+				patient = b.PatientName + " (" + b.ClientName + ")"
+			}
+			values := []string{b.Date, b.Time, patient, b.Phone, b.ServiceName, b.Status}
+			for j, col := range bookingsPDFColumns {
+				pdf.CellFormat(col.Width, rowHeight, fitText(pdf, values[j], col.Width), "1", 0, "L", false, 0, "")
+			}
+			pdf.Ln(-1)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+// AdminExportPDFHandler выгружает журнал записей в PDF с теми же фильтрами, что и страница записей
+func AdminExportPDFHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter := adminBookingFilterFromQuery(c)
+		filter.PerPage = 0
+		bookings, _, err := queryAdminBookings(db, filter)
+		if err != nil {
+			c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Ошибка при получении данных",
+			})
+			return
+		}
+
+		buf, err := buildBookingsPDF(bookings, filter)
+		if err != nil {
+			c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Ошибка при формировании PDF",
+			})
+			return
+		}
+
+		filename := "bookings.pdf"
+		if _, err := time.Parse("2006-01-02", filter.Date); err == nil {
+			filename = "bookings_" + filter.Date + ".pdf"
+		}
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+		c.Data(http.StatusOK, "application/pdf", buf.Bytes())
+	}
+}
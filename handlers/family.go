@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Dependent представляет члена семьи пациента
+type Dependent struct {
+	ID        int64  `json:"id"`
+	UserID    int64  `json:"user_id"`
+	Name      string `json:"name"`
+	BirthDate string `json:"birth_date"`
+	Relation  string `json:"relation"`
+}
+
+// getDependents возвращает членов семьи пациента
+func getDependents(db *sql.DB, userID int64) ([]Dependent, error) {
+	rows, err := db.Query(`
+		SELECT id, user_id, name, COALESCE(birth_date, ''), COALESCE(relation, '')
+		FROM dependents
+		WHERE user_id = ?
+		ORDER BY name
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dependents []Dependent
+	for rows.Next() {
+		var d Dependent
+		if err := rows.Scan(&d.ID, &d.UserID, &d.Name, &d.BirthDate, &d.Relation); err == nil {
+			dependents = append(dependents, d)
+		}
+	}
+	return dependents, rows.Err()
+}
+
+// parseDependent разбирает строку вида "Имя, ДД.ММ.ГГГГ, кем приходится"
+func parseDependent(text string) (Dependent, error) {
+	var d Dependent
+	parts := strings.Split(text, ",")
+	if len(parts) != 3 {
+		return d, fmt.Errorf("неверный формат")
+	}
+
+	d.Name = strings.TrimSpace(parts[0])
+	d.Relation = strings.TrimSpace(parts[2])
+	if d.Name == "" || d.Relation == "" {
+		return d, fmt.Errorf("не указано имя или родство")
+	}
+
+	birthDate, err := time.Parse("02.01.2006", strings.TrimSpace(parts[1]))
+	if err != nil || birthDate.After(time.Now()) {
+		return d, fmt.Errorf("неверная дата рождения")
+	}
+	d.BirthDate = birthDate.Format("2006-01-02")
+	return d, nil
+}
+
+func showFamily(bot *tgbotapi.BotAPI, chatID int64, db *sql.DB, userID int64) {
+	dependents, err := getDependents(db, userID)
+	if err != nil {
+		log.Printf("Error getting dependents: %v", err)
+		msg := tgbotapi.NewMessage(chatID, "Ошибка при получении списка членов семьи")
+		bot.Send(msg)
+		return
+	}
+
+	text := "Члены семьи, за которых вы можете записываться:\n\n"
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	if len(dependents) == 0 {
+		text = "Вы еще не добавили членов семьи.\n"
+	}
+	for _, d := range dependents {
+		text += fmt.Sprintf("• %s (%s), дата рождения: %s\n", d.Name, d.Relation, d.BirthDate)
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Удалить: "+d.Name, fmt.Sprintf("fam_del_%d", d.ID)),
+		))
+	}
+	keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("➕ Добавить члена семьи", "fam_add"),
+	))
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	bot.Send(msg)
+}
+
+// handleFamilyCallback обрабатывает callback'и членов семьи (префикс fam_)
+func handleFamilyCallback(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery, db *sql.DB) {
+	chatID := callback.Message.Chat.ID
+
+	switch {
+	case callback.Data == "fam_add":
+		_, err := db.Exec("UPDATE users SET state = 'waiting_for_dependent' WHERE telegram_id = ?", chatID)
+		if err != nil {
+			log.Printf("Error updating state: %v", err)
+			msg := tgbotapi.NewMessage(chatID, "Произошла ошибка. Попробуйте позже.")
+			bot.Send(msg)
+			return
+		}
+		msg := tgbotapi.NewMessage(chatID, "Отправьте данные члена семьи одним сообщением в формате:\nИмя Фамилия, ДД.ММ.ГГГГ, кем приходится\n\nНапример: Мария Иванова, 15.03.2016, дочь\n\nЧтобы отменить, отправьте «-» или «отмена».")
+		bot.Send(msg)
+
+	case strings.HasPrefix(callback.Data, "fam_del_"):
+		dependentID, _ := strconv.ParseInt(strings.TrimPrefix(callback.Data, "fam_del_"), 10, 64)
+		hasBookings, err := dependentHasBookings(db, dependentID)
+		if err != nil {
+			log.Printf("Error checking dependent bookings: %v", err)
+			msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при удалении. Попробуйте позже.")
+			bot.Send(msg)
+			return
+		}
+		if hasBookings {
+			msg := tgbotapi.NewMessage(chatID, "У члена семьи есть записи в клинике, поэтому удалить его нельзя. Если данные нужно исправить, напишите нам в этот чат.")
+			bot.Send(msg)
+			return
+		}
+		_, err = db.Exec(`
+			DELETE FROM dependents
+			WHERE id = ? AND user_id = (SELECT id FROM users WHERE telegram_id = ?)
+		`, dependentID, chatID)
+		if err != nil {
+			log.Printf("Error deleting dependent: %v", err)
+			msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при удалении. Попробуйте позже.")
+			bot.Send(msg)
+			return
+		}
+		msg := tgbotapi.NewMessage(chatID, "Член семьи удален.")
+		bot.Send(msg)
+	}
+}
+
+// saveDependentFromMessage сохраняет члена семьи из текстового сообщения
+func saveDependentFromMessage(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB) {
+	chatID := message.Chat.ID
+
+	switch strings.ToLower(strings.TrimSpace(message.Text)) {
+	case "-", "отмена", "отменить":
+		if _, err := db.Exec("UPDATE users SET state = 'ready' WHERE telegram_id = ?", chatID); err != nil {
+			log.Printf("Error updating state: %v", err)
+		}
+		msg := tgbotapi.NewMessage(chatID, "Добавление члена семьи отменено.")
+		bot.Send(msg)
+		return
+	}
+
+	d, err := parseDependent(message.Text)
+	if err != nil {
+		msg := tgbotapi.NewMessage(chatID, "Не удалось разобрать данные ("+err.Error()+"). Пожалуйста, используйте формат:\nИмя Фамилия, ДД.ММ.ГГГГ, кем приходится\n\nЧтобы отменить, отправьте «-» или «отмена».")
+		bot.Send(msg)
+		return
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO dependents (user_id, name, birth_date, relation)
+		SELECT id, ?, ?, ? FROM users WHERE telegram_id = ?
+	`, d.Name, d.BirthDate, d.Relation, chatID)
+	if err != nil {
+		log.Printf("Error saving dependent: %v", err)
+		msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при сохранении. Попробуйте позже.")
+		bot.Send(msg)
+		return
+	}
+
+	if _, err := db.Exec("UPDATE users SET state = 'ready' WHERE telegram_id = ?", chatID); err != nil {
+		log.Printf("Error updating state: %v", err)
+	}
+
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("%s добавлен(а) в список членов семьи. Теперь при записи через /book можно выбрать, для кого запись.", d.Name))
+	bot.Send(msg)
+}
+
+// Получение членов семьи пациента
+func GetDependentsHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.ParseInt(c.Param("user_id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID пользователя"})
+			return
+		}
+
+		dependents, err := getDependents(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при получении данных"})
+			return
+		}
+
+		c.JSON(http.StatusOK, dependents)
+	}
+}
+
+// Добавление члена семьи
+func AddDependentHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.ParseInt(c.Param("user_id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID пользователя"})
+			return
+		}
+
+		var d Dependent
+		if err := c.ShouldBindJSON(&d); err != nil || strings.TrimSpace(d.Name) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный формат данных"})
+			return
+		}
+		if d.BirthDate != "" {
+			if _, err := time.Parse("2006-01-02", d.BirthDate); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Неверная дата рождения"})
+				return
+			}
+		}
+
+		result, err := db.Exec(`
+			INSERT INTO dependents (user_id, name, birth_date, relation)
+			VALUES (?, ?, ?, ?)
+		`, userID, strings.TrimSpace(d.Name), d.BirthDate, d.Relation)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при добавлении члена семьи"})
+			return
+		}
+
+		d.ID, _ = result.LastInsertId()
+		d.UserID = userID
+		c.JSON(http.StatusOK, d)
+	}
+}
+
+// dependentHasBookings сообщает, есть ли у члена семьи записи, включая прошедшие и отмененные:
+// такие карточки не удаляются, чтобы записи не ссылались на несуществующего члена семьи
+func dependentHasBookings(db *sql.DB, dependentID int64) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM bookings WHERE dependent_id = ?", dependentID).Scan(&count)
+	return count > 0, err
+}
+
+// Удаление члена семьи
+func DeleteDependentHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dependentID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID члена семьи"})
+			return
+		}
+		hasBookings, err := dependentHasBookings(db, dependentID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при удалении члена семьи"})
+			return
+		}
+		if hasBookings {
+			c.JSON(http.StatusConflict, gin.H{"error": "У члена семьи есть записи, удалить его нельзя"})
+			return
+		}
+
+		_, err = db.Exec("DELETE FROM dependents WHERE id = ? AND user_id = ?", c.Param("id"), c.Param("user_id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при удалении члена семьи"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Член семьи удален"})
+	}
+}
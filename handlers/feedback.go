@@ -0,0 +1,397 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// feedbackDelay через сколько после завершения приема пациент получает запрос отзыва
+var feedbackDelay = 2 * time.Hour
+
+// feedbackAlertChatID чат администраторов для уведомлений о низких оценках, 0 - не отправлять
+var feedbackAlertChatID int64
+
+// feedbackLowRating оценка, при которой и ниже администраторы получают уведомление
+var feedbackLowRating = 3
+
+// showDoctorRatings показывать ли рейтинг врачей в публичном API
+var showDoctorRatings bool
+
+// feedbackMaxAge запросы отзыва не отправляются по приемам, завершенным раньше
+const feedbackMaxAge = 7 * 24 * time.Hour
+
+// SetFeedbackDelay задает время между завершением приема и запросом отзыва
+func SetFeedbackDelay(d time.Duration) {
+	if d > 0 {
+		feedbackDelay = d
+	}
+}
+
+// SetFeedbackAlerts задает чат для уведомлений о низких оценках и порог низкой оценки
+func SetFeedbackAlerts(chatID int64, lowRating int) {
+	feedbackAlertChatID = chatID
+	if lowRating >= 1 && lowRating <= 5 {
+		feedbackLowRating = lowRating
+	}
+}
+
+// SetShowDoctorRatings включает рейтинг врачей в /api/doctors для Mini App
+func SetShowDoctorRatings(show bool) {
+	showDoctorRatings = show
+}
+
+// feedbackBooking завершенный прием, по которому пациента просят оставить отзыв
+type feedbackBooking struct {
+	ID          int64
+	TelegramID  int64
+	Date        string
+	Time        string
+	ServiceName string
+	DoctorName  string
+	PatientName string
+}
+
+// RunFeedbackWorker периодически просит пациентов оценить завершенные приемы
+func RunFeedbackWorker(bot *tgbotapi.BotAPI, db *sql.DB) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sendFeedbackRequests(bot, db)
+	}
+}
+
+func sendFeedbackRequests(bot *tgbotapi.BotAPI, db *sql.DB) {
+	rows, err := db.Query(`
+		SELECT b.id, u.telegram_id, b.date, b.time, COALESCE(s.name, ''), COALESCE(d.name, ''), COALESCE(dp.name, '')
+		FROM bookings b
+		JOIN users u ON b.user_id = u.id
+		LEFT JOIN services s ON b.service_id = s.id
+		LEFT JOIN doctors d ON b.doctor_id = d.id
+		LEFT JOIN dependents dp ON b.dependent_id = dp.id
+		WHERE b.status = ? AND b.feedback_requested_at IS NULL
+		  AND b.completed_at <= datetime('now', ?) AND b.completed_at > datetime('now', ?)
+		  AND u.telegram_id IS NOT NULL AND COALESCE(u.is_blocked, 0) = 0
+		  AND NOT EXISTS (SELECT 1 FROM reviews r WHERE r.booking_id = b.id)
+	`, bookingStatusCompleted,
+		fmt.Sprintf("-%d minutes", int(feedbackDelay/time.Minute)),
+		fmt.Sprintf("-%d minutes", int(feedbackMaxAge/time.Minute)))
+	if err != nil {
+		log.Printf("Error getting bookings for feedback: %v", err)
+		return
+	}
+	var bookings []feedbackBooking
+	for rows.Next() {
+		var b feedbackBooking
+		if err := rows.Scan(&b.ID, &b.TelegramID, &b.Date, &b.Time, &b.ServiceName, &b.DoctorName, &b.PatientName); err == nil {
+			bookings = append(bookings, b)
+		}
+	}
+	rows.Close()
+
+	for _, b := range bookings {
+		// Запрос отправляется один раз, даже если Telegram вернул ошибку
+		if _, err := db.Exec("UPDATE bookings SET feedback_requested_at = CURRENT_TIMESTAMP WHERE id = ?", b.ID); err != nil {
+			log.Printf("Error marking feedback request: %v", err)
+			continue
+		}
+		if bot == nil {
+			continue
+		}
+		if _, err := bot.Send(feedbackRequestMessage(b)); err != nil {
+			log.Printf("Error sending feedback request for booking %d: %v", b.ID, err)
+		}
+	}
+}
+
+// feedbackRequestMessage сообщение с кнопками оценки от 1 до 5
+func feedbackRequestMessage(b feedbackBooking) tgbotapi.MessageConfig {
+	text := fmt.Sprintf("Как прошел прием %s в %s?\n\nУслуга: %s\n", b.Date, b.Time, b.ServiceName)
+	if b.DoctorName != "" {
+		text += fmt.Sprintf("Врач: %s\n", b.DoctorName)
+	}
+	if b.PatientName != "" {
+		text += fmt.Sprintf("Пациент: %s\n", b.PatientName)
+	}
+	text += "\nОцените прием от 1 до 5, это поможет нам стать лучше."
+
+	var row []tgbotapi.InlineKeyboardButton
+	for rating := 1; rating <= 5; rating++ {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%d ⭐", rating), fmt.Sprintf("fb_%d_%d", b.ID, rating)))
+	}
+	msg := tgbotapi.NewMessage(b.TelegramID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(row)
+	return msg
+}
+
+// handleFeedbackCallback сохраняет оценку приема (fb_<bookingID>_<оценка>) и просит комментарий
+func handleFeedbackCallback(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery, db *sql.DB) {
+	chatID := callback.Message.Chat.ID
+	parts := strings.Split(callback.Data, "_")
+	if len(parts) != 3 {
+		return
+	}
+	bookingID, _ := strconv.ParseInt(parts[1], 10, 64)
+	rating, _ := strconv.Atoi(parts[2])
+	if rating < 1 || rating > 5 {
+		return
+	}
+
+	// Оценить можно только свой завершенный прием
+	var userID, doctorID int64
+	var status string
+	err := db.QueryRow(`
+		SELECT b.user_id, COALESCE(b.doctor_id, 0), b.status
+		FROM bookings b JOIN users u ON b.user_id = u.id
+		WHERE b.id = ? AND u.telegram_id = ?
+	`, bookingID, chatID).Scan(&userID, &doctorID, &status)
+	if err != nil || status != bookingStatusCompleted {
+		bot.Send(tgbotapi.NewMessage(chatID, "Этот прием нельзя оценить."))
+		return
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO reviews (booking_id, user_id, doctor_id, rating) VALUES (?, ?, ?, ?)
+		ON CONFLICT(booking_id) DO NOTHING
+	`, bookingID, userID, nullInt64(doctorID), rating)
+	if err != nil {
+		log.Printf("Error saving review: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Произошла ошибка при сохранении оценки. Попробуйте позже."))
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		bot.Send(tgbotapi.NewMessage(chatID, "Вы уже оценили этот прием. Спасибо!"))
+		return
+	}
+
+	if rating <= feedbackLowRating {
+		alertLowRating(bot, db, bookingID)
+	}
+
+	_, err = db.Exec("UPDATE users SET state = 'waiting_for_review', review_booking = ? WHERE telegram_id = ?", bookingID, chatID)
+	if err != nil {
+		log.Printf("Error updating state: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Спасибо за оценку!"))
+		return
+	}
+	bot.Send(tgbotapi.NewMessage(chatID, "Спасибо за оценку! Если хотите, напишите комментарий одним сообщением. Чтобы пропустить, отправьте «-»."))
+}
+
+// saveReviewCommentFromMessage добавляет комментарий к последней оценке пациента
+func saveReviewCommentFromMessage(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB) {
+	chatID := message.Chat.ID
+	var bookingID int64
+	if err := db.QueryRow("SELECT COALESCE(review_booking, 0) FROM users WHERE telegram_id = ?", chatID).Scan(&bookingID); err != nil {
+		log.Printf("Error getting review booking: %v", err)
+	}
+	if _, err := db.Exec("UPDATE users SET state = 'ready', review_booking = NULL WHERE telegram_id = ?", chatID); err != nil {
+		log.Printf("Error updating state: %v", err)
+	}
+
+	comment := strings.TrimSpace(message.Text)
+	if comment == "-" || comment == "" || bookingID == 0 {
+		bot.Send(tgbotapi.NewMessage(chatID, "Спасибо за отзыв!"))
+		return
+	}
+
+	var rating int
+	err := db.QueryRow("SELECT rating FROM reviews WHERE booking_id = ?", bookingID).Scan(&rating)
+	if err == nil {
+		_, err = db.Exec("UPDATE reviews SET comment = ? WHERE booking_id = ?", comment, bookingID)
+	}
+	if err != nil {
+		log.Printf("Error saving review comment: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Произошла ошибка при сохранении комментария. Попробуйте позже."))
+		return
+	}
+	if rating <= feedbackLowRating {
+		alertLowRating(bot, db, bookingID)
+	}
+	bot.Send(tgbotapi.NewMessage(chatID, "Спасибо за отзыв!"))
+}
+
+// alertLowRating сообщает администраторам о низкой оценке. Вызывается при оценке и еще раз,
+// когда пациент дописал комментарий.
+func alertLowRating(bot *tgbotapi.BotAPI, db *sql.DB, bookingID int64) {
+	if feedbackAlertChatID == 0 || bot == nil {
+		return
+	}
+	var r adminReview
+	err := db.QueryRow(`
+		SELECT r.rating, COALESCE(r.comment, ''), b.date, b.time, COALESCE(s.name, ''), COALESCE(d.name, ''),
+			   COALESCE(dp.name, NULLIF(TRIM(COALESCE(u.first_name, '') || ' ' || COALESCE(u.last_name, '')), ''), u.username, ''), COALESCE(u.phone, '')
+		FROM reviews r
+		JOIN bookings b ON r.booking_id = b.id
+		JOIN users u ON r.user_id = u.id
+		LEFT JOIN services s ON b.service_id = s.id
+		LEFT JOIN doctors d ON r.doctor_id = d.id
+		LEFT JOIN dependents dp ON b.dependent_id = dp.id
+		WHERE r.booking_id = ?
+	`, bookingID).Scan(&r.Rating, &r.Comment, &r.Date, &r.Time, &r.ServiceName, &r.DoctorName, &r.PatientName, &r.Phone)
+	if err != nil {
+		log.Printf("Error loading review for alert: %v", err)
+		return
+	}
+
+	text := fmt.Sprintf("⚠️ Низкая оценка приема: %d из 5\n\nЗапись №%d, %s %s\nУслуга: %s\n", r.Rating, bookingID, r.Date, r.Time, r.ServiceName)
+	if r.DoctorName != "" {
+		text += fmt.Sprintf("Врач: %s\n", r.DoctorName)
+	}
+	text += fmt.Sprintf("Пациент: %s", r.PatientName)
+	if r.Phone != "" {
+		text += ", " + r.Phone
+	}
+	if r.Comment != "" {
+		text += "\n\nКомментарий: " + r.Comment
+	}
+	if _, err := bot.Send(tgbotapi.NewMessage(feedbackAlertChatID, text)); err != nil {
+		log.Printf("Error sending low rating alert: %v", err)
+	}
+}
+
+// doctorRating средняя оценка врача по отзывам
+type doctorRating struct {
+	DoctorID   int64
+	DoctorName string
+	Average    float64
+	Count      int
+	Low        int
+}
+
+// loadDoctorRatings средние оценки врачей, у которых есть отзывы
+func loadDoctorRatings(db *sql.DB) (map[int64]doctorRating, error) {
+	rows, err := db.Query(`
+		SELECT d.id, d.name, AVG(r.rating), COUNT(*), SUM(r.rating <= ?)
+		FROM reviews r
+		JOIN doctors d ON r.doctor_id = d.id
+		GROUP BY d.id, d.name
+	`, feedbackLowRating)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ratings := map[int64]doctorRating{}
+	for rows.Next() {
+		var r doctorRating
+		if err := rows.Scan(&r.DoctorID, &r.DoctorName, &r.Average, &r.Count, &r.Low); err != nil {
+			return nil, err
+		}
+		r.Average = math.Round(r.Average*10) / 10
+		ratings[r.DoctorID] = r
+	}
+	return ratings, rows.Err()
+}
+
+// fillDoctorRatings добавляет врачам среднюю оценку и количество отзывов
+func fillDoctorRatings(db *sql.DB, doctors []Doctor) {
+	ratings, err := loadDoctorRatings(db)
+	if err != nil {
+		log.Printf("Error loading doctor ratings: %v", err)
+		return
+	}
+	for i := range doctors {
+		r := ratings[doctors[i].ID]
+		doctors[i].Rating = r.Average
+		doctors[i].ReviewsCount = r.Count
+	}
+}
+
+// adminReview отзыв в админке
+type adminReview struct {
+	BookingID   int64
+	Rating      int
+	Comment     string
+	Date        string
+	Time        string
+	ServiceName string
+	DoctorName  string
+	PatientName string
+	Phone       string
+	UserID      int64
+	CreatedAt   string
+	IsLow       bool
+}
+
+// adminReviewsLimit сколько последних отзывов показывать на странице
+const adminReviewsLimit = 200
+
+// AdminReviewsHandler выводит рейтинг врачей и последние отзывы с фильтром по врачу и низким оценкам
+func AdminReviewsHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		doctorID, _ := strconv.ParseInt(c.Query("doctor_id"), 10, 64)
+		lowOnly := c.Query("low") == "1"
+
+		where := " WHERE 1=1"
+		var args []interface{}
+		if doctorID != 0 {
+			where += " AND r.doctor_id = ?"
+			args = append(args, doctorID)
+		}
+		if lowOnly {
+			where += " AND r.rating <= ?"
+			args = append(args, feedbackLowRating)
+		}
+		rows, err := db.Query(`
+			SELECT r.booking_id, r.rating, COALESCE(r.comment, ''), b.date, b.time, COALESCE(s.name, ''), COALESCE(d.name, ''),
+				   COALESCE(dp.name, NULLIF(TRIM(COALESCE(u.first_name, '') || ' ' || COALESCE(u.last_name, '')), ''), u.username, ''), COALESCE(u.phone, ''), r.user_id,
+				   strftime('%Y-%m-%d %H:%M', r.created_at)
+			FROM reviews r
+			JOIN bookings b ON r.booking_id = b.id
+			JOIN users u ON r.user_id = u.id
+			LEFT JOIN services s ON b.service_id = s.id
+			LEFT JOIN doctors d ON r.doctor_id = d.id
+			LEFT JOIN dependents dp ON b.dependent_id = dp.id
+		`+where+`
+			ORDER BY r.created_at DESC, r.id DESC
+			LIMIT `+strconv.Itoa(adminReviewsLimit), args...)
+		if err != nil {
+			log.Printf("Error getting reviews: %v", err)
+			c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Ошибка при получении данных",
+			})
+			return
+		}
+		defer rows.Close()
+
+		var reviews []adminReview
+		for rows.Next() {
+			var r adminReview
+			if err := rows.Scan(&r.BookingID, &r.Rating, &r.Comment, &r.Date, &r.Time, &r.ServiceName, &r.DoctorName,
+				&r.PatientName, &r.Phone, &r.UserID, &r.CreatedAt); err != nil {
+				continue
+			}
+			r.IsLow = r.Rating <= feedbackLowRating
+			reviews = append(reviews, r)
+		}
+
+		ratings, err := loadDoctorRatings(db)
+		if err != nil {
+			log.Printf("Error loading doctor ratings: %v", err)
+		}
+		var doctorRatings []doctorRating
+		for _, d := range loadAdminFilterOptions(db, "SELECT id, name FROM doctors ORDER BY name") {
+			r := ratings[d.ID]
+			r.DoctorID, r.DoctorName = d.ID, d.Name
+			doctorRatings = append(doctorRatings, r)
+		}
+
+		c.HTML(http.StatusOK, "admin_reviews.html", gin.H{
+			"reviews":   reviews,
+			"ratings":   doctorRatings,
+			"doctorID":  doctorID,
+			"lowOnly":   lowOnly,
+			"lowRating": feedbackLowRating,
+			"limit":     adminReviewsLimit,
+		})
+	}
+}
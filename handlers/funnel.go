@@ -0,0 +1,347 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Шаги воронки записи через бота
+const (
+	funnelStepStarted       = "started"
+	funnelStepService       = "service"
+	funnelStepDate          = "date"
+	funnelStepTime          = "time"
+	funnelStepPhone         = "phone"
+	funnelStepPhoneVerified = "phone_verified"
+	funnelStepConfirmed     = "confirmed"
+	funnelStepAbandoned     = "abandoned"
+)
+
+// Статусы сессии записи
+const (
+	funnelSessionActive    = "active"
+	funnelSessionConfirmed = "confirmed"
+	funnelSessionAbandoned = "abandoned"
+)
+
+// funnelAbandonMinutes через сколько минут без действий сессия считается брошенной
+const funnelAbandonMinutes = 30
+
+// funnelDropOffTitles где пациент ушел: последний пройденный шаг брошенной сессии
+var funnelDropOffTitles = map[string]string{
+	funnelStepStarted:       "Список услуг: услуга не выбрана",
+	funnelStepService:       "Список дат: дата не выбрана",
+	funnelStepDate:          "Список времени: время не выбрано",
+	funnelStepTime:          "Подтверждение записи: не подтвердил",
+	funnelStepPhone:         "Подтверждение телефона: код не введен",
+	funnelStepPhoneVerified: "После подтверждения телефона",
+}
+
+// funnelDropOffOrder порядок шагов в таблице ухода
+var funnelDropOffOrder = []string{
+	funnelStepStarted, funnelStepService, funnelStepDate, funnelStepTime, funnelStepPhone, funnelStepPhoneVerified,
+}
+
+// activeFunnelSession текущая сессия записи пациента, 0 - нет
+func activeFunnelSession(db *sql.DB, userID int64) int64 {
+	var id int64
+	err := db.QueryRow(`
+		SELECT id FROM bot_sessions WHERE user_id = ? AND status = ? ORDER BY id DESC LIMIT 1
+	`, userID, funnelSessionActive).Scan(&id)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error getting funnel session: %v", err)
+	}
+	return id
+}
+
+// abandonFunnelSession закрывает сессию как брошенную на последнем пройденном шаге
+func abandonFunnelSession(db *sql.DB, sessionID int64) error {
+	res, err := db.Exec(`
+		UPDATE bot_sessions SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND status = ?
+	`, funnelSessionAbandoned, sessionID, funnelSessionActive)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	_, err = db.Exec("INSERT INTO bot_funnel_events (session_id, step) VALUES (?, ?)", sessionID, funnelStepAbandoned)
+	return err
+}
+
+// startFunnelSession начинает новую сессию записи, незаконченная предыдущая считается брошенной
+func startFunnelSession(db *sql.DB, userID int64) (int64, error) {
+	if prev := activeFunnelSession(db, userID); prev != 0 {
+		if err := abandonFunnelSession(db, prev); err != nil {
+			return 0, err
+		}
+	}
+	res, err := db.Exec("INSERT INTO bot_sessions (user_id, last_step) VALUES (?, ?)", userID, funnelStepStarted)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	_, err = db.Exec("INSERT INTO bot_funnel_events (session_id, step) VALUES (?, ?)", id, funnelStepStarted)
+	return id, err
+}
+
+// trackFunnelStep записывает шаг воронки для пациента из чата. Ошибки только логируются:
+// статистика не должна мешать записи.
+func trackFunnelStep(db *sql.DB, chatID int64, step, serviceID string) {
+	var userID int64
+	if err := db.QueryRow("SELECT id FROM users WHERE telegram_id = ?", chatID).Scan(&userID); err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error getting user for funnel: %v", err)
+		}
+		return
+	}
+
+	var err error
+	sessionID := activeFunnelSession(db, userID)
+	switch {
+	case step == funnelStepStarted:
+		_, err = startFunnelSession(db, userID)
+		if err != nil {
+			log.Printf("Error starting funnel session: %v", err)
+		}
+		return
+	case sessionID == 0 && (step == funnelStepPhone || step == funnelStepPhoneVerified):
+		// Телефон подтверждают и вне записи
+		return
+	case sessionID == 0:
+		// Запись начали не с /book: из списка /services или по кнопке из старого сообщения
+		if sessionID, err = startFunnelSession(db, userID); err != nil {
+			log.Printf("Error starting funnel session: %v", err)
+			return
+		}
+	}
+
+	service := nullInt64(0)
+	if id, _ := strconv.ParseInt(serviceID, 10, 64); id != 0 {
+		service = nullInt64(id)
+	}
+	status := funnelSessionActive
+	if step == funnelStepConfirmed {
+		status = funnelSessionConfirmed
+	}
+	if _, err := db.Exec(`
+		UPDATE bot_sessions
+		SET last_step = ?, status = ?, service_id = COALESCE(?, service_id), updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, step, status, service, sessionID); err != nil {
+		log.Printf("Error updating funnel session: %v", err)
+		return
+	}
+	if _, err := db.Exec("INSERT INTO bot_funnel_events (session_id, step, service_id) VALUES (?, ?, ?)", sessionID, step, service); err != nil {
+		log.Printf("Error saving funnel event: %v", err)
+	}
+}
+
+// trackFunnelBooking отмечает сессию записью, созданной в ней
+func trackFunnelBooking(db *sql.DB, chatID int64, serviceID string, bookingID int64) {
+	trackFunnelStep(db, chatID, funnelStepConfirmed, serviceID)
+	_, err := db.Exec(`
+		UPDATE bot_sessions SET booking_id = ?
+		WHERE id = (
+			SELECT s.id FROM bot_sessions s JOIN users u ON s.user_id = u.id
+			WHERE u.telegram_id = ? AND s.status = ? ORDER BY s.id DESC LIMIT 1
+		)
+	`, bookingID, chatID, funnelSessionConfirmed)
+	if err != nil {
+		log.Printf("Error linking funnel session to booking: %v", err)
+	}
+}
+
+// RunFunnelWorker периодически закрывает сессии записи, в которых пациент перестал отвечать
+func RunFunnelWorker(db *sql.DB) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		abandonStaleFunnelSessions(db)
+	}
+}
+
+func abandonStaleFunnelSessions(db *sql.DB) {
+	rows, err := db.Query(`
+		SELECT id FROM bot_sessions WHERE status = ? AND updated_at <= datetime('now', ?)
+	`, funnelSessionActive, fmt.Sprintf("-%d minutes", funnelAbandonMinutes))
+	if err != nil {
+		log.Printf("Error getting stale funnel sessions: %v", err)
+		return
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := abandonFunnelSession(db, id); err != nil {
+			log.Printf("Error abandoning funnel session %d: %v", id, err)
+		}
+	}
+}
+
+// funnelRow сессии записи за день или по услуге и сколько из них дошли до каждого шага
+type funnelRow struct {
+	Title      string
+	Sessions   int
+	Service    int
+	Date       int
+	Time       int
+	Confirmed  int
+	Abandoned  int
+	Conversion float64
+}
+
+// funnelDropOff брошенные сессии по шагу, на котором ушел пациент
+type funnelDropOff struct {
+	Step  string
+	Title string
+	Count int
+	Share float64
+}
+
+// funnelReport воронка записи через бота за период
+type funnelReport struct {
+	Filter         analyticsFilter
+	Total          funnelRow
+	Days           []funnelRow
+	Services       []funnelRow
+	DropOff        []funnelDropOff
+	PhoneRequested int
+	PhoneVerified  int
+}
+
+// funnelRows считает сессии, начатые в периоде, с группировкой по выражению groupBy
+func funnelRows(db *sql.DB, f analyticsFilter, groupBy, orderBy string) ([]funnelRow, error) {
+	reached := func(step string) string {
+		return "SUM(EXISTS (SELECT 1 FROM bot_funnel_events e WHERE e.session_id = s.id AND e.step = '" + step + "'))"
+	}
+	rows, err := db.Query(`
+		SELECT `+groupBy+`, COUNT(*), `+reached(funnelStepService)+`, `+reached(funnelStepDate)+`, `+reached(funnelStepTime)+`,
+			   SUM(s.status = ?), SUM(s.status = ?)
+		FROM bot_sessions s
+		LEFT JOIN services sv ON s.service_id = sv.id
+		WHERE DATE(s.started_at) BETWEEN ? AND ?
+		GROUP BY 1
+		ORDER BY `+orderBy,
+		funnelSessionConfirmed, funnelSessionAbandoned, f.From, f.To)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []funnelRow
+	for rows.Next() {
+		var r funnelRow
+		if err := rows.Scan(&r.Title, &r.Sessions, &r.Service, &r.Date, &r.Time, &r.Confirmed, &r.Abandoned); err != nil {
+			return nil, err
+		}
+		r.Conversion = percent(float64(r.Confirmed), float64(r.Sessions))
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// buildFunnel собирает воронку по дням начала сессии и по выбранной услуге
+func buildFunnel(db *sql.DB, f analyticsFilter) (*funnelReport, error) {
+	r := &funnelReport{Filter: f}
+	var err error
+	if r.Days, err = funnelRows(db, f, "DATE(s.started_at)", "1"); err != nil {
+		return nil, err
+	}
+	if r.Services, err = funnelRows(db, f, "COALESCE(sv.name, 'Услуга не выбрана')", "2 DESC, 1"); err != nil {
+		return nil, err
+	}
+
+	r.Total.Title = "Всего"
+	for _, d := range r.Days {
+		r.Total.Sessions += d.Sessions
+		r.Total.Service += d.Service
+		r.Total.Date += d.Date
+		r.Total.Time += d.Time
+		r.Total.Confirmed += d.Confirmed
+		r.Total.Abandoned += d.Abandoned
+	}
+	r.Total.Conversion = percent(float64(r.Total.Confirmed), float64(r.Total.Sessions))
+
+	// Где уходят пациенты
+	counts := map[string]int{}
+	rows, err := db.Query(`
+		SELECT last_step, COUNT(*) FROM bot_sessions
+		WHERE status = ? AND DATE(started_at) BETWEEN ? AND ?
+		GROUP BY last_step
+	`, funnelSessionAbandoned, f.From, f.To)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var step string
+		var n int
+		if err := rows.Scan(&step, &n); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		counts[step] = n
+	}
+	rows.Close()
+	for _, step := range funnelDropOffOrder {
+		r.DropOff = append(r.DropOff, funnelDropOff{
+			Step:  step,
+			Title: funnelDropOffTitles[step],
+			Count: counts[step],
+			Share: percent(float64(counts[step]), float64(r.Total.Abandoned)),
+		})
+	}
+
+	err = db.QueryRow(`
+		SELECT COUNT(DISTINCT CASE WHEN e.step = ? THEN e.session_id END),
+			   COUNT(DISTINCT CASE WHEN e.step = ? THEN e.session_id END)
+		FROM bot_funnel_events e
+		JOIN bot_sessions s ON e.session_id = s.id
+		WHERE DATE(s.started_at) BETWEEN ? AND ?
+	`, funnelStepPhone, funnelStepPhoneVerified, f.From, f.To).Scan(&r.PhoneRequested, &r.PhoneVerified)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// AdminFunnelHandler выводит воронку записи через бота
+func AdminFunnelHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		f, filterErr := analyticsFilterFromQuery(c)
+		data := gin.H{"filter": f}
+		if filterErr != nil {
+			data["error"] = "Ошибка в периоде: " + filterErr.Error()
+			c.HTML(http.StatusBadRequest, "admin_funnel.html", data)
+			return
+		}
+
+		report, err := buildFunnel(db, f)
+		if err != nil {
+			log.Printf("Error building funnel: %v", err)
+			c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Ошибка при получении данных",
+			})
+			return
+		}
+		data["report"] = report
+		data["abandonMinutes"] = funnelAbandonMinutes
+		c.HTML(http.StatusOK, "admin_funnel.html", data)
+	}
+}
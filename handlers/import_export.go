@@ -0,0 +1,588 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xuri/excelize/v2"
+)
+
+// tableColumn колонка таблицы выгрузки: заголовок и другие допустимые названия при загрузке
+type tableColumn struct {
+	Key      string
+	Title    string
+	Aliases  []string
+	Required bool
+}
+
+var serviceTableColumns = []tableColumn{
+	{Key: "name", Title: "Название", Aliases: []string{"name", "услуга"}, Required: true},
+	{Key: "category", Title: "Категория", Aliases: []string{"category"}, Required: true},
+	{Key: "duration", Title: "Длительность", Aliases: []string{"duration", "длительность, мин"}, Required: true},
+	{Key: "price", Title: "Цена", Aliases: []string{"price", "стоимость"}, Required: true},
+	{Key: "capacity", Title: "Мест", Aliases: []string{"capacity", "вместимость"}},
+}
+
+var doctorTableColumns = []tableColumn{
+	{Key: "name", Title: "Имя", Aliases: []string{"name", "врач", "фио"}, Required: true},
+	{Key: "specialization", Title: "Специализация", Aliases: []string{"specialization"}, Required: true},
+	{Key: "description", Title: "Описание", Aliases: []string{"description"}},
+	{Key: "photo_url", Title: "Фото", Aliases: []string{"photo_url", "photo"}},
+}
+
+var bookingTableTitles = []string{"ID", "Дата", "Время", "Врач", "Услуга", "Пациент", "Клиент", "Телефон", "Статус", "Скидка", "Стоимость"}
+
+// importEntityTitles сущности, которые можно загружать из файла
+var importEntityTitles = map[string]string{
+	"services": "Услуги",
+	"doctors":  "Врачи",
+}
+
+// exportEntityTitles сущности, которые можно выгружать
+var exportEntityTitles = map[string]string{
+	"services": "Услуги",
+	"doctors":  "Врачи",
+	"bookings": "Записи",
+}
+
+// importRowError ошибка в строке загружаемого файла
+type importRowError struct {
+	Row    int    `json:"row"`
+	Column string `json:"column,omitempty"`
+	Error  string `json:"error"`
+}
+
+// importReport результат проверки и загрузки файла
+type importReport struct {
+	Entity  string           `json:"entity"`
+	DryRun  bool             `json:"dry_run"`
+	Applied bool             `json:"applied"`
+	Total   int              `json:"total"`
+	Created int              `json:"created"`
+	Updated int              `json:"updated"`
+	Errors  []importRowError `json:"errors"`
+}
+
+func (r *importReport) addError(row int, column, format string, args ...interface{}) {
+	r.Errors = append(r.Errors, importRowError{Row: row, Column: column, Error: fmt.Sprintf(format, args...)})
+}
+
+// exportTable возвращает заголовок и строки выгрузки
+func exportTable(db *sql.DB, entity string, filter adminBookingFilter) ([]string, [][]interface{}, error) {
+	var header []string
+	var rows [][]interface{}
+
+	switch entity {
+	case "services":
+		for _, col := range serviceTableColumns {
+			header = append(header, col.Title)
+		}
+		res, err := db.Query("SELECT name, category, duration, price, capacity FROM services ORDER BY category, name")
+		if err != nil {
+			return nil, nil, err
+		}
+		defer res.Close()
+		for res.Next() {
+			var name, category string
+			var duration, capacity int
+			var price float64
+			if err := res.Scan(&name, &category, &duration, &price, &capacity); err == nil {
+				rows = append(rows, []interface{}{name, category, duration, price, capacity})
+			}
+		}
+		return header, rows, res.Err()
+
+	case "doctors":
+		for _, col := range doctorTableColumns {
+			header = append(header, col.Title)
+		}
+		res, err := db.Query("SELECT name, specialization, COALESCE(description, ''), COALESCE(photo_url, '') FROM doctors ORDER BY name")
+		if err != nil {
+			return nil, nil, err
+		}
+		defer res.Close()
+		for res.Next() {
+			var name, specialization, description, photoURL string
+			if err := res.Scan(&name, &specialization, &description, &photoURL); err == nil {
+				rows = append(rows, []interface{}{name, specialization, description, photoURL})
+			}
+		}
+		return header, rows, res.Err()
+
+	case "bookings":
+		bookings, _, err := queryAdminBookings(db, filter)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, b := range bookings {
+			rows = append(rows, []interface{}{b.ID, b.Date, b.Time, b.DoctorName, b.ServiceName, b.PatientName, b.ClientName, b.Phone, b.Status, b.Discount, b.FinalPrice})
+		}
+		return bookingTableTitles, rows, nil
+	}
+
+	return nil, nil, fmt.Errorf("неизвестная таблица: %s", entity)
+}
+
+// writeCSV пишет таблицу в CSV с разделителем ";", который Excel открывает без настройки
+func writeCSV(w io.Writer, header []string, rows [][]interface{}) error {
+	// BOM, чтобы Excel распознал UTF-8
+	if _, err := w.Write([]byte("\xEF\xBB\xBF")); err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+	cw.Comma = ';'
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		record := make([]string, len(row))
+		for i, v := range row {
+			record[i] = fmt.Sprint(v)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeXLSX пишет таблицу в книгу Excel с одним листом
+func writeXLSX(w io.Writer, sheet string, header []string, rows [][]interface{}) error {
+	f := excelize.NewFile()
+	defer f.Close()
+
+	if err := f.SetSheetName("Sheet1", sheet); err != nil {
+		return err
+	}
+	headerRow := make([]interface{}, len(header))
+	for i, h := range header {
+		headerRow[i] = h
+	}
+	if err := f.SetSheetRow(sheet, "A1", &headerRow); err != nil {
+		return err
+	}
+	if style, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}}); err == nil {
+		lastCell, _ := excelize.CoordinatesToCellName(len(header), 1)
+		f.SetCellStyle(sheet, "A1", lastCell, style)
+	}
+	for i, row := range rows {
+		cell, _ := excelize.CoordinatesToCellName(1, i+2)
+		if err := f.SetSheetRow(sheet, cell, &row); err != nil {
+			return err
+		}
+	}
+	return f.Write(w)
+}
+
+// readTable читает строки из загруженного CSV или XLSX файла
+func readTable(file *multipart.FileHeader) ([][]string, error) {
+	src, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	switch strings.ToLower(filepath.Ext(file.Filename)) {
+	case ".csv":
+		data, err := io.ReadAll(src)
+		if err != nil {
+			return nil, err
+		}
+		data = bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))
+
+		// Разделитель определяем по строке заголовка
+		firstLine := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			firstLine = data[:i]
+		}
+		r := csv.NewReader(bytes.NewReader(data))
+		if bytes.Count(firstLine, []byte(";")) > bytes.Count(firstLine, []byte(",")) {
+			r.Comma = ';'
+		}
+		r.FieldsPerRecord = -1
+		r.LazyQuotes = true
+		return r.ReadAll()
+
+	case ".xlsx":
+		f, err := excelize.OpenReader(src)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		sheets := f.GetSheetList()
+		if len(sheets) == 0 {
+			return nil, fmt.Errorf("в файле нет листов")
+		}
+		return f.GetRows(sheets[0])
+	}
+
+	return nil, fmt.Errorf("поддерживаются только файлы CSV и XLSX")
+}
+
+// mapTableColumns сопоставляет колонки файла с полями по заголовку
+func mapTableColumns(header []string, columns []tableColumn, report *importReport) map[string]int {
+	index := make(map[string]int)
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(h))
+		for _, col := range columns {
+			if h == strings.ToLower(col.Title) || containsString(col.Aliases, h) {
+				index[col.Key] = i
+			}
+		}
+	}
+	for _, col := range columns {
+		if _, ok := index[col.Key]; !ok && col.Required {
+			report.addError(1, col.Title, "нет обязательной колонки")
+		}
+	}
+	return index
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// tableRow значения строки файла по ключам колонок
+type tableRow struct {
+	values map[string]string
+}
+
+func (r tableRow) get(key string) string {
+	return r.values[key]
+}
+
+func (r tableRow) has(key string) bool {
+	_, ok := r.values[key]
+	return ok
+}
+
+// parseDecimal понимает и запятую, и точку в качестве разделителя
+func parseDecimal(s string) (float64, error) {
+	s = strings.ReplaceAll(strings.ReplaceAll(s, " ", ""), " ", "")
+	return strconv.ParseFloat(strings.Replace(s, ",", ".", 1), 64)
+}
+
+// importTable проверяет строки и добавляет или обновляет записи по названию.
+// Изменения сохраняются, только если в файле нет ошибок и это не пробный запуск.
+func importTable(db *sql.DB, entity string, records [][]string, dryRun bool) (*importReport, error) {
+	report := &importReport{Entity: entity, DryRun: dryRun, Errors: []importRowError{}}
+
+	var columns []tableColumn
+	var upsert func(tx *sql.Tx, rowNum int, row tableRow) (created bool, err error)
+	switch entity {
+	case "services":
+		columns = serviceTableColumns
+		upsert = upsertServiceRow(report)
+	case "doctors":
+		columns = doctorTableColumns
+		upsert = upsertDoctorRow(report)
+	default:
+		return nil, fmt.Errorf("неизвестная таблица: %s", entity)
+	}
+
+	if len(records) == 0 {
+		report.addError(1, "", "файл пуст")
+		return report, nil
+	}
+	index := mapTableColumns(records[0], columns, report)
+	if len(report.Errors) > 0 {
+		return report, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	seen := make(map[string]int)
+	for i, record := range records[1:] {
+		rowNum := i + 2
+		row := tableRow{values: make(map[string]string)}
+		empty := true
+		for key, col := range index {
+			if col < len(record) {
+				row.values[key] = strings.TrimSpace(record[col])
+				if row.values[key] != "" {
+					empty = false
+				}
+			}
+		}
+		if empty {
+			continue
+		}
+		report.Total++
+
+		name := row.get("name")
+		if prev, ok := seen[name]; ok && name != "" {
+			report.addError(rowNum, columns[0].Title, "повторяет строку %d", prev)
+			continue
+		}
+		seen[name] = rowNum
+
+		errorsBefore := len(report.Errors)
+		created, err := upsert(tx, rowNum, row)
+		if err != nil {
+			return nil, err
+		}
+		if len(report.Errors) > errorsBefore {
+			continue
+		}
+		if created {
+			report.Created++
+		} else {
+			report.Updated++
+		}
+	}
+
+	if dryRun || len(report.Errors) > 0 {
+		return report, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	report.Applied = true
+	return report, nil
+}
+
+func upsertServiceRow(report *importReport) func(tx *sql.Tx, rowNum int, row tableRow) (bool, error) {
+	return func(tx *sql.Tx, rowNum int, row tableRow) (bool, error) {
+		errorsBefore := len(report.Errors)
+		name, category := row.get("name"), row.get("category")
+		if name == "" {
+			report.addError(rowNum, "Название", "не заполнено")
+		}
+		if category == "" {
+			report.addError(rowNum, "Категория", "не заполнена")
+		}
+		duration, err := strconv.Atoi(row.get("duration"))
+		if err != nil || duration <= 0 {
+			report.addError(rowNum, "Длительность", "должна быть целым числом минут больше нуля")
+		}
+		price, err := parseDecimal(row.get("price"))
+		if err != nil || price < 0 {
+			report.addError(rowNum, "Цена", "должна быть неотрицательным числом")
+		}
+		capacity := 1
+		if row.get("capacity") != "" {
+			capacity, err = strconv.Atoi(row.get("capacity"))
+			if err != nil || capacity < 1 {
+				report.addError(rowNum, "Мест", "должно быть целым числом не меньше 1")
+			}
+		}
+		if len(report.Errors) > errorsBefore {
+			return false, nil
+		}
+
+		var id int64
+		err = tx.QueryRow("SELECT id FROM services WHERE name = ?", name).Scan(&id)
+		if err == sql.ErrNoRows {
+			_, err = tx.Exec(`
+				INSERT INTO services (name, category, duration, price, capacity)
+				VALUES (?, ?, ?, ?, ?)
+			`, name, category, duration, price, capacity)
+			return true, err
+		}
+		if err != nil {
+			return false, err
+		}
+
+		// Если колонки вместимости нет в файле, оставляем текущее значение
+		if row.has("capacity") && row.get("capacity") != "" {
+			_, err = tx.Exec(`
+				UPDATE services SET category = ?, duration = ?, price = ?, capacity = ? WHERE id = ?
+			`, category, duration, price, capacity, id)
+		} else {
+			_, err = tx.Exec(`
+				UPDATE services SET category = ?, duration = ?, price = ? WHERE id = ?
+			`, category, duration, price, id)
+		}
+		return false, err
+	}
+}
+
+func upsertDoctorRow(report *importReport) func(tx *sql.Tx, rowNum int, row tableRow) (bool, error) {
+	return func(tx *sql.Tx, rowNum int, row tableRow) (bool, error) {
+		errorsBefore := len(report.Errors)
+		name, specialization := row.get("name"), row.get("specialization")
+		if name == "" {
+			report.addError(rowNum, "Имя", "не заполнено")
+		}
+		if specialization == "" {
+			report.addError(rowNum, "Специализация", "не заполнена")
+		}
+		if photo := row.get("photo_url"); photo != "" && !strings.HasPrefix(photo, "http://") && !strings.HasPrefix(photo, "https://") && !strings.HasPrefix(photo, "/") {
+			report.addError(rowNum, "Фото", "должно быть ссылкой")
+		}
+		if len(report.Errors) > errorsBefore {
+			return false, nil
+		}
+
+		var id int64
+		err := tx.QueryRow("SELECT id FROM doctors WHERE name = ?", name).Scan(&id)
+		if err == sql.ErrNoRows {
+			_, err = tx.Exec(`
+				INSERT INTO doctors (name, specialization, description, photo_url)
+				VALUES (?, ?, ?, ?)
+			`, name, specialization, row.get("description"), row.get("photo_url"))
+			return true, err
+		}
+		if err != nil {
+			return false, err
+		}
+
+		// Необязательные колонки обновляем, только если они есть в файле
+		if _, err := tx.Exec("UPDATE doctors SET specialization = ? WHERE id = ?", specialization, id); err != nil {
+			return false, err
+		}
+		for _, key := range []string{"description", "photo_url"} {
+			if row.has(key) {
+				if _, err := tx.Exec("UPDATE doctors SET "+key+" = ? WHERE id = ?", row.get(key), id); err != nil {
+					return false, err
+				}
+			}
+		}
+		return false, nil
+	}
+}
+
+// ExportTableHandler выгружает услуги, врачей или записи в CSV или XLSX (?format=xlsx).
+// Для записей действуют те же фильтры, что и на странице записей.
+func ExportTableHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		entity := c.Param("entity")
+		title, ok := exportEntityTitles[entity]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Неизвестная таблица"})
+			return
+		}
+		format := c.DefaultQuery("format", "csv")
+		if format != "csv" && format != "xlsx" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Поддерживаются форматы csv и xlsx"})
+			return
+		}
+
+		// Выгрузка записей не разбивается на страницы
+		filter := adminBookingFilterFromQuery(c)
+		filter.PerPage = 0
+		header, rows, err := exportTable(db, entity, filter)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при получении данных"})
+			return
+		}
+
+		var buf bytes.Buffer
+		contentType := "text/csv; charset=utf-8"
+		if format == "xlsx" {
+			contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+			err = writeXLSX(&buf, title, header, rows)
+		} else {
+			err = writeCSV(&buf, header, rows)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при формировании файла"})
+			return
+		}
+
+		filename := fmt.Sprintf("%s_%s.%s", entity, time.Now().Format("2006-01-02"), format)
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+		c.Data(http.StatusOK, contentType, buf.Bytes())
+	}
+}
+
+// ImportTableHandler загружает услуги или врачей из файла; ?dry_run=1 только проверяет файл
+func ImportTableHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		entity := c.Param("entity")
+		if _, ok := importEntityTitles[entity]; !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Неизвестная таблица"})
+			return
+		}
+
+		file, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Файл не передан"})
+			return
+		}
+		records, err := readTable(file)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Не удалось прочитать файл: " + err.Error()})
+			return
+		}
+
+		dryRun := c.Query("dry_run") == "1" || c.Query("dry_run") == "true"
+		report, err := importTable(db, entity, records, dryRun)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при загрузке данных"})
+			return
+		}
+
+		status := http.StatusOK
+		if len(report.Errors) > 0 {
+			status = http.StatusUnprocessableEntity
+		}
+		c.JSON(status, report)
+	}
+}
+
+// AdminImportExportHandler страница выгрузки и загрузки данных
+func AdminImportExportHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.HTML(http.StatusOK, "admin_import_export.html", gin.H{
+			"importEntities": importEntityTitles,
+		})
+	}
+}
+
+// AdminImportHandler загружает файл из админки и показывает отчет о проверке
+func AdminImportHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		render := func(status int, data gin.H) {
+			data["importEntities"] = importEntityTitles
+			c.HTML(status, "admin_import_export.html", data)
+		}
+
+		entity := c.PostForm("entity")
+		if _, ok := importEntityTitles[entity]; !ok {
+			render(http.StatusBadRequest, gin.H{"error": "Выберите, что загружать"})
+			return
+		}
+		file, err := c.FormFile("file")
+		if err != nil {
+			render(http.StatusBadRequest, gin.H{"error": "Выберите файл"})
+			return
+		}
+		records, err := readTable(file)
+		if err != nil {
+			render(http.StatusBadRequest, gin.H{"error": "Не удалось прочитать файл: " + err.Error()})
+			return
+		}
+
+		report, err := importTable(db, entity, records, c.PostForm("dry_run") != "")
+		if err != nil {
+			render(http.StatusInternalServerError, gin.H{"error": "Ошибка при загрузке данных"})
+			return
+		}
+
+		render(http.StatusOK, gin.H{
+			"report":      report,
+			"entityTitle": importEntityTitles[entity],
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Области действия ограничений на количество записей
+const (
+	limitScopeClinicDay     = "clinic_day"     // записей в клинике за день
+	limitScopeDoctorDay     = "doctor_day"     // записей к врачу за день
+	limitScopeCategoryDay   = "category_day"   // записей на категорию услуг за день
+	limitScopePatientActive = "patient_active" // активных записей у одного пациента
+)
+
+// limitScopeTitles названия областей для админки
+var limitScopeTitles = map[string]string{
+	limitScopeClinicDay:     "Клиника в день",
+	limitScopeDoctorDay:     "Врач в день",
+	limitScopeCategoryDay:   "Категория услуг в день",
+	limitScopePatientActive: "Активных записей у пациента",
+}
+
+// defaultClinicDailyLimit используется, если в базе нет ограничения на клинику в день
+var defaultClinicDailyLimit = 8
+
+// SetDefaultClinicDailyLimit задает ограничение на клинику в день по умолчанию
+func SetDefaultClinicDailyLimit(n int) {
+	if n > 0 {
+		defaultClinicDailyLimit = n
+	}
+}
+
+// limitRule представляет ограничение на количество записей
+type limitRule struct {
+	ID         int64
+	Scope      string
+	ScopeTitle string
+	DoctorID   int64 // 0 - для каждого врача
+	DoctorName string
+	Category   string
+	MaxCount   int
+}
+
+// limitError возвращается, когда запись нарушает ограничение
+type limitError struct {
+	reason string
+}
+
+func (e *limitError) Error() string {
+	return e.reason
+}
+
+func loadLimitRules(q dbExecutor) ([]limitRule, error) {
+	rows, err := q.Query(`
+		SELECT l.id, l.scope, COALESCE(l.doctor_id, 0), COALESCE(d.name, ''), COALESCE(l.category, ''), l.max_count
+		FROM booking_limits l
+		LEFT JOIN doctors d ON l.doctor_id = d.id
+		ORDER BY l.scope, l.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []limitRule
+	for rows.Next() {
+		var r limitRule
+		if err := rows.Scan(&r.ID, &r.Scope, &r.DoctorID, &r.DoctorName, &r.Category, &r.MaxCount); err == nil {
+			r.ScopeTitle = limitScopeTitles[r.Scope]
+			rules = append(rules, r)
+		}
+	}
+	return rules, rows.Err()
+}
+
+// dayLimitViolation проверяет дневные ограничения клиники, врача и категории услуги.
+// Запись excludeID (переносимая) не учитывается. Возвращает причину отказа или пустую строку.
+func dayLimitViolation(q dbExecutor, serviceID, doctorID int64, date string, excludeID int64) (string, error) {
+	rules, err := loadLimitRules(q)
+	if err != nil {
+		return "", err
+	}
+
+	var category string
+	if serviceID != 0 {
+		if err := q.QueryRow("SELECT category FROM services WHERE id = ?", serviceID).Scan(&category); err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+	}
+
+	clinicLimit := defaultClinicDailyLimit
+	doctorLimit := 0
+	var doctorLimitSpecific bool
+	for _, r := range rules {
+		switch r.Scope {
+		case limitScopeClinicDay:
+			clinicLimit = r.MaxCount
+		case limitScopeDoctorDay:
+			// Ограничение для конкретного врача важнее общего
+			if r.DoctorID == doctorID && doctorID != 0 {
+				doctorLimit = r.MaxCount
+				doctorLimitSpecific = true
+			} else if r.DoctorID == 0 && !doctorLimitSpecific {
+				doctorLimit = r.MaxCount
+			}
+		}
+	}
+
+	var count int
+	err = q.QueryRow(`
+		SELECT COUNT(*) FROM bookings
+		WHERE date = ? AND id <> ? AND status NOT IN ('Отменено', 'Отменена')
+	`, date, excludeID).Scan(&count)
+	if err != nil {
+		return "", err
+	}
+	if count >= clinicLimit {
+		return "На этот день больше нет мест", nil
+	}
+
+	if doctorID != 0 && doctorLimit > 0 {
+		err = q.QueryRow(`
+			SELECT COUNT(*) FROM bookings
+			WHERE date = ? AND doctor_id = ? AND id <> ? AND status NOT IN ('Отменено', 'Отменена')
+		`, date, doctorID, excludeID).Scan(&count)
+		if err != nil {
+			return "", err
+		}
+		if count >= doctorLimit {
+			return "У врача больше нет мест на этот день", nil
+		}
+	}
+
+	for _, r := range rules {
+		if r.Scope != limitScopeCategoryDay || r.Category != category || category == "" {
+			continue
+		}
+		err = q.QueryRow(`
+			SELECT COUNT(*) FROM bookings b
+			JOIN services s ON b.service_id = s.id
+			WHERE b.date = ? AND s.category = ? AND b.id <> ? AND b.status NOT IN ('Отменено', 'Отменена')
+		`, date, category, excludeID).Scan(&count)
+		if err != nil {
+			return "", err
+		}
+		if count >= r.MaxCount {
+			return fmt.Sprintf("На этот день больше нет мест для услуг категории «%s»", category), nil
+		}
+	}
+
+	return "", nil
+}
+
+// patientLimitViolation проверяет ограничение на количество активных записей пациента.
+// Пациентом считается член семьи, если запись делается за него.
+func patientLimitViolation(q dbExecutor, userID, dependentID int64) (string, error) {
+	if userID == 0 {
+		return "", nil
+	}
+
+	var maxCount int
+	err := q.QueryRow(`
+		SELECT COALESCE(MIN(max_count), 0) FROM booking_limits WHERE scope = ?
+	`, limitScopePatientActive).Scan(&maxCount)
+	if err != nil {
+		return "", err
+	}
+	if maxCount == 0 {
+		return "", nil
+	}
+
+	var count int
+	err = q.QueryRow(`
+		SELECT COUNT(*) FROM bookings
+		WHERE user_id = ? AND COALESCE(dependent_id, 0) = ? AND date >= ?
+		  AND status NOT IN ('Отменено', 'Отменена')
+	`, userID, dependentID, time.Now().Format("2006-01-02")).Scan(&count)
+	if err != nil {
+		return "", err
+	}
+	if count >= maxCount {
+		return fmt.Sprintf("У пациента уже %d активных записей — это максимум", count), nil
+	}
+	return "", nil
+}
+
+// checkBookingLimits проверяет все ограничения для новой записи
+func checkBookingLimits(q dbExecutor, p bookingParams) error {
+	reason, err := patientLimitViolation(q, p.UserID, p.DependentID)
+	if err != nil {
+		return err
+	}
+	if reason == "" {
+		reason, err = dayLimitViolation(q, p.ServiceID, p.DoctorID, p.Date, 0)
+		if err != nil {
+			return err
+		}
+	}
+	if reason != "" {
+		return &limitError{reason: reason}
+	}
+	return nil
+}
+
+// availableDates возвращает даты периода, на которые не исчерпаны дневные ограничения
+func availableDates(q dbExecutor, serviceID, doctorID int64, start, end time.Time) ([]string, error) {
+	var dates []string
+	for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+		dateStr := d.Format("2006-01-02")
+		reason, err := dayLimitViolation(q, serviceID, doctorID, dateStr, 0)
+		if err != nil {
+			return nil, err
+		}
+		if reason == "" {
+			dates = append(dates, dateStr)
+		}
+	}
+	return dates, nil
+}
+
+// renderAdminLimits выводит страницу ограничений
+func renderAdminLimits(c *gin.Context, db *sql.DB, status int, errorText string) {
+	rules, err := loadLimitRules(db)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Ошибка при получении данных",
+		})
+		return
+	}
+
+	var doctors []struct {
+		ID   int64
+		Name string
+	}
+	if rows, err := db.Query("SELECT id, name FROM doctors ORDER BY name"); err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var d struct {
+				ID   int64
+				Name string
+			}
+			if err := rows.Scan(&d.ID, &d.Name); err == nil {
+				doctors = append(doctors, d)
+			}
+		}
+	}
+
+	var categories []string
+	if rows, err := db.Query("SELECT DISTINCT category FROM services ORDER BY category"); err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var category string
+			if err := rows.Scan(&category); err == nil {
+				categories = append(categories, category)
+			}
+		}
+	}
+
+	c.HTML(status, "admin_limits.html", gin.H{
+		"rules":        rules,
+		"doctors":      doctors,
+		"categories":   categories,
+		"scopes":       limitScopeTitles,
+		"defaultLimit": defaultClinicDailyLimit,
+		"error":        errorText,
+	})
+}
+
+// AdminLimitsHandler выводит и добавляет ограничения на количество записей
+func AdminLimitsHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodGet {
+			renderAdminLimits(c, db, http.StatusOK, "")
+			return
+		}
+
+		// POST запрос - добавление ограничения
+		scope := c.PostForm("scope")
+		doctorID, _ := strconv.ParseInt(c.PostForm("doctor_id"), 10, 64)
+		category := c.PostForm("category")
+		maxCount, err := strconv.Atoi(c.PostForm("max_count"))
+
+		if _, ok := limitScopeTitles[scope]; !ok || err != nil || maxCount < 1 {
+			renderAdminLimits(c, db, http.StatusBadRequest, "Укажите область и максимальное количество записей")
+			return
+		}
+		if scope == limitScopeCategoryDay && category == "" {
+			renderAdminLimits(c, db, http.StatusBadRequest, "Для ограничения по категории укажите категорию")
+			return
+		}
+		if scope != limitScopeDoctorDay {
+			doctorID = 0
+		}
+		if scope != limitScopeCategoryDay {
+			category = ""
+		}
+
+		// Для одной области, врача и категории действует одно ограничение
+		tx, err := db.Begin()
+		if err != nil {
+			renderAdminLimits(c, db, http.StatusInternalServerError, "Ошибка при сохранении ограничения")
+			return
+		}
+		defer tx.Rollback()
+
+		_, err = tx.Exec(`
+			DELETE FROM booking_limits
+			WHERE scope = ? AND COALESCE(doctor_id, 0) = ? AND COALESCE(category, '') = ?
+		`, scope, doctorID, category)
+		if err == nil {
+			_, err = tx.Exec(`
+				INSERT INTO booking_limits (scope, doctor_id, category, max_count)
+				VALUES (?, ?, ?, ?)
+			`, scope, nullInt64(doctorID), category, maxCount)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			renderAdminLimits(c, db, http.StatusInternalServerError, "Ошибка при сохранении ограничения")
+			return
+		}
+
+		c.Redirect(http.StatusFound, "/admin/limits")
+	}
+}
+
+// AdminDeleteLimitHandler удаляет ограничение
+func AdminDeleteLimitHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		if id == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ID не указан"})
+			return
+		}
+
+		_, err := db.Exec("DELETE FROM booking_limits WHERE id = ?", id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при удалении ограничения"})
+			return
+		}
+
+		c.Redirect(http.StatusFound, "/admin/limits")
+	}
+}
@@ -0,0 +1,447 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Состояния зуба в зубной формуле
+const (
+	toothHealthy = "healthy" // здоров: сбрасывает прежнее состояние зуба или поверхности
+	toothCaries  = "caries"
+	toothFilling = "filling"
+	toothCrown   = "crown"
+	toothMissing = "missing"
+	toothImplant = "implant"
+)
+
+// toothConditionTitles названия состояний для админки
+var toothConditionTitles = map[string]string{
+	toothHealthy: "Здоров",
+	toothCaries:  "Кариес",
+	toothFilling: "Пломба",
+	toothCrown:   "Коронка",
+	toothMissing: "Отсутствует",
+	toothImplant: "Имплант",
+}
+
+// toothConditionOrder порядок состояний в формах
+var toothConditionOrder = []string{toothHealthy, toothCaries, toothFilling, toothCrown, toothMissing, toothImplant}
+
+// toothWholeOnly состояния, которые относятся ко всему зубу, а не к поверхности
+var toothWholeOnly = map[string]bool{
+	toothCrown:   true,
+	toothMissing: true,
+	toothImplant: true,
+}
+
+// toothSurfaceTitles поверхности зуба. Пустая строка - весь зуб.
+var toothSurfaceTitles = map[string]string{
+	"":  "Весь зуб",
+	"M": "Медиальная",
+	"D": "Дистальная",
+	"O": "Окклюзионная / режущий край",
+	"B": "Вестибулярная",
+	"L": "Оральная",
+}
+
+// toothSurfaceOrder порядок поверхностей в формах
+var toothSurfaceOrder = []string{"", "M", "D", "O", "B", "L"}
+
+// Ряды зубной формулы в том порядке, в котором их видит врач, лицом к пациенту
+var (
+	odontogramUpper        = []int{18, 17, 16, 15, 14, 13, 12, 11, 21, 22, 23, 24, 25, 26, 27, 28}
+	odontogramLower        = []int{48, 47, 46, 45, 44, 43, 42, 41, 31, 32, 33, 34, 35, 36, 37, 38}
+	odontogramPrimaryUpper = []int{55, 54, 53, 52, 51, 61, 62, 63, 64, 65}
+	odontogramPrimaryLower = []int{85, 84, 83, 82, 81, 71, 72, 73, 74, 75}
+)
+
+// toothChartEntry изменение зубной формулы. Формула хранится историей изменений,
+// текущее состояние собирается из нее.
+type toothChartEntry struct {
+	ID             int64  `json:"id"`
+	Tooth          int    `json:"tooth"`
+	Surface        string `json:"surface"`
+	Condition      string `json:"condition"`
+	ConditionTitle string `json:"condition_title"`
+	BookingID      int64  `json:"booking_id,omitempty"`
+	BookingDate    string `json:"booking_date,omitempty"`
+	Note           string `json:"note,omitempty"`
+	StaffName      string `json:"staff,omitempty"`
+	CreatedAt      string `json:"created_at"`
+}
+
+// toothState текущее состояние зуба
+type toothState struct {
+	Tooth          int               `json:"tooth"`
+	Condition      string            `json:"condition"` // состояние всего зуба
+	ConditionTitle string            `json:"condition_title"`
+	Surfaces       map[string]string `json:"surfaces,omitempty"` // состояния отдельных поверхностей
+}
+
+// Summary кратко описывает состояние зуба для ячейки формулы
+func (t toothState) Summary() string {
+	var parts []string
+	if t.Condition != toothHealthy {
+		parts = append(parts, t.ConditionTitle)
+	}
+	for _, s := range toothSurfaceOrder {
+		if cond, ok := t.Surfaces[s]; ok && s != "" {
+			parts = append(parts, s+": "+toothConditionTitles[cond])
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// odontogram зубная формула пациента: владельца аккаунта или члена семьи
+type odontogram struct {
+	UserID      int64             `json:"user_id"`
+	DependentID int64             `json:"dependent_id,omitempty"`
+	Teeth       []toothState      `json:"teeth"` // только зубы с отмеченным состоянием
+	History     []toothChartEntry `json:"history"`
+}
+
+// state возвращает состояние зуба, здоровый зуб если отметок нет
+func (o *odontogram) state(tooth int) toothState {
+	for _, t := range o.Teeth {
+		if t.Tooth == tooth {
+			return t
+		}
+	}
+	return toothState{Tooth: tooth, Condition: toothHealthy, ConditionTitle: toothConditionTitles[toothHealthy]}
+}
+
+// row возвращает состояния ряда зубов для вывода формулы
+func (o *odontogram) row(teeth []int) []toothState {
+	states := make([]toothState, len(teeth))
+	for i, n := range teeth {
+		states[i] = o.state(n)
+	}
+	return states
+}
+
+// loadOdontogram собирает зубную формулу из истории изменений
+func loadOdontogram(db *sql.DB, userID, dependentID int64) (*odontogram, error) {
+	rows, err := db.Query(`
+		SELECT t.id, t.tooth, t.surface, t.condition, COALESCE(t.booking_id, 0), COALESCE(b.date, ''),
+			   COALESCE(t.note, ''), COALESCE(s.username, ''), COALESCE(t.created_at, '')
+		FROM tooth_chart_entries t
+		LEFT JOIN bookings b ON t.booking_id = b.id
+		LEFT JOIN staff_users s ON t.staff_id = s.id
+		WHERE t.user_id = ? AND COALESCE(t.dependent_id, 0) = ?
+		ORDER BY t.id
+	`, userID, dependentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chart := &odontogram{UserID: userID, DependentID: dependentID, History: []toothChartEntry{}}
+	states := make(map[int]*toothState)
+	var order []int
+	for rows.Next() {
+		var e toothChartEntry
+		if err := rows.Scan(&e.ID, &e.Tooth, &e.Surface, &e.Condition, &e.BookingID, &e.BookingDate,
+			&e.Note, &e.StaffName, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.ConditionTitle = toothConditionTitles[e.Condition]
+		chart.History = append(chart.History, e)
+
+		st, ok := states[e.Tooth]
+		if !ok {
+			st = &toothState{Tooth: e.Tooth}
+			states[e.Tooth] = st
+			order = append(order, e.Tooth)
+		}
+		if e.Surface == "" {
+			// Отметка всего зуба заменяет прежние отметки поверхностей
+			st.Condition = e.Condition
+			st.Surfaces = nil
+			continue
+		}
+		if st.Surfaces == nil {
+			st.Surfaces = make(map[string]string)
+		}
+		if e.Condition == toothHealthy {
+			delete(st.Surfaces, e.Surface)
+		} else {
+			st.Surfaces[e.Surface] = e.Condition
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// История выводится от новых изменений к старым
+	for i, j := 0, len(chart.History)-1; i < j; i, j = i+1, j-1 {
+		chart.History[i], chart.History[j] = chart.History[j], chart.History[i]
+	}
+
+	chart.Teeth = []toothState{}
+	for _, n := range order {
+		st := states[n]
+		if st.Condition == "" {
+			st.Condition = toothHealthy
+		}
+		if st.Condition == toothHealthy && len(st.Surfaces) == 0 {
+			continue
+		}
+		st.ConditionTitle = toothConditionTitles[st.Condition]
+		chart.Teeth = append(chart.Teeth, *st)
+	}
+	return chart, nil
+}
+
+// toothChartRequest изменение зубной формулы из формы или JSON
+type toothChartRequest struct {
+	DependentID int64  `json:"dependent_id" form:"dependent_id"`
+	Tooth       int    `json:"tooth" form:"tooth"`
+	Surface     string `json:"surface" form:"surface"`
+	Condition   string `json:"condition" form:"condition"`
+	BookingID   int64  `json:"booking_id" form:"booking_id"`
+	Note        string `json:"note" form:"note"`
+}
+
+// toothChartError ошибка проверки изменения зубной формулы, текст показывается сотруднику
+type toothChartError struct {
+	reason string
+}
+
+func (e *toothChartError) Error() string {
+	return e.reason
+}
+
+// addToothChartEntry проверяет и сохраняет изменение зубной формулы пациента
+func addToothChartEntry(db *sql.DB, userID int64, staff staffSession, req toothChartRequest) (int64, error) {
+	req.Surface = strings.ToUpper(strings.TrimSpace(req.Surface))
+	if !toothNumberValid(req.Tooth) {
+		return 0, &toothChartError{fmt.Sprintf("неверный номер зуба %d: используйте нумерацию FDI (11-48, 51-85)", req.Tooth)}
+	}
+	if _, ok := toothConditionTitles[req.Condition]; !ok {
+		return 0, &toothChartError{"неизвестное состояние зуба"}
+	}
+	if _, ok := toothSurfaceTitles[req.Surface]; !ok {
+		return 0, &toothChartError{"неизвестная поверхность зуба"}
+	}
+	if req.Surface != "" && toothWholeOnly[req.Condition] {
+		return 0, &toothChartError{fmt.Sprintf("состояние «%s» отмечается для всего зуба", toothConditionTitles[req.Condition])}
+	}
+
+	if req.DependentID != 0 {
+		var n int
+		db.QueryRow("SELECT COUNT(*) FROM dependents WHERE id = ? AND user_id = ?", req.DependentID, userID).Scan(&n)
+		if n == 0 {
+			return 0, &toothChartError{"член семьи не найден у этого пациента"}
+		}
+	}
+	if req.BookingID != 0 {
+		// Изменение можно привязать только к приему этого же пациента
+		var n int
+		db.QueryRow(`
+			SELECT COUNT(*) FROM bookings WHERE id = ? AND user_id = ? AND COALESCE(dependent_id, 0) = ?
+		`, req.BookingID, userID, req.DependentID).Scan(&n)
+		if n == 0 {
+			return 0, &toothChartError{"прием не найден у этого пациента"}
+		}
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO tooth_chart_entries (user_id, dependent_id, tooth, surface, condition, booking_id, staff_id, note)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, userID, nullInt64(req.DependentID), req.Tooth, req.Surface, req.Condition,
+		nullInt64(req.BookingID), nullInt64(staff.ID), strings.TrimSpace(req.Note))
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// odontogramPatient проверяет, что пациент существует, и возвращает его имя
+func odontogramPatient(db *sql.DB, userID, dependentID int64) (string, error) {
+	var name string
+	err := db.QueryRow(`
+		SELECT COALESCE(NULLIF(TRIM(COALESCE(first_name, '') || ' ' || COALESCE(last_name, '')), ''), username, '')
+		FROM users WHERE id = ?
+	`, userID).Scan(&name)
+	if err != nil || dependentID == 0 {
+		return name, err
+	}
+	err = db.QueryRow("SELECT name FROM dependents WHERE id = ? AND user_id = ?", dependentID, userID).Scan(&name)
+	return name, err
+}
+
+// renderOdontogram выводит страницу зубной формулы
+func renderOdontogram(c *gin.Context, db *sql.DB, userID, dependentID int64, status int, errorText string) {
+	name, err := odontogramPatient(db, userID, dependentID)
+	if err == sql.ErrNoRows {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{
+			"error": "Пациент не найден",
+		})
+		return
+	}
+	chart, err := loadOdontogram(db, userID, dependentID)
+	if err != nil {
+		log.Printf("Error getting odontogram: %v", err)
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Ошибка при получении данных",
+		})
+		return
+	}
+
+	// Приемы пациента, к которым можно привязать изменение
+	bookings := loadAdminFilterOptions(db, `
+		SELECT b.id, b.date || ' ' || b.time || ' — ' || COALESCE(s.name, '')
+		FROM bookings b
+		LEFT JOIN services s ON b.service_id = s.id
+		WHERE b.user_id = ? AND COALESCE(b.dependent_id, 0) = ? AND b.status NOT IN ('Отменено', 'Отменена')
+		ORDER BY b.date DESC, b.time DESC
+	`, userID, dependentID)
+	dependents, err := getDependents(db, userID)
+	if err != nil {
+		log.Printf("Error getting dependents: %v", err)
+	}
+
+	// Зубы, требующие лечения, для плана услуг
+	var plan []toothState
+	for _, t := range chart.Teeth {
+		if t.Condition == toothCaries || t.Condition == toothMissing {
+			plan = append(plan, t)
+			continue
+		}
+		for _, cond := range t.Surfaces {
+			if cond == toothCaries {
+				plan = append(plan, t)
+				break
+			}
+		}
+	}
+
+	c.HTML(status, "admin_odontogram.html", gin.H{
+		"userID":       userID,
+		"dependentID":  dependentID,
+		"name":         name,
+		"dependents":   dependents,
+		"upper":        chart.row(odontogramUpper),
+		"lower":        chart.row(odontogramLower),
+		"primaryUpper": chart.row(odontogramPrimaryUpper),
+		"primaryLower": chart.row(odontogramPrimaryLower),
+		"plan":         plan,
+		"history":      chart.History,
+		"conditions":   toothConditionOrder,
+		"titles":       toothConditionTitles,
+		"surfaces":     toothSurfaceOrder,
+		"surfaceNames": toothSurfaceTitles,
+		"bookings":     bookings,
+		"bookingID":    c.Query("booking_id"),
+		"canEdit":      currentStaff(c).Role == staffRoleDoctor,
+		"error":        errorText,
+	})
+}
+
+// odontogramDependentID читает члена семьи из запроса: 0 - владелец аккаунта
+func odontogramDependentID(c *gin.Context) int64 {
+	id, _ := strconv.ParseInt(c.Query("dependent_id"), 10, 64)
+	return id
+}
+
+// AdminOdontogramHandler выводит зубную формулу пациента
+func AdminOdontogramHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := patientIDParam(c)
+		if !ok {
+			return
+		}
+		renderOdontogram(c, db, id, odontogramDependentID(c), http.StatusOK, "")
+	}
+}
+
+// AdminAddToothConditionHandler отмечает состояние зуба из формы на странице формулы
+func AdminAddToothConditionHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := patientIDParam(c)
+		if !ok {
+			return
+		}
+		var req toothChartRequest
+		if err := c.ShouldBind(&req); err != nil {
+			renderOdontogram(c, db, id, req.DependentID, http.StatusBadRequest, "Неверный формат данных")
+			return
+		}
+		if _, err := addToothChartEntry(db, id, currentStaff(c), req); err != nil {
+			if _, ok := err.(*toothChartError); ok {
+				renderOdontogram(c, db, id, req.DependentID, http.StatusBadRequest, err.Error())
+				return
+			}
+			log.Printf("Error saving tooth chart entry: %v", err)
+			renderOdontogram(c, db, id, req.DependentID, http.StatusInternalServerError, "Ошибка при сохранении зубной формулы")
+			return
+		}
+
+		target := fmt.Sprintf("/admin/patients/%d/chart", id)
+		if req.DependentID != 0 {
+			target += fmt.Sprintf("?dependent_id=%d", req.DependentID)
+		}
+		c.Redirect(http.StatusFound, target)
+	}
+}
+
+// AdminOdontogramJSONHandler отдает текущую зубную формулу и историю изменений в JSON
+func AdminOdontogramJSONHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID пациента"})
+			return
+		}
+		dependentID := odontogramDependentID(c)
+		if _, err := odontogramPatient(db, id, dependentID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Пациент не найден"})
+			return
+		}
+		chart, err := loadOdontogram(db, id, dependentID)
+		if err != nil {
+			log.Printf("Error getting odontogram: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при получении данных"})
+			return
+		}
+		c.JSON(http.StatusOK, chart)
+	}
+}
+
+// AdminAddToothConditionJSONHandler отмечает состояние зуба через JSON API
+func AdminAddToothConditionJSONHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID пациента"})
+			return
+		}
+		var req toothChartRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный формат данных"})
+			return
+		}
+		if _, err := odontogramPatient(db, id, 0); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Пациент не найден"})
+			return
+		}
+		entryID, err := addToothChartEntry(db, id, currentStaff(c), req)
+		if err != nil {
+			if _, ok := err.(*toothChartError); ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("Error saving tooth chart entry: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при сохранении зубной формулы"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"id": entryID})
+	}
+}
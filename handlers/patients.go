@@ -0,0 +1,464 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// bookingStatusNoShow статус записи, на которую пациент не пришел
+const bookingStatusNoShow = "Не явился"
+
+// adminPatientsPerPage количество пациентов на странице
+const adminPatientsPerPage = 50
+
+// errMergeTelegramConflict возвращается при объединении двух разных Telegram-аккаунтов
+var errMergeTelegramConflict = errors.New("оба пациента привязаны к разным аккаунтам Telegram")
+
+// patientRow пациент в списке админки
+type patientRow struct {
+	ID            int64
+	Name          string
+	Username      string
+	Phone         string
+	TelegramID    int64
+	PhoneVerified bool
+	IsBlocked     bool
+	Bookings      int
+	NoShows       int
+	LastVisit     string
+	CreatedAt     string
+}
+
+// patientFilters фильтры списка пациентов
+var patientFilters = map[string]string{
+	"blocked":     "COALESCE(u.is_blocked, 0) = 1",
+	"no_telegram": "u.telegram_id IS NULL",
+	"unverified":  "u.telegram_id IS NOT NULL AND COALESCE(u.phone_verified, 0) = 0",
+	"no_shows": `EXISTS (SELECT 1 FROM bookings nb WHERE nb.user_id = u.id AND nb.status = '` +
+		bookingStatusNoShow + `')`,
+}
+
+const patientSelect = `
+	SELECT u.id, TRIM(COALESCE(u.first_name, '') || ' ' || COALESCE(u.last_name, '')),
+		   COALESCE(u.username, ''), COALESCE(u.phone, ''), COALESCE(u.telegram_id, 0),
+		   COALESCE(u.phone_verified, 0), COALESCE(u.is_blocked, 0),
+		   (SELECT COUNT(*) FROM bookings b WHERE b.user_id = u.id),
+		   (SELECT COUNT(*) FROM bookings b WHERE b.user_id = u.id AND b.status = '` + bookingStatusNoShow + `'),
+		   COALESCE((SELECT MAX(b.date) FROM bookings b
+					 WHERE b.user_id = u.id AND b.date <= date('now') AND b.status NOT IN ('Отменено', 'Отменена')), ''),
+		   COALESCE(u.created_at, '')
+	FROM users u
+`
+
+func scanPatientRow(scanner interface{ Scan(...interface{}) error }) (patientRow, error) {
+	var p patientRow
+	err := scanner.Scan(&p.ID, &p.Name, &p.Username, &p.Phone, &p.TelegramID, &p.PhoneVerified, &p.IsBlocked,
+		&p.Bookings, &p.NoShows, &p.LastVisit, &p.CreatedAt)
+	return p, err
+}
+
+// patientsWhere строит условие поиска пациентов
+func patientsWhere(search, filter string) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if search != "" {
+		like := "%" + search + "%"
+		phoneLike := like
+		if phone := normalizePhone(search); phone != "" {
+			phoneLike = "%" + phone + "%"
+		}
+		conditions = append(conditions, `(u.first_name LIKE ? OR u.last_name LIKE ?
+			OR (COALESCE(u.first_name, '') || ' ' || COALESCE(u.last_name, '')) LIKE ?
+			OR u.username LIKE ? OR u.phone LIKE ? OR u.phone LIKE ? OR CAST(u.telegram_id AS TEXT) = ?)`)
+		args = append(args, like, like, like, like, like, phoneLike, search)
+	}
+	if cond, ok := patientFilters[filter]; ok {
+		conditions = append(conditions, cond)
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// isPatientBlocked проверяет, запрещена ли пациенту запись через бота
+func isPatientBlocked(q dbExecutor, userID int64) bool {
+	var blocked bool
+	if err := q.QueryRow("SELECT COALESCE(is_blocked, 0) FROM users WHERE id = ?", userID).Scan(&blocked); err != nil {
+		return false
+	}
+	return blocked
+}
+
+// botBookingBlocked сообщает заблокированному пользователю, что запись через бота недоступна
+func botBookingBlocked(bot *tgbotapi.BotAPI, chatID int64, db *sql.DB) bool {
+	var blocked bool
+	if err := db.QueryRow("SELECT COALESCE(is_blocked, 0) FROM users WHERE telegram_id = ?", chatID).Scan(&blocked); err != nil || !blocked {
+		return false
+	}
+	msg := tgbotapi.NewMessage(chatID, "Запись через бота для вас недоступна. Пожалуйста, свяжитесь с администратором клиники.")
+	bot.Send(msg)
+	return true
+}
+
+// patientBooking запись в истории пациента
+type patientBooking struct {
+	ID          int64
+	Date        string
+	Time        string
+	ServiceName string
+	DoctorName  string
+	PatientName string
+	Status      string
+	CanNoShow   bool
+}
+
+func loadPatientBookings(db *sql.DB, userID int64) ([]patientBooking, error) {
+	rows, err := db.Query(`
+		SELECT b.id, b.date, b.time, COALESCE(s.name, ''), COALESCE(d.name, ''), COALESCE(dp.name, ''), b.status
+		FROM bookings b
+		LEFT JOIN services s ON b.service_id = s.id
+		LEFT JOIN doctors d ON b.doctor_id = d.id
+		LEFT JOIN dependents dp ON b.dependent_id = dp.id
+		WHERE b.user_id = ?
+		ORDER BY b.date DESC, b.time DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	today := time.Now().Format("2006-01-02")
+	var bookings []patientBooking
+	for rows.Next() {
+		var b patientBooking
+		if err := rows.Scan(&b.ID, &b.Date, &b.Time, &b.ServiceName, &b.DoctorName, &b.PatientName, &b.Status); err != nil {
+			continue
+		}
+		b.CanNoShow = b.Date <= today && b.Status != bookingStatusNoShow && b.Status != bookingStatusCompleted &&
+			b.Status != "Отменено" && b.Status != "Отменена"
+		bookings = append(bookings, b)
+	}
+	return bookings, rows.Err()
+}
+
+// findPatientDuplicates ищет возможные дубликаты пациента: тот же телефон или те же имя и фамилия
+func findPatientDuplicates(db *sql.DB, p patientRow) ([]patientRow, error) {
+	var firstName, lastName string
+	db.QueryRow("SELECT COALESCE(first_name, ''), COALESCE(last_name, '') FROM users WHERE id = ?", p.ID).Scan(&firstName, &lastName)
+
+	phone := normalizePhone(p.Phone)
+	if phone == "" && (firstName == "" || lastName == "") {
+		return nil, nil
+	}
+	rows, err := db.Query(patientSelect+`
+		WHERE u.id != ?
+		  AND ((? != '' AND u.phone = ?)
+		    OR (? != '' AND ? != '' AND u.first_name = ? AND u.last_name = ?))
+		ORDER BY u.id
+	`, p.ID, phone, phone, firstName, lastName, firstName, lastName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []patientRow
+	for rows.Next() {
+		if d, err := scanPatientRow(rows); err == nil {
+			list = append(list, d)
+		}
+	}
+	return list, rows.Err()
+}
+
+// AdminPatientsHandler выводит справочник пациентов с поиском и фильтрами
+func AdminPatientsHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		search := strings.TrimSpace(c.Query("q"))
+		filter := c.Query("filter")
+		page, _ := strconv.Atoi(c.Query("page"))
+		if page < 1 {
+			page = 1
+		}
+
+		where, args := patientsWhere(search, filter)
+		var total int
+		if err := db.QueryRow("SELECT COUNT(*) FROM users u"+where, args...).Scan(&total); err != nil {
+			log.Printf("Error counting patients: %v", err)
+			c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Ошибка при получении данных",
+			})
+			return
+		}
+		pages := (total + adminPatientsPerPage - 1) / adminPatientsPerPage
+		if pages < 1 {
+			pages = 1
+		}
+
+		rows, err := db.Query(patientSelect+where+`
+			ORDER BY COALESCE(u.created_at, '') DESC, u.id DESC
+			LIMIT ? OFFSET ?
+		`, append(args, adminPatientsPerPage, (page-1)*adminPatientsPerPage)...)
+		if err != nil {
+			log.Printf("Error getting patients: %v", err)
+			c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Ошибка при получении данных",
+			})
+			return
+		}
+		defer rows.Close()
+
+		var patients []patientRow
+		for rows.Next() {
+			if p, err := scanPatientRow(rows); err == nil {
+				patients = append(patients, p)
+			}
+		}
+
+		pageURL := func(n int) template.URL {
+			v := url.Values{}
+			if search != "" {
+				v.Set("q", search)
+			}
+			if filter != "" {
+				v.Set("filter", filter)
+			}
+			v.Set("page", strconv.Itoa(n))
+			return template.URL("/admin/patients?" + v.Encode())
+		}
+		data := gin.H{
+			"patients": patients,
+			"search":   search,
+			"filter":   filter,
+			"page":     page,
+			"pages":    pages,
+			"total":    total,
+		}
+		if page > 1 {
+			data["prevURL"] = pageURL(page - 1)
+		}
+		if page < pages {
+			data["nextURL"] = pageURL(page + 1)
+		}
+
+		c.HTML(http.StatusOK, "admin_patients.html", data)
+	}
+}
+
+// renderAdminPatient выводит карточку пациента
+func renderAdminPatient(c *gin.Context, db *sql.DB, id int64, status int, errorText string) {
+	patient, err := scanPatientRow(db.QueryRow(patientSelect+" WHERE u.id = ?", id))
+	if err == sql.ErrNoRows {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{
+			"error": "Пациент не найден",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting patient: %v", err)
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Ошибка при получении данных",
+		})
+		return
+	}
+
+	var notes, blockedReason, state, birthDate string
+	db.QueryRow(`
+		SELECT COALESCE(notes, ''), COALESCE(blocked_reason, ''), COALESCE(state, ''), COALESCE(birth_date, '')
+		FROM users WHERE id = ?
+	`, id).Scan(&notes, &blockedReason, &state, &birthDate)
+
+	bookings, err := loadPatientBookings(db, id)
+	if err != nil {
+		log.Printf("Error getting patient bookings: %v", err)
+	}
+	dependents, err := getDependents(db, id)
+	if err != nil {
+		log.Printf("Error getting dependents: %v", err)
+	}
+	var files int
+	db.QueryRow("SELECT COUNT(*) FROM patient_files WHERE user_id = ?", id).Scan(&files)
+	duplicates, err := findPatientDuplicates(db, patient)
+	if err != nil {
+		log.Printf("Error finding duplicates: %v", err)
+	}
+	invoices, err := loadInvoices(db, "b.user_id = ?", id)
+	if err != nil {
+		log.Printf("Error getting patient invoices: %v", err)
+	}
+	var balance float64
+	for _, inv := range invoices {
+		balance += inv.Balance()
+	}
+
+	c.HTML(status, "admin_patient.html", gin.H{
+		"patient":       patient,
+		"notes":         notes,
+		"birthDate":     birthDate,
+		"blockedReason": blockedReason,
+		"waitingCode":   state == "waiting_for_code",
+		"bookings":      bookings,
+		"dependents":    dependents,
+		"duplicates":    duplicates,
+		"files":         files,
+		"invoices":      invoices,
+		"balance":       roundMoney(balance),
+		"clinical":      currentStaff(c).canViewClinical(),
+		"error":         errorText,
+	})
+}
+
+func patientIDParam(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{
+			"error": "Неверный ID пациента",
+		})
+		return 0, false
+	}
+	return id, true
+}
+
+// AdminPatientHandler выводит карточку пациента с историей записей
+func AdminPatientHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := patientIDParam(c)
+		if !ok {
+			return
+		}
+		renderAdminPatient(c, db, id, http.StatusOK, "")
+	}
+}
+
+// AdminPatientNotesHandler сохраняет заметки администратора о пациенте и дату рождения
+func AdminPatientNotesHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := patientIDParam(c)
+		if !ok {
+			return
+		}
+		notes := strings.TrimSpace(c.PostForm("notes"))
+		birthDate := c.PostForm("birth_date")
+		if _, err := time.Parse("2006-01-02", birthDate); birthDate != "" && err != nil {
+			renderAdminPatient(c, db, id, http.StatusBadRequest, "Неверный формат даты рождения")
+			return
+		}
+		if _, err := db.Exec("UPDATE users SET notes = ?, birth_date = NULLIF(?, '') WHERE id = ?", notes, birthDate, id); err != nil {
+			log.Printf("Error saving patient notes: %v", err)
+			renderAdminPatient(c, db, id, http.StatusInternalServerError, "Ошибка при сохранении заметок")
+			return
+		}
+		c.Redirect(http.StatusFound, fmt.Sprintf("/admin/patients/%d", id))
+	}
+}
+
+// AdminPatientBlockHandler запрещает или разрешает пациенту запись через бота
+func AdminPatientBlockHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := patientIDParam(c)
+		if !ok {
+			return
+		}
+
+		var err error
+		if c.PostForm("action") == "unblock" {
+			_, err = db.Exec("UPDATE users SET is_blocked = 0, blocked_reason = NULL WHERE id = ?", id)
+		} else {
+			reason := strings.TrimSpace(c.PostForm("reason"))
+			_, err = db.Exec("UPDATE users SET is_blocked = 1, blocked_reason = ? WHERE id = ?", reason, id)
+		}
+		if err != nil {
+			log.Printf("Error blocking patient: %v", err)
+			renderAdminPatient(c, db, id, http.StatusInternalServerError, "Ошибка при сохранении")
+			return
+		}
+		c.Redirect(http.StatusFound, fmt.Sprintf("/admin/patients/%d", id))
+	}
+}
+
+// mergePatientRecords объединяет двух пациентов в одной транзакции
+func mergePatientRecords(db *sql.DB, fromID, toID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := mergePatients(tx, fromID, toID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AdminPatientMergeHandler объединяет дубликат с карточкой пациента
+func AdminPatientMergeHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := patientIDParam(c)
+		if !ok {
+			return
+		}
+		sourceID, err := strconv.ParseInt(c.PostForm("source_id"), 10, 64)
+		if err != nil || sourceID <= 0 || sourceID == id {
+			renderAdminPatient(c, db, id, http.StatusBadRequest, "Укажите ID другого пациента")
+			return
+		}
+		var exists int
+		db.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", sourceID).Scan(&exists)
+		if exists == 0 {
+			renderAdminPatient(c, db, id, http.StatusNotFound, "Пациент для объединения не найден")
+			return
+		}
+
+		err = mergePatientRecords(db, sourceID, id)
+		if err == errMergeTelegramConflict {
+			renderAdminPatient(c, db, id, http.StatusConflict, "Нельзя объединить: "+err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("Error merging patients: %v", err)
+			renderAdminPatient(c, db, id, http.StatusInternalServerError, "Ошибка при объединении")
+			return
+		}
+		c.Redirect(http.StatusFound, fmt.Sprintf("/admin/patients/%d", id))
+	}
+}
+
+// AdminNoShowBookingHandler отмечает, что пациент не пришел на прием
+func AdminNoShowBookingHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		result, err := db.Exec(`
+			UPDATE bookings SET status = ?
+			WHERE id = ? AND date <= ? AND status NOT IN ('Отменено', 'Отменена', ?)
+		`, bookingStatusNoShow, id, time.Now().Format("2006-01-02"), bookingStatusCompleted)
+		if err != nil {
+			c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Ошибка при обновлении записи",
+			})
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			c.HTML(http.StatusBadRequest, "error.html", gin.H{
+				"error": "Неявку можно отметить только для прошедшей неотмененной записи",
+			})
+			return
+		}
+
+		redirect := "/admin/bookings"
+		if back := c.PostForm("back"); strings.HasPrefix(back, "/admin/") {
+			redirect = back
+		}
+		c.Redirect(http.StatusFound, redirect)
+	}
+}
@@ -0,0 +1,662 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Статусы платежей
+const (
+	paymentStatusPending  = "pending"
+	paymentStatusPaid     = "paid"
+	paymentStatusCanceled = "canceled"
+	paymentStatusExpired  = "expired"
+)
+
+// paymentCurrency валюта депозитов
+const paymentCurrency = "RUB"
+
+// paymentStatusTitles названия статусов платежей для админки
+var paymentStatusTitles = map[string]string{
+	paymentStatusPending:  "Ожидает оплаты",
+	paymentStatusPaid:     "Оплачен",
+	paymentStatusCanceled: "Отменен",
+	paymentStatusExpired:  "Истек срок оплаты",
+}
+
+// paymentMethodTitles названия способов оплаты: провайдеры онлайн-оплаты и оплата на месте
+var paymentMethodTitles = map[string]string{
+	"telegram": "Telegram Payments",
+	"yookassa": "ЮKassa",
+	"fake":     "Тестовая оплата",
+	"cash":     "Наличные",
+	"card":     "Карта",
+	"online":   "Онлайн-перевод",
+}
+
+// PaymentRequest описывает платеж, который нужно зарегистрировать у провайдера
+type PaymentRequest struct {
+	PaymentID   int64
+	Amount      float64
+	Currency    string
+	Description string
+}
+
+// ProviderPayment состояние платежа у провайдера
+type ProviderPayment struct {
+	ID              string // идентификатор платежа у провайдера
+	Status          string // pending, paid или canceled
+	ConfirmationURL string // ссылка на страницу оплаты, если провайдер ее выдает
+}
+
+// PaymentProvider платежная система, через которую пациенты вносят депозит
+type PaymentProvider interface {
+	// Name возвращает код провайдера, который сохраняется в платеже
+	Name() string
+	// CreatePayment регистрирует платеж у провайдера
+	CreatePayment(req PaymentRequest) (ProviderPayment, error)
+	// ParseWebhook разбирает уведомление провайдера о смене статуса платежа
+	ParseWebhook(r *http.Request) (ProviderPayment, error)
+}
+
+// paymentProvider провайдер для оплаты по ссылке; nil - оплата по ссылке не настроена
+var paymentProvider PaymentProvider
+
+// telegramPaymentToken токен платежного провайдера из BotFather; если задан, депозит
+// оплачивается счетом Telegram Payments прямо в чате
+var telegramPaymentToken string
+
+// depositTimeout время на оплату депозита, после которого запись отменяется
+var depositTimeout = time.Hour
+
+// SetPaymentProvider задает провайдера для оплаты депозитов по ссылке
+func SetPaymentProvider(p PaymentProvider) {
+	paymentProvider = p
+}
+
+// SetTelegramPaymentToken включает оплату депозитов счетами Telegram Payments
+func SetTelegramPaymentToken(token string) {
+	telegramPaymentToken = token
+}
+
+// depositsEnabled сообщает, настроен ли хотя бы один способ онлайн-оплаты. Без него депозит
+// не запрашивается: запись, которую нельзя оплатить, была бы отменена по таймауту
+func depositsEnabled() bool {
+	return telegramPaymentToken != "" || paymentProvider != nil
+}
+
+// SetDepositTimeout задает время на оплату депозита
+func SetDepositTimeout(d time.Duration) {
+	if d > 0 {
+		depositTimeout = d
+	}
+}
+
+// FakePaymentProvider локальный провайдер для разработки и тестов: платежи не списывают деньги,
+// статус меняется уведомлением {"id": "...", "status": "paid"} на адрес вебхука без подписи.
+// Включается только явно через PAYMENT_PROVIDER=fake
+type FakePaymentProvider struct{}
+
+func (p *FakePaymentProvider) Name() string {
+	return "fake"
+}
+
+func (p *FakePaymentProvider) CreatePayment(req PaymentRequest) (ProviderPayment, error) {
+	return ProviderPayment{
+		ID:     fmt.Sprintf("fake-%d", req.PaymentID),
+		Status: paymentStatusPending,
+	}, nil
+}
+
+func (p *FakePaymentProvider) ParseWebhook(r *http.Request) (ProviderPayment, error) {
+	var payload struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		return ProviderPayment{}, err
+	}
+	if payload.ID == "" {
+		return ProviderPayment{}, fmt.Errorf("fake payment: id is empty")
+	}
+	switch payload.Status {
+	case paymentStatusPending, paymentStatusPaid, paymentStatusCanceled:
+	default:
+		return ProviderPayment{}, fmt.Errorf("fake payment: unknown status %q", payload.Status)
+	}
+	return ProviderPayment{ID: payload.ID, Status: payload.Status}, nil
+}
+
+// YooKassaProvider оплата по ссылке через API ЮKassa
+type YooKassaProvider struct {
+	ShopID    string
+	SecretKey string
+	ReturnURL string // куда вернуть пациента после оплаты
+	APIURL    string // по умолчанию https://api.yookassa.ru/v3
+	Client    *http.Client
+}
+
+// yooKassaPayment ответ API ЮKassa с платежом
+type yooKassaPayment struct {
+	ID           string `json:"id"`
+	Status       string `json:"status"`
+	Confirmation struct {
+		ConfirmationURL string `json:"confirmation_url"`
+	} `json:"confirmation"`
+}
+
+func (p *YooKassaProvider) Name() string {
+	return "yookassa"
+}
+
+func (p *YooKassaProvider) CreatePayment(req PaymentRequest) (ProviderPayment, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"amount": map[string]string{
+			"value":    fmt.Sprintf("%.2f", req.Amount),
+			"currency": req.Currency,
+		},
+		"capture": true,
+		"confirmation": map[string]string{
+			"type":       "redirect",
+			"return_url": p.ReturnURL,
+		},
+		"description": req.Description,
+		"metadata": map[string]string{
+			"payment_id": strconv.FormatInt(req.PaymentID, 10),
+		},
+	})
+	if err != nil {
+		return ProviderPayment{}, err
+	}
+
+	var created yooKassaPayment
+	// Ключ идемпотентности не дает создать второй платеж при повторе запроса
+	if err := p.do(http.MethodPost, "/payments", body, fmt.Sprintf("payment-%d", req.PaymentID), &created); err != nil {
+		return ProviderPayment{}, err
+	}
+	return p.providerPayment(created), nil
+}
+
+// ParseWebhook берет из уведомления только ID платежа, а статус перечитывает через API:
+// уведомления ЮKassa не подписаны, и доверять их содержимому нельзя
+func (p *YooKassaProvider) ParseWebhook(r *http.Request) (ProviderPayment, error) {
+	var notification struct {
+		Event  string `json:"event"`
+		Object struct {
+			ID string `json:"id"`
+		} `json:"object"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+		return ProviderPayment{}, err
+	}
+	if notification.Object.ID == "" {
+		return ProviderPayment{}, fmt.Errorf("yookassa: payment id is empty")
+	}
+
+	var current yooKassaPayment
+	if err := p.do(http.MethodGet, "/payments/"+notification.Object.ID, nil, "", &current); err != nil {
+		return ProviderPayment{}, err
+	}
+	return p.providerPayment(current), nil
+}
+
+func (p *YooKassaProvider) providerPayment(yp yooKassaPayment) ProviderPayment {
+	status := paymentStatusPending
+	switch yp.Status {
+	case "succeeded":
+		status = paymentStatusPaid
+	case "canceled":
+		status = paymentStatusCanceled
+	}
+	return ProviderPayment{
+		ID:              yp.ID,
+		Status:          status,
+		ConfirmationURL: yp.Confirmation.ConfirmationURL,
+	}
+}
+
+// do выполняет запрос к API ЮKassa и разбирает ответ в out
+func (p *YooKassaProvider) do(method, path string, body []byte, idempotenceKey string, out interface{}) error {
+	apiURL := p.APIURL
+	if apiURL == "" {
+		apiURL = "https://api.yookassa.ru/v3"
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(apiURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(p.ShopID, p.SecretKey)
+	req.Header.Set("Content-Type", "application/json")
+	if idempotenceKey != "" {
+		req.Header.Set("Idempotence-Key", idempotenceKey)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("yookassa: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// payment платеж по записи
+type payment struct {
+	ID              int64
+	BookingID       int64
+	UserID          int64
+	Amount          float64
+	Status          string
+	Provider        string
+	ExternalID      string
+	ConfirmationURL string
+	ExpiresAt       string
+	PaidAt          string
+	CreatedAt       string
+}
+
+func (p payment) StatusTitle() string {
+	if title, ok := paymentStatusTitles[p.Status]; ok {
+		return title
+	}
+	return p.Status
+}
+
+func (p payment) MethodTitle() string {
+	if title, ok := paymentMethodTitles[p.Provider]; ok {
+		return title
+	}
+	return p.Provider
+}
+
+// amountMinorUnits переводит сумму в копейки, как того требует Telegram Payments
+func amountMinorUnits(amount float64) int {
+	return int(math.Round(amount * 100))
+}
+
+// loadPayments возвращает платежи по условию на таблицу payments
+func loadPayments(db *sql.DB, where string, args ...interface{}) ([]payment, error) {
+	rows, err := db.Query(`
+		SELECT id, booking_id, user_id, amount, status, provider, COALESCE(external_id, ''),
+			   COALESCE(confirmation_url, ''), COALESCE(expires_at, ''), COALESCE(paid_at, ''), COALESCE(created_at, '')
+		FROM payments
+		WHERE `+where+`
+		ORDER BY id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []payment
+	for rows.Next() {
+		var p payment
+		if err := rows.Scan(&p.ID, &p.BookingID, &p.UserID, &p.Amount, &p.Status, &p.Provider, &p.ExternalID,
+			&p.ConfirmationURL, &p.ExpiresAt, &p.PaidAt, &p.CreatedAt); err == nil {
+			payments = append(payments, p)
+		}
+	}
+	return payments, rows.Err()
+}
+
+// paymentByID возвращает платеж по ID
+func paymentByID(db *sql.DB, id int64) (payment, error) {
+	payments, err := loadPayments(db, "id = ?", id)
+	if err != nil {
+		return payment{}, err
+	}
+	if len(payments) == 0 {
+		return payment{}, sql.ErrNoRows
+	}
+	return payments[0], nil
+}
+
+// bookingDeposit депозит по записи: не больше цены приема с учетом скидки
+func bookingDeposit(db *sql.DB, bookingID int64) float64 {
+	var deposit float64
+	err := db.QueryRow(`
+		SELECT MIN(s.deposit, COALESCE(b.final_price, s.price))
+		FROM bookings b
+		JOIN services s ON s.id = b.service_id
+		WHERE b.id = ?
+	`, bookingID).Scan(&deposit)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error getting booking deposit: %v", err)
+	}
+	return deposit
+}
+
+// requestDeposit создает платеж по депозиту за запись и отправляет пациенту счет или ссылку на оплату
+func requestDeposit(bot *tgbotapi.BotAPI, db *sql.DB, chatID, userID, bookingID int64) error {
+	var serviceName, date, bookingTime string
+	var deposit float64
+	err := db.QueryRow(`
+		SELECT s.name, MIN(s.deposit, COALESCE(b.final_price, s.price)), b.date, b.time
+		FROM bookings b
+		JOIN services s ON s.id = b.service_id
+		WHERE b.id = ?
+	`, bookingID).Scan(&serviceName, &deposit, &date, &bookingTime)
+	if err != nil {
+		return err
+	}
+	if deposit <= 0 || !depositsEnabled() {
+		return nil
+	}
+
+	provider := "telegram"
+	if telegramPaymentToken == "" {
+		provider = paymentProvider.Name()
+	}
+
+	minutes := int(depositTimeout / time.Minute)
+	result, err := db.Exec(`
+		INSERT INTO payments (booking_id, user_id, amount, currency, status, provider, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, datetime('now', ?))
+	`, bookingID, userID, deposit, paymentCurrency, paymentStatusPending, provider, fmt.Sprintf("+%d minutes", minutes))
+	if err != nil {
+		return err
+	}
+	paymentID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	description := fmt.Sprintf("Депозит за запись: %s, %s в %s. Сумма будет учтена при оплате приема.", serviceName, date, bookingTime)
+	deadline := fmt.Sprintf("Оплатите депозит %.2f ₽ в течение %d мин., иначе запись будет отменена.", deposit, minutes)
+
+	if telegramPaymentToken != "" {
+		invoice := tgbotapi.NewInvoice(chatID, "Депозит за запись", description, fmt.Sprintf("payment_%d", paymentID),
+			telegramPaymentToken, "", paymentCurrency, []tgbotapi.LabeledPrice{
+				{Label: serviceName, Amount: amountMinorUnits(deposit)},
+			})
+		if _, err := bot.Send(tgbotapi.NewMessage(chatID, deadline)); err != nil {
+			log.Printf("Error sending deposit notice: %v", err)
+		}
+		_, err = bot.Send(invoice)
+		return err
+	}
+
+	pp, err := paymentProvider.CreatePayment(PaymentRequest{
+		PaymentID:   paymentID,
+		Amount:      deposit,
+		Currency:    paymentCurrency,
+		Description: description,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(`
+		UPDATE payments SET external_id = ?, confirmation_url = ? WHERE id = ?
+	`, pp.ID, pp.ConfirmationURL, paymentID); err != nil {
+		return err
+	}
+
+	msg := tgbotapi.NewMessage(chatID, description+"\n\n"+deadline)
+	if pp.ConfirmationURL != "" {
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonURL("Оплатить депозит", pp.ConfirmationURL),
+		))
+	}
+	_, err = bot.Send(msg)
+	return err
+}
+
+// notifyPaymentUser отправляет сообщение пациенту, оплачивающему запись
+func notifyPaymentUser(bot *tgbotapi.BotAPI, db *sql.DB, userID int64, text string) {
+	var telegramID int64
+	db.QueryRow("SELECT COALESCE(telegram_id, 0) FROM users WHERE id = ?", userID).Scan(&telegramID)
+	if telegramID == 0 {
+		return
+	}
+	if _, err := bot.Send(tgbotapi.NewMessage(telegramID, text)); err != nil {
+		log.Printf("Error sending payment notification: %v", err)
+	}
+}
+
+// markPaymentPaid отмечает платеж оплаченным и подтверждает запись. Оплата могла прийти
+// уже после отмены записи по истечении срока - тогда пациенту предлагается вернуть деньги.
+func markPaymentPaid(bot *tgbotapi.BotAPI, db *sql.DB, paymentID int64, externalID string) error {
+	result, err := db.Exec(`
+		UPDATE payments
+		SET status = ?, paid_at = datetime('now'), external_id = COALESCE(NULLIF(?, ''), external_id)
+		WHERE id = ? AND status != ?
+	`, paymentStatusPaid, externalID, paymentID, paymentStatusPaid)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil // уведомление о платеже пришло повторно
+	}
+
+	p, err := paymentByID(db, paymentID)
+	if err != nil {
+		return err
+	}
+
+	result, err = db.Exec(`
+		UPDATE bookings SET status = 'Подтверждено'
+		WHERE id = ? AND status NOT IN ('Отменено', 'Отменена')
+	`, p.BookingID)
+	if err != nil {
+		return err
+	}
+
+	if bot != nil {
+		if n, _ := result.RowsAffected(); n > 0 {
+			notifyPaymentUser(bot, db, p.UserID, fmt.Sprintf("Депозит %.2f ₽ получен, запись подтверждена. Ждем вас!", p.Amount))
+		} else {
+			notifyPaymentUser(bot, db, p.UserID, fmt.Sprintf("Депозит %.2f ₽ получен, но запись уже отменена. Свяжитесь с клиникой для возврата средств.", p.Amount))
+		}
+	}
+	return nil
+}
+
+// cancelUnpaidBooking закрывает неоплаченный платеж и отменяет запись, освобождая время для листа ожидания
+func cancelUnpaidBooking(bot *tgbotapi.BotAPI, db *sql.DB, paymentID int64, status string) error {
+	result, err := db.Exec("UPDATE payments SET status = ? WHERE id = ? AND status = ?", status, paymentID, paymentStatusPending)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	p, err := paymentByID(db, paymentID)
+	if err != nil {
+		return err
+	}
+
+	// Запись могли уже отменить пациент или администратор
+	slot, err := freedSlotForBooking(db, p.BookingID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.Exec("UPDATE bookings SET status = 'Отменено' WHERE id = ?", p.BookingID); err != nil {
+		return err
+	}
+
+	if bot != nil {
+		notifyPaymentUser(bot, db, p.UserID, fmt.Sprintf(
+			"Запись на %s в %s отменена: депозит не был оплачен. Вы можете записаться снова через /book.", slot.Date, slot.Time))
+		offerFreedSlot(bot, db, slot)
+	}
+	return nil
+}
+
+// RunPaymentWorker периодически отменяет записи, депозит по которым не оплачен вовремя
+func RunPaymentWorker(bot *tgbotapi.BotAPI, db *sql.DB) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		processExpiredPayments(bot, db)
+	}
+}
+
+func processExpiredPayments(bot *tgbotapi.BotAPI, db *sql.DB) {
+	rows, err := db.Query(`
+		SELECT id FROM payments
+		WHERE status = ? AND expires_at <= datetime('now')
+	`, paymentStatusPending)
+	if err != nil {
+		log.Printf("Error getting expired payments: %v", err)
+		return
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := cancelUnpaidBooking(bot, db, id, paymentStatusExpired); err != nil {
+			log.Printf("Error expiring payment %d: %v", id, err)
+		}
+	}
+}
+
+// invoicePaymentID извлекает ID платежа из payload счета Telegram
+func invoicePaymentID(payload string) int64 {
+	id, _ := strconv.ParseInt(strings.TrimPrefix(payload, "payment_"), 10, 64)
+	return id
+}
+
+// handlePreCheckoutQuery проверяет перед списанием, что счет еще можно оплатить
+func handlePreCheckoutQuery(bot *tgbotapi.BotAPI, query *tgbotapi.PreCheckoutQuery, db *sql.DB) {
+	answer := tgbotapi.PreCheckoutConfig{PreCheckoutQueryID: query.ID, OK: true}
+
+	var status string
+	var amount float64
+	var expired bool
+	err := db.QueryRow(`
+		SELECT status, amount, expires_at <= datetime('now') FROM payments WHERE id = ?
+	`, invoicePaymentID(query.InvoicePayload)).Scan(&status, &amount, &expired)
+	switch {
+	case err != nil:
+		answer = tgbotapi.PreCheckoutConfig{PreCheckoutQueryID: query.ID, ErrorMessage: "Счет не найден"}
+	case status == paymentStatusPaid:
+		answer = tgbotapi.PreCheckoutConfig{PreCheckoutQueryID: query.ID, ErrorMessage: "Счет уже оплачен"}
+	case status != paymentStatusPending || expired:
+		answer = tgbotapi.PreCheckoutConfig{PreCheckoutQueryID: query.ID, ErrorMessage: "Срок оплаты истек, запись отменена. Запишитесь снова через /book."}
+	case query.Currency != paymentCurrency || query.TotalAmount != amountMinorUnits(amount):
+		answer = tgbotapi.PreCheckoutConfig{PreCheckoutQueryID: query.ID, ErrorMessage: "Сумма счета изменилась"}
+	}
+
+	if _, err := bot.Request(answer); err != nil {
+		log.Printf("Error answering pre-checkout query: %v", err)
+	}
+}
+
+// handleSuccessfulPayment сохраняет оплату счета Telegram
+func handleSuccessfulPayment(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB) {
+	sp := message.SuccessfulPayment
+	if err := markPaymentPaid(bot, db, invoicePaymentID(sp.InvoicePayload), sp.TelegramPaymentChargeID); err != nil {
+		log.Printf("Error saving telegram payment: %v", err)
+	}
+}
+
+// PaymentWebhookHandler принимает уведомления провайдера о смене статуса платежа
+func PaymentWebhookHandler(db *sql.DB, bot *tgbotapi.BotAPI) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if paymentProvider == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Оплата по ссылке не настроена"})
+			return
+		}
+		pp, err := paymentProvider.ParseWebhook(c.Request)
+		if err != nil {
+			log.Printf("Error parsing payment webhook: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверное уведомление"})
+			return
+		}
+
+		var paymentID int64
+		err = db.QueryRow(`
+			SELECT id FROM payments WHERE provider = ? AND external_id = ?
+		`, paymentProvider.Name(), pp.ID).Scan(&paymentID)
+		if err == sql.ErrNoRows {
+			// Повторная доставка не поможет, поэтому отвечаем успехом
+			log.Printf("Payment webhook for unknown payment %s", pp.ID)
+			c.JSON(http.StatusOK, gin.H{"message": "Платеж не найден"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при получении данных"})
+			return
+		}
+
+		switch pp.Status {
+		case paymentStatusPaid:
+			err = markPaymentPaid(bot, db, paymentID, "")
+		case paymentStatusCanceled:
+			err = cancelUnpaidBooking(bot, db, paymentID, paymentStatusCanceled)
+		}
+		if err != nil {
+			log.Printf("Error updating payment %d: %v", paymentID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при обновлении платежа"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "OK"})
+	}
+}
+
+// AdminMarkPaymentPaidHandler отмечает депозит оплаченным на месте, например наличными на ресепшене
+func AdminMarkPaymentPaidHandler(db *sql.DB, bot *tgbotapi.BotAPI) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.HTML(http.StatusBadRequest, "error.html", gin.H{
+				"error": "Неверный ID платежа",
+			})
+			return
+		}
+
+		p, err := paymentByID(db, id)
+		if err != nil {
+			c.HTML(http.StatusNotFound, "error.html", gin.H{
+				"error": "Платеж не найден",
+			})
+			return
+		}
+
+		if p.Status != paymentStatusPending {
+			renderAdminBooking(c, db, p.BookingID, http.StatusBadRequest, "Платеж уже закрыт: "+p.StatusTitle())
+			return
+		}
+
+		if err := markPaymentPaid(bot, db, id, ""); err != nil {
+			log.Printf("Error marking payment %d paid: %v", id, err)
+			renderAdminBooking(c, db, p.BookingID, http.StatusInternalServerError, "Ошибка при сохранении оплаты")
+			return
+		}
+
+		c.Redirect(http.StatusFound, fmt.Sprintf("/admin/bookings/%d", p.BookingID))
+	}
+}
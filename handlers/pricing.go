@@ -0,0 +1,521 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Виды скидок
+const (
+	discountKindPromo      = "promo"       // промокод, который пациент вводит в боте
+	discountKindFirstVisit = "first_visit" // первая запись пациента в клинику
+	discountKindBirthday   = "birthday"    // прием рядом с днем рождения пациента
+	discountKindSale       = "sale"        // распродажа по категории услуг на период
+)
+
+// discountKindTitles названия видов скидок для админки и бота
+var discountKindTitles = map[string]string{
+	discountKindPromo:      "Промокод",
+	discountKindFirstVisit: "Первый визит",
+	discountKindBirthday:   "День рождения",
+	discountKindSale:       "Распродажа",
+}
+
+// Способы расчета скидки
+const (
+	discountValuePercent = "percent" // процент от цены услуги
+	discountValueFixed   = "fixed"   // фиксированная сумма в рублях
+)
+
+// birthdayDiscountDays сколько дней до и после дня рождения действует скидка
+const birthdayDiscountDays = 7
+
+// discountRule скидка из таблицы discounts
+type discountRule struct {
+	ID        int64
+	Kind      string
+	Code      string
+	ValueType string
+	Value     float64
+	Category  string
+	ValidFrom string
+	ValidTo   string
+	MaxUses   int
+	Uses      int // записи со скидкой, кроме отмененных
+	IsActive  bool
+}
+
+func (d discountRule) KindTitle() string {
+	return discountKindTitles[d.Kind]
+}
+
+// ValueTitle размер скидки для показа: процент или сумма
+func (d discountRule) ValueTitle() string {
+	if d.ValueType == discountValueFixed {
+		return fmt.Sprintf("%.2f ₽", d.Value)
+	}
+	return fmt.Sprintf("%g%%", d.Value)
+}
+
+// Title название скидки, которое сохраняется в записи и показывается пациенту
+func (d discountRule) Title() string {
+	switch {
+	case d.Kind == discountKindPromo:
+		return "Промокод " + d.Code
+	case d.Kind == discountKindSale && d.Category != "":
+		return "Распродажа: " + d.Category
+	}
+	return d.KindTitle()
+}
+
+// amount размер скидки в рублях для цены услуги; скидка не больше самой цены
+func (d discountRule) amount(price float64) float64 {
+	v := d.Value
+	if d.ValueType != discountValueFixed {
+		v = price * d.Value / 100
+	}
+	return roundMoney(math.Min(v, price))
+}
+
+// appliesTo проверяет категорию услуги и период действия по дате приема
+func (d discountRule) appliesTo(category, date string) bool {
+	if d.Category != "" && d.Category != category {
+		return false
+	}
+	if d.ValidFrom != "" && date < d.ValidFrom {
+		return false
+	}
+	if d.ValidTo != "" && date > d.ValidTo {
+		return false
+	}
+	return true
+}
+
+func loadDiscountRules(q dbExecutor, where string, args ...interface{}) ([]discountRule, error) {
+	rows, err := q.Query(`
+		SELECT d.id, d.kind, COALESCE(d.code, ''), d.value_type, d.value, COALESCE(d.category, ''),
+			   COALESCE(d.valid_from, ''), COALESCE(d.valid_to, ''), d.max_uses, d.is_active,
+			   (SELECT COUNT(*) FROM bookings b
+			    WHERE b.discount_id = d.id AND b.status NOT IN ('Отменено', 'Отменена'))
+		FROM discounts d
+		WHERE `+where+`
+		ORDER BY d.kind, d.id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []discountRule
+	for rows.Next() {
+		var d discountRule
+		if err := rows.Scan(&d.ID, &d.Kind, &d.Code, &d.ValueType, &d.Value, &d.Category,
+			&d.ValidFrom, &d.ValidTo, &d.MaxUses, &d.IsActive, &d.Uses); err == nil {
+			rules = append(rules, d)
+		}
+	}
+	return rules, rows.Err()
+}
+
+// promoError промокод нельзя применить к записи; текст показывается пациенту
+type promoError struct {
+	reason string
+}
+
+func (e *promoError) Error() string {
+	return e.reason
+}
+
+// normalizePromoCode приводит введенный промокод к виду, в котором он хранится
+func normalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// findPromoCode ищет промокод и проверяет, что его можно применить к записи пациента
+func findPromoCode(q dbExecutor, code string, userID int64, category, date string) (discountRule, error) {
+	promos, err := loadDiscountRules(q, "d.kind = ? AND d.code = ?", discountKindPromo, normalizePromoCode(code))
+	if err != nil {
+		return discountRule{}, err
+	}
+	if len(promos) == 0 || !promos[0].IsActive {
+		return discountRule{}, &promoError{reason: "Промокод не найден"}
+	}
+	promo := promos[0]
+
+	if promo.Category != "" && promo.Category != category {
+		return promo, &promoError{reason: fmt.Sprintf("Промокод действует только на услуги категории «%s»", promo.Category)}
+	}
+	if !promo.appliesTo(category, date) {
+		return promo, &promoError{reason: "Промокод не действует на выбранную дату"}
+	}
+	if promo.MaxUses > 0 && promo.Uses >= promo.MaxUses {
+		return promo, &promoError{reason: "Промокод больше не действует"}
+	}
+	if userID != 0 {
+		var used int
+		err := q.QueryRow(`
+			SELECT COUNT(*) FROM bookings
+			WHERE discount_id = ? AND user_id = ? AND status NOT IN ('Отменено', 'Отменена')
+		`, promo.ID, userID).Scan(&used)
+		if err != nil {
+			return promo, err
+		}
+		if used > 0 {
+			return promo, &promoError{reason: "Вы уже воспользовались этим промокодом"}
+		}
+	}
+	return promo, nil
+}
+
+// isFirstVisit проверяет, что у пациента (владельца аккаунта или члена семьи) еще не было записей
+func isFirstVisit(q dbExecutor, userID, dependentID int64) (bool, error) {
+	if userID == 0 {
+		return false, nil
+	}
+	var count int
+	err := q.QueryRow(`
+		SELECT COUNT(*) FROM bookings
+		WHERE user_id = ? AND COALESCE(dependent_id, 0) = ? AND status NOT IN ('Отменено', 'Отменена')
+	`, userID, dependentID).Scan(&count)
+	return count == 0, err
+}
+
+// isNearBirthday проверяет, что дата приема не дальше birthdayDiscountDays от дня рождения пациента
+func isNearBirthday(q dbExecutor, userID, dependentID int64, date string) (bool, error) {
+	var birthDate string
+	var err error
+	if dependentID != 0 {
+		err = q.QueryRow("SELECT COALESCE(birth_date, '') FROM dependents WHERE id = ?", dependentID).Scan(&birthDate)
+	} else {
+		err = q.QueryRow("SELECT COALESCE(birth_date, '') FROM users WHERE id = ?", userID).Scan(&birthDate)
+	}
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	birth, err := time.Parse("2006-01-02", birthDate)
+	if err != nil {
+		return false, nil
+	}
+	day, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return false, nil
+	}
+	// День рождения в конце декабря ближе к январскому приему следующего года
+	for year := day.Year() - 1; year <= day.Year()+1; year++ {
+		birthday := time.Date(year, birth.Month(), birth.Day(), 0, 0, 0, 0, time.UTC)
+		if math.Abs(day.Sub(birthday).Hours()/24) <= birthdayDiscountDays {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// priceQuote цена записи со скидкой
+type priceQuote struct {
+	BasePrice     float64
+	Discount      float64
+	FinalPrice    float64
+	DiscountID    int64
+	DiscountTitle string
+	PromoIgnored  bool // промокод подходит, но автоматическая скидка выгоднее
+}
+
+// quotePrice рассчитывает цену записи по прайсу и действующим скидкам. Скидки не суммируются:
+// применяется самая выгодная для пациента из автоматических скидок и введенного промокода.
+// Если промокод нельзя применить, возвращается promoError.
+func quotePrice(q dbExecutor, p bookingParams) (priceQuote, error) {
+	var price float64
+	var category string
+	if err := q.QueryRow("SELECT price, category FROM services WHERE id = ?", p.ServiceID).Scan(&price, &category); err != nil {
+		return priceQuote{}, err
+	}
+	quote := priceQuote{BasePrice: price, FinalPrice: price}
+
+	apply := func(d discountRule) bool {
+		amount := d.amount(price)
+		if amount <= quote.Discount {
+			return false
+		}
+		quote.Discount = amount
+		quote.DiscountID = d.ID
+		quote.DiscountTitle = d.Title()
+		return true
+	}
+
+	rules, err := loadDiscountRules(q, "d.is_active = 1 AND d.kind != ?", discountKindPromo)
+	if err != nil {
+		return quote, err
+	}
+	for _, d := range rules {
+		if !d.appliesTo(category, p.Date) {
+			continue
+		}
+		ok := true
+		switch d.Kind {
+		case discountKindFirstVisit:
+			ok, err = isFirstVisit(q, p.UserID, p.DependentID)
+		case discountKindBirthday:
+			ok, err = isNearBirthday(q, p.UserID, p.DependentID, p.Date)
+		}
+		if err != nil {
+			return quote, err
+		}
+		if ok {
+			apply(d)
+		}
+	}
+
+	if p.PromoCode != "" {
+		promo, err := findPromoCode(q, p.PromoCode, p.UserID, category, p.Date)
+		if err != nil {
+			return quote, err
+		}
+		quote.PromoIgnored = !apply(promo)
+	}
+
+	quote.FinalPrice = roundMoney(price - quote.Discount)
+	return quote, nil
+}
+
+// priceText строки со стоимостью для подтверждения записи в боте
+func (q priceQuote) priceText() string {
+	if q.Discount == 0 {
+		return fmt.Sprintf("Стоимость: %.2f ₽", q.BasePrice)
+	}
+	return fmt.Sprintf("Стоимость: %.2f ₽\nСкидка (%s): −%.2f ₽\nИтого: %.2f ₽",
+		q.BasePrice, q.DiscountTitle, q.Discount, q.FinalPrice)
+}
+
+// clearPromoCode сбрасывает введенный в боте промокод
+func clearPromoCode(db *sql.DB, chatID int64) {
+	if _, err := db.Exec("UPDATE users SET promo_code = NULL, promo_booking = NULL WHERE telegram_id = ?", chatID); err != nil {
+		log.Printf("Error clearing promo code: %v", err)
+	}
+}
+
+// askPromoCode просит пациента прислать промокод для выбранных услуги и времени
+func askPromoCode(bot *tgbotapi.BotAPI, chatID int64, serviceID, date, time string, db *sql.DB) {
+	_, err := db.Exec(`
+		UPDATE users SET state = 'waiting_for_promo', promo_booking = ? WHERE telegram_id = ?
+	`, strings.Join([]string{serviceID, date, time}, "_"), chatID)
+	if err != nil {
+		log.Printf("Error updating state: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Произошла ошибка. Попробуйте позже."))
+		return
+	}
+	bot.Send(tgbotapi.NewMessage(chatID, "Отправьте промокод одним сообщением. Чтобы продолжить без промокода, отправьте «-»."))
+}
+
+// savePromoCodeFromMessage проверяет присланный промокод и снова показывает подтверждение записи с новой ценой
+func savePromoCodeFromMessage(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB) {
+	chatID := message.Chat.ID
+	var userID int64
+	var pending string
+	err := db.QueryRow("SELECT id, COALESCE(promo_booking, '') FROM users WHERE telegram_id = ?", chatID).Scan(&userID, &pending)
+	if err != nil {
+		log.Printf("Error getting promo booking: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Произошла ошибка. Попробуйте позже."))
+		return
+	}
+	parts := strings.Split(pending, "_")
+	if len(parts) != 3 {
+		db.Exec("UPDATE users SET state = 'ready', promo_booking = NULL WHERE telegram_id = ?", chatID)
+		bot.Send(tgbotapi.NewMessage(chatID, "Выберите время заново: /book"))
+		return
+	}
+	serviceID, date, bookingTime := parts[0], parts[1], parts[2]
+
+	code := normalizePromoCode(message.Text)
+	if code == "-" {
+		code = ""
+	}
+	if code != "" {
+		serviceIDInt, _ := strconv.ParseInt(serviceID, 10, 64)
+		_, err := quotePrice(db, bookingParams{UserID: userID, ServiceID: serviceIDInt, Date: date, PromoCode: code})
+		if pe, ok := err.(*promoError); ok {
+			bot.Send(tgbotapi.NewMessage(chatID, pe.reason+". Отправьте другой промокод или «-», чтобы продолжить без него."))
+			return
+		}
+		if err != nil {
+			log.Printf("Error checking promo code: %v", err)
+			bot.Send(tgbotapi.NewMessage(chatID, "Произошла ошибка при проверке промокода. Попробуйте позже."))
+			return
+		}
+	}
+
+	_, err = db.Exec(`
+		UPDATE users SET state = 'ready', promo_code = NULLIF(?, ''), promo_booking = NULL WHERE telegram_id = ?
+	`, code, chatID)
+	if err != nil {
+		log.Printf("Error saving promo code: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Произошла ошибка. Попробуйте позже."))
+		return
+	}
+	confirmBooking(bot, chatID, serviceID, date, bookingTime, db)
+}
+
+// renderAdminDiscounts выводит страницу скидок и промокодов
+func renderAdminDiscounts(c *gin.Context, db *sql.DB, status int, errorText string) {
+	rules, err := loadDiscountRules(db, "1 = 1")
+	if err != nil {
+		log.Printf("Error getting discounts: %v", err)
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Ошибка при получении данных",
+		})
+		return
+	}
+
+	var categories []string
+	if rows, err := db.Query("SELECT DISTINCT category FROM services ORDER BY category"); err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var category string
+			if err := rows.Scan(&category); err == nil {
+				categories = append(categories, category)
+			}
+		}
+	}
+
+	c.HTML(status, "admin_discounts.html", gin.H{
+		"rules":        rules,
+		"categories":   categories,
+		"kinds":        discountKindTitles,
+		"birthdayDays": birthdayDiscountDays,
+		"error":        errorText,
+	})
+}
+
+// AdminDiscountsHandler выводит и добавляет скидки и промокоды
+func AdminDiscountsHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodGet {
+			renderAdminDiscounts(c, db, http.StatusOK, "")
+			return
+		}
+
+		// POST запрос - добавление скидки
+		d := discountRule{
+			Kind:      c.PostForm("kind"),
+			Code:      normalizePromoCode(c.PostForm("code")),
+			ValueType: c.PostForm("value_type"),
+			Category:  c.PostForm("category"),
+			ValidFrom: c.PostForm("valid_from"),
+			ValidTo:   c.PostForm("valid_to"),
+		}
+		value, valueErr := strconv.ParseFloat(strings.Replace(c.PostForm("value"), ",", ".", 1), 64)
+		d.Value = value
+		d.MaxUses, _ = strconv.Atoi(c.PostForm("max_uses"))
+
+		if _, ok := discountKindTitles[d.Kind]; !ok {
+			renderAdminDiscounts(c, db, http.StatusBadRequest, "Выберите вид скидки")
+			return
+		}
+		if d.ValueType != discountValuePercent && d.ValueType != discountValueFixed {
+			d.ValueType = discountValuePercent
+		}
+		if valueErr != nil || value <= 0 || (d.ValueType == discountValuePercent && value > 100) {
+			renderAdminDiscounts(c, db, http.StatusBadRequest, "Укажите размер скидки: процент от 0 до 100 или сумму больше нуля")
+			return
+		}
+		for _, date := range []string{d.ValidFrom, d.ValidTo} {
+			if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+				renderAdminDiscounts(c, db, http.StatusBadRequest, "Неверный формат даты")
+				return
+			}
+		}
+		if d.ValidFrom != "" && d.ValidTo != "" && d.ValidFrom > d.ValidTo {
+			renderAdminDiscounts(c, db, http.StatusBadRequest, "Дата начала позже даты окончания")
+			return
+		}
+		if d.Kind == discountKindPromo && d.Code == "" {
+			renderAdminDiscounts(c, db, http.StatusBadRequest, "Для промокода укажите код")
+			return
+		}
+		if strings.Contains(d.Code, " ") {
+			renderAdminDiscounts(c, db, http.StatusBadRequest, "Код промокода не должен содержать пробелов")
+			return
+		}
+		if d.Kind == discountKindSale && (d.Category == "" || d.ValidFrom == "" || d.ValidTo == "") {
+			renderAdminDiscounts(c, db, http.StatusBadRequest, "Для распродажи укажите категорию и период")
+			return
+		}
+		if d.Kind != discountKindPromo {
+			d.Code = ""
+			d.MaxUses = 0
+		}
+		if d.MaxUses < 0 {
+			d.MaxUses = 0
+		}
+
+		var exists int
+		db.QueryRow("SELECT COUNT(*) FROM discounts WHERE code = ?", d.Code).Scan(&exists)
+		if d.Code != "" && exists > 0 {
+			renderAdminDiscounts(c, db, http.StatusBadRequest, "Промокод с таким кодом уже есть")
+			return
+		}
+
+		_, err := db.Exec(`
+			INSERT INTO discounts (kind, code, value_type, value, category, valid_from, valid_to, max_uses)
+			VALUES (?, NULLIF(?, ''), ?, ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), ?)
+		`, d.Kind, d.Code, d.ValueType, d.Value, d.Category, d.ValidFrom, d.ValidTo, d.MaxUses)
+		if err != nil {
+			log.Printf("Error creating discount: %v", err)
+			renderAdminDiscounts(c, db, http.StatusInternalServerError, "Ошибка при сохранении скидки")
+			return
+		}
+
+		c.Redirect(http.StatusFound, "/admin/discounts")
+	}
+}
+
+// AdminToggleDiscountHandler включает или выключает скидку
+func AdminToggleDiscountHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, err := db.Exec("UPDATE discounts SET is_active = 1 - is_active WHERE id = ?", c.Param("id"))
+		if err != nil {
+			log.Printf("Error toggling discount: %v", err)
+			renderAdminDiscounts(c, db, http.StatusInternalServerError, "Ошибка при изменении скидки")
+			return
+		}
+		c.Redirect(http.StatusFound, "/admin/discounts")
+	}
+}
+
+// AdminDeleteDiscountHandler удаляет скидку. В записях остаются ее название и сумма.
+func AdminDeleteDiscountHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tx, err := db.Begin()
+		if err != nil {
+			renderAdminDiscounts(c, db, http.StatusInternalServerError, "Ошибка при удалении скидки")
+			return
+		}
+		defer tx.Rollback()
+
+		_, err = tx.Exec("UPDATE bookings SET discount_id = NULL WHERE discount_id = ?", c.Param("id"))
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM discounts WHERE id = ?", c.Param("id"))
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Error deleting discount: %v", err)
+			renderAdminDiscounts(c, db, http.StatusInternalServerError, "Ошибка при удалении скидки")
+			return
+		}
+		c.Redirect(http.StatusFound, "/admin/discounts")
+	}
+}
@@ -0,0 +1,446 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Статусы приглашений на повторный визит
+const (
+	recallStatusSent   = "sent"
+	recallStatusFailed = "failed"
+)
+
+const (
+	// recallMaxOverdueDays приглашения не отправляются, если срок наступил давно:
+	// новое правило не должно разослать сообщения всем пациентам за годы
+	recallMaxOverdueDays = 30
+	// recallSendFromHour и recallSendToHour часы, в которые отправляются приглашения
+	recallSendFromHour = 10
+	recallSendToHour   = 20
+	// recallMaxMessage ограничение длины своего текста приглашения
+	recallMaxMessage = 1000
+	// recallReportLimit сколько последних приглашений показывать в отчете
+	recallReportLimit = 200
+)
+
+// recallRule правило повторного визита для услуги
+type recallRule struct {
+	ID          int64
+	ServiceID   int64
+	ServiceName string
+	Days        int
+	Message     string
+	IsActive    bool
+	// Статистика за период отчета
+	Sent    int
+	Failed  int
+	Clicked int
+	Booked  int
+	// Due пациенты, которым приглашение будет отправлено сейчас
+	Due int
+}
+
+// Conversion доля записавшихся среди получивших приглашение, %
+func (r recallRule) Conversion() float64 {
+	return percent(float64(r.Booked), float64(r.Sent))
+}
+
+// dueRecall пациент, которому пора на повторный визит
+type dueRecall struct {
+	RuleID      int64
+	ServiceID   int64
+	ServiceName string
+	Message     string
+	Days        int
+	UserID      int64
+	TelegramID  int64
+	DependentID int64
+	PatientName string
+	BookingID   int64
+	LastVisit   string
+	DueDate     string
+}
+
+// loadDueRecalls последние визиты пациентов по услугам с правилом, у которых наступил срок
+// повторного визита, нет более поздней записи на эту услугу и еще не было приглашения
+func loadDueRecalls(db *sql.DB) ([]dueRecall, error) {
+	rows, err := db.Query(`
+		SELECT r.id, r.service_id, s.name, COALESCE(r.message, ''), r.days,
+		       b.user_id, u.telegram_id, COALESCE(b.dependent_id, 0), COALESCE(dp.name, ''),
+		       b.id, b.date, date(b.date, '+' || r.days || ' days')
+		FROM recall_rules r
+		JOIN services s ON r.service_id = s.id
+		JOIN bookings b ON b.service_id = r.service_id
+		JOIN users u ON b.user_id = u.id
+		LEFT JOIN dependents dp ON b.dependent_id = dp.id
+		WHERE r.is_active = 1
+		  AND b.status NOT IN ('Отменено', 'Отменена', ?)
+		  AND b.date < date('now', 'localtime')
+		  AND date(b.date, '+' || r.days || ' days') <= date('now', 'localtime')
+		  AND date(b.date, '+' || r.days || ' days') > date('now', 'localtime', ?)
+		  AND u.telegram_id IS NOT NULL AND COALESCE(u.is_blocked, 0) = 0 AND u.marketing_opt_out = 0
+		  AND NOT EXISTS (
+			SELECT 1 FROM bookings b2
+			WHERE b2.user_id = b.user_id AND b2.service_id = b.service_id
+			  AND COALESCE(b2.dependent_id, 0) = COALESCE(b.dependent_id, 0)
+			  AND b2.status NOT IN ('Отменено', 'Отменена', ?)
+			  AND (b2.date > b.date OR (b2.date = b.date AND b2.id > b.id))
+		  )
+		  AND NOT EXISTS (SELECT 1 FROM recalls rc WHERE rc.service_id = b.service_id AND rc.source_booking_id = b.id)
+		ORDER BY b.date, b.id
+	`, bookingStatusNoShow, fmt.Sprintf("-%d days", recallMaxOverdueDays), bookingStatusNoShow)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []dueRecall
+	for rows.Next() {
+		var d dueRecall
+		if err := rows.Scan(&d.RuleID, &d.ServiceID, &d.ServiceName, &d.Message, &d.Days,
+			&d.UserID, &d.TelegramID, &d.DependentID, &d.PatientName,
+			&d.BookingID, &d.LastVisit, &d.DueDate); err != nil {
+			return nil, err
+		}
+		due = append(due, d)
+	}
+	return due, rows.Err()
+}
+
+// RunRecallWorker приглашает пациентов на повторные визиты по правилам услуг
+func RunRecallWorker(bot *tgbotapi.BotAPI, db *sql.DB) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Не пишем пациентам ночью
+		if hour := time.Now().Hour(); hour < recallSendFromHour || hour >= recallSendToHour {
+			continue
+		}
+		sendRecalls(bot, db)
+	}
+}
+
+func sendRecalls(bot *tgbotapi.BotAPI, db *sql.DB) {
+	due, err := loadDueRecalls(db)
+	if err != nil {
+		log.Printf("Error getting due recalls: %v", err)
+		return
+	}
+
+	for _, d := range due {
+		// Приглашение фиксируется до отправки и не повторяется, даже если Telegram вернул ошибку
+		res, err := db.Exec(`
+			INSERT INTO recalls (rule_id, user_id, dependent_id, service_id, source_booking_id, due_date, status)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, d.RuleID, d.UserID, nullInt64(d.DependentID), d.ServiceID, d.BookingID, d.DueDate, recallStatusSent)
+		if err != nil {
+			log.Printf("Error saving recall: %v", err)
+			continue
+		}
+		recallID, _ := res.LastInsertId()
+		if bot == nil {
+			continue
+		}
+		if _, err := bot.Send(recallMessage(d, recallID)); err != nil {
+			log.Printf("Error sending recall %d: %v", recallID, err)
+			db.Exec("UPDATE recalls SET status = ?, error = ? WHERE id = ?", recallStatusFailed, err.Error(), recallID)
+		}
+	}
+}
+
+// recallMessage приглашение с кнопкой, которая сразу открывает выбор даты для услуги
+func recallMessage(d dueRecall, recallID int64) tgbotapi.MessageConfig {
+	text := d.Message
+	if text == "" {
+		text = fmt.Sprintf("Здравствуйте! С последнего визита на услугу «%s» (%s) прошло %d дн. Рекомендуем записаться на повторный прием.",
+			d.ServiceName, d.LastVisit, d.Days)
+	}
+	if d.PatientName != "" {
+		text += fmt.Sprintf("\n\nПациент: %s", d.PatientName)
+	}
+
+	msg := tgbotapi.NewMessage(d.TelegramID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("📅 Записаться", fmt.Sprintf("rc_%d", recallID)),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Отписаться от рассылок", broadcastUnsubscribeData),
+		),
+	)
+	return msg
+}
+
+// handleRecallCallback пациент нажал «Записаться» в приглашении (rc_<recallID>)
+func handleRecallCallback(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery, db *sql.DB) {
+	chatID := callback.Message.Chat.ID
+	recallID, err := strconv.ParseInt(strings.TrimPrefix(callback.Data, "rc_"), 10, 64)
+	if err != nil {
+		bot.Request(tgbotapi.NewCallback(callback.ID, "Ошибка: неверный формат данных"))
+		return
+	}
+
+	var serviceID int64
+	err = db.QueryRow(`
+		SELECT rc.service_id
+		FROM recalls rc
+		JOIN users u ON rc.user_id = u.id
+		JOIN services s ON rc.service_id = s.id
+		WHERE rc.id = ? AND u.telegram_id = ?
+	`, recallID, chatID).Scan(&serviceID)
+	if err == sql.ErrNoRows {
+		bot.Send(tgbotapi.NewMessage(chatID, "Услуга больше недоступна. Выберите другую: /book"))
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting recall: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Произошла ошибка. Попробуйте позже."))
+		return
+	}
+
+	if _, err := db.Exec("UPDATE recalls SET clicked_at = COALESCE(clicked_at, CURRENT_TIMESTAMP) WHERE id = ?", recallID); err != nil {
+		log.Printf("Error marking recall click: %v", err)
+	}
+
+	service := strconv.FormatInt(serviceID, 10)
+	trackFunnelStep(db, chatID, funnelStepStarted, "")
+	trackFunnelStep(db, chatID, funnelStepService, service)
+	startDateSelection(bot, chatID, service, db)
+}
+
+// adminRecall приглашение в отчете
+type adminRecall struct {
+	ID          int64
+	UserID      int64
+	PatientName string
+	ServiceName string
+	LastVisit   string
+	DueDate     string
+	Status      string
+	Error       string
+	SentAt      string
+	ClickedAt   string
+	BookingID   int64
+	BookingDate string
+}
+
+// StatusTitle итог приглашения для отчета
+func (r adminRecall) StatusTitle() string {
+	switch {
+	case r.Status == recallStatusFailed:
+		return "Не доставлено"
+	case r.BookingID != 0:
+		return "Записался"
+	case r.ClickedAt != "":
+		return "Нажал «Записаться»"
+	default:
+		return "Отправлено"
+	}
+}
+
+// recallBookingSQL первая неотмененная запись пациента на услугу после приглашения.
+// Учитываются записи через бота и через администратора.
+const recallBookingSQL = `
+	SELECT MIN(b.id) FROM bookings b
+	WHERE b.user_id = rc.user_id AND b.service_id = rc.service_id
+	  AND COALESCE(b.dependent_id, 0) = COALESCE(rc.dependent_id, 0)
+	  AND b.id <> rc.source_booking_id AND b.created_at >= rc.sent_at AND b.status NOT IN ('Отменено', 'Отменена')`
+
+// loadRecallRules правила со статистикой приглашений, отправленных за период
+func loadRecallRules(db *sql.DB, f analyticsFilter) ([]recallRule, error) {
+	rows, err := db.Query(`
+		SELECT r.id, r.service_id, s.name, r.days, COALESCE(r.message, ''), r.is_active,
+		       COUNT(rc.id),
+		       COALESCE(SUM(rc.status = ?), 0),
+		       COALESCE(SUM(rc.clicked_at IS NOT NULL), 0),
+		       COALESCE(SUM((`+recallBookingSQL+`) IS NOT NULL), 0)
+		FROM recall_rules r
+		JOIN services s ON r.service_id = s.id
+		LEFT JOIN recalls rc ON rc.service_id = r.service_id AND DATE(rc.sent_at) BETWEEN ? AND ?
+		GROUP BY r.id
+		ORDER BY s.name
+	`, recallStatusFailed, f.From, f.To)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []recallRule
+	for rows.Next() {
+		var r recallRule
+		if err := rows.Scan(&r.ID, &r.ServiceID, &r.ServiceName, &r.Days, &r.Message, &r.IsActive,
+			&r.Sent, &r.Failed, &r.Clicked, &r.Booked); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// loadRecalls последние приглашения за период, serviceID 0 - по всем услугам
+func loadRecalls(db *sql.DB, f analyticsFilter, serviceID int64) ([]adminRecall, error) {
+	query := `
+		SELECT rc.id, rc.user_id,
+		       COALESCE(dp.name, NULLIF(TRIM(COALESCE(u.first_name, '') || ' ' || COALESCE(u.last_name, '')), ''), u.username, ''),
+		       COALESCE(s.name, ''), COALESCE(src.date, ''), rc.due_date, rc.status, COALESCE(rc.error, ''),
+		       COALESCE(strftime('%Y-%m-%d %H:%M', rc.sent_at, 'localtime'), ''),
+		       COALESCE(strftime('%Y-%m-%d %H:%M', rc.clicked_at, 'localtime'), ''),
+		       COALESCE(nb.id, 0), COALESCE(nb.date, '')
+		FROM recalls rc
+		JOIN users u ON rc.user_id = u.id
+		LEFT JOIN dependents dp ON rc.dependent_id = dp.id
+		LEFT JOIN services s ON rc.service_id = s.id
+		LEFT JOIN bookings src ON rc.source_booking_id = src.id
+		LEFT JOIN bookings nb ON nb.id = (` + recallBookingSQL + `)
+		WHERE DATE(rc.sent_at) BETWEEN ? AND ?`
+	args := []interface{}{f.From, f.To}
+	if serviceID != 0 {
+		query += " AND rc.service_id = ?"
+		args = append(args, serviceID)
+	}
+	query += " ORDER BY rc.sent_at DESC, rc.id DESC LIMIT ?"
+	args = append(args, recallReportLimit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []adminRecall
+	for rows.Next() {
+		var r adminRecall
+		if err := rows.Scan(&r.ID, &r.UserID, &r.PatientName, &r.ServiceName, &r.LastVisit, &r.DueDate,
+			&r.Status, &r.Error, &r.SentAt, &r.ClickedAt, &r.BookingID, &r.BookingDate); err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	return list, rows.Err()
+}
+
+// renderAdminRecalls выводит правила повторных визитов и отчет по приглашениям
+func renderAdminRecalls(c *gin.Context, db *sql.DB, status int, errorText string) {
+	f, filterErr := analyticsFilterFromQuery(c)
+	serviceID, _ := strconv.ParseInt(c.Query("service_id"), 10, 64)
+	data := gin.H{
+		"filter":       f,
+		"serviceID":    serviceID,
+		"services":     loadAdminFilterOptions(db, "SELECT id, name FROM services ORDER BY name"),
+		"maxOverdue":   recallMaxOverdueDays,
+		"sendFromHour": recallSendFromHour,
+		"sendToHour":   recallSendToHour,
+		"error":        errorText,
+	}
+	if filterErr != nil {
+		data["error"] = "Ошибка в периоде: " + filterErr.Error()
+		c.HTML(http.StatusBadRequest, "admin_recalls.html", data)
+		return
+	}
+
+	rules, err := loadRecallRules(db, f)
+	if err == nil {
+		var due []dueRecall
+		if due, err = loadDueRecalls(db); err == nil {
+			for i := range rules {
+				for _, d := range due {
+					if d.RuleID == rules[i].ID {
+						rules[i].Due++
+					}
+				}
+			}
+		}
+	}
+	var recalls []adminRecall
+	if err == nil {
+		recalls, err = loadRecalls(db, f, serviceID)
+	}
+	if err != nil {
+		log.Printf("Error building recall report: %v", err)
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Ошибка при получении данных",
+		})
+		return
+	}
+
+	data["rules"] = rules
+	data["recalls"] = recalls
+	data["recallLimit"] = recallReportLimit
+	c.HTML(status, "admin_recalls.html", data)
+}
+
+// AdminRecallsHandler выводит отчет и добавляет или изменяет правило повторного визита для услуги
+func AdminRecallsHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodGet {
+			renderAdminRecalls(c, db, http.StatusOK, "")
+			return
+		}
+
+		// POST запрос - правило для услуги; повторное сохранение заменяет срок и текст
+		serviceID, _ := strconv.ParseInt(c.PostForm("service_id"), 10, 64)
+		days, _ := strconv.Atoi(c.PostForm("days"))
+		message := strings.TrimSpace(c.PostForm("message"))
+
+		if serviceID == 0 {
+			renderAdminRecalls(c, db, http.StatusBadRequest, "Выберите услугу")
+			return
+		}
+		if days < 1 || days > 3650 {
+			renderAdminRecalls(c, db, http.StatusBadRequest, "Укажите срок повторного визита от 1 до 3650 дней")
+			return
+		}
+		if len([]rune(message)) > recallMaxMessage {
+			renderAdminRecalls(c, db, http.StatusBadRequest, fmt.Sprintf("Текст приглашения длиннее %d символов", recallMaxMessage))
+			return
+		}
+
+		_, err := db.Exec(`
+			INSERT INTO recall_rules (service_id, days, message) VALUES (?, ?, NULLIF(?, ''))
+			ON CONFLICT(service_id) DO UPDATE SET days = excluded.days, message = excluded.message, is_active = 1
+		`, serviceID, days, message)
+		if err != nil {
+			log.Printf("Error saving recall rule: %v", err)
+			renderAdminRecalls(c, db, http.StatusInternalServerError, "Ошибка при сохранении правила")
+			return
+		}
+
+		c.Redirect(http.StatusFound, "/admin/recalls")
+	}
+}
+
+// AdminToggleRecallRuleHandler включает или выключает правило повторного визита
+func AdminToggleRecallRuleHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, err := db.Exec("UPDATE recall_rules SET is_active = 1 - is_active WHERE id = ?", c.Param("id"))
+		if err != nil {
+			log.Printf("Error toggling recall rule: %v", err)
+			renderAdminRecalls(c, db, http.StatusInternalServerError, "Ошибка при изменении правила")
+			return
+		}
+		c.Redirect(http.StatusFound, "/admin/recalls")
+	}
+}
+
+// AdminDeleteRecallRuleHandler удаляет правило. Отправленные приглашения остаются в отчете.
+func AdminDeleteRecallRuleHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, err := db.Exec("DELETE FROM recall_rules WHERE id = ?", c.Param("id"))
+		if err != nil {
+			log.Printf("Error deleting recall rule: %v", err)
+			renderAdminRecalls(c, db, http.StatusInternalServerError, "Ошибка при удалении правила")
+			return
+		}
+		c.Redirect(http.StatusFound, "/admin/recalls")
+	}
+}
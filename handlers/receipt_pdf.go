@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+
+	"github.com/go-pdf/fpdf"
+)
+
+var receiptPDFColumns = []pdfColumn{
+	{"Наименование", 85},
+	{"Кол-во", 18},
+	{"Цена, ₽", 27},
+	{"Скидка", 20},
+	{"Сумма, ₽", 30},
+}
+
+// buildReceiptPDF формирует квитанцию об оплате: строки счета по приему, сумму платежа и остаток.
+// Для депозита, внесенного до выставления счета, строк нет.
+func buildReceiptPDF(db *sql.DB, p payment) (*bytes.Buffer, error) {
+	booking, err := loadBookingDetails(db, p.BookingID)
+	if err != nil {
+		return nil, err
+	}
+	inv, err := loadInvoice(db, "i.booking_id = ?", p.BookingID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.AddUTF8FontFromBytes("DejaVu", "", fontRegular)
+	pdf.AddUTF8FontFromBytes("DejaVu", "B", fontBold)
+	pdf.SetMargins(10, 10, 10)
+	pdf.AddPage()
+
+	pdf.SetFont("DejaVu", "B", 14)
+	pdf.CellFormat(0, 8, clinicName, "", 1, "L", false, 0, "")
+	pdf.SetFont("DejaVu", "B", 16)
+	pdf.CellFormat(0, 10, fmt.Sprintf("Квитанция № %d", p.ID), "", 1, "L", false, 0, "")
+
+	patient := booking.ClientName
+	if booking.PatientName != "" {
+		patient = booking.PatientName + " (" + booking.ClientName + ")"
+	}
+	pdf.SetFont("DejaVu", "", 10)
+	for _, line := range []string{
+		"Дата оплаты: " + p.PaidAt,
+		"Пациент: " + patient,
+		fmt.Sprintf("Прием: %s %s, %s", booking.Date, booking.Time, booking.ServiceName),
+	} {
+		pdf.CellFormat(0, 6, line, "", 1, "L", false, 0, "")
+	}
+	pdf.Ln(4)
+
+	if inv != nil {
+		pdf.SetFont("DejaVu", "B", 9)
+		pdf.SetFillColor(240, 240, 240)
+		for _, col := range receiptPDFColumns {
+			pdf.CellFormat(col.Width, 7, col.Title, "1", 0, "L", true, 0, "")
+		}
+		pdf.Ln(-1)
+
+		pdf.SetFont("DejaVu", "", 9)
+		for _, item := range inv.Items {
+			discount := ""
+			if item.DiscountPercent > 0 {
+				discount = fmt.Sprintf("%.4g%%", item.DiscountPercent)
+			}
+			values := []string{
+				item.Description,
+				fmt.Sprintf("%d", item.Quantity),
+				fmt.Sprintf("%.2f", item.UnitPrice),
+				discount,
+				fmt.Sprintf("%.2f", item.Amount),
+			}
+			for j, col := range receiptPDFColumns {
+				pdf.CellFormat(col.Width, 7, fitText(pdf, values[j], col.Width), "1", 0, "L", false, 0, "")
+			}
+			pdf.Ln(-1)
+		}
+		pdf.Ln(3)
+	}
+
+	total := func(label string, amount float64) {
+		pdf.CellFormat(150, 7, label, "", 0, "R", false, 0, "")
+		pdf.CellFormat(30, 7, fmt.Sprintf("%.2f ₽", amount), "", 1, "R", false, 0, "")
+	}
+	pdf.SetFont("DejaVu", "B", 11)
+	total(fmt.Sprintf("Оплачено (%s):", p.MethodTitle()), p.Amount)
+	pdf.SetFont("DejaVu", "", 10)
+	if inv != nil {
+		total("Итого по счету:", inv.Total)
+		total("Всего оплачено:", inv.Paid)
+		if balance := inv.Balance(); balance > 0 {
+			total("Остаток к оплате:", balance)
+		}
+	} else {
+		pdf.CellFormat(0, 7, "Депозит будет учтен в счете за прием.", "", 1, "R", false, 0, "")
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
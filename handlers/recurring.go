@@ -0,0 +1,793 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Максимальное количество повторений в одной серии
+const maxSeriesOccurrences = 52
+
+// seriesRequest описывает параметры серии повторяющихся записей
+type seriesRequest struct {
+	UserID        int64  `json:"user_id"`
+	DoctorID      int64  `json:"doctor_id"`
+	ServiceID     int64  `json:"service_id"`
+	StartDate     string `json:"start_date"`
+	Time          string `json:"time"`
+	IntervalUnit  string `json:"interval_unit"` // week или month
+	IntervalCount int    `json:"interval_count"`
+	Occurrences   int    `json:"occurrences"`
+	UntilDate     string `json:"until_date"`
+}
+
+// seriesOccurrence описывает одно повторение серии
+type seriesOccurrence struct {
+	Date      string `json:"date"`
+	Time      string `json:"time"`
+	BookingID int64  `json:"booking_id,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// seriesRescheduleRequest описывает перенос будущих повторений серии
+type seriesRescheduleRequest struct {
+	FromDate  string `json:"from_date"`
+	Time      string `json:"time"`
+	DoctorID  int64  `json:"doctor_id"`
+	ShiftDays int    `json:"shift_days"`
+}
+
+var errSeriesNotFound = errors.New("серия не найдена")
+
+// validate проверяет параметры серии
+func (r *seriesRequest) validate() error {
+	if r.UserID == 0 || r.DoctorID == 0 || r.ServiceID == 0 {
+		return errors.New("не указан пациент, врач или услуга")
+	}
+	if _, err := time.Parse("2006-01-02", r.StartDate); err != nil {
+		return errors.New("неверная дата начала")
+	}
+	if _, err := time.Parse("15:04", r.Time); err != nil {
+		return errors.New("неверное время")
+	}
+	if r.IntervalUnit != "week" && r.IntervalUnit != "month" {
+		return errors.New("интервал должен быть week или month")
+	}
+	if r.IntervalCount <= 0 {
+		r.IntervalCount = 1
+	}
+	if r.Occurrences <= 0 && r.UntilDate == "" {
+		return errors.New("укажите количество повторений или дату окончания")
+	}
+	if r.UntilDate != "" {
+		if _, err := time.Parse("2006-01-02", r.UntilDate); err != nil {
+			return errors.New("неверная дата окончания")
+		}
+	}
+	if r.Occurrences > maxSeriesOccurrences {
+		return fmt.Errorf("не более %d повторений", maxSeriesOccurrences)
+	}
+	return nil
+}
+
+// addMonthsClamped прибавляет месяцы, не перескакивая через конец месяца (31.01 -> 28.02)
+func addMonthsClamped(t time.Time, months int) time.Time {
+	first := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location()).AddDate(0, months, 0)
+	lastDay := first.AddDate(0, 1, -1).Day()
+	day := t.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return time.Date(first.Year(), first.Month(), day, 0, 0, 0, 0, t.Location())
+}
+
+// seriesDates возвращает даты повторений серии
+func seriesDates(start time.Time, unit string, every, occurrences int, until time.Time) []time.Time {
+	var dates []time.Time
+	for i := 0; len(dates) < maxSeriesOccurrences; i++ {
+		var d time.Time
+		if unit == "month" {
+			d = addMonthsClamped(start, i*every)
+		} else {
+			d = start.AddDate(0, 0, 7*i*every)
+		}
+		if !until.IsZero() && d.After(until) {
+			break
+		}
+		if occurrences > 0 && len(dates) >= occurrences {
+			break
+		}
+		dates = append(dates, d)
+	}
+	return dates
+}
+
+// createBookingSeries создает серию и размещает все повторения, которые удалось разместить.
+// Если не удалось разместить ни одного повторения, серия не сохраняется.
+func createBookingSeries(db *sql.DB, req seriesRequest) (int64, []seriesOccurrence, []seriesOccurrence, error) {
+	if err := req.validate(); err != nil {
+		return 0, nil, nil, err
+	}
+
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM doctors WHERE id = ?", req.DoctorID).Scan(&exists); err != nil || exists == 0 {
+		return 0, nil, nil, errors.New("врач не найден")
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM services WHERE id = ?", req.ServiceID).Scan(&exists); err != nil || exists == 0 {
+		return 0, nil, nil, errors.New("услуга не найдена")
+	}
+
+	start, _ := time.Parse("2006-01-02", req.StartDate)
+	var until time.Time
+	if req.UntilDate != "" {
+		until, _ = time.Parse("2006-01-02", req.UntilDate)
+	}
+	dates := seriesDates(start, req.IntervalUnit, req.IntervalCount, req.Occurrences, until)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO booking_series (user_id, doctor_id, service_id, time, start_date, interval_unit, interval_count, occurrences, until_date)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, req.UserID, req.DoctorID, req.ServiceID, req.Time, req.StartDate, req.IntervalUnit, req.IntervalCount, req.Occurrences, req.UntilDate)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	seriesID, err := result.LastInsertId()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	today := time.Now().Format("2006-01-02")
+	var created, conflicts []seriesOccurrence
+	for _, d := range dates {
+		occ := seriesOccurrence{Date: d.Format("2006-01-02"), Time: req.Time}
+		if occ.Date < today {
+			occ.Reason = "Дата в прошлом"
+			conflicts = append(conflicts, occ)
+			continue
+		}
+		// Повторение не должно попасть на выходной, отсутствие или перерыв врача
+		if err := checkDoctorWorks(tx, req.DoctorID, occ.Date, occ.Time); err != nil {
+			occ.Reason = err.Error()
+			conflicts = append(conflicts, occ)
+			continue
+		}
+
+		id, err := insertBooking(tx, bookingParams{
+			UserID:    req.UserID,
+			ServiceID: req.ServiceID,
+			DoctorID:  req.DoctorID,
+			SeriesID:  seriesID,
+			Date:      occ.Date,
+			Time:      occ.Time,
+		})
+		if err == errSlotTaken {
+			occ.Reason = "Время у врача уже занято"
+			conflicts = append(conflicts, occ)
+			continue
+		}
+		if le, ok := err.(*limitError); ok {
+			occ.Reason = le.reason
+			conflicts = append(conflicts, occ)
+			continue
+		}
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		occ.BookingID = id
+		created = append(created, occ)
+	}
+
+	if len(created) == 0 {
+		return 0, nil, conflicts, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, nil, nil, err
+	}
+	return seriesID, created, conflicts, nil
+}
+
+// cancelSeries отменяет все активные повторения серии начиная с fromDate
+func cancelSeries(db *sql.DB, seriesID int64, fromDate string) (int64, error) {
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM booking_series WHERE id = ?", seriesID).Scan(&exists); err != nil {
+		return 0, err
+	}
+	if exists == 0 {
+		return 0, errSeriesNotFound
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE bookings SET status = 'Отменено'
+		WHERE series_id = ? AND date >= ? AND status NOT IN ('Отменено', 'Отменена')
+	`, seriesID, fromDate)
+	if err != nil {
+		return 0, err
+	}
+	cancelled, _ := result.RowsAffected()
+
+	// Серия закрывается, если в ней больше не осталось активных записей
+	_, err = tx.Exec(`
+		UPDATE booking_series SET status = 'cancelled'
+		WHERE id = ? AND NOT EXISTS (
+			SELECT 1 FROM bookings WHERE series_id = ? AND status NOT IN ('Отменено', 'Отменена')
+		)
+	`, seriesID, seriesID)
+	if err != nil {
+		return 0, err
+	}
+
+	return cancelled, tx.Commit()
+}
+
+// rescheduleSeries переносит будущие повторения серии на новое время, врача или со сдвигом дат.
+// Повторения, которые нельзя перенести, остаются на прежнем месте и возвращаются как конфликты.
+func rescheduleSeries(db *sql.DB, seriesID int64, req seriesRescheduleRequest) ([]seriesOccurrence, []seriesOccurrence, error) {
+	var seriesDoctorID int64
+	var seriesTime string
+	err := db.QueryRow("SELECT doctor_id, time FROM booking_series WHERE id = ?", seriesID).Scan(&seriesDoctorID, &seriesTime)
+	if err == sql.ErrNoRows {
+		return nil, nil, errSeriesNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if req.FromDate == "" {
+		req.FromDate = time.Now().Format("2006-01-02")
+	}
+	if req.Time != "" {
+		if _, err := time.Parse("15:04", req.Time); err != nil {
+			return nil, nil, errors.New("неверное время")
+		}
+	}
+	if req.Time == "" && req.DoctorID == 0 && req.ShiftDays == 0 {
+		return nil, nil, errors.New("не указаны параметры переноса")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	// При сдвиге вперед сначала переносим поздние повторения, чтобы серия не конфликтовала сама с собой
+	order := "ASC"
+	if req.ShiftDays > 0 {
+		order = "DESC"
+	}
+	rows, err := tx.Query(`
+		SELECT id, date, time, COALESCE(doctor_id, 0)
+		FROM bookings
+		WHERE series_id = ? AND date >= ? AND status NOT IN ('Отменено', 'Отменена')
+		ORDER BY date `+order, seriesID, req.FromDate)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	type occurrence struct {
+		ID       int64
+		Date     string
+		Time     string
+		DoctorID int64
+	}
+	var occurrences []occurrence
+	for rows.Next() {
+		var o occurrence
+		if err := rows.Scan(&o.ID, &o.Date, &o.Time, &o.DoctorID); err == nil {
+			occurrences = append(occurrences, o)
+		}
+	}
+	rows.Close()
+
+	today := time.Now().Format("2006-01-02")
+	var moved, conflicts []seriesOccurrence
+	for _, o := range occurrences {
+		newDate := o.Date
+		if req.ShiftDays != 0 {
+			d, err := time.Parse("2006-01-02", o.Date)
+			if err != nil {
+				continue
+			}
+			newDate = d.AddDate(0, 0, req.ShiftDays).Format("2006-01-02")
+		}
+		newTime := o.Time
+		if req.Time != "" {
+			newTime = req.Time
+		}
+		newDoctorID := o.DoctorID
+		if req.DoctorID != 0 {
+			newDoctorID = req.DoctorID
+		}
+
+		occ := seriesOccurrence{Date: newDate, Time: newTime, BookingID: o.ID}
+		if newDate < today {
+			occ.Reason = "Дата в прошлом"
+			conflicts = append(conflicts, occ)
+			continue
+		}
+		// Те же проверки, что при переносе одной записи: расписание врача, занятость и дневные ограничения
+		if err := checkDoctorWorks(tx, newDoctorID, newDate, newTime); err != nil {
+			occ.Reason = err.Error()
+			conflicts = append(conflicts, occ)
+			continue
+		}
+		if err := moveBooking(tx, o.ID, newDoctorID, newDate, newTime); err != nil {
+			switch e := err.(type) {
+			case *limitError:
+				occ.Reason = e.reason
+			default:
+				if err != errSlotTaken {
+					return nil, nil, err
+				}
+				occ.Reason = "Время у врача уже занято"
+			}
+			conflicts = append(conflicts, occ)
+			continue
+		}
+		moved = append(moved, occ)
+	}
+
+	if req.Time != "" {
+		seriesTime = req.Time
+	}
+	if req.DoctorID != 0 {
+		seriesDoctorID = req.DoctorID
+	}
+	if _, err := tx.Exec("UPDATE booking_series SET time = ?, doctor_id = ? WHERE id = ?", seriesTime, seriesDoctorID, seriesID); err != nil {
+		return nil, nil, err
+	}
+
+	return moved, conflicts, tx.Commit()
+}
+
+// seriesFreedSlots возвращает время активных повторений серии начиная с fromDate
+func seriesFreedSlots(db *sql.DB, seriesID int64, fromDate string) []freedSlot {
+	rows, err := db.Query(`
+		SELECT service_id, COALESCE(doctor_id, 0), date, time
+		FROM bookings
+		WHERE series_id = ? AND date >= ? AND status NOT IN ('Отменено', 'Отменена')
+	`, seriesID, fromDate)
+	if err != nil {
+		log.Printf("Error getting series bookings: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var slots []freedSlot
+	for rows.Next() {
+		var s freedSlot
+		if err := rows.Scan(&s.ServiceID, &s.DoctorID, &s.Date, &s.Time); err == nil {
+			slots = append(slots, s)
+		}
+	}
+	return slots
+}
+
+// seriesTelegramID возвращает Telegram ID пациента серии
+func seriesTelegramID(db *sql.DB, seriesID int64) int64 {
+	var telegramID int64
+	err := db.QueryRow(`
+		SELECT COALESCE(u.telegram_id, 0)
+		FROM booking_series s
+		JOIN users u ON s.user_id = u.id
+		WHERE s.id = ?
+	`, seriesID).Scan(&telegramID)
+	if err != nil {
+		log.Printf("Error getting series patient: %v", err)
+	}
+	return telegramID
+}
+
+// Создание серии повторяющихся записей
+func CreateBookingSeriesHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req seriesRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный формат данных"})
+			return
+		}
+
+		seriesID, created, conflicts, err := createBookingSeries(db, req)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if seriesID == 0 {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":     "Не удалось разместить ни одной записи серии",
+				"conflicts": conflicts,
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"series_id": seriesID,
+			"created":   created,
+			"conflicts": conflicts,
+		})
+	}
+}
+
+// Получение серии и ее повторений
+func GetBookingSeriesHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+
+		var series struct {
+			ID            int64  `json:"id"`
+			UserID        int64  `json:"user_id"`
+			DoctorID      int64  `json:"doctor_id"`
+			ServiceID     int64  `json:"service_id"`
+			Time          string `json:"time"`
+			StartDate     string `json:"start_date"`
+			IntervalUnit  string `json:"interval_unit"`
+			IntervalCount int    `json:"interval_count"`
+			Occurrences   int    `json:"occurrences"`
+			UntilDate     string `json:"until_date"`
+			Status        string `json:"status"`
+		}
+		err := db.QueryRow(`
+			SELECT id, user_id, doctor_id, service_id, time, start_date, interval_unit, interval_count,
+				   COALESCE(occurrences, 0), COALESCE(until_date, ''), status
+			FROM booking_series
+			WHERE id = ?
+		`, id).Scan(&series.ID, &series.UserID, &series.DoctorID, &series.ServiceID, &series.Time, &series.StartDate,
+			&series.IntervalUnit, &series.IntervalCount, &series.Occurrences, &series.UntilDate, &series.Status)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Серия не найдена"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при получении данных"})
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT id, date, time, status
+			FROM bookings
+			WHERE series_id = ?
+			ORDER BY date, time
+		`, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при получении данных"})
+			return
+		}
+		defer rows.Close()
+
+		var bookings []struct {
+			ID     int64  `json:"id"`
+			Date   string `json:"date"`
+			Time   string `json:"time"`
+			Status string `json:"status"`
+		}
+		for rows.Next() {
+			var b struct {
+				ID     int64  `json:"id"`
+				Date   string `json:"date"`
+				Time   string `json:"time"`
+				Status string `json:"status"`
+			}
+			if err := rows.Scan(&b.ID, &b.Date, &b.Time, &b.Status); err == nil {
+				bookings = append(bookings, b)
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"series":   series,
+			"bookings": bookings,
+		})
+	}
+}
+
+// Отмена будущих повторений серии
+func CancelBookingSeriesHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		seriesID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID серии"})
+			return
+		}
+		fromDate := c.DefaultQuery("from", time.Now().Format("2006-01-02"))
+
+		cancelled, err := cancelSeries(db, seriesID, fromDate)
+		if err == errSeriesNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Серия не найдена"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при отмене серии"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"cancelled": cancelled})
+	}
+}
+
+// Перенос будущих повторений серии
+func RescheduleBookingSeriesHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		seriesID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID серии"})
+			return
+		}
+
+		var req seriesRescheduleRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный формат данных"})
+			return
+		}
+
+		moved, conflicts, err := rescheduleSeries(db, seriesID, req)
+		if err == errSeriesNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Серия не найдена"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"moved":     moved,
+			"conflicts": conflicts,
+		})
+	}
+}
+
+// renderAdminSeries выводит страницу серий с результатом последнего действия
+func renderAdminSeries(c *gin.Context, db *sql.DB, status int, data gin.H) {
+	rows, err := db.Query(`
+		SELECT s.id, s.start_date, s.time, s.interval_unit, s.interval_count, s.status,
+			   COALESCE(u.username, ''), COALESCE(u.telegram_id, 0), d.name, sv.name,
+			   (SELECT COUNT(*) FROM bookings b
+				WHERE b.series_id = s.id AND b.date >= date('now') AND b.status NOT IN ('Отменено', 'Отменена'))
+		FROM booking_series s
+		JOIN users u ON s.user_id = u.id
+		JOIN doctors d ON s.doctor_id = d.id
+		JOIN services sv ON s.service_id = sv.id
+		ORDER BY s.created_at DESC
+	`)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Ошибка при получении данных",
+		})
+		return
+	}
+	defer rows.Close()
+
+	var series []struct {
+		ID            int64
+		StartDate     string
+		Time          string
+		IntervalUnit  string
+		IntervalCount int
+		Status        string
+		Username      string
+		TelegramID    int64
+		DoctorName    string
+		ServiceName   string
+		Upcoming      int
+	}
+	for rows.Next() {
+		var s struct {
+			ID            int64
+			StartDate     string
+			Time          string
+			IntervalUnit  string
+			IntervalCount int
+			Status        string
+			Username      string
+			TelegramID    int64
+			DoctorName    string
+			ServiceName   string
+			Upcoming      int
+		}
+		if err := rows.Scan(&s.ID, &s.StartDate, &s.Time, &s.IntervalUnit, &s.IntervalCount, &s.Status,
+			&s.Username, &s.TelegramID, &s.DoctorName, &s.ServiceName, &s.Upcoming); err == nil {
+			series = append(series, s)
+		}
+	}
+
+	var users []struct {
+		ID         int64
+		Username   string
+		TelegramID int64
+		Name       string
+	}
+	if userRows, err := db.Query(`
+		SELECT id, COALESCE(username, ''), COALESCE(telegram_id, 0),
+		       TRIM(COALESCE(first_name, '') || ' ' || COALESCE(last_name, ''))
+		FROM users ORDER BY username
+	`); err == nil {
+		defer userRows.Close()
+		for userRows.Next() {
+			var u struct {
+				ID         int64
+				Username   string
+				TelegramID int64
+				Name       string
+			}
+			if err := userRows.Scan(&u.ID, &u.Username, &u.TelegramID, &u.Name); err == nil {
+				users = append(users, u)
+			}
+		}
+	}
+
+	var doctors []struct {
+		ID   int64
+		Name string
+	}
+	if doctorRows, err := db.Query("SELECT id, name FROM doctors ORDER BY name"); err == nil {
+		defer doctorRows.Close()
+		for doctorRows.Next() {
+			var d struct {
+				ID   int64
+				Name string
+			}
+			if err := doctorRows.Scan(&d.ID, &d.Name); err == nil {
+				doctors = append(doctors, d)
+			}
+		}
+	}
+
+	var services []struct {
+		ID   int64
+		Name string
+	}
+	if serviceRows, err := db.Query("SELECT id, name FROM services ORDER BY category, name"); err == nil {
+		defer serviceRows.Close()
+		for serviceRows.Next() {
+			var s struct {
+				ID   int64
+				Name string
+			}
+			if err := serviceRows.Scan(&s.ID, &s.Name); err == nil {
+				services = append(services, s)
+			}
+		}
+	}
+
+	if data == nil {
+		data = gin.H{}
+	}
+	data["series"] = series
+	data["users"] = users
+	data["doctors"] = doctors
+	data["services"] = services
+	c.HTML(status, "admin_series.html", data)
+}
+
+// AdminSeriesHandler выводит список серий и создает новую серию
+func AdminSeriesHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodGet {
+			renderAdminSeries(c, db, http.StatusOK, nil)
+			return
+		}
+
+		// POST запрос - создание серии
+		var req seriesRequest
+		req.UserID, _ = strconv.ParseInt(c.PostForm("user_id"), 10, 64)
+		req.DoctorID, _ = strconv.ParseInt(c.PostForm("doctor_id"), 10, 64)
+		req.ServiceID, _ = strconv.ParseInt(c.PostForm("service_id"), 10, 64)
+		req.StartDate = c.PostForm("start_date")
+		req.Time = c.PostForm("time")
+		req.IntervalUnit = c.PostForm("interval_unit")
+		req.IntervalCount, _ = strconv.Atoi(c.PostForm("interval_count"))
+		req.Occurrences, _ = strconv.Atoi(c.PostForm("occurrences"))
+		req.UntilDate = c.PostForm("until_date")
+
+		seriesID, created, conflicts, err := createBookingSeries(db, req)
+		if err != nil {
+			renderAdminSeries(c, db, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if seriesID == 0 {
+			renderAdminSeries(c, db, http.StatusConflict, gin.H{
+				"error":     "Не удалось разместить ни одной записи серии",
+				"conflicts": conflicts,
+			})
+			return
+		}
+
+		renderAdminSeries(c, db, http.StatusOK, gin.H{
+			"message":   fmt.Sprintf("Серия #%d создана: %d записей", seriesID, len(created)),
+			"conflicts": conflicts,
+		})
+	}
+}
+
+// AdminCancelSeriesHandler отменяет будущие повторения серии и уведомляет пациента
+func AdminCancelSeriesHandler(db *sql.DB, bot *tgbotapi.BotAPI) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		seriesID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID серии"})
+			return
+		}
+		fromDate := c.PostForm("from_date")
+		if fromDate == "" {
+			fromDate = time.Now().Format("2006-01-02")
+		}
+
+		slots := seriesFreedSlots(db, seriesID, fromDate)
+
+		cancelled, err := cancelSeries(db, seriesID, fromDate)
+		if err != nil {
+			renderAdminSeries(c, db, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Предлагаем освободившееся время листу ожидания
+		go func() {
+			for _, slot := range slots {
+				offerFreedSlot(bot, db, slot)
+			}
+		}()
+
+		if telegramID := seriesTelegramID(db, seriesID); telegramID != 0 && cancelled > 0 {
+			msg := tgbotapi.NewMessage(telegramID, fmt.Sprintf("Ваши регулярные записи начиная с %s были отменены администратором.", fromDate))
+			bot.Send(msg)
+		}
+
+		c.Redirect(http.StatusFound, "/admin/series")
+	}
+}
+
+// AdminRescheduleSeriesHandler переносит будущие повторения серии и уведомляет пациента
+func AdminRescheduleSeriesHandler(db *sql.DB, bot *tgbotapi.BotAPI) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		seriesID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID серии"})
+			return
+		}
+
+		var req seriesRescheduleRequest
+		req.FromDate = c.PostForm("from_date")
+		req.Time = c.PostForm("time")
+		req.DoctorID, _ = strconv.ParseInt(c.PostForm("doctor_id"), 10, 64)
+		req.ShiftDays, _ = strconv.Atoi(c.PostForm("shift_days"))
+
+		moved, conflicts, err := rescheduleSeries(db, seriesID, req)
+		if err != nil {
+			renderAdminSeries(c, db, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if telegramID := seriesTelegramID(db, seriesID); telegramID != 0 && len(moved) > 0 {
+			text := "Ваши регулярные записи были перенесены администратором. Новые даты:\n"
+			for _, m := range moved {
+				text += fmt.Sprintf("• %s %s\n", m.Date, m.Time)
+			}
+			msg := tgbotapi.NewMessage(telegramID, text)
+			bot.Send(msg)
+		}
+
+		renderAdminSeries(c, db, http.StatusOK, gin.H{
+			"message":   fmt.Sprintf("Перенесено записей: %d", len(moved)),
+			"conflicts": conflicts,
+		})
+	}
+}
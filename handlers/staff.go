@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Роли сотрудников админки
+const (
+	staffRoleAdmin     = "admin"     // администратор: все разделы, медицинские записи только просмотр
+	staffRoleRegistrar = "registrar" // регистратура: записи и пациенты без медицинских данных
+	staffRoleDoctor    = "doctor"    // врач: ведет медицинские записи своих приемов
+)
+
+// staffRoleTitles названия ролей для админки
+var staffRoleTitles = map[string]string{
+	staffRoleAdmin:     "Администратор",
+	staffRoleRegistrar: "Регистратура",
+	staffRoleDoctor:    "Врач",
+}
+
+// staffSession сотрудник, вошедший в админку
+type staffSession struct {
+	ID       int64 // 0 - встроенная учетная запись администратора
+	Username string
+	Role     string
+	DoctorID int64
+}
+
+// currentStaff возвращает сотрудника текущей сессии.
+// Сессии, созданные до появления ролей, считаются администраторскими.
+func currentStaff(c *gin.Context) staffSession {
+	session := sessions.Default(c)
+	s := staffSession{Role: staffRoleAdmin}
+	if role, ok := session.Get("role").(string); ok && role != "" {
+		s.Role = role
+	}
+	if id, ok := session.Get("staff_id").(int64); ok {
+		s.ID = id
+	}
+	if username, ok := session.Get("username").(string); ok {
+		s.Username = username
+	}
+	if doctorID, ok := session.Get("doctor_id").(int64); ok {
+		s.DoctorID = doctorID
+	}
+	return s
+}
+
+// canViewClinical проверяет доступ к медицинским записям
+func (s staffSession) canViewClinical() bool {
+	return s.Role == staffRoleDoctor || s.Role == staffRoleAdmin
+}
+
+// AdminRoleMiddleware пропускает только сотрудников с указанными ролями
+func AdminRoleMiddleware(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := currentStaff(c).Role
+		for _, r := range roles {
+			if r == role {
+				c.Next()
+				return
+			}
+		}
+		if strings.HasPrefix(c.Request.URL.Path, "/admin/api/") {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Недостаточно прав"})
+			return
+		}
+		c.HTML(http.StatusForbidden, "error.html", gin.H{
+			"error": "Недостаточно прав для этого раздела",
+		})
+		c.Abort()
+	}
+}
+
+// authenticateStaff проверяет логин и пароль сотрудника
+func authenticateStaff(db *sql.DB, username, password string) (*staffSession, error) {
+	var s staffSession
+	var hash string
+	var doctorID sql.NullInt64
+	err := db.QueryRow(`
+		SELECT id, username, role, doctor_id, password_hash FROM staff_users WHERE username = ?
+	`, username).Scan(&s.ID, &s.Username, &s.Role, &doctorID, &hash)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return nil, nil
+	}
+	s.DoctorID = doctorID.Int64
+	return &s, nil
+}
+
+// staffUsersCount число сотрудников с указанной ролью, без роли - всех сотрудников.
+// При ошибке возвращает -1, чтобы не включить встроенный вход администратора
+func staffUsersCount(db *sql.DB, role ...string) int {
+	query := "SELECT COUNT(*) FROM staff_users"
+	var args []interface{}
+	if len(role) > 0 {
+		query += " WHERE role = ?"
+		args = append(args, role[0])
+	}
+	var n int
+	if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+		log.Printf("Error counting staff users: %v", err)
+		return -1
+	}
+	return n
+}
+
+// staffAccount учетная запись сотрудника
+type staffAccount struct {
+	ID         int64
+	Username   string
+	Role       string
+	RoleTitle  string
+	DoctorName string
+	CreatedAt  string
+}
+
+// renderAdminStaff выводит страницу сотрудников
+func renderAdminStaff(c *gin.Context, db *sql.DB, status int, errorText string) {
+	rows, err := db.Query(`
+		SELECT s.id, s.username, s.role, COALESCE(d.name, ''), COALESCE(s.created_at, '')
+		FROM staff_users s
+		LEFT JOIN doctors d ON s.doctor_id = d.id
+		ORDER BY s.username
+	`)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Ошибка при получении данных",
+		})
+		return
+	}
+	defer rows.Close()
+
+	var staff []staffAccount
+	for rows.Next() {
+		var s staffAccount
+		if err := rows.Scan(&s.ID, &s.Username, &s.Role, &s.DoctorName, &s.CreatedAt); err == nil {
+			s.RoleTitle = staffRoleTitles[s.Role]
+			staff = append(staff, s)
+		}
+	}
+
+	c.HTML(status, "admin_staff.html", gin.H{
+		"staff":   staff,
+		"roles":   staffRoleTitles,
+		"doctors": loadAdminFilterOptions(db, "SELECT id, name FROM doctors ORDER BY name"),
+		"error":   errorText,
+	})
+}
+
+// AdminStaffHandler выводит и добавляет учетные записи сотрудников
+func AdminStaffHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodGet {
+			renderAdminStaff(c, db, http.StatusOK, "")
+			return
+		}
+
+		// POST запрос - добавление сотрудника
+		username := strings.TrimSpace(c.PostForm("username"))
+		password := c.PostForm("password")
+		role := c.PostForm("role")
+		doctorID, _ := strconv.ParseInt(c.PostForm("doctor_id"), 10, 64)
+
+		if _, ok := staffRoleTitles[role]; !ok || username == "" || len(password) < 8 {
+			renderAdminStaff(c, db, http.StatusBadRequest, "Укажите логин, роль и пароль не короче 8 символов")
+			return
+		}
+		if role == staffRoleDoctor && doctorID == 0 {
+			renderAdminStaff(c, db, http.StatusBadRequest, "Для врача выберите его карточку врача")
+			return
+		}
+		if role != staffRoleDoctor {
+			doctorID = 0
+		}
+		// После первого сотрудника встроенный вход admin/admin отключается
+		if role != staffRoleAdmin && staffUsersCount(db) == 0 {
+			renderAdminStaff(c, db, http.StatusBadRequest, "Первым заведите сотрудника с ролью администратора: после этого вход admin/admin отключится")
+			return
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			renderAdminStaff(c, db, http.StatusInternalServerError, "Ошибка при сохранении сотрудника")
+			return
+		}
+		_, err = db.Exec(`
+			INSERT INTO staff_users (username, password_hash, role, doctor_id) VALUES (?, ?, ?, ?)
+		`, username, string(hash), role, nullInt64(doctorID))
+		if err != nil {
+			log.Printf("Error creating staff user: %v", err)
+			renderAdminStaff(c, db, http.StatusConflict, "Не удалось создать сотрудника: возможно, логин уже занят")
+			return
+		}
+
+		c.Redirect(http.StatusFound, "/admin/staff")
+	}
+}
+
+// AdminDeleteStaffHandler удаляет учетную запись сотрудника
+func AdminDeleteStaffHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var role string
+		db.QueryRow("SELECT role FROM staff_users WHERE id = ?", c.Param("id")).Scan(&role)
+		if role == staffRoleAdmin && staffUsersCount(db, staffRoleAdmin) == 1 && staffUsersCount(db) > 1 {
+			renderAdminStaff(c, db, http.StatusBadRequest, "Нельзя удалить последнего администратора")
+			return
+		}
+		if _, err := db.Exec("DELETE FROM staff_users WHERE id = ?", c.Param("id")); err != nil {
+			renderAdminStaff(c, db, http.StatusInternalServerError, "Ошибка при удалении сотрудника")
+			return
+		}
+		c.Redirect(http.StatusFound, "/admin/staff")
+	}
+}
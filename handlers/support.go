@@ -0,0 +1,431 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Направления сообщений переписки
+const (
+	supportDirectionIn  = "in"  // от пациента
+	supportDirectionOut = "out" // ответ клиники
+)
+
+const (
+	// supportMaxText ограничение Telegram на длину сообщения
+	supportMaxText = 4096
+	// supportThreadLimit сколько последних сообщений показывать в переписке
+	supportThreadLimit = 200
+	// supportInboxLimit сколько переписок показывать во входящих
+	supportInboxLimit = 200
+)
+
+// supportChatID чат администраторов, куда пересылаются сообщения пациентов, 0 - не пересылать
+var supportChatID int64
+
+// SetSupportChatID задает чат администраторов для переписки с пациентами.
+// Ответ реплаем на пересланное сообщение в этом чате уходит пациенту.
+func SetSupportChatID(chatID int64) {
+	supportChatID = chatID
+}
+
+// isSupportChat сообщение пришло из чата администраторов
+func isSupportChat(chatID int64) bool {
+	return supportChatID != 0 && chatID == supportChatID
+}
+
+// supportPatient пациент, с которым идет переписка
+type supportPatient struct {
+	ID         int64
+	TelegramID int64
+	Name       string
+	Username   string
+	Phone      string
+}
+
+func loadSupportPatient(db *sql.DB, userID int64) (supportPatient, error) {
+	var p supportPatient
+	err := db.QueryRow(`
+		SELECT id, COALESCE(telegram_id, 0),
+		       COALESCE(NULLIF(TRIM(COALESCE(first_name, '') || ' ' || COALESCE(last_name, '')), ''), username, ''),
+		       COALESCE(username, ''), COALESCE(phone, '')
+		FROM users WHERE id = ?
+	`, userID).Scan(&p.ID, &p.TelegramID, &p.Name, &p.Username, &p.Phone)
+	return p, err
+}
+
+// saveSupportMessageFromPatient сохраняет свободный текст пациента во входящие регистратуры
+// и пересылает его в чат администраторов
+func saveSupportMessageFromPatient(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB) {
+	chatID := message.Chat.ID
+	text := strings.TrimSpace(message.Text)
+	if text == "" {
+		bot.Send(tgbotapi.NewMessage(chatID, "Пожалуйста, используйте команды для взаимодействия с ботом. /help для получения списка команд."))
+		return
+	}
+
+	var userID int64
+	if err := db.QueryRow("SELECT id FROM users WHERE telegram_id = ?", chatID).Scan(&userID); err != nil {
+		log.Printf("Error getting user for support message: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Произошла ошибка. Попробуйте позже."))
+		return
+	}
+
+	// Подтверждаем прием только первого сообщения, пока регистратура его не прочитала
+	var unread int
+	db.QueryRow(`
+		SELECT COUNT(*) FROM support_messages WHERE user_id = ? AND direction = ? AND read_at IS NULL
+	`, userID, supportDirectionIn).Scan(&unread)
+
+	res, err := db.Exec(`
+		INSERT INTO support_messages (user_id, direction, text) VALUES (?, ?, ?)
+	`, userID, supportDirectionIn, text)
+	if err != nil {
+		log.Printf("Error saving support message: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Произошла ошибка. Попробуйте позже."))
+		return
+	}
+	messageID, _ := res.LastInsertId()
+
+	forwardSupportMessage(bot, db, userID, messageID, text)
+
+	if unread == 0 {
+		bot.Send(tgbotapi.NewMessage(chatID, "Сообщение передано администратору клиники, ответ придет в этот чат.\n\nДля записи и других действий используйте команды: /help"))
+	}
+}
+
+// forwardSupportMessage отправляет сообщение пациента в чат администраторов
+// и запоминает его номер, чтобы принять ответ реплаем
+func forwardSupportMessage(bot *tgbotapi.BotAPI, db *sql.DB, userID, messageID int64, text string) {
+	if supportChatID == 0 || bot == nil {
+		return
+	}
+	p, err := loadSupportPatient(db, userID)
+	if err != nil {
+		log.Printf("Error loading patient for support message: %v", err)
+		return
+	}
+
+	header := fmt.Sprintf("💬 Пациент №%d", p.ID)
+	if p.Name != "" {
+		header += ": " + p.Name
+	}
+	if p.Username != "" {
+		header += " (@" + p.Username + ")"
+	}
+	if p.Phone != "" {
+		header += ", " + p.Phone
+	}
+	sent, err := bot.Send(tgbotapi.NewMessage(supportChatID, header+"\n\n"+text+"\n\nОтветьте на это сообщение, чтобы написать пациенту."))
+	if err != nil {
+		log.Printf("Error forwarding support message: %v", err)
+		return
+	}
+	if _, err := db.Exec("UPDATE support_messages SET group_message_id = ? WHERE id = ?", sent.MessageID, messageID); err != nil {
+		log.Printf("Error saving support group message: %v", err)
+	}
+}
+
+// handleSupportChatMessage принимает ответ сотрудника реплаем в чате администраторов
+func handleSupportChatMessage(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB) {
+	if message.ReplyToMessage == nil || strings.TrimSpace(message.Text) == "" {
+		return
+	}
+
+	var userID int64
+	err := db.QueryRow(`
+		SELECT user_id FROM support_messages WHERE group_message_id = ? ORDER BY id DESC LIMIT 1
+	`, message.ReplyToMessage.MessageID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting support thread: %v", err)
+		return
+	}
+
+	author := ""
+	if message.From != nil {
+		author = strings.TrimSpace(message.From.FirstName + " " + message.From.LastName)
+		if author == "" {
+			author = message.From.UserName
+		}
+	}
+	if _, err := sendSupportReply(bot, db, userID, strings.TrimSpace(message.Text), author, 0); err != nil {
+		reply := tgbotapi.NewMessage(message.Chat.ID, "Не удалось отправить ответ пациенту: "+err.Error())
+		reply.ReplyToMessageID = message.MessageID
+		bot.Send(reply)
+	}
+}
+
+// sendSupportReply отправляет ответ клиники пациенту и отмечает его сообщения прочитанными.
+// Возвращает номер сохраненного ответа.
+func sendSupportReply(bot *tgbotapi.BotAPI, db *sql.DB, userID int64, text, author string, staffID int64) (int64, error) {
+	if text == "" {
+		return 0, fmt.Errorf("введите текст ответа")
+	}
+	if len([]rune(text)) > supportMaxText {
+		return 0, fmt.Errorf("ответ длиннее %d символов", supportMaxText)
+	}
+	p, err := loadSupportPatient(db, userID)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("пациент не найден")
+	}
+	if err != nil {
+		return 0, err
+	}
+	if p.TelegramID == 0 {
+		return 0, fmt.Errorf("пациент не пользуется ботом")
+	}
+	if bot == nil {
+		return 0, fmt.Errorf("бот недоступен")
+	}
+
+	if _, err := bot.Send(tgbotapi.NewMessage(p.TelegramID, "💬 Ответ клиники:\n\n"+text)); err != nil {
+		if apiErr, ok := err.(*tgbotapi.Error); ok && apiErr.Code == http.StatusForbidden {
+			return 0, fmt.Errorf("пациент заблокировал бота")
+		}
+		return 0, err
+	}
+
+	markSupportRead(db, userID)
+	res, err := db.Exec(`
+		INSERT INTO support_messages (user_id, direction, text, author, staff_id) VALUES (?, ?, ?, NULLIF(?, ''), ?)
+	`, userID, supportDirectionOut, text, author, nullInt64(staffID))
+	if err != nil {
+		// Пациент ответ уже получил, поэтому ошибку только логируем
+		log.Printf("Error saving support reply: %v", err)
+		return 0, nil
+	}
+	id, _ := res.LastInsertId()
+	return id, nil
+}
+
+// mirrorSupportReply копирует ответ из админки в чат администраторов, чтобы коллеги видели
+// всю переписку. На копию тоже можно ответить реплаем.
+func mirrorSupportReply(bot *tgbotapi.BotAPI, db *sql.DB, userID, replyID int64, author, text string) {
+	if supportChatID == 0 || bot == nil {
+		return
+	}
+	p, err := loadSupportPatient(db, userID)
+	if err != nil {
+		log.Printf("Error loading patient for support reply copy: %v", err)
+		return
+	}
+	sent, err := bot.Send(tgbotapi.NewMessage(supportChatID, fmt.Sprintf("↩️ %s ответил(а) пациенту №%d %s:\n\n%s", author, p.ID, p.Name, text)))
+	if err != nil {
+		log.Printf("Error copying support reply: %v", err)
+		return
+	}
+	if replyID != 0 {
+		db.Exec("UPDATE support_messages SET group_message_id = ? WHERE id = ?", sent.MessageID, replyID)
+	}
+}
+
+// markSupportRead отмечает сообщения пациента прочитанными
+func markSupportRead(db *sql.DB, userID int64) {
+	if _, err := db.Exec(`
+		UPDATE support_messages SET read_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND direction = ? AND read_at IS NULL
+	`, userID, supportDirectionIn); err != nil {
+		log.Printf("Error marking support messages read: %v", err)
+	}
+}
+
+// supportUnreadCount сколько сообщений пациентов не прочитано
+func supportUnreadCount(db *sql.DB) int {
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM support_messages WHERE direction = ? AND read_at IS NULL", supportDirectionIn).Scan(&n); err != nil {
+		log.Printf("Error counting unread support messages: %v", err)
+	}
+	return n
+}
+
+// supportThread переписка с пациентом во входящих
+type supportThread struct {
+	UserID      int64
+	PatientName string
+	Phone       string
+	LastText    string
+	LastOut     bool
+	LastAt      string
+	Unread      int
+}
+
+// supportMessage сообщение переписки
+type supportMessage struct {
+	ID        int64
+	Direction string
+	Text      string
+	Author    string
+	CreatedAt string
+	Unread    bool
+}
+
+// Incoming сообщение от пациента
+func (m supportMessage) Incoming() bool {
+	return m.Direction == supportDirectionIn
+}
+
+// loadSupportThreads переписки, последние сверху; unreadOnly - только с непрочитанными
+func loadSupportThreads(db *sql.DB, unreadOnly bool) ([]supportThread, error) {
+	query := `
+		SELECT m.user_id,
+		       COALESCE(NULLIF(TRIM(COALESCE(u.first_name, '') || ' ' || COALESCE(u.last_name, '')), ''), u.username, ''),
+		       COALESCE(u.phone, ''), m.text, m.direction = ?,
+		       COALESCE(strftime('%Y-%m-%d %H:%M', m.created_at, 'localtime'), ''),
+		       (SELECT COUNT(*) FROM support_messages x WHERE x.user_id = m.user_id AND x.direction = ? AND x.read_at IS NULL) AS unread
+		FROM support_messages m
+		JOIN users u ON m.user_id = u.id
+		WHERE m.id = (SELECT MAX(id) FROM support_messages WHERE user_id = m.user_id)`
+	if unreadOnly {
+		query += " AND unread > 0"
+	}
+	query += " ORDER BY m.id DESC LIMIT ?"
+
+	rows, err := db.Query(query, supportDirectionOut, supportDirectionIn, supportInboxLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var threads []supportThread
+	for rows.Next() {
+		var t supportThread
+		if err := rows.Scan(&t.UserID, &t.PatientName, &t.Phone, &t.LastText, &t.LastOut, &t.LastAt, &t.Unread); err != nil {
+			return nil, err
+		}
+		threads = append(threads, t)
+	}
+	return threads, rows.Err()
+}
+
+// loadSupportMessages последние сообщения переписки с пациентом по порядку
+func loadSupportMessages(db *sql.DB, userID int64) ([]supportMessage, error) {
+	rows, err := db.Query(`
+		SELECT id, direction, text, COALESCE(author, ''),
+		       COALESCE(strftime('%Y-%m-%d %H:%M', created_at, 'localtime'), ''),
+		       direction = ? AND read_at IS NULL
+		FROM (SELECT * FROM support_messages WHERE user_id = ? ORDER BY id DESC LIMIT ?)
+		ORDER BY id
+	`, supportDirectionIn, userID, supportThreadLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []supportMessage
+	for rows.Next() {
+		var m supportMessage
+		if err := rows.Scan(&m.ID, &m.Direction, &m.Text, &m.Author, &m.CreatedAt, &m.Unread); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// AdminSupportHandler входящие сообщения пациентов
+func AdminSupportHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		unreadOnly := c.Query("unread") == "1"
+		threads, err := loadSupportThreads(db, unreadOnly)
+		if err != nil {
+			log.Printf("Error getting support threads: %v", err)
+			c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Ошибка при получении данных",
+			})
+			return
+		}
+		c.HTML(http.StatusOK, "admin_support.html", gin.H{
+			"threads":     threads,
+			"unreadOnly":  unreadOnly,
+			"unread":      supportUnreadCount(db),
+			"inboxLimit":  supportInboxLimit,
+			"groupChatOn": supportChatID != 0,
+		})
+	}
+}
+
+// renderAdminSupportThread выводит переписку с пациентом
+func renderAdminSupportThread(c *gin.Context, db *sql.DB, userID int64, status int, errorText, draft string) {
+	p, err := loadSupportPatient(db, userID)
+	if err == sql.ErrNoRows {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{
+			"error": "Пациент не найден",
+		})
+		return
+	}
+	var messages []supportMessage
+	if err == nil {
+		messages, err = loadSupportMessages(db, userID)
+	}
+	if err != nil {
+		log.Printf("Error getting support thread: %v", err)
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Ошибка при получении данных",
+		})
+		return
+	}
+
+	// Открытая переписка считается прочитанной; непрочитанные подсвечиваются один раз
+	markSupportRead(db, userID)
+
+	c.HTML(status, "admin_support_thread.html", gin.H{
+		"patient":     p,
+		"messages":    messages,
+		"unread":      supportUnreadCount(db),
+		"threadLimit": supportThreadLimit,
+		"error":       errorText,
+		"draft":       draft,
+	})
+}
+
+// AdminSupportThreadHandler выводит переписку с пациентом и отправляет ответ через бота
+func AdminSupportThreadHandler(db *sql.DB, bot *tgbotapi.BotAPI) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.HTML(http.StatusBadRequest, "error.html", gin.H{
+				"error": "Неверный ID пациента",
+			})
+			return
+		}
+
+		if c.Request.Method == http.MethodGet {
+			renderAdminSupportThread(c, db, userID, http.StatusOK, "", "")
+			return
+		}
+
+		// POST запрос - ответ пациенту
+		text := strings.TrimSpace(c.PostForm("text"))
+		staff := currentStaff(c)
+		author := staff.Username
+		if author == "" {
+			author = staffRoleTitles[staff.Role]
+		}
+		replyID, err := sendSupportReply(bot, db, userID, text, author, staff.ID)
+		if err != nil {
+			log.Printf("Error sending support reply: %v", err)
+			renderAdminSupportThread(c, db, userID, http.StatusBadRequest, "Не удалось отправить ответ: "+err.Error(), text)
+			return
+		}
+		mirrorSupportReply(bot, db, userID, replyID, author, text)
+
+		c.Redirect(http.StatusFound, fmt.Sprintf("/admin/support/%d", userID))
+	}
+}
+
+// AdminSupportUnreadHandler число непрочитанных сообщений для счетчика
+func AdminSupportUnreadHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"unread": supportUnreadCount(db)})
+	}
+}
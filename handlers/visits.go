@@ -0,0 +1,495 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bookingStatusCompleted статус записи, по которой врач заполнил медицинскую запись
+const bookingStatusCompleted = "Завершено"
+
+// icd10Pattern формат кода МКБ-10: буква, две цифры и необязательное уточнение после точки
+var icd10Pattern = regexp.MustCompile(`^[A-Z][0-9]{2}(\.[0-9A-Z]{1,4})?$`)
+
+// dentalICD10 частые стоматологические диагнозы МКБ-10 для подсказок в форме
+var dentalICD10 = []struct {
+	Code  string
+	Title string
+}{
+	{"K00.6", "Нарушения прорезывания зубов"},
+	{"K01.1", "Ретинированные зубы"},
+	{"K02.0", "Кариес эмали"},
+	{"K02.1", "Кариес дентина"},
+	{"K02.2", "Кариес цемента"},
+	{"K03.0", "Повышенное стирание зубов"},
+	{"K03.6", "Отложения на зубах (зубной камень)"},
+	{"K04.0", "Пульпит"},
+	{"K04.1", "Некроз пульпы"},
+	{"K04.5", "Хронический апикальный периодонтит"},
+	{"K05.0", "Острый гингивит"},
+	{"K05.1", "Хронический гингивит"},
+	{"K05.3", "Хронический пародонтит"},
+	{"K07.3", "Аномалии положения зубов"},
+	{"K08.1", "Потеря зубов вследствие несчастного случая, удаления или болезни пародонта"},
+	{"K08.3", "Оставшийся корень зуба"},
+	{"K12.0", "Рецидивирующие афты полости рта"},
+}
+
+// toothNumberValid проверяет номер зуба по системе FDI: постоянные 11-48, молочные 51-85
+func toothNumberValid(n int) bool {
+	quadrant, tooth := n/10, n%10
+	switch {
+	case quadrant >= 1 && quadrant <= 4:
+		return tooth >= 1 && tooth <= 8
+	case quadrant >= 5 && quadrant <= 8:
+		return tooth >= 1 && tooth <= 5
+	}
+	return false
+}
+
+// parseTeeth разбирает список номеров зубов через запятую или пробел
+func parseTeeth(s string) (string, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' '
+	})
+	seen := make(map[int]bool)
+	var teeth []int
+	for _, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || !toothNumberValid(n) {
+			return "", fmt.Errorf("неверный номер зуба %q: используйте нумерацию FDI (11-48, 51-85)", f)
+		}
+		if !seen[n] {
+			seen[n] = true
+			teeth = append(teeth, n)
+		}
+	}
+	sort.Ints(teeth)
+	parts := make([]string, len(teeth))
+	for i, n := range teeth {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ","), nil
+}
+
+// visitDiagnosis диагноз приема
+type visitDiagnosis struct {
+	Code        string
+	Description string
+	Teeth       string
+}
+
+// visitProcedure выполненная процедура
+type visitProcedure struct {
+	Name  string
+	Teeth string
+}
+
+// visitRecord медицинская запись о приеме. В API для пациентов не отдается.
+type visitRecord struct {
+	ID          int64
+	BookingID   int64
+	Date        string
+	Time        string
+	ServiceName string
+	DoctorName  string
+	Notes       string
+	Diagnoses   []visitDiagnosis
+	Procedures  []visitProcedure
+	UpdatedAt   string
+}
+
+// loadVisitRecords возвращает медицинские записи по условию на bookings b
+func loadVisitRecords(db *sql.DB, where string, args ...interface{}) ([]visitRecord, error) {
+	rows, err := db.Query(`
+		SELECT v.id, v.booking_id, b.date, b.time, COALESCE(s.name, ''), COALESCE(d.name, ''),
+			   COALESCE(v.notes, ''), COALESCE(v.updated_at, '')
+		FROM visit_records v
+		JOIN bookings b ON v.booking_id = b.id
+		LEFT JOIN services s ON b.service_id = s.id
+		LEFT JOIN doctors d ON v.doctor_id = d.id
+		WHERE `+where+`
+		ORDER BY b.date DESC, b.time DESC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	var records []visitRecord
+	for rows.Next() {
+		var r visitRecord
+		if err := rows.Scan(&r.ID, &r.BookingID, &r.Date, &r.Time, &r.ServiceName, &r.DoctorName, &r.Notes, &r.UpdatedAt); err == nil {
+			records = append(records, r)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range records {
+		if records[i].Diagnoses, err = loadVisitDiagnoses(db, records[i].ID); err != nil {
+			return nil, err
+		}
+		if records[i].Procedures, err = loadVisitProcedures(db, records[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+func loadVisitDiagnoses(db *sql.DB, visitID int64) ([]visitDiagnosis, error) {
+	rows, err := db.Query(`
+		SELECT code, COALESCE(description, ''), COALESCE(teeth, '')
+		FROM visit_diagnoses WHERE visit_id = ? ORDER BY id
+	`, visitID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []visitDiagnosis
+	for rows.Next() {
+		var d visitDiagnosis
+		if err := rows.Scan(&d.Code, &d.Description, &d.Teeth); err == nil {
+			list = append(list, d)
+		}
+	}
+	return list, rows.Err()
+}
+
+func loadVisitProcedures(db *sql.DB, visitID int64) ([]visitProcedure, error) {
+	rows, err := db.Query(`
+		SELECT name, COALESCE(teeth, '') FROM visit_procedures WHERE visit_id = ? ORDER BY id
+	`, visitID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []visitProcedure
+	for rows.Next() {
+		var p visitProcedure
+		if err := rows.Scan(&p.Name, &p.Teeth); err == nil {
+			list = append(list, p)
+		}
+	}
+	return list, rows.Err()
+}
+
+// bookingDetails запись на странице просмотра
+type bookingDetails struct {
+	ID          int64
+	UserID      int64
+	DependentID int64
+	DoctorID    int64
+	Date        string
+	Time        string
+	Status      string
+	ServiceName string
+	DoctorName  string
+	ClientName  string
+	PatientName string
+	Phone       string
+
+	BasePrice     float64
+	Discount      float64
+	FinalPrice    float64
+	DiscountTitle string
+}
+
+func loadBookingDetails(db *sql.DB, id int64) (*bookingDetails, error) {
+	var b bookingDetails
+	err := db.QueryRow(`
+		SELECT b.id, b.user_id, COALESCE(b.dependent_id, 0), COALESCE(b.doctor_id, 0), b.date, b.time, b.status,
+			   COALESCE(s.name, ''), COALESCE(d.name, ''),
+			   COALESCE(NULLIF(TRIM(COALESCE(u.first_name, '') || ' ' || COALESCE(u.last_name, '')), ''), u.username, ''),
+			   COALESCE(dp.name, ''), COALESCE(u.phone, ''),
+			   COALESCE(b.base_price, s.price, 0), b.discount, COALESCE(b.final_price, s.price, 0), COALESCE(b.discount_title, '')
+		FROM bookings b
+		JOIN users u ON b.user_id = u.id
+		LEFT JOIN services s ON b.service_id = s.id
+		LEFT JOIN doctors d ON b.doctor_id = d.id
+		LEFT JOIN dependents dp ON b.dependent_id = dp.id
+		WHERE b.id = ?
+	`, id).Scan(&b.ID, &b.UserID, &b.DependentID, &b.DoctorID, &b.Date, &b.Time, &b.Status,
+		&b.ServiceName, &b.DoctorName, &b.ClientName, &b.PatientName, &b.Phone,
+		&b.BasePrice, &b.Discount, &b.FinalPrice, &b.DiscountTitle)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// visitEditError возвращает причину, по которой сотрудник не может вести запись о приеме
+func visitEditError(staff staffSession, b *bookingDetails) string {
+	if staff.Role != staffRoleDoctor {
+		return "Медицинские записи ведут только врачи"
+	}
+	if b.DoctorID != 0 && b.DoctorID != staff.DoctorID {
+		return "Это прием другого врача"
+	}
+	if b.Status == "Отменено" || b.Status == "Отменена" || b.Status == bookingStatusNoShow {
+		return "Прием не состоялся"
+	}
+	at, err := time.ParseInLocation("2006-01-02 15:04", b.Date+" "+b.Time, time.Local)
+	if err != nil || at.After(time.Now()) {
+		return "Медицинскую запись можно заполнить только после приема"
+	}
+	return ""
+}
+
+// renderAdminBooking выводит страницу записи с медицинской записью и историей приемов пациента
+func renderAdminBooking(c *gin.Context, db *sql.DB, id int64, status int, errorText string) {
+	booking, err := loadBookingDetails(db, id)
+	if err == sql.ErrNoRows {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{
+			"error": "Запись не найдена",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting booking: %v", err)
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Ошибка при получении данных",
+		})
+		return
+	}
+
+	files, err := loadPatientFiles(db, "f.booking_id = ?", id)
+	if err != nil {
+		log.Printf("Error getting booking files: %v", err)
+	}
+
+	payments, err := loadPayments(db, "booking_id = ?", id)
+	if err != nil {
+		log.Printf("Error getting booking payments: %v", err)
+	}
+
+	inv, err := loadInvoice(db, "i.booking_id = ?", id)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error getting booking invoice: %v", err)
+	}
+
+	staff := currentStaff(c)
+	data := gin.H{
+		"booking":  booking,
+		"files":    files,
+		"payments": payments,
+		"invoice":  inv,
+		"canInvoice": inv == nil && booking.Status == bookingStatusCompleted &&
+			(staff.Role == staffRoleRegistrar || staff.Role == staffRoleAdmin),
+		"clinical": staff.canViewClinical(),
+		"error":    errorText,
+	}
+
+	if staff.canViewClinical() {
+		records, err := loadVisitRecords(db, "v.booking_id = ?", id)
+		if err != nil {
+			log.Printf("Error getting visit record: %v", err)
+		}
+		if len(records) > 0 {
+			data["record"] = records[0]
+		}
+
+		// Прошлые приемы того же пациента: владельца аккаунта или члена семьи
+		history, err := loadVisitRecords(db, `b.user_id = ? AND COALESCE(b.dependent_id, 0) = ? AND b.id != ?`,
+			booking.UserID, booking.DependentID, id)
+		if err != nil {
+			log.Printf("Error getting visit history: %v", err)
+		}
+		data["history"] = history
+
+		data["editError"] = visitEditError(staff, booking)
+		data["icd10"] = dentalICD10
+		data["blankRows"] = []int{1, 2, 3} // пустые строки для новых диагнозов и процедур
+	}
+
+	c.HTML(status, "admin_booking.html", data)
+}
+
+// AdminBookingHandler выводит страницу записи
+func AdminBookingHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.HTML(http.StatusBadRequest, "error.html", gin.H{
+				"error": "Неверный ID записи",
+			})
+			return
+		}
+		renderAdminBooking(c, db, id, http.StatusOK, "")
+	}
+}
+
+// visitFormDiagnoses читает диагнозы из формы
+func visitFormDiagnoses(c *gin.Context) ([]visitDiagnosis, error) {
+	codes := c.PostFormArray("diagnosis_code")
+	descriptions := c.PostFormArray("diagnosis_description")
+	teeth := c.PostFormArray("diagnosis_teeth")
+
+	var list []visitDiagnosis
+	for i, code := range codes {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if code == "" {
+			continue
+		}
+		if !icd10Pattern.MatchString(code) {
+			return nil, fmt.Errorf("неверный код МКБ-10 %q", code)
+		}
+		d := visitDiagnosis{Code: code}
+		if i < len(descriptions) {
+			d.Description = strings.TrimSpace(descriptions[i])
+		}
+		if i < len(teeth) {
+			parsed, err := parseTeeth(teeth[i])
+			if err != nil {
+				return nil, err
+			}
+			d.Teeth = parsed
+		}
+		list = append(list, d)
+	}
+	return list, nil
+}
+
+// visitFormProcedures читает выполненные процедуры из формы
+func visitFormProcedures(c *gin.Context) ([]visitProcedure, error) {
+	names := c.PostFormArray("procedure_name")
+	teeth := c.PostFormArray("procedure_teeth")
+
+	var list []visitProcedure
+	for i, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		p := visitProcedure{Name: name}
+		if i < len(teeth) {
+			parsed, err := parseTeeth(teeth[i])
+			if err != nil {
+				return nil, err
+			}
+			p.Teeth = parsed
+		}
+		list = append(list, p)
+	}
+	return list, nil
+}
+
+// saveVisitRecord сохраняет медицинскую запись и отмечает прием завершенным
+func saveVisitRecord(db *sql.DB, bookingID int64, staff staffSession, notes string, diagnoses []visitDiagnosis, procedures []visitProcedure) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var visitID int64
+	err = tx.QueryRow("SELECT id FROM visit_records WHERE booking_id = ?", bookingID).Scan(&visitID)
+	switch {
+	case err == sql.ErrNoRows:
+		result, err := tx.Exec(`
+			INSERT INTO visit_records (booking_id, doctor_id, staff_id, notes) VALUES (?, ?, ?, ?)
+		`, bookingID, nullInt64(staff.DoctorID), nullInt64(staff.ID), notes)
+		if err != nil {
+			return err
+		}
+		if visitID, err = result.LastInsertId(); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		_, err = tx.Exec(`
+			UPDATE visit_records SET doctor_id = ?, staff_id = ?, notes = ?, updated_at = CURRENT_TIMESTAMP
+			WHERE id = ?
+		`, nullInt64(staff.DoctorID), nullInt64(staff.ID), notes, visitID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM visit_diagnoses WHERE visit_id = ?", visitID); err != nil {
+		return err
+	}
+	for _, d := range diagnoses {
+		if _, err := tx.Exec(`
+			INSERT INTO visit_diagnoses (visit_id, code, description, teeth) VALUES (?, ?, ?, ?)
+		`, visitID, d.Code, d.Description, d.Teeth); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM visit_procedures WHERE visit_id = ?", visitID); err != nil {
+		return err
+	}
+	for _, p := range procedures {
+		if _, err := tx.Exec(`
+			INSERT INTO visit_procedures (visit_id, name, teeth) VALUES (?, ?, ?)
+		`, visitID, p.Name, p.Teeth); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE bookings SET status = ?, completed_at = COALESCE(completed_at, CURRENT_TIMESTAMP) WHERE id = ?
+	`, bookingStatusCompleted, bookingID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AdminSaveVisitHandler сохраняет медицинскую запись о приеме
+func AdminSaveVisitHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.HTML(http.StatusBadRequest, "error.html", gin.H{
+				"error": "Неверный ID записи",
+			})
+			return
+		}
+		booking, err := loadBookingDetails(db, id)
+		if err != nil {
+			c.HTML(http.StatusNotFound, "error.html", gin.H{
+				"error": "Запись не найдена",
+			})
+			return
+		}
+
+		staff := currentStaff(c)
+		if reason := visitEditError(staff, booking); reason != "" {
+			renderAdminBooking(c, db, id, http.StatusForbidden, reason)
+			return
+		}
+
+		diagnoses, err := visitFormDiagnoses(c)
+		if err != nil {
+			renderAdminBooking(c, db, id, http.StatusBadRequest, err.Error())
+			return
+		}
+		procedures, err := visitFormProcedures(c)
+		if err != nil {
+			renderAdminBooking(c, db, id, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		notes := strings.TrimSpace(c.PostForm("notes"))
+		if err := saveVisitRecord(db, id, staff, notes, diagnoses, procedures); err != nil {
+			log.Printf("Error saving visit record: %v", err)
+			renderAdminBooking(c, db, id, http.StatusInternalServerError, "Ошибка при сохранении медицинской записи")
+			return
+		}
+
+		c.Redirect(http.StatusFound, fmt.Sprintf("/admin/bookings/%d", id))
+	}
+}
@@ -0,0 +1,553 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// Сколько пациентов из листа ожидания одновременно получают предложение
+	waitlistOfferBatch = 3
+	// Сколько минут действует предложение освободившегося времени
+	waitlistOfferMinutes = 30
+)
+
+// freedSlot описывает освободившееся после отмены время
+type freedSlot struct {
+	ServiceID int64
+	DoctorID  int64
+	Date      string
+	Time      string
+}
+
+// freedSlotForBooking возвращает время записи, которое освободится после ее отмены
+func freedSlotForBooking(db *sql.DB, bookingID int64) (freedSlot, error) {
+	var slot freedSlot
+	err := db.QueryRow(`
+		SELECT service_id, COALESCE(doctor_id, 0), date, time
+		FROM bookings
+		WHERE id = ? AND status NOT IN ('Отменено', 'Отменена')
+	`, bookingID).Scan(&slot.ServiceID, &slot.DoctorID, &slot.Date, &slot.Time)
+	return slot, err
+}
+
+// offerFreedSlot рассылает предложение освободившегося времени следующим пациентам из листа ожидания
+func offerFreedSlot(bot *tgbotapi.BotAPI, db *sql.DB, slot freedSlot) {
+	if slot.Date < time.Now().Format("2006-01-02") {
+		return
+	}
+
+	// Время могли уже занять в обычном порядке
+	if err := checkSlotAvailable(db, slot.ServiceID, slot.DoctorID, slot.Date, slot.Time, 0); err != nil {
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT w.id, COALESCE(u.telegram_id, 0)
+		FROM waitlist w
+		JOIN users u ON w.user_id = u.id
+		WHERE w.status = 'waiting' AND u.telegram_id IS NOT NULL AND COALESCE(u.is_blocked, 0) = 0
+		  AND w.service_id = ?
+		  AND (w.doctor_id IS NULL OR w.doctor_id = ? OR ? = 0)
+		  AND ? BETWEEN w.date_from AND w.date_to
+		  AND NOT EXISTS (
+			SELECT 1 FROM waitlist_offers o
+			WHERE o.waitlist_id = w.id AND o.service_id = ? AND COALESCE(o.doctor_id, 0) = ?
+			  AND o.date = ? AND o.time = ?
+		  )
+		ORDER BY w.created_at, w.id
+		LIMIT ?
+	`, slot.ServiceID, slot.DoctorID, slot.DoctorID, slot.Date,
+		slot.ServiceID, slot.DoctorID, slot.Date, slot.Time, waitlistOfferBatch)
+	if err != nil {
+		log.Printf("Error getting waitlist: %v", err)
+		return
+	}
+
+	type candidate struct {
+		WaitlistID int64
+		TelegramID int64
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.WaitlistID, &c.TelegramID); err == nil {
+			candidates = append(candidates, c)
+		}
+	}
+	rows.Close()
+
+	if len(candidates) == 0 {
+		return
+	}
+
+	var serviceName, doctorName string
+	db.QueryRow("SELECT name FROM services WHERE id = ?", slot.ServiceID).Scan(&serviceName)
+	if slot.DoctorID != 0 {
+		db.QueryRow("SELECT name FROM doctors WHERE id = ?", slot.DoctorID).Scan(&doctorName)
+	}
+
+	for _, c := range candidates {
+		result, err := db.Exec(`
+			INSERT INTO waitlist_offers (waitlist_id, service_id, doctor_id, date, time, expires_at)
+			VALUES (?, ?, ?, ?, ?, datetime('now', ?))
+		`, c.WaitlistID, slot.ServiceID, nullInt64(slot.DoctorID), slot.Date, slot.Time, fmt.Sprintf("+%d minutes", waitlistOfferMinutes))
+		if err != nil {
+			log.Printf("Error creating waitlist offer: %v", err)
+			continue
+		}
+		offerID, _ := result.LastInsertId()
+
+		text := fmt.Sprintf("🔔 Освободилось время!\n\nУслуга: %s\nДата: %s\nВремя: %s\n", serviceName, slot.Date, slot.Time)
+		if doctorName != "" {
+			text += fmt.Sprintf("Врач: %s\n", doctorName)
+		}
+		text += fmt.Sprintf("\nПредложение действует %d минут. Время получит тот, кто подтвердит первым.", waitlistOfferMinutes)
+
+		msg := tgbotapi.NewMessage(c.TelegramID, text)
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("Записаться", fmt.Sprintf("wl_take_%d", offerID)),
+				tgbotapi.NewInlineKeyboardButtonData("Отказаться", fmt.Sprintf("wl_skip_%d", offerID)),
+			),
+		)
+		if _, err := bot.Send(msg); err != nil {
+			log.Printf("Error sending waitlist offer: %v", err)
+		}
+	}
+}
+
+// handleWaitlistCallback обрабатывает callback'и листа ожидания (префикс wl_)
+func handleWaitlistCallback(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery, db *sql.DB) {
+	chatID := callback.Message.Chat.ID
+	parts := strings.Split(callback.Data, "_")
+	if len(parts) < 3 {
+		return
+	}
+
+	switch parts[1] {
+	case "join":
+		// wl_join_<serviceID>
+		showWaitlistDoctors(bot, chatID, parts[2], db)
+
+	case "doc":
+		// wl_doc_<serviceID>_<doctorID>
+		if len(parts) != 4 {
+			return
+		}
+		if doctorID, _ := strconv.ParseInt(parts[3], 10, 64); doctorID != 0 {
+			sendDoctorCard(bot, chatID, doctorID, db)
+		}
+		showWaitlistRanges(bot, chatID, parts[2], parts[3])
+
+	case "range":
+		// wl_range_<serviceID>_<doctorID>_<days>
+		if len(parts) != 5 {
+			return
+		}
+		serviceID, _ := strconv.ParseInt(parts[2], 10, 64)
+		doctorID, _ := strconv.ParseInt(parts[3], 10, 64)
+		days, _ := strconv.Atoi(parts[4])
+		joinWaitlist(bot, chatID, serviceID, doctorID, days, db)
+
+	case "take":
+		offerID, _ := strconv.ParseInt(parts[2], 10, 64)
+		takeWaitlistOffer(bot, chatID, offerID, db)
+
+	case "skip":
+		offerID, _ := strconv.ParseInt(parts[2], 10, 64)
+		declineWaitlistOffer(bot, chatID, offerID, db)
+
+	case "leave":
+		waitlistID, _ := strconv.ParseInt(parts[2], 10, 64)
+		leaveWaitlist(bot, chatID, waitlistID, db)
+	}
+}
+
+func showWaitlistDoctors(bot *tgbotapi.BotAPI, chatID int64, serviceID string, db *sql.DB) {
+	rows, err := db.Query("SELECT id, name FROM doctors ORDER BY name")
+	if err != nil {
+		log.Printf("Error getting doctors: %v", err)
+		msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении списка врачей. Попробуйте позже.")
+		bot.Send(msg)
+		return
+	}
+	defer rows.Close()
+
+	keyboard := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Любой врач", fmt.Sprintf("wl_doc_%s_0", serviceID)),
+		),
+	}
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			continue
+		}
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(name, fmt.Sprintf("wl_doc_%s_%d", serviceID, id)),
+		))
+	}
+
+	msg := tgbotapi.NewMessage(chatID, "Лист ожидания: выберите врача")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	bot.Send(msg)
+}
+
+func showWaitlistRanges(bot *tgbotapi.BotAPI, chatID int64, serviceID, doctorID string) {
+	ranges := []struct {
+		Days  int
+		Title string
+	}{
+		{3, "Ближайшие 3 дня"},
+		{7, "Ближайшая неделя"},
+		{14, "Ближайшие 2 недели"},
+		{30, "Ближайший месяц"},
+	}
+
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for _, r := range ranges {
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(r.Title, fmt.Sprintf("wl_range_%s_%s_%d", serviceID, doctorID, r.Days)),
+		))
+	}
+
+	msg := tgbotapi.NewMessage(chatID, "Лист ожидания: в какой период вам удобно прийти?")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	bot.Send(msg)
+}
+
+func joinWaitlist(bot *tgbotapi.BotAPI, chatID int64, serviceID, doctorID int64, days int, db *sql.DB) {
+	var userID int64
+	err := db.QueryRow("SELECT id FROM users WHERE telegram_id = ?", chatID).Scan(&userID)
+	if err != nil {
+		log.Printf("Error getting user ID: %v", err)
+		msg := tgbotapi.NewMessage(chatID, "Произошла ошибка. Попробуйте позже.")
+		bot.Send(msg)
+		return
+	}
+
+	dateFrom := time.Now().Format("2006-01-02")
+	dateTo := time.Now().AddDate(0, 0, days).Format("2006-01-02")
+
+	// Повторная запись в лист ожидания обновляет период
+	result, err := db.Exec(`
+		UPDATE waitlist SET date_from = ?, date_to = ?
+		WHERE user_id = ? AND service_id = ? AND COALESCE(doctor_id, 0) = ? AND status = 'waiting'
+	`, dateFrom, dateTo, userID, serviceID, doctorID)
+	if err == nil {
+		if n, _ := result.RowsAffected(); n == 0 {
+			_, err = db.Exec(`
+				INSERT INTO waitlist (user_id, service_id, doctor_id, date_from, date_to)
+				VALUES (?, ?, ?, ?, ?)
+			`, userID, serviceID, nullInt64(doctorID), dateFrom, dateTo)
+		}
+	}
+	if err != nil {
+		log.Printf("Error joining waitlist: %v", err)
+		msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при записи в лист ожидания. Попробуйте позже.")
+		bot.Send(msg)
+		return
+	}
+
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf(
+		"Вы в листе ожидания с %s по %s. Как только освободится подходящее время, мы пришлем предложение.\n\n/waitlist - посмотреть лист ожидания",
+		dateFrom, dateTo,
+	))
+	bot.Send(msg)
+}
+
+// takeWaitlistOffer атомарно закрепляет освободившееся время за первым подтвердившим пациентом
+func takeWaitlistOffer(bot *tgbotapi.BotAPI, chatID int64, offerID int64, db *sql.DB) {
+	reply := func(text string) {
+		msg := tgbotapi.NewMessage(chatID, text)
+		bot.Send(msg)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		reply("Произошла ошибка. Попробуйте позже.")
+		return
+	}
+	defer tx.Rollback()
+
+	var waitlistID, userID int64
+	var slot freedSlot
+	err = tx.QueryRow(`
+		SELECT o.waitlist_id, w.user_id, o.service_id, COALESCE(o.doctor_id, 0), o.date, o.time
+		FROM waitlist_offers o
+		JOIN waitlist w ON o.waitlist_id = w.id
+		JOIN users u ON w.user_id = u.id
+		WHERE o.id = ? AND u.telegram_id = ?
+	`, offerID, chatID).Scan(&waitlistID, &userID, &slot.ServiceID, &slot.DoctorID, &slot.Date, &slot.Time)
+	if err != nil {
+		reply("Предложение не найдено.")
+		return
+	}
+
+	result, err := tx.Exec(`
+		UPDATE waitlist_offers SET status = 'accepted'
+		WHERE id = ? AND status = 'pending' AND expires_at > datetime('now')
+	`, offerID)
+	if err != nil {
+		log.Printf("Error accepting waitlist offer: %v", err)
+		reply("Произошла ошибка. Попробуйте позже.")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		reply("К сожалению, это предложение больше недоступно.")
+		return
+	}
+
+	bookingID, err := insertBooking(tx, bookingParams{
+		UserID:    userID,
+		ServiceID: slot.ServiceID,
+		DoctorID:  slot.DoctorID,
+		Date:      slot.Date,
+		Time:      slot.Time,
+	})
+	if err == errSlotTaken {
+		tx.Rollback()
+		db.Exec("UPDATE waitlist_offers SET status = 'taken' WHERE id = ?", offerID)
+		reply("К сожалению, это время уже заняли. Вы остаетесь в листе ожидания.")
+		return
+	}
+	if le, ok := err.(*limitError); ok {
+		tx.Rollback()
+		db.Exec("UPDATE waitlist_offers SET status = 'declined' WHERE id = ?", offerID)
+		reply("Не удалось записаться: " + le.reason + ".")
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating booking from waitlist: %v", err)
+		reply("Произошла ошибка при создании записи. Попробуйте позже.")
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE waitlist SET status = 'booked' WHERE id = ?", waitlistID); err != nil {
+		log.Printf("Error updating waitlist: %v", err)
+		reply("Произошла ошибка. Попробуйте позже.")
+		return
+	}
+
+	// Остальные предложения на это время больше не действуют, когда в нем не осталось мест:
+	// в групповой услуге время остается доступным и для других ожидающих
+	_, free, err := slotSeats(tx, slot.ServiceID, slot.DoctorID, slot.Date, slot.Time, 0)
+	if err != nil {
+		log.Printf("Error getting free seats: %v", err)
+		reply("Произошла ошибка. Попробуйте позже.")
+		return
+	}
+	var others []int64
+	if free == 0 {
+		rows, err := tx.Query(`
+			SELECT COALESCE(u.telegram_id, 0)
+			FROM waitlist_offers o
+			JOIN waitlist w ON o.waitlist_id = w.id
+			JOIN users u ON w.user_id = u.id
+			WHERE o.id != ? AND o.status = 'pending' AND o.service_id = ? AND COALESCE(o.doctor_id, 0) = ?
+			  AND o.date = ? AND o.time = ?
+		`, offerID, slot.ServiceID, slot.DoctorID, slot.Date, slot.Time)
+		if err != nil {
+			log.Printf("Error getting competing offers: %v", err)
+			reply("Произошла ошибка. Попробуйте позже.")
+			return
+		}
+		for rows.Next() {
+			var telegramID int64
+			if err := rows.Scan(&telegramID); err == nil {
+				others = append(others, telegramID)
+			}
+		}
+		rows.Close()
+
+		_, err = tx.Exec(`
+			UPDATE waitlist_offers SET status = 'taken'
+			WHERE id != ? AND status = 'pending' AND service_id = ? AND COALESCE(doctor_id, 0) = ?
+			  AND date = ? AND time = ?
+		`, offerID, slot.ServiceID, slot.DoctorID, slot.Date, slot.Time)
+		if err != nil {
+			log.Printf("Error closing competing offers: %v", err)
+			reply("Произошла ошибка. Попробуйте позже.")
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing waitlist booking: %v", err)
+		reply("Произошла ошибка при создании записи. Попробуйте позже.")
+		return
+	}
+
+	reply(fmt.Sprintf("✅ Вы записаны на %s в %s (запись #%d). Мы свяжемся с вами для подтверждения.", slot.Date, slot.Time, bookingID))
+
+	for _, telegramID := range others {
+		msg := tgbotapi.NewMessage(telegramID, fmt.Sprintf("Время %s %s уже заняли. Вы остаетесь в листе ожидания.", slot.Date, slot.Time))
+		bot.Send(msg)
+	}
+}
+
+// declineWaitlistOffer отклоняет предложение и передает время следующим в очереди
+func declineWaitlistOffer(bot *tgbotapi.BotAPI, chatID int64, offerID int64, db *sql.DB) {
+	var slot freedSlot
+	err := db.QueryRow(`
+		SELECT o.service_id, COALESCE(o.doctor_id, 0), o.date, o.time
+		FROM waitlist_offers o
+		JOIN waitlist w ON o.waitlist_id = w.id
+		JOIN users u ON w.user_id = u.id
+		WHERE o.id = ? AND u.telegram_id = ? AND o.status = 'pending'
+	`, offerID, chatID).Scan(&slot.ServiceID, &slot.DoctorID, &slot.Date, &slot.Time)
+	if err != nil {
+		msg := tgbotapi.NewMessage(chatID, "Предложение больше недоступно.")
+		bot.Send(msg)
+		return
+	}
+
+	if _, err := db.Exec("UPDATE waitlist_offers SET status = 'declined' WHERE id = ?", offerID); err != nil {
+		log.Printf("Error declining waitlist offer: %v", err)
+		return
+	}
+
+	msg := tgbotapi.NewMessage(chatID, "Хорошо, вы остаетесь в листе ожидания.")
+	bot.Send(msg)
+
+	if !slotOffersCoverSeats(db, slot) {
+		offerFreedSlot(bot, db, slot)
+	}
+}
+
+// slotOffersCoverSeats проверяет, хватает ли действующих предложений на свободные места во времени.
+// Принятые предложения уже стали записями и учтены в slotSeats, поэтому считаются только
+// неистекшие ожидающие ответа: после отмены такой записи время снова предлагается
+func slotOffersCoverSeats(db *sql.DB, slot freedSlot) bool {
+	_, free, err := slotSeats(db, slot.ServiceID, slot.DoctorID, slot.Date, slot.Time, 0)
+	if err != nil {
+		log.Printf("Error getting free seats: %v", err)
+		return true
+	}
+	var pending int
+	err = db.QueryRow(`
+		SELECT COUNT(*)
+		FROM waitlist_offers
+		WHERE service_id = ? AND COALESCE(doctor_id, 0) = ? AND date = ? AND time = ?
+		  AND status = 'pending' AND expires_at > datetime('now')
+	`, slot.ServiceID, slot.DoctorID, slot.Date, slot.Time).Scan(&pending)
+	if err != nil {
+		log.Printf("Error counting waitlist offers: %v", err)
+		return true
+	}
+	return pending >= free
+}
+
+func leaveWaitlist(bot *tgbotapi.BotAPI, chatID int64, waitlistID int64, db *sql.DB) {
+	_, err := db.Exec(`
+		UPDATE waitlist SET status = 'cancelled'
+		WHERE id = ? AND user_id = (SELECT id FROM users WHERE telegram_id = ?)
+	`, waitlistID, chatID)
+	if err != nil {
+		log.Printf("Error leaving waitlist: %v", err)
+		msg := tgbotapi.NewMessage(chatID, "Произошла ошибка. Попробуйте позже.")
+		bot.Send(msg)
+		return
+	}
+
+	msg := tgbotapi.NewMessage(chatID, "Вы покинули лист ожидания.")
+	bot.Send(msg)
+}
+
+func showUserWaitlist(bot *tgbotapi.BotAPI, chatID int64, db *sql.DB, userID int64) {
+	rows, err := db.Query(`
+		SELECT w.id, s.name, COALESCE(d.name, ''), w.date_from, w.date_to
+		FROM waitlist w
+		JOIN services s ON w.service_id = s.id
+		LEFT JOIN doctors d ON w.doctor_id = d.id
+		WHERE w.user_id = ? AND w.status = 'waiting'
+		ORDER BY w.created_at
+	`, userID)
+	if err != nil {
+		msg := tgbotapi.NewMessage(chatID, "Ошибка при получении листа ожидания")
+		bot.Send(msg)
+		return
+	}
+	defer rows.Close()
+
+	var lines []string
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for rows.Next() {
+		var id int64
+		var serviceName, doctorName, dateFrom, dateTo string
+		if err := rows.Scan(&id, &serviceName, &doctorName, &dateFrom, &dateTo); err != nil {
+			continue
+		}
+		if doctorName == "" {
+			doctorName = "любой врач"
+		}
+		lines = append(lines, fmt.Sprintf("• %s (%s)\n  с %s по %s", serviceName, doctorName, dateFrom, dateTo))
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Покинуть: "+serviceName, fmt.Sprintf("wl_leave_%d", id)),
+		))
+	}
+
+	if len(lines) == 0 {
+		msg := tgbotapi.NewMessage(chatID, "Вы не стоите в листе ожидания")
+		bot.Send(msg)
+		return
+	}
+
+	msg := tgbotapi.NewMessage(chatID, "Ваш лист ожидания:\n\n"+strings.Join(lines, "\n\n"))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	bot.Send(msg)
+}
+
+// RunWaitlistWorker периодически закрывает просроченные предложения и передает время следующим в очереди
+func RunWaitlistWorker(bot *tgbotapi.BotAPI, db *sql.DB) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		processExpiredWaitlistOffers(bot, db)
+	}
+}
+
+func processExpiredWaitlistOffers(bot *tgbotapi.BotAPI, db *sql.DB) {
+	rows, err := db.Query(`
+		SELECT DISTINCT service_id, COALESCE(doctor_id, 0), date, time
+		FROM waitlist_offers
+		WHERE status = 'pending' AND expires_at <= datetime('now')
+	`)
+	if err != nil {
+		log.Printf("Error getting expired waitlist offers: %v", err)
+		return
+	}
+	var slots []freedSlot
+	for rows.Next() {
+		var s freedSlot
+		if err := rows.Scan(&s.ServiceID, &s.DoctorID, &s.Date, &s.Time); err == nil {
+			slots = append(slots, s)
+		}
+	}
+	rows.Close()
+
+	if _, err := db.Exec("UPDATE waitlist_offers SET status = 'expired' WHERE status = 'pending' AND expires_at <= datetime('now')"); err != nil {
+		log.Printf("Error expiring waitlist offers: %v", err)
+		return
+	}
+
+	if _, err := db.Exec("UPDATE waitlist SET status = 'expired' WHERE status = 'waiting' AND date_to < date('now')"); err != nil {
+		log.Printf("Error expiring waitlist: %v", err)
+	}
+
+	for _, slot := range slots {
+		if !slotOffersCoverSeats(db, slot) {
+			offerFreedSlot(bot, db, slot)
+		}
+	}
+}
@@ -0,0 +1,510 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// walkInBookingDays на сколько дней вперед можно выбрать дату в форме записи
+const walkInBookingDays = 60
+
+// normalizePhone приводит российский номер к виду +7XXXXXXXXXX.
+// Возвращает пустую строку, если номер не распознан.
+func normalizePhone(phone string) string {
+	var digits strings.Builder
+	for _, c := range phone {
+		if c >= '0' && c <= '9' {
+			digits.WriteRune(c)
+		}
+	}
+	d := digits.String()
+	switch {
+	case len(d) == 11 && (d[0] == '7' || d[0] == '8'):
+		return "+7" + d[1:]
+	case len(d) == 10:
+		return "+7" + d
+	}
+	return ""
+}
+
+// adminPatient пациент в форме записи из админки
+type adminPatient struct {
+	ID          int64
+	Name        string
+	Username    string
+	Phone       string
+	HasTelegram bool
+}
+
+// searchPatients ищет пациентов по имени, username или телефону
+func searchPatients(db *sql.DB, query string) ([]adminPatient, error) {
+	like := "%" + query + "%"
+	phoneLike := like
+	if phone := normalizePhone(query); phone != "" {
+		phoneLike = "%" + phone + "%"
+	}
+	rows, err := db.Query(`
+		SELECT id, TRIM(COALESCE(first_name, '') || ' ' || COALESCE(last_name, '')),
+			   COALESCE(username, ''), COALESCE(phone, ''), telegram_id IS NOT NULL
+		FROM users
+		WHERE first_name LIKE ? OR last_name LIKE ?
+		   OR (COALESCE(first_name, '') || ' ' || COALESCE(last_name, '')) LIKE ?
+		   OR username LIKE ? OR phone LIKE ? OR phone LIKE ?
+		ORDER BY first_name, last_name
+		LIMIT 20
+	`, like, like, like, like, like, phoneLike)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var patients []adminPatient
+	for rows.Next() {
+		var p adminPatient
+		if err := rows.Scan(&p.ID, &p.Name, &p.Username, &p.Phone, &p.HasTelegram); err == nil {
+			patients = append(patients, p)
+		}
+	}
+	return patients, rows.Err()
+}
+
+// loadPatient возвращает пациента по ID
+func loadPatient(db *sql.DB, id int64) (*adminPatient, error) {
+	var p adminPatient
+	err := db.QueryRow(`
+		SELECT id, TRIM(COALESCE(first_name, '') || ' ' || COALESCE(last_name, '')),
+			   COALESCE(username, ''), COALESCE(phone, ''), telegram_id IS NOT NULL
+		FROM users WHERE id = ?
+	`, id).Scan(&p.ID, &p.Name, &p.Username, &p.Phone, &p.HasTelegram)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// createWalkInPatient создает пациента без Telegram. Если пациент с таким телефоном
+// уже есть, возвращает его, чтобы не плодить дубликаты.
+func createWalkInPatient(db *sql.DB, firstName, lastName, phone string) (int64, error) {
+	var id int64
+	err := db.QueryRow("SELECT id FROM users WHERE phone = ? ORDER BY telegram_id IS NULL, id LIMIT 1", phone).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO users (telegram_id, first_name, last_name, phone)
+		VALUES (NULL, ?, ?, ?)
+	`, firstName, lastName, phone)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// mergePatients переносит записи, серии, лист ожидания и членов семьи пациента fromID
+// к пациенту toID, дополняет пустые поля карточки и удаляет fromID
+func mergePatients(tx *sql.Tx, fromID, toID int64) error {
+	var from struct {
+		TelegramID    sql.NullInt64
+		Username      string
+		FirstName     string
+		LastName      string
+		Phone         string
+		PhoneVerified bool
+		Notes         string
+		IsBlocked     bool
+		BlockedReason string
+	}
+	err := tx.QueryRow(`
+		SELECT telegram_id, COALESCE(username, ''), COALESCE(first_name, ''), COALESCE(last_name, ''),
+			   COALESCE(phone, ''), COALESCE(phone_verified, 0), COALESCE(notes, ''),
+			   COALESCE(is_blocked, 0), COALESCE(blocked_reason, '')
+		FROM users WHERE id = ?
+	`, fromID).Scan(&from.TelegramID, &from.Username, &from.FirstName, &from.LastName,
+		&from.Phone, &from.PhoneVerified, &from.Notes, &from.IsBlocked, &from.BlockedReason)
+	if err != nil {
+		return err
+	}
+
+	var toTelegramID sql.NullInt64
+	if err := tx.QueryRow("SELECT telegram_id FROM users WHERE id = ?", toID).Scan(&toTelegramID); err != nil {
+		return err
+	}
+	if from.TelegramID.Valid && toTelegramID.Valid {
+		return errMergeTelegramConflict
+	}
+
+	// Одну рассылку пациент получает один раз: у дубликата остаются только рассылки, которых не было у основной карточки
+	if _, err := tx.Exec(`
+		DELETE FROM broadcast_recipients
+		WHERE user_id = ? AND broadcast_id IN (SELECT broadcast_id FROM broadcast_recipients WHERE user_id = ?)
+	`, fromID, toID); err != nil {
+		return err
+	}
+
+	for _, table := range []string{"bookings", "booking_series", "waitlist", "dependents", "tooth_chart_entries", "patient_files", "payments", "support_messages", "bot_sessions", "reviews", "broadcast_recipients", "recalls"} {
+		if _, err := tx.Exec("UPDATE "+table+" SET user_id = ? WHERE user_id = ?", toID, fromID); err != nil {
+			return err
+		}
+	}
+
+	// Удаляем дубликат до обновления карточки: telegram_id уникален
+	if _, err := tx.Exec("DELETE FROM users WHERE id = ?", fromID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE users SET
+			telegram_id = COALESCE(telegram_id, ?),
+			username = COALESCE(NULLIF(username, ''), ?),
+			first_name = COALESCE(NULLIF(first_name, ''), ?),
+			last_name = COALESCE(NULLIF(last_name, ''), ?),
+			phone_verified = CASE WHEN COALESCE(phone, '') = '' THEN ? ELSE phone_verified END,
+			phone = COALESCE(NULLIF(phone, ''), ?),
+			notes = TRIM(COALESCE(notes, '') || CHAR(10) || ?, CHAR(10)),
+			is_blocked = MAX(COALESCE(is_blocked, 0), ?),
+			blocked_reason = COALESCE(NULLIF(blocked_reason, ''), ?)
+		WHERE id = ?
+	`, from.TelegramID, nullString(from.Username), nullString(from.FirstName), nullString(from.LastName),
+		from.PhoneVerified, nullString(from.Phone), from.Notes, from.IsBlocked, nullString(from.BlockedReason), toID)
+	return err
+}
+
+// nullString превращает пустую строку в NULL для базы данных
+func nullString(v string) interface{} {
+	if v == "" {
+		return nil
+	}
+	return v
+}
+
+// linkWalkInPatients привязывает к Telegram-аккаунту пациентов, записанных администратором
+// без Telegram с тем же телефоном. Вызывается только для номера из контакта Telegram.
+// Возвращает количество привязанных карточек.
+func linkWalkInPatients(db *sql.DB, userID int64, phone string) (int, error) {
+	phone = normalizePhone(phone)
+	if phone == "" {
+		return 0, nil
+	}
+
+	rows, err := db.Query("SELECT id FROM users WHERE telegram_id IS NULL AND phone = ? AND id != ?", phone, userID)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		if err := mergePatients(tx, id, userID); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+// requestPhoneContact просит пациента поделиться своим контактом кнопкой Telegram
+func requestPhoneContact(bot *tgbotapi.BotAPI, chatID int64) {
+	msg := tgbotapi.NewMessage(chatID, "Нажмите кнопку ниже, чтобы отправить свой номер телефона. Если вы записывались в клинике по этому номеру, мы привяжем записи к вашему аккаунту.")
+	keyboard := tgbotapi.NewReplyKeyboard(tgbotapi.NewKeyboardButtonRow(
+		tgbotapi.NewKeyboardButtonContact("📱 Отправить мой номер"),
+	))
+	keyboard.OneTimeKeyboard = true
+	msg.ReplyMarkup = keyboard
+	bot.Send(msg)
+}
+
+// handleContactMessage подтверждает телефон по контакту, который пациент отправил кнопкой.
+// Telegram сам подставляет номер владельца аккаунта, поэтому только после этого
+// к аккаунту привязываются карточки, заведенные администратором по тому же телефону
+func handleContactMessage(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB, userID int64) {
+	chatID := message.Chat.ID
+	reply := func(text string) {
+		msg := tgbotapi.NewMessage(chatID, text)
+		msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
+		bot.Send(msg)
+	}
+
+	// Чужой контакт, пересланный или выбранный из записной книжки, не подтверждает номер
+	if message.From == nil || message.Contact.UserID != message.From.ID {
+		reply("Это не ваш контакт. Чтобы подтвердить номер, отправьте свой контакт командой /phone.")
+		return
+	}
+	phone := normalizePhone(message.Contact.PhoneNumber)
+	if phone == "" {
+		reply("Не удалось распознать номер телефона. Запись по другим номерам возможна через администратора клиники.")
+		return
+	}
+
+	_, err := db.Exec(`
+		UPDATE users SET phone = ?, phone_verified = 1, confirmation_code = NULL, code_expires_at = NULL,
+			state = CASE WHEN state IN ('waiting_for_phone', 'waiting_for_code') THEN 'ready' ELSE state END
+		WHERE id = ?
+	`, phone, userID)
+	if err != nil {
+		log.Printf("Error saving contact phone: %v", err)
+		reply("Произошла ошибка при сохранении номера телефона. Попробуйте позже.")
+		return
+	}
+	trackFunnelStep(db, chatID, funnelStepPhoneVerified, "")
+
+	text := "Номер телефона " + phone + " подтвержден."
+	linked, err := linkWalkInPatients(db, userID, phone)
+	if err != nil {
+		log.Printf("Error linking walk-in patient: %v", err)
+	} else if linked > 0 {
+		text += "\nМы нашли ваши записи в клинике и привязали их к этому аккаунту. Посмотреть их можно командой /my_bookings."
+	}
+	reply(text)
+}
+
+// walkInTimeSlot время в форме записи
+type walkInTimeSlot struct {
+	Time string
+	Free int
+}
+
+// walkInFreeTimes возвращает свободное время врача на дату с учетом расписания и занятости
+func walkInFreeTimes(db *sql.DB, serviceID, doctorID int64, date string) ([]walkInTimeSlot, string, error) {
+	day, err := time.ParseInLocation("2006-01-02", date, time.Local)
+	if err != nil {
+		return nil, "", err
+	}
+
+	reason, err := dayLimitViolation(db, serviceID, doctorID, date, 0)
+	if err != nil || reason != "" {
+		return nil, reason, err
+	}
+
+	schedule, err := loadCalendarSchedule(db, date, date)
+	if err != nil {
+		return nil, "", err
+	}
+	workDay := schedule.day(doctorID, day)
+	if len(workDay.Shifts) == 0 {
+		return nil, "Врач не принимает в этот день: " + workDay.OffReason, nil
+	}
+
+	start, end := defaultWorkStart, defaultWorkEnd
+	for i, shift := range workDay.Shifts {
+		if i == 0 || shift.Start < start {
+			start = shift.Start
+		}
+		if i == 0 || shift.End > end {
+			end = shift.End
+		}
+	}
+	from, _ := time.Parse("15:04", start)
+	to, _ := time.Parse("15:04", end)
+
+	now := time.Now()
+	var slots []walkInTimeSlot
+	for t := from; t.Before(to); t = t.Add(calendarStep) {
+		timeStr := t.Format("15:04")
+		if state, _ := workDay.slotState(timeStr); state != "free" {
+			continue
+		}
+		at, _ := time.ParseInLocation("2006-01-02 15:04", date+" "+timeStr, time.Local)
+		if at.Before(now) {
+			continue
+		}
+		_, free, err := slotSeats(db, serviceID, doctorID, date, timeStr, 0)
+		if err != nil {
+			return nil, "", err
+		}
+		if free > 0 {
+			slots = append(slots, walkInTimeSlot{Time: timeStr, Free: free})
+		}
+	}
+	if len(slots) == 0 {
+		return nil, "На этот день нет свободного времени", nil
+	}
+	return slots, "", nil
+}
+
+// walkInForm состояние формы записи из админки
+type walkInForm struct {
+	Query       string
+	UserID      int64
+	DependentID int64
+	ServiceID   int64
+	DoctorID    int64
+	Date        string
+	Time        string
+}
+
+func walkInFormFromRequest(c *gin.Context) walkInForm {
+	value := func(key string) string {
+		if v := c.PostForm(key); v != "" {
+			return v
+		}
+		return c.Query(key)
+	}
+	f := walkInForm{
+		Query: strings.TrimSpace(value("q")),
+		Date:  value("date"),
+		Time:  value("time"),
+	}
+	f.UserID, _ = strconv.ParseInt(value("user_id"), 10, 64)
+	f.DependentID, _ = strconv.ParseInt(value("dependent_id"), 10, 64)
+	f.ServiceID, _ = strconv.ParseInt(value("service_id"), 10, 64)
+	f.DoctorID, _ = strconv.ParseInt(value("doctor_id"), 10, 64)
+	return f
+}
+
+// renderWalkInForm выводит форму записи пациента администратором
+func renderWalkInForm(c *gin.Context, db *sql.DB, status int, f walkInForm, errorText string) {
+	data := gin.H{
+		"form":     f,
+		"error":    errorText,
+		"services": loadAdminFilterOptions(db, "SELECT id, name FROM services ORDER BY name"),
+		"doctors":  loadAdminFilterOptions(db, "SELECT id, name FROM doctors ORDER BY name"),
+		"minDate":  time.Now().Format("2006-01-02"),
+		"maxDate":  time.Now().AddDate(0, 0, walkInBookingDays).Format("2006-01-02"),
+	}
+
+	if f.UserID == 0 {
+		if f.Query != "" {
+			patients, err := searchPatients(db, f.Query)
+			if err != nil {
+				log.Printf("Error searching patients: %v", err)
+			}
+			data["patients"] = patients
+			data["searched"] = true
+		}
+		c.HTML(status, "admin_booking_new.html", data)
+		return
+	}
+
+	patient, err := loadPatient(db, f.UserID)
+	if err != nil {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{
+			"error": "Пациент не найден",
+		})
+		return
+	}
+	data["patient"] = patient
+	data["dependents"] = loadAdminFilterOptions(db, fmt.Sprintf("SELECT id, name FROM dependents WHERE user_id = %d ORDER BY name", f.UserID))
+
+	if f.ServiceID != 0 && f.Date != "" {
+		slots, reason, err := walkInFreeTimes(db, f.ServiceID, f.DoctorID, f.Date)
+		if err != nil {
+			log.Printf("Error getting free times: %v", err)
+			reason = "Не удалось получить свободное время"
+		}
+		data["slots"] = slots
+		data["slotsReason"] = reason
+		data["slotsLoaded"] = true
+	}
+
+	c.HTML(status, "admin_booking_new.html", data)
+}
+
+// walkInBookingError переводит ошибку сервиса записи в сообщение для формы
+func walkInBookingError(err error) string {
+	if e, ok := err.(*limitError); ok {
+		return e.reason
+	}
+	switch err {
+	case errSlotTaken:
+		return "На это время нет свободных мест"
+	case errDependentNotFound:
+		return "Член семьи не найден"
+	}
+	log.Printf("Error creating walk-in booking: %v", err)
+	return "Ошибка при сохранении записи"
+}
+
+// AdminNewBookingHandler записывает пациента из админки: по телефону или при визите в клинику
+func AdminNewBookingHandler(db *sql.DB, bot *tgbotapi.BotAPI) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		f := walkInFormFromRequest(c)
+		if c.Request.Method == http.MethodGet {
+			renderWalkInForm(c, db, http.StatusOK, f, "")
+			return
+		}
+
+		// POST запрос - создание записи
+		if f.UserID == 0 || f.ServiceID == 0 || f.Date == "" || f.Time == "" {
+			renderWalkInForm(c, db, http.StatusBadRequest, f, "Выберите пациента, услугу, дату и время")
+			return
+		}
+		if err := checkDoctorWorks(db, f.DoctorID, f.Date, f.Time); err != nil {
+			renderWalkInForm(c, db, http.StatusBadRequest, f, err.Error())
+			return
+		}
+
+		id, err := insertBooking(db, bookingParams{
+			UserID:      f.UserID,
+			DependentID: f.DependentID,
+			ServiceID:   f.ServiceID,
+			DoctorID:    f.DoctorID,
+			Date:        f.Date,
+			Time:        f.Time,
+			Status:      "Подтверждено",
+		})
+		if err != nil {
+			renderWalkInForm(c, db, http.StatusConflict, f, walkInBookingError(err))
+			return
+		}
+
+		if telegramID := bookingTelegramID(db, id); telegramID != 0 {
+			msg := tgbotapi.NewMessage(telegramID, fmt.Sprintf("Администратор записал вас на %s в %s.", f.Date, f.Time))
+			bot.Send(msg)
+		}
+
+		c.Redirect(http.StatusFound, "/admin/bookings?date="+url.QueryEscape(f.Date))
+	}
+}
+
+// AdminCreatePatientHandler создает карточку пациента без Telegram по имени и телефону
+func AdminCreatePatientHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		firstName := strings.TrimSpace(c.PostForm("first_name"))
+		lastName := strings.TrimSpace(c.PostForm("last_name"))
+		phone := normalizePhone(c.PostForm("phone"))
+
+		if firstName == "" || phone == "" {
+			renderWalkInForm(c, db, http.StatusBadRequest, walkInForm{}, "Укажите имя и телефон в формате +7XXXXXXXXXX")
+			return
+		}
+
+		id, err := createWalkInPatient(db, firstName, lastName, phone)
+		if err != nil {
+			log.Printf("Error creating patient: %v", err)
+			renderWalkInForm(c, db, http.StatusInternalServerError, walkInForm{}, "Ошибка при создании пациента")
+			return
+		}
+
+		c.Redirect(http.StatusFound, fmt.Sprintf("/admin/bookings/new?user_id=%d", id))
+	}
+}
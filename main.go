@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"log"
 	"net"
+	"time"
 
 	"MVP_ChatBot/handlers"
 
@@ -47,10 +48,72 @@ func main() {
 	// Инициализация базы данных
 	log.Printf("Using database at: %s", config.DatabasePath)
 	db := InitDB(config.DatabasePath, config.MigrationsPath)
+	handlers.SetDefaultClinicDailyLimit(config.MaxBookingsPerDay)
+
+	// Хранилище файлов пациентов
+	if config.FileStorage == "s3" {
+		if config.S3Endpoint == "" || config.S3Bucket == "" {
+			log.Fatal("S3_ENDPOINT and S3_BUCKET must be set for FILE_STORAGE=s3")
+		}
+		handlers.SetFileStore(&handlers.S3FileStore{
+			Endpoint:  config.S3Endpoint,
+			Region:    config.S3Region,
+			Bucket:    config.S3Bucket,
+			AccessKey: config.S3AccessKey,
+			SecretKey: config.S3SecretKey,
+		})
+	} else {
+		handlers.SetFileStore(&handlers.LocalFileStore{Dir: config.FilesDir})
+	}
+
+	// Оплата депозитов
+	switch config.PaymentProvider {
+	case "yookassa":
+		if config.YooKassaShopID == "" || config.YooKassaSecretKey == "" {
+			log.Fatal("YOOKASSA_SHOP_ID and YOOKASSA_SECRET_KEY must be set for PAYMENT_PROVIDER=yookassa")
+		}
+		handlers.SetPaymentProvider(&handlers.YooKassaProvider{
+			ShopID:    config.YooKassaShopID,
+			SecretKey: config.YooKassaSecretKey,
+			ReturnURL: config.PaymentReturnURL,
+		})
+	case "fake":
+		log.Printf("PAYMENT_PROVIDER=fake: deposits are marked paid by unsigned webhooks, do not use in production")
+		handlers.SetPaymentProvider(&handlers.FakePaymentProvider{})
+	case "":
+		// Оплата по ссылке не настроена: депозиты берутся только через TELEGRAM_PAYMENT_TOKEN
+	default:
+		log.Fatalf("Unknown PAYMENT_PROVIDER %q", config.PaymentProvider)
+	}
+	handlers.SetTelegramPaymentToken(config.TelegramPaymentToken)
+	handlers.SetDepositTimeout(time.Duration(config.DepositTimeoutMinutes) * time.Minute)
+	handlers.SetClinicName(config.ClinicName)
+	handlers.SetFeedbackDelay(time.Duration(config.FeedbackDelayHours) * time.Hour)
+	handlers.SetFeedbackAlerts(config.FeedbackAlertChatID, config.FeedbackLowRating)
+	handlers.SetShowDoctorRatings(config.ShowDoctorRatings)
+	handlers.SetSupportChatID(config.SupportChatID)
 
 	// Запуск веб-сервера
 	go startWebServer(db, bot, config)
 
+	// Обработка листа ожидания
+	go handlers.RunWaitlistWorker(bot, db)
+
+	// Отмена записей с неоплаченным депозитом
+	go handlers.RunPaymentWorker(bot, db)
+
+	// Брошенные сессии записи в воронке бота
+	go handlers.RunFunnelWorker(db)
+
+	// Запросы отзывов после завершенных приемов
+	go handlers.RunFeedbackWorker(bot, db)
+
+	// Отправка рассылок
+	go handlers.RunBroadcastWorker(bot, db)
+
+	// Приглашения на повторные визиты
+	go handlers.RunRecallWorker(bot, db)
+
 	// Запуск обработки обновлений бота
 	handlers.ProcessBotUpdates(bot, updates, db)
 }
@@ -71,14 +134,17 @@ func startWebServer(db *sql.DB, bot *tgbotapi.BotAPI, config *Config) {
 	store := cookie.NewStore([]byte(config.SessionSecret))
 	r.Use(sessions.Sessions("adminsession", store))
 
+	// Загруженные изображения: фото врачей
+	r.GET("/media/*path", handlers.MediaHandler())
+
 	// Редирект с корневого пути на админку
 	r.GET("/", func(c *gin.Context) {
 		c.Redirect(302, "/admin/login")
 	})
 
 	// Админка
-	r.GET("/admin/login", handlers.AdminLoginHandler())
-	r.POST("/admin/login", handlers.AdminLoginHandler())
+	r.GET("/admin/login", handlers.AdminLoginHandler(db))
+	r.POST("/admin/login", handlers.AdminLoginHandler(db))
 	r.GET("/admin/logout", handlers.AdminLogoutHandler())
 
 	// Защищенные маршруты
@@ -87,8 +153,69 @@ func startWebServer(db *sql.DB, bot *tgbotapi.BotAPI, config *Config) {
 	{
 		// Бронирования
 		admin.GET("/bookings", handlers.AdminBookingsHandler(db))
+		admin.GET("/api/bookings", handlers.AdminBookingsJSONHandler(db))
+		admin.GET("/bookings/new", handlers.AdminNewBookingHandler(db, bot))
+		admin.POST("/bookings/new", handlers.AdminNewBookingHandler(db, bot))
+		admin.GET("/bookings/:id", handlers.AdminBookingHandler(db))
+		admin.POST("/bookings/:id/visit", handlers.AdminRoleMiddleware("doctor"), handlers.AdminSaveVisitHandler(db))
+		admin.POST("/bookings/no-show/:id", handlers.AdminNoShowBookingHandler(db))
+		admin.POST("/payments/:id/paid", handlers.AdminMarkPaymentPaidHandler(db, bot))
+		admin.GET("/payments/:id/receipt", handlers.AdminReceiptHandler(db))
+
+		// Счета
+		admin.POST("/bookings/:id/invoice", handlers.AdminRoleMiddleware("registrar", "admin"), handlers.AdminCreateInvoiceHandler(db))
+		admin.GET("/invoices/:id", handlers.AdminInvoiceHandler(db))
+		admin.POST("/invoices/:id/items", handlers.AdminRoleMiddleware("registrar", "admin"), handlers.AdminAddInvoiceItemHandler(db))
+		admin.POST("/invoices/:id/items/:item_id/delete", handlers.AdminRoleMiddleware("registrar", "admin"), handlers.AdminDeleteInvoiceItemHandler(db))
+		admin.POST("/invoices/:id/payments", handlers.AdminRoleMiddleware("registrar", "admin"), handlers.AdminInvoicePaymentHandler(db, bot))
+
+		admin.GET("/patients", handlers.AdminPatientsHandler(db))
+		admin.POST("/patients", handlers.AdminCreatePatientHandler(db))
+		admin.GET("/patients/:id", handlers.AdminPatientHandler(db))
+		admin.POST("/patients/:id/notes", handlers.AdminPatientNotesHandler(db))
+		admin.POST("/patients/:id/block", handlers.AdminPatientBlockHandler(db))
+		admin.POST("/patients/:id/merge", handlers.AdminPatientMergeHandler(db))
+		admin.GET("/patients/:id/files", handlers.AdminPatientFilesHandler(db))
+		admin.POST("/patients/:id/files", handlers.AdminPatientFilesHandler(db))
+		admin.GET("/files/:id", handlers.AdminDownloadFileHandler(db))
+		admin.POST("/files/:id/delete", handlers.AdminDeleteFileHandler(db))
+		admin.GET("/patients/:id/chart", handlers.AdminRoleMiddleware("doctor", "admin"), handlers.AdminOdontogramHandler(db))
+		admin.POST("/patients/:id/chart", handlers.AdminRoleMiddleware("doctor"), handlers.AdminAddToothConditionHandler(db))
+		admin.GET("/api/patients/:id/chart", handlers.AdminRoleMiddleware("doctor", "admin"), handlers.AdminOdontogramJSONHandler(db))
+		admin.POST("/api/patients/:id/chart", handlers.AdminRoleMiddleware("doctor"), handlers.AdminAddToothConditionJSONHandler(db))
+		admin.GET("/api/users/:user_id/dependents", handlers.AdminRoleMiddleware("registrar", "admin"), handlers.GetDependentsHandler(db))
+		admin.POST("/api/users/:user_id/dependents", handlers.AdminRoleMiddleware("registrar", "admin"), handlers.AddDependentHandler(db))
+		admin.DELETE("/api/users/:user_id/dependents/:id", handlers.AdminRoleMiddleware("registrar", "admin"), handlers.DeleteDependentHandler(db))
+
+		// Переписка с пациентами
+		admin.GET("/support", handlers.AdminRoleMiddleware("registrar", "admin"), handlers.AdminSupportHandler(db))
+		admin.GET("/support/:id", handlers.AdminRoleMiddleware("registrar", "admin"), handlers.AdminSupportThreadHandler(db, bot))
+		admin.POST("/support/:id", handlers.AdminRoleMiddleware("registrar", "admin"), handlers.AdminSupportThreadHandler(db, bot))
+		admin.GET("/api/support/unread", handlers.AdminRoleMiddleware("registrar", "admin"), handlers.AdminSupportUnreadHandler(db))
+
+		admin.GET("/calendar", handlers.AdminCalendarHandler(db))
+		admin.POST("/calendar/move", handlers.AdminCalendarMoveHandler(db, bot))
+		admin.POST("/calendar/book", handlers.AdminCalendarCreateHandler(db, bot))
+		admin.POST("/calendar/time-off", handlers.AdminAddTimeOffHandler(db))
+		admin.POST("/calendar/time-off/:id/delete", handlers.AdminDeleteTimeOffHandler(db))
 		admin.POST("/bookings/delete/:id", handlers.AdminDeleteBookingHandler(db, bot))
 
+		// Регулярные записи
+		admin.GET("/series", handlers.AdminSeriesHandler(db))
+		admin.POST("/series", handlers.AdminSeriesHandler(db))
+		admin.POST("/series/:id/cancel", handlers.AdminCancelSeriesHandler(db, bot))
+		admin.POST("/series/:id/reschedule", handlers.AdminRescheduleSeriesHandler(db, bot))
+		admin.GET("/limits", handlers.AdminLimitsHandler(db))
+		admin.POST("/limits", handlers.AdminLimitsHandler(db))
+		admin.POST("/limits/delete/:id", handlers.AdminDeleteLimitHandler(db))
+		admin.GET("/staff", handlers.AdminRoleMiddleware("admin"), handlers.AdminStaffHandler(db))
+		admin.POST("/staff", handlers.AdminRoleMiddleware("admin"), handlers.AdminStaffHandler(db))
+		admin.POST("/staff/:id/delete", handlers.AdminRoleMiddleware("admin"), handlers.AdminDeleteStaffHandler(db))
+		admin.GET("/import-export", handlers.AdminImportExportHandler(db))
+		admin.POST("/import", handlers.AdminImportHandler(db))
+		admin.POST("/api/import/:entity", handlers.ImportTableHandler(db))
+		admin.GET("/export/:entity", handlers.ExportTableHandler(db))
+
 		// Услуги
 		admin.GET("/services", handlers.AdminServicesHandler(db))
 		admin.POST("/services", handlers.AdminServicesHandler(db))
@@ -97,6 +224,33 @@ func startWebServer(db *sql.DB, bot *tgbotapi.BotAPI, config *Config) {
 		admin.POST("/services/delete/:id", handlers.AdminDeleteServiceHandler(db))
 		admin.GET("/export_pdf", handlers.AdminExportPDFHandler(db))
 
+		// Скидки и промокоды
+		admin.GET("/discounts", handlers.AdminDiscountsHandler(db))
+		admin.POST("/discounts", handlers.AdminDiscountsHandler(db))
+		admin.POST("/discounts/:id/toggle", handlers.AdminToggleDiscountHandler(db))
+		admin.POST("/discounts/:id/delete", handlers.AdminDeleteDiscountHandler(db))
+
+		// Аналитика
+		admin.GET("/analytics", handlers.AdminRoleMiddleware("admin"), handlers.AdminAnalyticsHandler(db))
+		admin.GET("/analytics/export/:section", handlers.AdminRoleMiddleware("admin"), handlers.AdminAnalyticsCSVHandler(db))
+		admin.GET("/api/analytics", handlers.AdminRoleMiddleware("admin"), handlers.AdminAnalyticsJSONHandler(db))
+		admin.GET("/api/analytics/:section", handlers.AdminRoleMiddleware("admin"), handlers.AdminAnalyticsJSONHandler(db))
+		admin.GET("/analytics/funnel", handlers.AdminRoleMiddleware("admin"), handlers.AdminFunnelHandler(db))
+
+		// Рассылки
+		admin.GET("/broadcasts", handlers.AdminRoleMiddleware("admin"), handlers.AdminBroadcastsHandler(db))
+		admin.POST("/broadcasts", handlers.AdminRoleMiddleware("admin"), handlers.AdminBroadcastsHandler(db))
+		admin.GET("/broadcasts/:id", handlers.AdminRoleMiddleware("admin"), handlers.AdminBroadcastHandler(db))
+		admin.POST("/broadcasts/:id/send", handlers.AdminRoleMiddleware("admin"), handlers.AdminSendBroadcastHandler(db))
+		admin.POST("/broadcasts/:id/cancel", handlers.AdminRoleMiddleware("admin"), handlers.AdminCancelBroadcastHandler(db))
+		admin.POST("/broadcasts/:id/delete", handlers.AdminRoleMiddleware("admin"), handlers.AdminDeleteBroadcastHandler(db))
+
+		// Повторные визиты
+		admin.GET("/recalls", handlers.AdminRoleMiddleware("admin"), handlers.AdminRecallsHandler(db))
+		admin.POST("/recalls", handlers.AdminRoleMiddleware("admin"), handlers.AdminRecallsHandler(db))
+		admin.POST("/recalls/:id/toggle", handlers.AdminRoleMiddleware("admin"), handlers.AdminToggleRecallRuleHandler(db))
+		admin.POST("/recalls/:id/delete", handlers.AdminRoleMiddleware("admin"), handlers.AdminDeleteRecallRuleHandler(db))
+
 		// Врачи
 		admin.GET("/doctors", handlers.AdminDoctorsHandler(db))
 		admin.POST("/doctors", handlers.AdminDoctorsHandler(db))
@@ -106,6 +260,7 @@ func startWebServer(db *sql.DB, bot *tgbotapi.BotAPI, config *Config) {
 		admin.GET("/doctors/:doctor_id/schedule", handlers.AdminDoctorScheduleHandler(db))
 		admin.POST("/doctors/:doctor_id/schedule", handlers.AdminDoctorScheduleHandler(db))
 		admin.POST("/doctors/:doctor_id/schedule/delete/:schedule_id", handlers.AdminDeleteScheduleHandler(db))
+		admin.GET("/reviews", handlers.AdminReviewsHandler(db))
 	}
 
 	// Публичный API
@@ -121,13 +276,27 @@ func startWebServer(db *sql.DB, bot *tgbotapi.BotAPI, config *Config) {
 		api.POST("/doctors", handlers.AddDoctorHandler(db))
 		api.PUT("/doctors/:id", handlers.UpdateDoctorHandler(db))
 		api.DELETE("/doctors/:id", handlers.DeleteDoctorHandler(db))
+		api.POST("/doctors/:id/photo", handlers.UploadDoctorPhotoHandler(db))
+		api.DELETE("/doctors/:id/photo", handlers.DeleteDoctorPhotoHandler(db))
 
 		// Записи
 		api.GET("/available-dates", handlers.GetAvailableDatesHandler(db))
 		api.GET("/available-times", handlers.GetAvailableTimesHandler(db))
+		api.GET("/available-slots", handlers.GetAvailableSlotsHandler(db))
 		api.POST("/bookings", handlers.CreateBookingHandler(db))
 		api.GET("/bookings/:user_id", handlers.GetUserBookingsHandler(db))
-		api.DELETE("/bookings/:id", handlers.CancelBookingHandler(db))
+		api.DELETE("/bookings/:id", handlers.CancelBookingHandler(db, bot))
+
+		// Регулярные записи
+		api.POST("/booking-series", handlers.CreateBookingSeriesHandler(db))
+		api.GET("/booking-series/:id", handlers.GetBookingSeriesHandler(db))
+		api.PUT("/booking-series/:id", handlers.RescheduleBookingSeriesHandler(db))
+		api.DELETE("/booking-series/:id", handlers.CancelBookingSeriesHandler(db))
+
+		// Уведомления платежного провайдера
+		if config.PaymentProvider != "" {
+			api.POST("/payments/webhook", handlers.PaymentWebhookHandler(db, bot))
+		}
 	}
 
 	// Запуск сервера
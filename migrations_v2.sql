@@ -1,7 +1,7 @@
 -- Таблица пользователей
 CREATE TABLE IF NOT EXISTS users (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
-    telegram_id INTEGER UNIQUE NOT NULL,
+    telegram_id INTEGER UNIQUE, -- NULL у пациентов, записанных без Telegram
     username TEXT,
     first_name TEXT,
     last_name TEXT,
@@ -46,4 +46,440 @@ CREATE TABLE IF NOT EXISTS bookings (
 );
 
 -- Создаем индексы для оптимизации запросов
-CREATE INDEX IF NOT EXISTS idx_bookings_date ON bookings(date); 
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idx_bookings_date ON bookings(date); 
+
+-- Врач, к которому относится запись
+ALTER TABLE bookings ADD COLUMN doctor_id INTEGER REFERENCES doctors(id);
+
+-- Таблица серий повторяющихся записей
+CREATE TABLE IF NOT EXISTS booking_series (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    doctor_id INTEGER NOT NULL,
+    service_id INTEGER NOT NULL,
+    time TEXT NOT NULL,
+    start_date TEXT NOT NULL,
+    interval_unit TEXT NOT NULL, -- week или month
+    interval_count INTEGER NOT NULL DEFAULT 1,
+    occurrences INTEGER,
+    until_date TEXT,
+    status TEXT NOT NULL DEFAULT 'active',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY(doctor_id) REFERENCES doctors(id) ON DELETE CASCADE,
+    FOREIGN KEY(service_id) REFERENCES services(id) ON DELETE CASCADE
+);
+
+ALTER TABLE bookings ADD COLUMN series_id INTEGER REFERENCES booking_series(id);
+
+CREATE INDEX IF NOT EXISTS idx_bookings_series ON bookings(series_id);
+CREATE INDEX IF NOT EXISTS idx_bookings_doctor_date ON bookings(doctor_id, date);
+
+-- Лист ожидания
+CREATE TABLE IF NOT EXISTS waitlist (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    service_id INTEGER NOT NULL,
+    doctor_id INTEGER, -- NULL означает любого врача
+    date_from TEXT NOT NULL,
+    date_to TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'waiting', -- waiting, booked, cancelled, expired
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY(service_id) REFERENCES services(id) ON DELETE CASCADE
+);
+
+-- Предложения освободившегося времени из листа ожидания
+CREATE TABLE IF NOT EXISTS waitlist_offers (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    waitlist_id INTEGER NOT NULL,
+    service_id INTEGER NOT NULL,
+    doctor_id INTEGER,
+    date TEXT NOT NULL,
+    time TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending', -- pending, accepted, declined, expired, taken
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(waitlist_id) REFERENCES waitlist(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_waitlist_service ON waitlist(service_id, status);
+CREATE INDEX IF NOT EXISTS idx_waitlist_offers_slot ON waitlist_offers(service_id, date, time);
+
+-- Вместимость услуги: сколько пациентов принимается одновременно (групповые приемы)
+ALTER TABLE services ADD COLUMN capacity INTEGER NOT NULL DEFAULT 1;
+
+-- Члены семьи (иждивенцы), за которых пациент может записываться
+CREATE TABLE IF NOT EXISTS dependents (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    birth_date TEXT,
+    relation TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Пациент записи, если это не сам владелец аккаунта
+ALTER TABLE bookings ADD COLUMN dependent_id INTEGER REFERENCES dependents(id);
+
+CREATE INDEX IF NOT EXISTS idx_dependents_user ON dependents(user_id);
+
+-- Ограничения на количество записей, настраиваемые в админке
+-- scope: clinic_day, doctor_day, category_day, patient_active
+CREATE TABLE IF NOT EXISTS booking_limits (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    scope TEXT NOT NULL,
+    doctor_id INTEGER,
+    category TEXT NOT NULL DEFAULT '',
+    max_count INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(doctor_id) REFERENCES doctors(id) ON DELETE CASCADE
+);
+
+-- Расписание врачей: день недели 1 - понедельник ... 7 - воскресенье
+CREATE TABLE IF NOT EXISTS doctor_schedule (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    doctor_id INTEGER NOT NULL,
+    day_of_week INTEGER NOT NULL,
+    start_time TEXT NOT NULL,
+    end_time TEXT NOT NULL,
+    break_start TEXT,
+    break_end TEXT,
+    FOREIGN KEY(doctor_id) REFERENCES doctors(id) ON DELETE CASCADE
+);
+
+-- Отпуска, больничные и другие нерабочие дни врачей
+CREATE TABLE IF NOT EXISTS doctor_time_off (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    doctor_id INTEGER NOT NULL,
+    date_from TEXT NOT NULL,
+    date_to TEXT NOT NULL,
+    reason TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(doctor_id) REFERENCES doctors(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_doctor_schedule_doctor ON doctor_schedule(doctor_id, day_of_week);
+CREATE INDEX IF NOT EXISTS idx_doctor_time_off_doctor ON doctor_time_off(doctor_id, date_from, date_to);
+
+-- Карточка пациента в админке: заметки, блокировка записи через бота и подтверждение телефона
+ALTER TABLE users ADD COLUMN notes TEXT;
+ALTER TABLE users ADD COLUMN is_blocked INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN blocked_reason TEXT;
+ALTER TABLE users ADD COLUMN phone_verified INTEGER NOT NULL DEFAULT 0;
+-- Раньше подтверждение не сохранялось: телефон без ожидающего кода считается подтвержденным
+UPDATE users SET phone_verified = 1
+WHERE phone_verified = 0 AND telegram_id IS NOT NULL AND COALESCE(phone, '') != '' AND confirmation_code IS NULL;
+
+-- Учетные записи сотрудников админки и их роли: admin, registrar, doctor
+CREATE TABLE IF NOT EXISTS staff_users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username TEXT NOT NULL UNIQUE,
+    password_hash TEXT NOT NULL,
+    role TEXT NOT NULL,
+    doctor_id INTEGER, -- карточка врача для роли doctor
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(doctor_id) REFERENCES doctors(id) ON DELETE SET NULL
+);
+
+-- Медицинская запись о приеме: заметки врача, диагнозы МКБ-10 и выполненные процедуры
+CREATE TABLE IF NOT EXISTS visit_records (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    booking_id INTEGER NOT NULL UNIQUE,
+    doctor_id INTEGER,
+    staff_id INTEGER,
+    notes TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(booking_id) REFERENCES bookings(id) ON DELETE CASCADE,
+    FOREIGN KEY(doctor_id) REFERENCES doctors(id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS visit_diagnoses (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    visit_id INTEGER NOT NULL,
+    code TEXT NOT NULL, -- код МКБ-10
+    description TEXT,
+    teeth TEXT, -- номера зубов FDI через запятую
+    FOREIGN KEY(visit_id) REFERENCES visit_records(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS visit_procedures (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    visit_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    teeth TEXT,
+    FOREIGN KEY(visit_id) REFERENCES visit_records(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_visit_diagnoses_visit ON visit_diagnoses(visit_id);
+CREATE INDEX IF NOT EXISTS idx_visit_procedures_visit ON visit_procedures(visit_id);
+
+-- Зубная формула: история отметок состояния зубов (FDI) и их поверхностей
+CREATE TABLE IF NOT EXISTS tooth_chart_entries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    dependent_id INTEGER, -- NULL - формула владельца аккаунта
+    tooth INTEGER NOT NULL, -- номер зуба FDI
+    surface TEXT NOT NULL DEFAULT '', -- M, D, O, B, L или пусто для всего зуба
+    condition TEXT NOT NULL, -- healthy, caries, filling, crown, missing, implant
+    booking_id INTEGER, -- прием, на котором сделана отметка
+    staff_id INTEGER,
+    note TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY(dependent_id) REFERENCES dependents(id) ON DELETE CASCADE,
+    FOREIGN KEY(booking_id) REFERENCES bookings(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_tooth_chart_patient ON tooth_chart_entries(user_id, dependent_id);
+
+-- Файлы пациентов: снимки, фото и документы из бота или загруженные в админке
+CREATE TABLE IF NOT EXISTS patient_files (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    booking_id INTEGER,
+    storage_key TEXT NOT NULL UNIQUE, -- ключ в хранилище файлов
+    file_name TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    source TEXT NOT NULL, -- telegram или admin
+    caption TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY(booking_id) REFERENCES bookings(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_patient_files_user ON patient_files(user_id);
+
+-- Фото врачей: загруженные файлы отдаются через /media, file_id Telegram кешируется для бота
+ALTER TABLE doctors ADD COLUMN photo_thumb_url TEXT;
+ALTER TABLE doctors ADD COLUMN photo_telegram_id TEXT;
+
+-- Депозит, который пациент вносит онлайн при записи через бота (0 - без депозита)
+ALTER TABLE services ADD COLUMN deposit REAL NOT NULL DEFAULT 0;
+
+-- Платежи по записям: депозиты через Telegram Payments, провайдера по ссылке или на месте
+CREATE TABLE IF NOT EXISTS payments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    booking_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    amount REAL NOT NULL,
+    currency TEXT NOT NULL DEFAULT 'RUB',
+    status TEXT NOT NULL DEFAULT 'pending', -- pending, paid, canceled, expired
+    provider TEXT NOT NULL, -- telegram, fake, yookassa
+    external_id TEXT, -- ID платежа у провайдера
+    confirmation_url TEXT,
+    expires_at DATETIME, -- после этого времени неоплаченная запись отменяется
+    paid_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(booking_id) REFERENCES bookings(id) ON DELETE CASCADE,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_payments_booking ON payments(booking_id);
+CREATE INDEX IF NOT EXISTS idx_payments_status ON payments(status, expires_at);
+CREATE INDEX IF NOT EXISTS idx_payments_external ON payments(provider, external_id);
+
+-- Счета за приемы: строки из оказанных услуг со скидками, оплаты берутся из payments по той же записи
+CREATE TABLE IF NOT EXISTS invoices (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    booking_id INTEGER NOT NULL UNIQUE,
+    total REAL NOT NULL DEFAULT 0, -- сумма строк с учетом скидок
+    staff_id INTEGER,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(booking_id) REFERENCES bookings(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS invoice_items (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    invoice_id INTEGER NOT NULL,
+    service_id INTEGER,
+    description TEXT NOT NULL,
+    quantity INTEGER NOT NULL DEFAULT 1,
+    unit_price REAL NOT NULL,
+    discount_percent REAL NOT NULL DEFAULT 0,
+    amount REAL NOT NULL, -- количество * цена с учетом скидки
+    FOREIGN KEY(invoice_id) REFERENCES invoices(id) ON DELETE CASCADE,
+    FOREIGN KEY(service_id) REFERENCES services(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_invoice_items_invoice ON invoice_items(invoice_id);
+
+-- Сотрудник, принявший оплату на месте (наличные, карта, перевод)
+ALTER TABLE payments ADD COLUMN staff_id INTEGER;
+
+-- Скидки: промокоды, первый визит, день рождения и распродажи по категориям услуг
+CREATE TABLE IF NOT EXISTS discounts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    kind TEXT NOT NULL, -- promo, first_visit, birthday, sale
+    code TEXT UNIQUE, -- только у промокодов, в верхнем регистре
+    value_type TEXT NOT NULL DEFAULT 'percent', -- percent или fixed
+    value REAL NOT NULL,
+    category TEXT, -- пусто - на все услуги
+    valid_from TEXT, -- период по дате приема, YYYY-MM-DD
+    valid_to TEXT,
+    max_uses INTEGER NOT NULL DEFAULT 0, -- 0 - без ограничения
+    is_active INTEGER NOT NULL DEFAULT 1,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Цена записи на момент создания: по прайсу, скидка и итог для отчетов
+ALTER TABLE bookings ADD COLUMN base_price REAL;
+ALTER TABLE bookings ADD COLUMN discount REAL NOT NULL DEFAULT 0;
+ALTER TABLE bookings ADD COLUMN final_price REAL;
+ALTER TABLE bookings ADD COLUMN discount_id INTEGER REFERENCES discounts(id) ON DELETE SET NULL;
+ALTER TABLE bookings ADD COLUMN discount_title TEXT;
+CREATE INDEX IF NOT EXISTS idx_bookings_discount ON bookings(discount_id);
+
+-- Дата рождения владельца аккаунта для скидки ко дню рождения
+ALTER TABLE users ADD COLUMN birth_date TEXT;
+-- Промокод, введенный в боте, и запись, для которой его вводят
+ALTER TABLE users ADD COLUMN promo_code TEXT;
+ALTER TABLE users ADD COLUMN promo_booking TEXT;
+
+-- Воронка записи через бота: сессия от /book до записи или ухода пациента
+CREATE TABLE IF NOT EXISTS bot_sessions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    status TEXT NOT NULL DEFAULT 'active', -- active, confirmed, abandoned
+    last_step TEXT NOT NULL, -- последний пройденный шаг, для брошенных - где ушли
+    service_id INTEGER,
+    booking_id INTEGER,
+    started_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY(service_id) REFERENCES services(id) ON DELETE SET NULL,
+    FOREIGN KEY(booking_id) REFERENCES bookings(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_bot_sessions_user ON bot_sessions(user_id, status);
+CREATE INDEX IF NOT EXISTS idx_bot_sessions_status ON bot_sessions(status, updated_at);
+CREATE INDEX IF NOT EXISTS idx_bot_sessions_started ON bot_sessions(started_at);
+
+-- События воронки: started, service, date, time, phone, phone_verified, confirmed, abandoned
+CREATE TABLE IF NOT EXISTS bot_funnel_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    session_id INTEGER NOT NULL,
+    step TEXT NOT NULL,
+    service_id INTEGER,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(session_id) REFERENCES bot_sessions(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_bot_funnel_events_session ON bot_funnel_events(session_id, step);
+
+-- Когда прием завершен и когда пациенту отправлен запрос отзыва
+ALTER TABLE bookings ADD COLUMN completed_at DATETIME;
+ALTER TABLE bookings ADD COLUMN feedback_requested_at DATETIME;
+
+-- Отзывы пациентов после приема: оценка от 1 до 5 и комментарий
+CREATE TABLE IF NOT EXISTS reviews (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    booking_id INTEGER NOT NULL UNIQUE,
+    user_id INTEGER NOT NULL,
+    doctor_id INTEGER,
+    rating INTEGER NOT NULL,
+    comment TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(booking_id) REFERENCES bookings(id) ON DELETE CASCADE,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY(doctor_id) REFERENCES doctors(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_reviews_doctor ON reviews(doctor_id);
+CREATE INDEX IF NOT EXISTS idx_bookings_feedback ON bookings(status, completed_at);
+
+-- Отзыв, к которому пациент пишет комментарий в боте
+ALTER TABLE users ADD COLUMN review_booking INTEGER;
+
+-- Отказ пациента от рекламных рассылок (команда /unsubscribe в боте)
+ALTER TABLE users ADD COLUMN marketing_opt_out INTEGER NOT NULL DEFAULT 0;
+
+-- Рассылки пациентам: текст, фото, кнопки-ссылки и сегмент получателей
+CREATE TABLE IF NOT EXISTS broadcasts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    text TEXT NOT NULL,
+    photo_url TEXT, -- /media/broadcasts/...
+    photo_telegram_id TEXT, -- file_id после первой отправки, чтобы не загружать фото повторно
+    buttons TEXT, -- по строке на кнопку: текст | ссылка
+    segment TEXT NOT NULL, -- all, inactive, doctor, service
+    doctor_id INTEGER,
+    service_id INTEGER,
+    status TEXT NOT NULL DEFAULT 'draft', -- draft, sending, done, cancelled
+    staff_id INTEGER,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    started_at DATETIME,
+    finished_at DATETIME,
+    FOREIGN KEY(doctor_id) REFERENCES doctors(id) ON DELETE SET NULL,
+    FOREIGN KEY(service_id) REFERENCES services(id) ON DELETE SET NULL
+);
+
+-- Получатели рассылки: список фиксируется при запуске, статус доставки по каждому
+CREATE TABLE IF NOT EXISTS broadcast_recipients (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    broadcast_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    telegram_id INTEGER NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending', -- pending, sent, blocked, failed, skipped
+    error TEXT,
+    sent_at DATETIME,
+    UNIQUE(broadcast_id, user_id),
+    FOREIGN KEY(broadcast_id) REFERENCES broadcasts(id) ON DELETE CASCADE,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_broadcast_recipients_status ON broadcast_recipients(broadcast_id, status);
+
+-- Правила повторных визитов: через сколько дней после услуги пригласить пациента снова
+CREATE TABLE IF NOT EXISTS recall_rules (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    service_id INTEGER NOT NULL UNIQUE,
+    days INTEGER NOT NULL,
+    message TEXT, -- свой текст приглашения, пусто - стандартный
+    is_active INTEGER NOT NULL DEFAULT 1,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(service_id) REFERENCES services(id) ON DELETE CASCADE
+);
+
+-- Отправленные приглашения на повторный визит, одно на последний визит пациента
+CREATE TABLE IF NOT EXISTS recalls (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    rule_id INTEGER,
+    user_id INTEGER NOT NULL,
+    dependent_id INTEGER,
+    service_id INTEGER NOT NULL,
+    source_booking_id INTEGER NOT NULL, -- визит, после которого наступил срок
+    due_date TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'sent', -- sent, failed
+    error TEXT,
+    sent_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    clicked_at DATETIME, -- пациент нажал «Записаться»
+    UNIQUE(service_id, source_booking_id),
+    FOREIGN KEY(rule_id) REFERENCES recall_rules(id) ON DELETE SET NULL,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY(service_id) REFERENCES services(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_recalls_sent_at ON recalls(sent_at);
+
+-- Переписка пациентов с регистратурой через бота
+CREATE TABLE IF NOT EXISTS support_messages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    direction TEXT NOT NULL, -- in - от пациента, out - ответ клиники
+    text TEXT NOT NULL,
+    author TEXT, -- сотрудник, ответивший пациенту
+    staff_id INTEGER,
+    group_message_id INTEGER, -- копия сообщения в чате администраторов, на нее отвечают реплаем
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    read_at DATETIME, -- для входящих: когда прочитано сотрудником
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_support_messages_user ON support_messages(user_id, id);
+CREATE INDEX IF NOT EXISTS idx_support_messages_group ON support_messages(group_message_id);
+
+-- Услуга, для которой пациент выбирает дату: дату можно написать текстом
+ALTER TABLE users ADD COLUMN booking_service INTEGER;
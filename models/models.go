@@ -32,6 +32,7 @@ type Service struct {
 	Category string `json:"category"`
 	Duration int    `json:"duration"` // в минутах
 	Price    int    `json:"price"`
+	Capacity int    `json:"capacity"` // количество пациентов на одном приеме
 }
 
 // Booking представляет запись на прием
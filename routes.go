@@ -16,8 +16,8 @@ func setupRoutes(r *gin.Engine, db *sql.DB, bot *tgbotapi.BotAPI) {
 	})
 
 	// Админка
-	r.GET("/admin/login", handlers.AdminLoginHandler())
-	r.POST("/admin/login", handlers.AdminLoginHandler())
+	r.GET("/admin/login", handlers.AdminLoginHandler(db))
+	r.POST("/admin/login", handlers.AdminLoginHandler(db))
 	r.GET("/admin/logout", handlers.AdminLogoutHandler())
 
 	// Защищенные маршруты